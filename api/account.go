@@ -0,0 +1,413 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// deletedName replaces the name of a deleted player wherever it was kept
+const deletedName = "Deleted player"
+
+type AccountService struct {
+	db *gorm.DB
+	gs *GameService
+}
+
+func NewAccountService(db *gorm.DB, gs *GameService) *AccountService {
+	service := &AccountService{db, gs}
+
+	http.HandleFunc("/account", service.DeleteAccount)
+	http.HandleFunc("/account/export", service.ExportAccount)
+
+	return service
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+// ExportRatings is the rating part of a data export
+type ExportRatings struct {
+	ELO int `json:"elo"`
+}
+
+// DeleteAccount Deletes the user's account once their password, or for users without one a recent sign in, is
+// confirmed. Their unfinished games are resigned and their finished games are kept for their opponents, but
+// their name is removed everywhere.
+func (as *AccountService) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodDelete {
+		return
+	}
+
+	user, sessionID, userErr := as.gs.us.AuthenticateSession(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	request := &DeleteAccountRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, NewUserError(1, "Invalid JSON request", err.Error()))
+		return
+	}
+
+	if userErr := as.gs.us.confirmIdentity(user, sessionID, request.Password); userErr != nil {
+		RenderJSONResponse(w, http.StatusForbidden, userErr)
+		return
+	}
+
+	// Other users' access through the user's apps ends before the apps go
+	var apps []string
+	err := as.db.Model(&OAuthApp{}).Where("owner = ?", user.UUID).Pluck("client_id", &apps).Error
+	if err == nil {
+		err = as.gs.us.RevokeAppSessions(apps, time.Now())
+	}
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, NewUserError(28, "Internal server error", "Error deleting account"))
+		return
+	}
+
+	uuid := user.UUID.String()
+	as.gs.LeaveMatchmaking(uuid)
+	as.gs.resignAll(uuid)
+
+	if err := as.deleteUser(user); err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, NewUserError(28, "Internal server error", "Error deleting account"))
+		return
+	}
+
+	if err := as.gs.us.RevokeSessions(user.UUID, "", time.Now()); err != nil {
+		log.Println(err)
+	}
+
+	for _, listener := range as.gs.us.listeners {
+		listener.UserDeleted(user)
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &NewUserResponse{Successful: true})
+}
+
+// deleteUser Soft deletes the user after clearing their name, email and password, removes their name from
+// tournament standings, takes them out of clubs and events still to be played and drops everything else that
+// only concerns them
+func (as *AccountService) deleteUser(user *User) error {
+	uuid := user.UUID.String()
+
+	return as.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(user).Updates(map[string]interface{}{
+			"first_name": "Deleted",
+			"last_name":  "player",
+			// The email is freed so it can register again
+			"email":    fmt.Sprintf("deleted-%s@deleted.invalid", uuid),
+			"password": []byte{},
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Delete(user).Error; err != nil {
+			return err
+		}
+
+		for _, model := range []interface{}{&SwissPlayer{}, &TournamentPlayer{}} {
+			if err := tx.Model(model).Where("player = ?", uuid).Update("name", deletedName).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := leaveClubs(tx, uuid); err != nil {
+			return err
+		}
+
+		if err := leaveEvents(tx, uuid); err != nil {
+			return err
+		}
+
+		deletions := []struct {
+			model interface{}
+			query string
+		}{
+			{&Profile{}, "user_uuid = ?"},
+			{&EmailChange{}, "user_uuid = ?"},
+			{&PasswordReset{}, "user_uuid = ?"},
+			{&TwoFactor{}, "user_uuid = ?"},
+			{&RecoveryCode{}, "user_uuid = ?"},
+			{&LoginChallenge{}, "user_uuid = ?"},
+			{&OIDCIdentity{}, "user_uuid = ?"},
+			{&OAuthCode{}, "user_uuid = ?"},
+			{&OAuthApp{}, "owner = ?"},
+			{&PersonalToken{}, "user_uuid = ?"},
+			{&Webhook{}, "created_by = ?"},
+			{&Notification{}, "player = ?"},
+			{&Friendship{}, "player = ? OR friend = ?"},
+			{&Follow{}, "player = ? OR followed = ?"},
+			{&Block{}, "player = ? OR blocked = ?"},
+			{&ChatMute{}, "player = ? OR muted = ?"},
+			{&ChatSetting{}, "player = ?"},
+		}
+
+		for _, deletion := range deletions {
+			args := make([]interface{}, strings.Count(deletion.query, "?"))
+			for i := range args {
+				args[i] = uuid
+			}
+
+			if err := tx.Where(deletion.query, args...).Delete(deletion.model).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// leaveClubs Ends the player's memberships. A club left without an admin is handed to its longest standing member,
+// and team match challenges with the player in the lineup are called off as they can't be played.
+func leaveClubs(tx *gorm.DB, uuid string) error {
+	var adminOf []uint
+	if err := tx.Model(&Membership{}).Where("player = ? AND role = ? AND status = ?", uuid, ClubAdmin, MembershipActive).Pluck("club_id", &adminOf).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Where("player = ?", uuid).Delete(&Membership{}).Error; err != nil {
+		return err
+	}
+
+	for _, clubID := range adminOf {
+		var admins int64
+		if err := tx.Model(&Membership{}).Where("club_id = ? AND role = ? AND status = ?", clubID, ClubAdmin, MembershipActive).Count(&admins).Error; err != nil {
+			return err
+		}
+
+		successor := &Membership{}
+		if admins == 0 && tx.Where("club_id = ? AND status = ?", clubID, MembershipActive).Order("created_at").First(successor).RowsAffected > 0 {
+			if err := tx.Model(successor).Update("role", ClubAdmin).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	lineups := tx.Model(&TeamBoard{}).Select("team_match_id").Where("home = ? OR away = ?", uuid, uuid)
+	return tx.Model(&TeamMatch{}).Where("id IN (?) AND status = ?", lineups, TeamMatchProposed).Update("status", TeamMatchDeclined).Error
+}
+
+// leaveEvents Takes the player out of the pairings of arenas and Swiss tournaments that aren't over and out of
+// simuls that haven't started, calling off the ones they were to host. Finished events keep their results.
+func leaveEvents(tx *gorm.DB, uuid string) error {
+	arenas := tx.Model(&Arena{}).Select("id").Where("status <> ?", ArenaFinished)
+	if err := tx.Model(&ArenaPlayer{}).Where("player = ? AND arena_id IN (?)", uuid, arenas).Update("active", false).Error; err != nil {
+		return err
+	}
+
+	swiss := tx.Model(&Swiss{}).Select("id").Where("status <> ?", SwissFinished)
+	if err := tx.Model(&SwissPlayer{}).Where("player = ? AND swiss_id IN (?)", uuid, swiss).Update("withdrawn", true).Error; err != nil {
+		return err
+	}
+
+	open := tx.Model(&Simul{}).Select("id").Where("status = ?", SimulOpen)
+	hosted := tx.Model(&Simul{}).Select("id").Where("host = ? AND status = ?", uuid, SimulOpen)
+	if err := tx.Where("(player = ? AND simul_id IN (?)) OR simul_id IN (?)", uuid, open, hosted).Delete(&SimulParticipant{}).Error; err != nil {
+		return err
+	}
+
+	return tx.Where("host = ? AND status = ?", uuid, SimulOpen).Delete(&Simul{}).Error
+}
+
+// LeaveMatchmaking Takes the player out of every matchmaking pool they are waiting in
+func (gs *GameService) LeaveMatchmaking(uuid string) {
+	gs.gameRequests <- &GameRequest{UUID: uuid, Leave: true}
+}
+
+// resignAll Resigns every unfinished game of the player, so their opponents aren't left waiting
+func (gs *GameService) resignAll(uuid string) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	var ids []uint
+	if err := gs.db.Model(&Game{}).Where("(player_white = ? OR player_black = ?) AND result = ?", uuid, uuid, NoOutcome.String()).Pluck("id", &ids).Error; err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, id := range ids {
+		// Ending a Bughouse board also ends its partner, which may be one of the later games
+		game := &Game{}
+		if gs.db.First(game, id).RowsAffected == 0 || game.Result != NoOutcome.String() {
+			continue
+		}
+
+		if err := game.loadBoard(); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		game.board.end(winnerOutcome(game.getColor(uuid).Other()), Resignation)
+		game.record()
+		gs.db.Save(game)
+
+		gs.EndGame(game)
+	}
+}
+
+// ExportAccount Gives the user a zip archive of their data: their profile, rating, every game they played
+// as PGN and every chat message they wrote
+func (as *AccountService) ExportAccount(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodGet {
+		return
+	}
+
+	user, userErr := as.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	archive, err := as.export(user)
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, NewUserError(28, "Internal server error", "Error exporting account"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="checkers-%s.zip"`, user.UUID))
+	if _, err := w.Write(archive); err != nil {
+		log.Println(err)
+	}
+}
+
+// export Builds the zip archive of the user's data
+func (as *AccountService) export(user *User) ([]byte, error) {
+	uuid := user.UUID.String()
+
+	profile, err := as.gs.us.loadProfile(user)
+	if err != nil {
+		return nil, err
+	}
+
+	var games []*Game
+	if err := as.db.Where("player_white = ? OR player_black = ?", uuid, uuid).Order("id").Find(&games).Error; err != nil {
+		return nil, err
+	}
+
+	var messages []*ChatMessage
+	if err := as.db.Where("player = ?", uuid).Order("id").Find(&messages).Error; err != nil {
+		return nil, err
+	}
+
+	names, err := as.playerNames(games)
+	if err != nil {
+		return nil, err
+	}
+
+	var pgn strings.Builder
+	for _, game := range games {
+		pgn.WriteString(exportPGN(game, names))
+	}
+
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"profile.json", profile},
+		{"ratings.json", &ExportRatings{user.ELO}},
+		{"chat.json", messages},
+	}
+
+	for _, file := range files {
+		writer, err := archive.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(file.data); err != nil {
+			return nil, err
+		}
+	}
+
+	writer, err := archive.Create("games.pgn")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := writer.Write([]byte(pgn.String())); err != nil {
+		return nil, err
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// playerNames Finds the name of everyone who played in the games, deleted players included
+func (as *AccountService) playerNames(games []*Game) (map[string]string, error) {
+	var uuids []string
+	for _, game := range games {
+		uuids = append(uuids, game.PlayerWhite, game.PlayerBlack)
+	}
+
+	var users []*User
+	if err := as.db.Unscoped().Where("uuid IN ?", uuids).Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	for _, user := range users {
+		names[user.UUID.String()] = user.FirstName + " " + user.LastName
+	}
+
+	return names, nil
+}
+
+// exportPGN Writes a game as PGN with the seven tag roster ahead of the tags stored with it
+func exportPGN(game *Game, names map[string]string) string {
+	name := func(uuid string) string {
+		if name, ok := names[uuid]; ok {
+			return name
+		}
+		return uuid
+	}
+
+	tags := [][2]string{
+		{"Event", fmt.Sprintf("Checkers game %d", game.ID)},
+		{"Site", "Checkers"},
+		{"Date", game.CreatedAt.Format("2006.01.02")},
+		{"Round", "-"},
+		{"White", name(game.PlayerWhite)},
+		{"Black", name(game.PlayerBlack)},
+		{"Result", game.Result},
+	}
+
+	var sb strings.Builder
+	for _, tag := range tags {
+		sb.WriteString(fmt.Sprintf("[%s \"%s\"]\n", tag[0], strings.ReplaceAll(tag[1], `"`, `\"`)))
+	}
+
+	if !strings.HasPrefix(game.PGN, "[") {
+		sb.WriteString("\n")
+	}
+	sb.WriteString(game.PGN)
+	sb.WriteString("\n\n")
+
+	return sb.String()
+}
@@ -0,0 +1,735 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pjebs/jsonerror"
+	"gorm.io/gorm"
+)
+
+const (
+	ArenaScheduled = "scheduled"
+	ArenaStarted   = "started"
+	ArenaFinished  = "finished"
+
+	// arenaTick is how often waiting arena players are paired and arenas are started and finished
+	arenaTick = 2 * time.Second
+
+	maxArenaMinutes = 12 * 60
+)
+
+// arenaRecurrences are how often a recurring arena is held again
+var arenaRecurrences = map[string]time.Duration{
+	"hourly": time.Hour,
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// Arena is a tournament of fixed length where players are paired again as soon as they finish a game
+type Arena struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	CreatedBy   string    `gorm:"not null" json:"created_by"`
+	Name        string    `gorm:"not null" json:"name"`
+	Variant     string    `gorm:"not null;default:standard" json:"variant"`
+	TimeControl string    `gorm:"not null" json:"time_control"`
+	// ClubID restricts the arena to members of a club
+	ClubID uint `gorm:"index" json:"club_id,omitempty"`
+	// Minutes is how long the arena runs, games still being played at the end count once they finish
+	Minutes  int       `gorm:"not null" json:"minutes"`
+	StartsAt time.Time `gorm:"index" json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+	// Recurrence schedules the next arena when this one finishes: hourly, daily, weekly or empty for none
+	Recurrence string         `json:"recurrence,omitempty"`
+	Berserk    bool           `json:"berserk"`
+	Status     string         `gorm:"not null;default:scheduled;index" json:"status"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+	Players    []*ArenaPlayer `json:"players,omitempty"`
+}
+
+// ArenaPlayer is a player's score in an arena, Rank is set once the arena has finished
+type ArenaPlayer struct {
+	ID      uint   `gorm:"primarykey" json:"-"`
+	ArenaID uint   `gorm:"not null;index" json:"-"`
+	Player  string `gorm:"not null" json:"player"`
+	Score   int    `json:"score"`
+	Games   int    `json:"games"`
+	Wins    int    `json:"wins"`
+	Draws   int    `json:"draws"`
+	Losses  int    `json:"losses"`
+	// Streak counts the wins in a row, from two on the player is on fire and scores double
+	Streak   int  `json:"streak"`
+	Berserks int  `json:"berserks"`
+	Rank     int  `json:"rank,omitempty"`
+	Active   bool `json:"active"`
+	// GameID is the arena game the player is in, zero while they wait for a pairing
+	GameID uint `json:"game_id,omitempty"`
+	// LastOpponent and ColorBalance (whites minus blacks) keep pairings varied
+	LastOpponent string    `json:"-"`
+	ColorBalance int       `json:"-"`
+	CreatedAt    time.Time `json:"joined_at"`
+}
+
+// ArenaPairing is a game of an arena, recording who went berserk in it
+type ArenaPairing struct {
+	ID           uint   `gorm:"primarykey"`
+	ArenaID      uint   `gorm:"not null;index"`
+	GameID       uint   `gorm:"not null;uniqueIndex"`
+	WhiteBerserk bool   `gorm:"not null;default:false"`
+	BlackBerserk bool   `gorm:"not null;default:false"`
+	White        string `gorm:"not null"`
+	Black        string `gorm:"not null"`
+}
+
+func (a *Arena) setup() (*GameSetup, error) {
+	tc, err := ParseTimeControl(a.TimeControl)
+	if err != nil {
+		return nil, err
+	}
+
+	setup := &GameSetup{Variant: a.Variant, Chess960Position: RandomChess960Position, TimeControl: tc}
+	return setup, setup.Validate()
+}
+
+func (a *Arena) validate() error {
+	if _, ok := arenaRecurrences[a.Recurrence]; !ok && a.Recurrence != "" {
+		return fmt.Errorf("recurrence must be hourly, daily or weekly, got %s", a.Recurrence)
+	}
+
+	switch {
+	case a.Name == "":
+		return errors.New("an arena needs a name")
+	case a.TimeControl == "":
+		return errors.New("an arena needs a time_control")
+	case a.Minutes < 1 || a.Minutes > maxArenaMinutes:
+		return fmt.Errorf("minutes must be between 1 and %d", maxArenaMinutes)
+	case a.Variant == VariantBughouse || a.Variant == VariantFromPosition:
+		return fmt.Errorf("arenas cannot be played as %s", a.Variant)
+	case a.Recurrence != "" && time.Duration(a.Minutes)*time.Minute > arenaRecurrences[a.Recurrence]:
+		return fmt.Errorf("a %s arena cannot run longer than its recurrence", a.Recurrence)
+	}
+
+	_, err := a.setup()
+	return err
+}
+
+// points Scores a game for a player: 2 for a win and 1 for a draw, doubled while on fire,
+// with an extra point for winning after going berserk
+func (p *ArenaPlayer) points(outcome float64, berserk bool) int {
+	points := int(outcome * 2)
+	if p.Streak >= 2 {
+		points *= 2
+	}
+
+	if berserk && outcome == 1 {
+		points++
+	}
+
+	return points
+}
+
+// record Adds the result of a game to the player's score
+func (p *ArenaPlayer) record(outcome float64, berserk bool, opponent string) {
+	p.Score += p.points(outcome, berserk)
+	p.Games++
+	p.GameID = 0
+	p.LastOpponent = opponent
+
+	switch outcome {
+	case 1:
+		p.Wins++
+		p.Streak++
+	case 0.5:
+		p.Draws++
+		p.Streak = 0
+	default:
+		p.Losses++
+		p.Streak = 0
+	}
+}
+
+// rankPlayers Sorts players by score, then wins, then who joined first
+func rankPlayers(players []*ArenaPlayer) {
+	sort.SliceStable(players, func(i, j int) bool {
+		a, b := players[i], players[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Wins != b.Wins {
+			return a.Wins > b.Wins
+		}
+		return a.CreatedAt.Before(b.CreatedAt)
+	})
+}
+
+type ArenaService struct {
+	db *gorm.DB
+	gs *GameService
+}
+
+func NewArenaService(db *gorm.DB, gs *GameService) *ArenaService {
+	if err := db.AutoMigrate(&Arena{}, &ArenaPlayer{}, &ArenaPairing{}); err != nil {
+		panic(err)
+	}
+
+	service := &ArenaService{db, gs}
+	gs.AddListener(service)
+	go service.scheduler()
+
+	http.HandleFunc("/arenas", service.HandleArenas)
+	http.HandleFunc("/arenas/join", service.Join)
+	http.HandleFunc("/arenas/withdraw", service.Withdraw)
+	http.HandleFunc("/arenas/berserk", service.GoBerserk)
+
+	return service
+}
+
+type NewArenaRequest struct {
+	Name        string    `json:"name"`
+	Variant     string    `json:"variant"`
+	ClubID      uint      `json:"club_id"`
+	TimeControl string    `json:"time_control"`
+	Minutes     int       `json:"minutes"`
+	StartsAt    time.Time `json:"starts_at"`
+	Recurrence  string    `json:"recurrence"`
+	Berserk     bool      `json:"berserk"`
+}
+
+type ArenaResponse struct {
+	Successful bool              `json:"success"`
+	Arena      *Arena            `json:"arena,omitempty"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+type ArenaListResponse struct {
+	Successful bool              `json:"success"`
+	Arenas     []*Arena          `json:"arenas"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+func arenaError(code int, error, message string) *ArenaResponse {
+	return &ArenaResponse{Error: jsonerror.New(code, error, message).Render()}
+}
+
+// HandleArenas Lists scheduled and running arenas on GET without an id, shows one arena with its standings
+// on GET with an id, and schedules a new arena on POST
+func (as *ArenaService) HandleArenas(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("id") != "" {
+			as.Show(w, r)
+		} else {
+			as.List(w, r)
+		}
+	case http.MethodPost:
+		as.Create(w, r)
+	}
+}
+
+// Create Schedules an arena, starting now when no starts_at is given
+func (as *ArenaService) Create(w http.ResponseWriter, r *http.Request) {
+	user, userErr := as.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	var request NewArenaRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, arenaError(1, "Invalid JSON request", err.Error()))
+		return
+	}
+
+	arena := &Arena{
+		CreatedBy:   user.UUID.String(),
+		Name:        request.Name,
+		Variant:     request.Variant,
+		ClubID:      request.ClubID,
+		TimeControl: request.TimeControl,
+		Minutes:     request.Minutes,
+		StartsAt:    request.StartsAt,
+		Recurrence:  request.Recurrence,
+		Berserk:     request.Berserk,
+		Status:      ArenaScheduled,
+	}
+
+	if arena.Variant == "" {
+		arena.Variant = VariantStandard
+	}
+
+	if arena.StartsAt.IsZero() || arena.StartsAt.Before(time.Now()) {
+		arena.StartsAt = time.Now()
+	}
+	arena.EndsAt = arena.StartsAt.Add(time.Duration(arena.Minutes) * time.Minute)
+
+	if err := arena.validate(); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, arenaError(80, "Invalid arena settings", err.Error()))
+		return
+	}
+
+	if err := checkClubEvent(as.db, arena.ClubID, arena.CreatedBy); err != nil {
+		RenderJSONResponse(w, http.StatusForbidden, arenaError(113, "Not a club admin", err.Error()))
+		return
+	}
+
+	if err := as.db.Create(arena).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, arenaError(28, "Internal server error", "Error creating arena"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusCreated, &ArenaResponse{Successful: true, Arena: arena})
+}
+
+// List Shows the arenas that are scheduled or running
+func (as *ArenaService) List(w http.ResponseWriter, r *http.Request) {
+	var arenas []*Arena
+	if err := as.db.Where("status <> ?", ArenaFinished).Order("starts_at").Find(&arenas).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &ArenaListResponse{Error: jsonerror.New(28, "Internal server error", "Error loading arenas").Render()})
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &ArenaListResponse{Successful: true, Arenas: arenas})
+}
+
+// Show Gives an arena with its players in standings order, the final ranking once it has finished
+func (as *ArenaService) Show(w http.ResponseWriter, r *http.Request) {
+	arena, errResponse, status := as.findArena(r.URL.Query().Get("id"))
+	if errResponse != nil {
+		RenderJSONResponse(w, status, errResponse)
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &ArenaResponse{Successful: true, Arena: arena})
+}
+
+// findArena Loads an arena by its id with its players ranked
+func (as *ArenaService) findArena(rawID string) (*Arena, *ArenaResponse, int) {
+	id, err := strconv.ParseUint(rawID, 10, 64)
+	if err != nil {
+		return nil, arenaError(81, "Arena not found", "Invalid arena id: "+rawID), http.StatusBadRequest
+	}
+
+	arena := &Arena{}
+	if as.db.Preload("Players").First(arena, id).RowsAffected == 0 {
+		return nil, arenaError(81, "Arena not found", fmt.Sprintf("Arena does not exist with given ID: %d", id)), http.StatusNotFound
+	}
+
+	rankPlayers(arena.Players)
+	return arena, nil, http.StatusOK
+}
+
+// authenticatedArena Authenticates the user and loads the arena they are acting on
+func (as *ArenaService) authenticatedArena(w http.ResponseWriter, r *http.Request) (*User, *Arena, bool) {
+	if r.Method != http.MethodPost {
+		return nil, nil, false
+	}
+
+	user, userErr := as.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return nil, nil, false
+	}
+
+	arena, errResponse, status := as.findArena(r.URL.Query().Get("id"))
+	if errResponse != nil {
+		RenderJSONResponse(w, status, errResponse)
+		return nil, nil, false
+	}
+
+	return user, arena, true
+}
+
+// Join Enters the user in an arena that hasn't ended, or lets a player who withdrew back in
+func (as *ArenaService) Join(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	user, arena, ok := as.authenticatedArena(w, r)
+	if !ok {
+		return
+	}
+
+	if arena.Status == ArenaFinished || time.Now().After(arena.EndsAt) {
+		RenderJSONResponse(w, http.StatusBadRequest, arenaError(82, "Arena is over", "The arena has already ended"))
+		return
+	}
+
+	if arena.ClubID != 0 && !clubMember(as.db, arena.ClubID, user.UUID.String()) {
+		RenderJSONResponse(w, http.StatusForbidden, &ArenaResponse{Error: membersOnly(arena.ClubID)})
+		return
+	}
+
+	player := &ArenaPlayer{}
+	err := as.db.Where("arena_id = ? AND player = ?", arena.ID, user.UUID.String()).
+		Attrs(ArenaPlayer{ArenaID: arena.ID, Player: user.UUID.String()}).
+		FirstOrCreate(player).Error
+	if err == nil {
+		err = as.db.Model(player).Update("active", true).Error
+	}
+
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, arenaError(28, "Internal server error", "Error joining arena"))
+		return
+	}
+
+	as.gs.mu.Lock()
+	as.sendStandings(arena.ID, "arena_standings")
+	as.gs.mu.Unlock()
+
+	RenderJSONResponse(w, http.StatusOK, &ArenaResponse{Successful: true})
+}
+
+// Withdraw Stops the user from being paired again, their score stays in the standings
+func (as *ArenaService) Withdraw(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	user, arena, ok := as.authenticatedArena(w, r)
+	if !ok {
+		return
+	}
+
+	result := as.db.Model(&ArenaPlayer{}).Where("arena_id = ? AND player = ?", arena.ID, user.UUID.String()).Update("active", false)
+	if result.RowsAffected == 0 {
+		RenderJSONResponse(w, http.StatusBadRequest, arenaError(83, "Not in the arena", "You have not joined this arena"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &ArenaResponse{Successful: true})
+}
+
+// GoBerserk Halves the user's clock in the arena game named by game_id before they make their first move,
+// a win then scores an extra point
+func (as *ArenaService) GoBerserk(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodPost {
+		return
+	}
+
+	user, userErr := as.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	as.gs.mu.Lock()
+	defer as.gs.mu.Unlock()
+
+	pairing := &ArenaPairing{}
+	if as.db.Where("game_id = ?", r.URL.Query().Get("game_id")).First(pairing).RowsAffected == 0 {
+		RenderJSONResponse(w, http.StatusNotFound, arenaError(84, "Not an arena game", "No arena game with given ID: "+r.URL.Query().Get("game_id")))
+		return
+	}
+
+	arena := &Arena{}
+	game := &Game{}
+	if as.db.First(arena, pairing.ArenaID).RowsAffected == 0 || as.db.First(game, pairing.GameID).RowsAffected == 0 || game.loadBoard() != nil {
+		RenderJSONResponse(w, http.StatusInternalServerError, arenaError(28, "Internal server error", "Error loading arena game"))
+		return
+	}
+
+	color := game.getColor(user.UUID.String())
+	berserk := &pairing.WhiteBerserk
+	if color == Black {
+		berserk = &pairing.BlackBerserk
+	}
+
+	switch {
+	case color == NoColor:
+		RenderJSONResponse(w, http.StatusForbidden, arenaError(60, "Game does not belong to you", "Game does not belong to you"))
+		return
+	case !arena.Berserk:
+		RenderJSONResponse(w, http.StatusBadRequest, arenaError(85, "Berserk not allowed", "This arena is played without berserk"))
+		return
+	case *berserk:
+		RenderJSONResponse(w, http.StatusBadRequest, arenaError(86, "Already berserk", "You have already gone berserk in this game"))
+		return
+	// White has moved after the first ply and black after the second
+	case game.board.Outcome() != NoOutcome || len(game.board.Moves()) >= int(color):
+		RenderJSONResponse(w, http.StatusBadRequest, arenaError(87, "Too late to go berserk", "Berserk is only possible before your first move"))
+		return
+	}
+
+	*berserk = true
+	now := time.Now()
+	if color == White {
+		game.WhiteClock = game.timeLeft(White, now).Milliseconds() / 2
+	} else {
+		game.BlackClock = game.timeLeft(Black, now).Milliseconds() / 2
+	}
+	// The clock of the side to move keeps running from now on the halved time
+	if game.board.Position().Turn() == color {
+		game.ClockUpdatedAt = now
+	}
+
+	as.db.Save(game)
+	as.db.Save(pairing)
+
+	as.gs.track(game)
+	as.gs.watchClock(game)
+	as.gs.sendGameState(game, nil)
+	for _, player := range []string{game.PlayerWhite, game.PlayerBlack} {
+		as.gs.send(player, &broadcastMessage{"berserk", game.ID, map[string]string{"color": color.Name()}})
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &ArenaResponse{Successful: true})
+}
+
+// scheduler Starts arenas when they are due, pairs their waiting players and finishes them at the end
+func (as *ArenaService) scheduler() {
+	for range time.Tick(arenaTick) {
+		now := time.Now()
+
+		var due []*Arena
+		if err := as.db.Preload("Players").Where("status = ? AND starts_at <= ?", ArenaScheduled, now).Find(&due).Error; err != nil {
+			log.Println(err)
+		}
+
+		for _, arena := range due {
+			as.start(arena)
+		}
+
+		var arenas []*Arena
+		if err := as.db.Where("status = ?", ArenaStarted).Find(&arenas).Error; err != nil {
+			log.Println(err)
+			continue
+		}
+
+		for _, arena := range arenas {
+			if now.Before(arena.EndsAt) {
+				as.pair(arena)
+			} else {
+				as.finish(arena)
+			}
+		}
+	}
+}
+
+// start Opens an arena that is due and tells its players
+func (as *ArenaService) start(arena *Arena) {
+	if err := as.db.Model(arena).Update("status", ArenaStarted).Error; err != nil {
+		log.Println(err)
+		return
+	}
+
+	var players []string
+	for _, player := range arena.Players {
+		players = append(players, player.Player)
+	}
+
+	as.gs.mu.Lock()
+	as.gs.notifyAll(players, NotifyTournamentStart, fmt.Sprintf("The arena %s has started", arena.Name), fmt.Sprintf("/arenas?id=%d", arena.ID))
+	as.gs.mu.Unlock()
+}
+
+// pair Starts games between the arena's active players who are waiting and online, players close
+// in score meet each other and nobody plays the same opponent twice in a row unless there's no one else.
+// Players who blocked each other never meet, one left with only such opponents waits for the next pairing.
+func (as *ArenaService) pair(arena *Arena) {
+	var waiting []*ArenaPlayer
+	if err := as.db.Where("arena_id = ? AND active = ? AND game_id = 0", arena.ID, true).Find(&waiting).Error; err != nil {
+		log.Println(err)
+		return
+	}
+
+	available := waiting[:0]
+	for _, player := range waiting {
+		if as.gs.available(player.Player) {
+			available = append(available, player)
+		}
+	}
+	rankPlayers(available)
+
+	setup, err := arena.setup()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for len(available) >= 2 {
+		player := available[0]
+		opponent := -1
+		for i := 1; i < len(available); i++ {
+			if blocked(as.db, player.Player, available[i].Player) {
+				continue
+			}
+			if opponent == -1 {
+				opponent = i
+			}
+			if available[i].Player != player.LastOpponent {
+				opponent = i
+				break
+			}
+		}
+
+		if opponent == -1 {
+			available = available[1:]
+			continue
+		}
+
+		other := available[opponent]
+		available = append(available[1:opponent], available[opponent+1:]...)
+
+		if err := as.startGame(arena, setup, player, other); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// startGame Creates an arena game between two waiting players, giving white to whoever has had black more often
+func (as *ArenaService) startGame(arena *Arena, setup *GameSetup, a, b *ArenaPlayer) error {
+	if a.ColorBalance > b.ColorBalance {
+		a, b = b, a
+	}
+
+	game, err := as.gs.createGame(a.Player, b.Player, setup, time.Now())
+	if err != nil {
+		return err
+	}
+
+	game.ArenaID = arena.ID
+	as.db.Save(game)
+
+	pairing := &ArenaPairing{ArenaID: arena.ID, GameID: game.ID, White: a.Player, Black: b.Player}
+	if err := as.db.Create(pairing).Error; err != nil {
+		return err
+	}
+
+	as.db.Model(a).Updates(map[string]interface{}{"game_id": game.ID, "color_balance": a.ColorBalance + 1})
+	as.db.Model(b).Updates(map[string]interface{}{"game_id": game.ID, "color_balance": b.ColorBalance - 1})
+
+	as.gs.mu.Lock()
+	defer as.gs.mu.Unlock()
+
+	as.gs.announceGame(game)
+	return nil
+}
+
+// finish Ranks the players once the last arena game is over, and schedules the next arena if it recurs
+func (as *ArenaService) finish(arena *Arena) {
+	var playing int64
+	as.db.Model(&Game{}).Where("arena_id = ? AND result = ?", arena.ID, NoOutcome.String()).Count(&playing)
+	if playing > 0 {
+		return
+	}
+
+	var players []*ArenaPlayer
+	if err := as.db.Where("arena_id = ?", arena.ID).Find(&players).Error; err != nil {
+		log.Println(err)
+		return
+	}
+
+	rankPlayers(players)
+	for i, player := range players {
+		player.Rank = i + 1
+		as.db.Model(player).Update("rank", player.Rank)
+	}
+
+	now := time.Now()
+	arena.Status = ArenaFinished
+	arena.FinishedAt = &now
+	as.db.Save(arena)
+
+	if every, ok := arenaRecurrences[arena.Recurrence]; ok {
+		next := &Arena{
+			CreatedBy:   arena.CreatedBy,
+			Name:        arena.Name,
+			Variant:     arena.Variant,
+			TimeControl: arena.TimeControl,
+			Minutes:     arena.Minutes,
+			StartsAt:    arena.StartsAt.Add(every),
+			Recurrence:  arena.Recurrence,
+			Berserk:     arena.Berserk,
+			Status:      ArenaScheduled,
+		}
+		for next.StartsAt.Before(now) {
+			next.StartsAt = next.StartsAt.Add(every)
+		}
+		next.EndsAt = next.StartsAt.Add(time.Duration(next.Minutes) * time.Minute)
+
+		if err := as.db.Create(next).Error; err != nil {
+			log.Println(err)
+		}
+	}
+
+	as.gs.mu.Lock()
+	defer as.gs.mu.Unlock()
+
+	as.sendStandings(arena.ID, "arena_result")
+}
+
+// sendStandings Sends the arena with its players in standings order to every player in it who is connected
+func (as *ArenaService) sendStandings(arenaID uint, eventType string) {
+	arena, errResponse, _ := as.findArena(strconv.FormatUint(uint64(arenaID), 10))
+	if errResponse != nil {
+		return
+	}
+
+	message := &broadcastMessage{Type: eventType, Payload: arena}
+	for _, player := range arena.Players {
+		as.gs.send(player.Player, message)
+	}
+}
+
+// GameStarted Arena games need nothing when they start, they are announced by the service that made them
+func (as *ArenaService) GameStarted(*Game) {}
+
+// GameMoved Arena games need nothing on a move
+func (as *ArenaService) GameMoved(*Game) {}
+
+// GameEnded Scores a finished arena game for both players, frees them to be paired again and sends the new standings
+func (as *ArenaService) GameEnded(game *Game) {
+	if game.ArenaID == 0 {
+		return
+	}
+
+	pairing := &ArenaPairing{}
+	if as.db.Where("game_id = ?", game.ID).First(pairing).RowsAffected == 0 {
+		return
+	}
+
+	var white float64
+	switch game.board.Outcome() {
+	case WhiteWon:
+		white = 1
+	case Draw:
+		white = 0.5
+	}
+
+	results := []struct {
+		player, opponent string
+		outcome          float64
+		berserk          bool
+	}{
+		{pairing.White, pairing.Black, white, pairing.WhiteBerserk},
+		{pairing.Black, pairing.White, 1 - white, pairing.BlackBerserk},
+	}
+
+	for _, result := range results {
+		player := &ArenaPlayer{}
+		if as.db.Where("arena_id = ? AND player = ?", game.ArenaID, result.player).First(player).RowsAffected == 0 {
+			continue
+		}
+
+		player.record(result.outcome, result.berserk, result.opponent)
+		if result.berserk {
+			player.Berserks++
+		}
+		// The player may withdraw meanwhile, so active is left alone
+		as.db.Model(player).Select("score", "games", "wins", "draws", "losses", "streak", "berserks", "game_id", "last_opponent").Updates(player)
+	}
+
+	as.sendStandings(game.ArenaID, "arena_standings")
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type Outcome string
+
+const (
+	NoOutcome Outcome = "*"
+	WhiteWon  Outcome = "1-0"
+	BlackWon  Outcome = "0-1"
+	Draw      Outcome = "1/2-1/2"
+)
+
+func (o Outcome) String() string {
+	return string(o)
+}
+
+// Method is how the game ended
+type Method string
+
+const (
+	NoMethod             Method = "NoMethod"
+	Checkmate            Method = "Checkmate"
+	Resignation          Method = "Resignation"
+	DrawOffer            Method = "DrawOffer"
+	Stalemate            Method = "Stalemate"
+	FivefoldRepetition   Method = "FivefoldRepetition"
+	SeventyFiveMoveRule  Method = "SeventyFiveMoveRule"
+	InsufficientMaterial Method = "InsufficientMaterial"
+	KingOfTheHill        Method = "KingOfTheHill"
+	ThreeChecks          Method = "ThreeChecks"
+	KingExploded         Method = "KingExploded"
+	AllPiecesLost        Method = "AllPiecesLost"
+	BackRankReached      Method = "BackRankReached"
+	Timeout              Method = "Timeout"
+	// PartnerGameOver ends a Bughouse game with the team result of the partner board
+	PartnerGameOver Method = "PartnerGameOver"
+)
+
+func (m Method) String() string {
+	return string(m)
+}
+
+type TagPair struct {
+	Key   string
+	Value string
+}
+
+// Board is a game of chess from its starting position, with every move played since
+type Board struct {
+	tags      []TagPair
+	positions []*Position
+	keys      []string
+	moves     []*Move
+	outcome   Outcome
+	method    Method
+	// received lists the pieces added to a pocket from outside the game, by the number of moves played at the time
+	received map[int][]Piece
+}
+
+// NewBoard Creates a game starting from the given position, recording the setup in PGN tags when it isn't the standard start
+func NewBoard(start *Position) *Board {
+	board := &Board{
+		outcome: NoOutcome,
+		method:  NoMethod,
+	}
+	board.push(start)
+
+	switch {
+	case start.chess960:
+		board.SetTagPair("Variant", "Chess960")
+	case start.Variant().Name() != VariantStandard:
+		board.SetTagPair("Variant", start.Variant().PGNName())
+	}
+
+	if start.String() != start.Variant().StartingPosition().String() {
+		board.SetTagPair("SetUp", "1")
+		board.SetTagPair("FEN", start.String())
+	}
+
+	board.evaluate()
+
+	return board
+}
+
+func (b *Board) Position() *Position {
+	return b.positions[len(b.positions)-1]
+}
+
+func (b *Board) FEN() string {
+	return b.Position().String()
+}
+
+func (b *Board) Moves() []*Move {
+	return append([]*Move(nil), b.moves...)
+}
+
+func (b *Board) Outcome() Outcome {
+	return b.outcome
+}
+
+func (b *Board) Method() Method {
+	return b.method
+}
+
+func (b *Board) ValidMoves() []*Move {
+	if b.outcome != NoOutcome {
+		return nil
+	}
+
+	return b.Position().ValidMoves()
+}
+
+var ErrGameOver = errors.New("game is already over")
+
+// Move Plays a move, returning an error if it is not legal in the current position
+func (b *Board) Move(m *Move) error {
+	if b.outcome != NoOutcome {
+		return ErrGameOver
+	}
+
+	legal, err := b.Position().legalMove(m)
+	if err != nil {
+		return err
+	}
+
+	b.moves = append(b.moves, legal)
+	b.push(b.Position().Play(legal))
+	b.evaluate()
+
+	return nil
+}
+
+// AddToPocket Gives a piece to a pocket in the current position, in Bughouse this is how a capture
+// on the partner's board arrives. The transfer is kept in the PGN so the game can be replayed.
+func (b *Board) AddToPocket(p Piece) error {
+	pos := b.Position()
+	if !pos.hasPockets() {
+		return fmt.Errorf("%s games have no pockets", pos.Variant().Name())
+	}
+
+	if p.Type == NoPieceType || p.Type == King {
+		return fmt.Errorf("invalid pocket piece: %c", p.Letter())
+	}
+
+	next := pos.copy()
+	next.pockets[p.Color][p.Type]++
+	b.positions[len(b.positions)-1] = next
+	b.keys[len(b.keys)-1] = next.key()
+
+	if b.received == nil {
+		b.received = make(map[int][]Piece)
+	}
+	b.received[len(b.moves)] = append(b.received[len(b.moves)], p)
+
+	return nil
+}
+
+func (b *Board) push(pos *Position) {
+	b.positions = append(b.positions, pos)
+	b.keys = append(b.keys, pos.key())
+}
+
+// evaluate ends the game if the current position is decided by the rules
+func (b *Board) evaluate() {
+	pos := b.Position()
+
+	if outcome, method := pos.Variant().Result(pos, pos.ValidMoves()); outcome != NoOutcome {
+		b.end(outcome, method)
+		return
+	}
+
+	switch {
+	case b.repetitions() >= 5:
+		b.end(Draw, FivefoldRepetition)
+	case pos.halfMoves >= 150:
+		b.end(Draw, SeventyFiveMoveRule)
+	}
+}
+
+func (b *Board) end(outcome Outcome, method Method) {
+	b.outcome = outcome
+	b.method = method
+}
+
+// repetitions counts how many times the current position has occurred
+func (b *Board) repetitions() int {
+	key := b.keys[len(b.keys)-1]
+	count := 0
+	for _, k := range b.keys {
+		if k == key {
+			count++
+		}
+	}
+
+	return count
+}
+
+func winnerOutcome(color Color) Outcome {
+	switch color {
+	case White:
+		return WhiteWon
+	case Black:
+		return BlackWon
+	}
+
+	return Draw
+}
+
+func (b *Board) SetTagPair(key, value string) {
+	for i := range b.tags {
+		if b.tags[i].Key == key {
+			b.tags[i].Value = value
+			return
+		}
+	}
+
+	b.tags = append(b.tags, TagPair{key, value})
+}
+
+func (b *Board) GetTagPair(key string) string {
+	for _, tag := range b.tags {
+		if tag.Key == key {
+			return tag.Value
+		}
+	}
+
+	return ""
+}
+
+// String returns the game as PGN
+func (b *Board) String() string {
+	var sb strings.Builder
+	for _, tag := range b.tags {
+		sb.WriteString(fmt.Sprintf("[%s \"%s\"]\n", tag.Key, strings.ReplaceAll(tag.Value, `"`, `\"`)))
+	}
+
+	if len(b.tags) > 0 {
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString(b.receivedComment(0))
+
+	for i, m := range b.moves {
+		pos := b.positions[i]
+		switch {
+		case pos.turn == White:
+			sb.WriteString(fmt.Sprintf("%d. ", pos.moveNumber))
+		case i == 0:
+			sb.WriteString(fmt.Sprintf("%d... ", pos.moveNumber))
+		}
+
+		sb.WriteString(AlgebraicNotation{}.Encode(pos, m))
+		sb.WriteString(" ")
+		sb.WriteString(b.receivedComment(i + 1))
+	}
+
+	sb.WriteString(b.outcome.String())
+
+	return sb.String()
+}
+
+// receivedComment writes the pieces received after the given number of moves as a {[%pocket +N +p]} comment
+func (b *Board) receivedComment(ply int) string {
+	pieces := b.received[ply]
+	if len(pieces) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("{[%pocket")
+	for _, p := range pieces {
+		sb.WriteString(" +")
+		sb.WriteByte(p.Letter())
+	}
+	sb.WriteString("]} ")
+
+	return sb.String()
+}
+
+var (
+	pocketCommentRe = regexp.MustCompile(`\{\s*\[%pocket((?:\s+\+[QRBNPqrbnp])*)\s*\]\s*\}`)
+	tagPairRegex    = regexp.MustCompile(`\[\s*(\w+)\s+"((?:[^"\\]|\\.)*)"\s*\]`)
+	commentRegex    = regexp.MustCompile(`\{[^}]*\}|;[^\n]*`)
+	moveNumberRe    = regexp.MustCompile(`^\d+\.+`)
+	resultTokenSet  = map[string]Outcome{"1-0": WhiteWon, "0-1": BlackWon, "1/2-1/2": Draw, "*": NoOutcome}
+)
+
+// ParsePGN Reads a single game from PGN, honouring the SetUp/FEN and Variant tags
+func ParsePGN(pgn string) (*Board, error) {
+	var tags []TagPair
+	for _, match := range tagPairRegex.FindAllStringSubmatch(pgn, -1) {
+		tags = append(tags, TagPair{match[1], strings.ReplaceAll(match[2], `\"`, `"`)})
+	}
+
+	movetext := tagPairRegex.ReplaceAllString(pgn, "")
+	// Pocket transfers become +N style tokens before the other comments are dropped
+	movetext = pocketCommentRe.ReplaceAllString(movetext, " $1 ")
+	movetext = commentRegex.ReplaceAllString(movetext, " ")
+	movetext, err := stripVariations(movetext)
+	if err != nil {
+		return nil, err
+	}
+
+	board := &Board{tags: tags}
+	variant, chess960, err := variantFromPGNTag(board.GetTagPair("Variant"))
+	if err != nil {
+		return nil, err
+	}
+
+	start := variant.StartingPosition()
+	if fen := board.GetTagPair("FEN"); fen != "" {
+		if start, err = ParseVariantFEN(variant, fen); err != nil {
+			return nil, err
+		}
+	}
+
+	if chess960 {
+		start.chess960 = true
+	}
+
+	board.push(start)
+	board.outcome = NoOutcome
+	board.method = NoMethod
+	board.evaluate()
+
+	result := NoOutcome
+	for _, token := range strings.Fields(movetext) {
+		token = moveNumberRe.ReplaceAllString(token, "")
+		if token == "" || strings.HasPrefix(token, "$") {
+			continue
+		}
+
+		if outcome, ok := resultTokenSet[token]; ok {
+			result = outcome
+			continue
+		}
+
+		if len(token) == 2 && token[0] == '+' {
+			piece := Piece{pieceTypeFromLetter(token[1]), Black}
+			if token[1] >= 'A' && token[1] <= 'Z' {
+				piece.Color = White
+			}
+
+			if err := board.AddToPocket(piece); err != nil {
+				return nil, fmt.Errorf("invalid pgn pocket transfer %q on ply %d: %w", token, len(board.moves), err)
+			}
+			continue
+		}
+
+		m, err := AlgebraicNotation{}.Decode(board.Position(), token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pgn move %q on ply %d: %w", token, len(board.moves)+1, err)
+		}
+
+		if err := board.Move(m); err != nil {
+			return nil, fmt.Errorf("invalid pgn move %q on ply %d: %w", token, len(board.moves)+1, err)
+		}
+	}
+
+	// A result recorded in the PGN without a rules-based ending (e.g. a resignation) still stands
+	if board.outcome == NoOutcome && result != NoOutcome {
+		board.outcome = result
+	}
+
+	return board, nil
+}
+
+func stripVariations(movetext string) (string, error) {
+	var sb strings.Builder
+	depth := 0
+	for _, r := range movetext {
+		switch {
+		case r == '(':
+			depth++
+		case r == ')':
+			if depth == 0 {
+				return "", errors.New("invalid pgn: unbalanced variation")
+			}
+			depth--
+		case depth == 0:
+			sb.WriteRune(r)
+		}
+	}
+
+	if depth != 0 {
+		return "", errors.New("invalid pgn: unbalanced variation")
+	}
+
+	return sb.String(), nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// BughouseStart tells a Bughouse player which of the two linked games is theirs and who their partner is
+type BughouseStart struct {
+	GameID        uint    `json:"game_id"`
+	PartnerGameID uint    `json:"partner_game_id"`
+	Partner       string  `json:"partner"`
+	Games         []*Game `json:"games"`
+}
+
+// PocketUpdate gives the pieces each side can drop in a Crazyhouse or Bughouse game
+type PocketUpdate struct {
+	GameID uint           `json:"game_id"`
+	White  map[string]int `json:"white"`
+	Black  map[string]int `json:"black"`
+	FEN    string         `json:"fen"`
+}
+
+func (g *Game) pocketUpdate() *PocketUpdate {
+	pos := g.board.Position()
+	return &PocketUpdate{
+		GameID: g.ID,
+		White:  pos.Pocket(White),
+		Black:  pos.Pocket(Black),
+		FEN:    pos.String(),
+	}
+}
+
+// StartBughouse Creates the two linked games for four matched players and notifies all of them.
+// The first two players meet on the first board and the last two on the second, white on one board
+// being partnered with black on the other so that every capture feeds a pocket of the right color.
+func (gs *GameService) StartBughouse(players []*GameRequest) {
+	now := time.Now()
+	setup := &players[0].Setup
+
+	first, err := gs.createGame(players[0].UUID, players[1].UUID, setup, now)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	second, err := gs.createGame(players[2].UUID, players[3].UUID, setup, now)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	first.LinkedGameID, second.LinkedGameID = second.ID, first.ID
+	gs.db.Save(first)
+	gs.db.Save(second)
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	games := []*Game{first, second}
+	partners := map[string]string{
+		first.PlayerWhite:  second.PlayerBlack,
+		second.PlayerBlack: first.PlayerWhite,
+		first.PlayerBlack:  second.PlayerWhite,
+		second.PlayerWhite: first.PlayerBlack,
+	}
+
+	for i, game := range games {
+		partnerGame := games[1-i]
+		for _, player := range []string{game.PlayerWhite, game.PlayerBlack} {
+			gs.send(player, &broadcastMessage{"game_start", game.ID, game})
+			gs.send(player, &broadcastMessage{"bughouse_start", game.ID, &BughouseStart{
+				GameID:        game.ID,
+				PartnerGameID: partnerGame.ID,
+				Partner:       partners[player],
+				Games:         games,
+			}})
+		}
+		gs.track(game)
+
+		for _, listener := range gs.listeners {
+			listener.GameStarted(game)
+		}
+	}
+
+	// Both clocks start together, and a flag on either board ends the match
+	gs.watchClock(first)
+	gs.watchClock(second)
+}
+
+// linkedGame Loads the partner board of a Bughouse game, nil for every other game
+func (gs *GameService) linkedGame(game *Game) (*Game, error) {
+	if game.LinkedGameID == 0 {
+		return nil, nil
+	}
+
+	linked := &Game{}
+	if err := gs.db.First(linked, game.LinkedGameID).Error; err != nil {
+		return nil, err
+	}
+
+	if err := linked.loadBoard(); err != nil {
+		return nil, err
+	}
+
+	return linked, nil
+}
+
+// audience returns everyone who follows the game's moves, which in Bughouse is all four players, along
+// with the spectators of the game and in Bughouse those of the partner board
+func (gs *GameService) audience(game, linked *Game) []string {
+	players := []string{game.PlayerWhite, game.PlayerBlack}
+	if linked != nil {
+		players = append(players, linked.PlayerWhite, linked.PlayerBlack)
+	}
+
+	for spectator := range gs.spectators[game.ID] {
+		players = append(players, spectator)
+	}
+
+	if linked != nil {
+		for spectator := range gs.spectators[linked.ID] {
+			if !gs.spectators[game.ID][spectator] {
+				players = append(players, spectator)
+			}
+		}
+	}
+
+	return players
+}
+
+// passToPartner Puts a piece captured on one Bughouse board into the pocket of the same color on the
+// partner board, where it belongs to the capturer's partner
+func (gs *GameService) passToPartner(game, linked *Game, captured Piece) {
+	if linked.board.Outcome() != NoOutcome {
+		return
+	}
+
+	if err := linked.board.AddToPocket(captured); err != nil {
+		log.Println(err)
+		return
+	}
+
+	linked.record()
+	gs.db.Save(linked)
+
+	gs.track(linked)
+
+	for _, player := range gs.audience(linked, game) {
+		gs.send(player, &broadcastMessage{"pockets", linked.ID, linked.pocketUpdate()})
+	}
+}
+
+// teamOutcome returns the result on the partner board for a Bughouse team result, the winning team
+// having the other color there
+func teamOutcome(outcome Outcome) Outcome {
+	switch outcome {
+	case WhiteWon:
+		return BlackWon
+	case BlackWon:
+		return WhiteWon
+	}
+
+	return outcome
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pjebs/jsonerror"
+	"gorm.io/gorm"
+)
+
+const (
+	// Players talk to their opponent, spectators to each other
+	ChatPlayers    = "players"
+	ChatSpectators = "spectators"
+
+	maxChatLength = 140
+
+	// Each player can send chatBurst messages in any chatWindow
+	chatBurst  = 5
+	chatWindow = 10 * time.Second
+)
+
+// ChatMessage is a line of chat said during a game, kept with the game so moderators can read it when a player is reported
+type ChatMessage struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	GameID    uint      `gorm:"not null;index" json:"game_id"`
+	Room      string    `gorm:"not null" json:"room"`
+	Player    string    `gorm:"not null;index" json:"player"`
+	// Text is what the player wrote, Filtered is set when words were masked before it was passed on
+	Text     string `gorm:"not null" json:"text"`
+	Filtered bool   `json:"filtered,omitempty"`
+}
+
+// ChatMute hides every message of the muted player from the player who muted them
+type ChatMute struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	Player    string `gorm:"not null;uniqueIndex:idx_chat_mute"`
+	Muted     string `gorm:"not null;uniqueIndex:idx_chat_mute"`
+}
+
+// ChatSetting is a player's choice of whether to chat at all, along with the players they have muted
+type ChatSetting struct {
+	Player    string    `gorm:"primaryKey" json:"-"`
+	UpdatedAt time.Time `json:"-"`
+	Disabled  bool      `json:"disabled"`
+	Muted     []string  `gorm:"-" json:"muted"`
+}
+
+// chatFilter masks blocked words and turns down links, configured by CHAT_BLOCKED_WORDS, a comma separated
+// list of words, and CHAT_ALLOW_LINKS
+type chatFilter struct {
+	words *regexp.Regexp
+	links *regexp.Regexp
+}
+
+var linkPattern = regexp.MustCompile(`(?i)(https?://|www\.)\S+|\b[a-z0-9-]+\.(com|net|org|io|gg|ly|me|tv|co|xyz)\b`)
+
+func newChatFilter() *chatFilter {
+	filter := &chatFilter{}
+
+	var words []string
+	for _, word := range strings.Split(os.Getenv("CHAT_BLOCKED_WORDS"), ",") {
+		if word = strings.TrimSpace(word); word != "" {
+			words = append(words, regexp.QuoteMeta(word))
+		}
+	}
+
+	if len(words) > 0 {
+		filter.words = regexp.MustCompile(`(?i)\b(` + strings.Join(words, "|") + `)\b`)
+	}
+
+	if os.Getenv("CHAT_ALLOW_LINKS") != "true" {
+		filter.links = linkPattern
+	}
+
+	return filter
+}
+
+// clean Returns the text with blocked words masked and whether any were, or an error if the text has a link
+func (f *chatFilter) clean(text string) (string, bool, error) {
+	if f.links != nil && f.links.MatchString(text) {
+		return "", false, errors.New("links are not allowed in chat")
+	}
+
+	if f.words == nil || !f.words.MatchString(text) {
+		return text, false, nil
+	}
+
+	return f.words.ReplaceAllStringFunc(text, func(word string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	}), true, nil
+}
+
+type ChatService struct {
+	db     *gorm.DB
+	gs     *GameService
+	filter *chatFilter
+	// moderators are the emails of the users who can read reports, from the comma separated MODERATORS
+	moderators map[string]bool
+	// mu guards recent, the times of each player's latest messages
+	mu     sync.Mutex
+	recent map[string][]time.Time
+}
+
+func NewChatService(db *gorm.DB, gs *GameService) *ChatService {
+	if err := db.AutoMigrate(&ChatMessage{}, &ChatMute{}, &ChatSetting{}, &Report{}); err != nil {
+		panic(err)
+	}
+
+	service := &ChatService{
+		db:         db,
+		gs:         gs,
+		filter:     newChatFilter(),
+		moderators: EmailsFromEnv("MODERATORS"),
+		recent:     make(map[string][]time.Time),
+	}
+
+	gs.HandleMessage("chat", service.Chat)
+
+	http.HandleFunc("/chat/settings", service.HandleSettings)
+	http.HandleFunc("/chat/mute", service.Mute)
+	http.HandleFunc("/chat/unmute", service.Unmute)
+	http.HandleFunc("/reports", service.HandleReports)
+	http.HandleFunc("/reports/resolve", service.ResolveReport)
+
+	return service
+}
+
+// ChatResponse answers a chat socket message, carrying the message as it was passed on
+type ChatResponse struct {
+	Successful bool              `json:"success"`
+	Type       string            `json:"type"`
+	GameID     uint              `json:"game_id,omitempty"`
+	Message    *ChatMessage      `json:"message,omitempty"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+type ChatSettingsRequest struct {
+	Disabled bool `json:"disabled"`
+}
+
+type ChatSettingsResponse struct {
+	Successful bool              `json:"success"`
+	Settings   *ChatSetting      `json:"settings,omitempty"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+func chatError(code int, error, message string) *ChatSettingsResponse {
+	return &ChatSettingsResponse{Error: jsonerror.New(code, error, message).Render()}
+}
+
+// Chat Says a line in the players' or spectators' chat of a game and answers the sender. Everything that can be
+// is loaded before taking the game service lock, which is then held once to pass the message on and answer.
+func (cs *ChatService) Chat(user *User, message map[string]interface{}) {
+	uuid := user.UUID.String()
+	line, response := cs.prepare(user, message, time.Now())
+
+	cs.gs.mu.Lock()
+	defer cs.gs.mu.Unlock()
+
+	if line != nil {
+		for _, recipient := range cs.say(uuid, line, response) {
+			cs.gs.send(recipient, &broadcastMessage{Type: "chat", GameID: line.message.GameID, Payload: response.Message})
+		}
+	}
+
+	cs.gs.send(uuid, response)
+}
+
+// allow Reports whether the player may send another message, counting it if so
+func (cs *ChatService) allow(player string, now time.Time) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	recent := cs.recent[player][:0]
+	for _, sent := range cs.recent[player] {
+		if now.Sub(sent) < chatWindow {
+			recent = append(recent, sent)
+		}
+	}
+
+	if len(recent) >= chatBurst {
+		cs.recent[player] = recent
+		return false
+	}
+
+	cs.recent[player] = append(recent, now)
+	return true
+}
+
+// chatLine is a checked chat message waiting to be stored and passed on
+type chatLine struct {
+	message *ChatMessage
+	// cleaned is the text as passed on, with blocked words masked
+	cleaned string
+	// recipients is the opponent in the players' chat, the spectators are only known under the game service lock
+	recipients []string
+	// silenced are the players the spectators' chat skips
+	silenced map[string]bool
+}
+
+// prepare Checks a chat message as far as it can without the game service lock. Players' chat goes to the
+// opponent unless they muted the sender, and is refused if either turned chat off or blocked the other. For
+// spectators' chat it loads who to skip. The line is nil when the message was turned down.
+func (cs *ChatService) prepare(user *User, message map[string]interface{}, now time.Time) (*chatLine, *ChatResponse) {
+	uuid := user.UUID.String()
+	gameID, gameIDOk := message["game_id"].(float64)
+	text, textOk := message["text"].(string)
+	text = strings.TrimSpace(text)
+	room, _ := message["room"].(string)
+	if room == "" {
+		room = ChatPlayers
+	}
+
+	response := &ChatResponse{Type: "chat", GameID: uint(gameID)}
+
+	switch {
+	case !gameIDOk:
+		response.Error = jsonerror.New(130, "Chat message improperly formatted", "Failed to parse game_id").Render()
+	case !textOk || text == "" || utf8.RuneCountInString(text) > maxChatLength:
+		response.Error = jsonerror.New(130, "Chat message improperly formatted", "Chat messages must have between 1 and 140 characters").Render()
+	case room != ChatPlayers && room != ChatSpectators:
+		response.Error = jsonerror.New(130, "Chat message improperly formatted", "Room must be players or spectators").Render()
+	case !cs.allow(uuid, now):
+		response.Error = jsonerror.New(131, "Slow down", "You are sending messages too quickly").Render()
+	}
+
+	if response.Error != nil {
+		return nil, response
+	}
+
+	cleaned, filtered, err := cs.filter.clean(text)
+	if err != nil {
+		response.Error = jsonerror.New(132, "Message not allowed", err.Error()).Render()
+		return nil, response
+	}
+
+	game := &Game{}
+	if cs.db.First(game, uint(gameID)).RowsAffected == 0 {
+		response.Error = jsonerror.New(61, "Game does not exist with given ID.", "Game does not exist with given ID").Render()
+		return nil, response
+	}
+
+	line := &chatLine{
+		message: &ChatMessage{GameID: game.ID, Room: room, Player: uuid, Text: text, Filtered: filtered},
+		cleaned: cleaned,
+	}
+
+	if room == ChatSpectators {
+		if line.silenced, err = cs.silenced(uuid); err != nil {
+			log.Println(err)
+			response.Error = jsonerror.New(28, "Internal server error", "Error loading chat settings").Render()
+			return nil, response
+		}
+		return line, response
+	}
+
+	color := game.getColor(uuid)
+	if color == NoColor {
+		response.Error = jsonerror.New(60, "Game does not belong to you", "Only the players can talk in the players' chat").Render()
+		return nil, response
+	}
+
+	if cs.disabled(uuid) {
+		response.Error = jsonerror.New(133, "Chat disabled", "You have turned chat off").Render()
+		return nil, response
+	}
+
+	opponent := game.PlayerWhite
+	if color == White {
+		opponent = game.PlayerBlack
+	}
+
+	if cs.disabled(opponent) {
+		response.Error = jsonerror.New(133, "Chat disabled", "Your opponent has turned chat off").Render()
+		return nil, response
+	}
+
+	if blocked(cs.db, uuid, opponent) {
+		response.Error = blockedError()
+		return nil, response
+	}
+
+	if !cs.muted(opponent, uuid) {
+		line.recipients = []string{opponent}
+	}
+
+	return line, response
+}
+
+// say Stores a prepared chat message and fills in the response, returning who to pass it on to. The spectators'
+// chat goes to the game's other spectators, skipping the silenced ones. The lock must be held.
+func (cs *ChatService) say(uuid string, line *chatLine, response *ChatResponse) []string {
+	recipients := line.recipients
+	if line.message.Room == ChatSpectators {
+		spectators := cs.gs.spectators[line.message.GameID]
+		if !spectators[uuid] {
+			response.Error = jsonerror.New(134, "Not watching", "Watch the game to talk with its spectators").Render()
+			return nil
+		}
+
+		for spectator := range spectators {
+			if spectator != uuid && !line.silenced[spectator] {
+				recipients = append(recipients, spectator)
+			}
+		}
+	}
+
+	if err := cs.db.Create(line.message).Error; err != nil {
+		log.Println(err)
+		response.Error = jsonerror.New(28, "Internal server error", "Error saving chat message").Render()
+		return nil
+	}
+
+	passed := *line.message
+	passed.Text = line.cleaned
+	response.Successful = true
+	response.Message = &passed
+	return recipients
+}
+
+// disabled Reports whether the player has turned chat off
+func (cs *ChatService) disabled(player string) bool {
+	return cs.db.Where("player = ? AND disabled = ?", player, true).First(&ChatSetting{}).RowsAffected > 0
+}
+
+// muted Reports whether the player has muted the other
+func (cs *ChatService) muted(player, other string) bool {
+	return cs.db.Where("player = ? AND muted = ?", player, other).First(&ChatMute{}).RowsAffected > 0
+}
+
+// silenced Returns the players who don't get the sender's messages: those who turned chat off, muted the sender,
+// or blocked or were blocked by them
+func (cs *ChatService) silenced(sender string) (map[string]bool, error) {
+	var players []string
+	if err := cs.db.Model(&ChatSetting{}).Where("disabled = ?", true).Pluck("player", &players).Error; err != nil {
+		return nil, err
+	}
+
+	var muting []string
+	if err := cs.db.Model(&ChatMute{}).Where("muted = ?", sender).Pluck("player", &muting).Error; err != nil {
+		return nil, err
+	}
+
+	var blocks []*Block
+	if err := cs.db.Where("player = ? OR blocked = ?", sender, sender).Find(&blocks).Error; err != nil {
+		return nil, err
+	}
+
+	silenced := make(map[string]bool)
+	for _, player := range append(players, muting...) {
+		silenced[player] = true
+	}
+	for _, block := range blocks {
+		silenced[block.Player] = true
+		silenced[block.Blocked] = true
+	}
+	delete(silenced, sender)
+
+	return silenced, nil
+}
+
+// settings Loads the player's chat setting with the players they muted
+func (cs *ChatService) settings(player string) (*ChatSetting, error) {
+	setting := &ChatSetting{Player: player}
+	if err := cs.db.Limit(1).Find(setting, "player = ?", player).Error; err != nil {
+		return nil, err
+	}
+
+	setting.Muted = []string{}
+	if err := cs.db.Model(&ChatMute{}).Where("player = ?", player).Order("created_at").Pluck("muted", &setting.Muted).Error; err != nil {
+		return nil, err
+	}
+
+	return setting, nil
+}
+
+// renderSettings Sends the player's chat settings as the response
+func (cs *ChatService) renderSettings(w http.ResponseWriter, player string) {
+	setting, err := cs.settings(player)
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, chatError(28, "Internal server error", "Error loading chat settings"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &ChatSettingsResponse{Successful: true, Settings: setting})
+}
+
+// HandleSettings Gives the user's chat settings on GET and turns their chat on or off on POST
+func (cs *ChatService) HandleSettings(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		return
+	}
+
+	user, userErr := cs.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		request := &ChatSettingsRequest{}
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			RenderJSONResponse(w, http.StatusBadRequest, chatError(1, "Invalid JSON request", err.Error()))
+			return
+		}
+
+		setting := &ChatSetting{Player: user.UUID.String(), Disabled: request.Disabled}
+		if err := cs.db.Save(setting).Error; err != nil {
+			log.Println(err)
+			RenderJSONResponse(w, http.StatusInternalServerError, chatError(28, "Internal server error", "Error saving chat settings"))
+			return
+		}
+	}
+
+	cs.renderSettings(w, user.UUID.String())
+}
+
+// authenticatedMute Authenticates the user and finds the player named by the player query parameter
+func (cs *ChatService) authenticatedMute(w http.ResponseWriter, r *http.Request) (*User, string, bool) {
+	if r.Method != http.MethodPost {
+		return nil, "", false
+	}
+
+	user, userErr := cs.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return nil, "", false
+	}
+
+	player := r.URL.Query().Get("player")
+	if _, err := cs.gs.us.GetUser(player); err != nil || player == user.UUID.String() {
+		RenderJSONResponse(w, http.StatusNotFound, chatError(135, "Player not found", "No other player with given UUID: "+player))
+		return nil, "", false
+	}
+
+	return user, player, true
+}
+
+// Mute Hides the chat of a player from the user in every game
+func (cs *ChatService) Mute(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	user, player, ok := cs.authenticatedMute(w, r)
+	if !ok {
+		return
+	}
+
+	mute := &ChatMute{Player: user.UUID.String(), Muted: player}
+	if err := cs.db.Where(mute).FirstOrCreate(mute).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, chatError(28, "Internal server error", "Error muting player"))
+		return
+	}
+
+	cs.renderSettings(w, user.UUID.String())
+}
+
+// Unmute Shows the chat of a muted player to the user again
+func (cs *ChatService) Unmute(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	user, player, ok := cs.authenticatedMute(w, r)
+	if !ok {
+		return
+	}
+
+	if err := cs.db.Where("player = ? AND muted = ?", user.UUID.String(), player).Delete(&ChatMute{}).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, chatError(28, "Internal server error", "Error unmuting player"))
+		return
+	}
+
+	cs.renderSettings(w, user.UUID.String())
+}
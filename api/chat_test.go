@@ -0,0 +1,50 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSaySpectators(t *testing.T) {
+	db := newTestDB(t, &ChatMessage{}, &ChatMute{}, &ChatSetting{}, &Block{})
+	cs := &ChatService{db: db, gs: &GameService{spectators: map[uint]map[string]bool{
+		1: {"sender": true, "listener": true, "quiet": true, "muting": true, "blocker": true, "blocked": true},
+	}}}
+
+	rows := []interface{}{
+		&ChatSetting{Player: "quiet", Disabled: true},
+		&ChatSetting{Player: "listener", Disabled: false},
+		&ChatMute{Player: "muting", Muted: "sender"},
+		&ChatMute{Player: "listener", Muted: "someone else"},
+		&Block{Player: "blocker", Blocked: "sender"},
+		&Block{Player: "sender", Blocked: "blocked"},
+	}
+	for _, row := range rows {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	silenced, err := cs.silenced("sender")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	say := func(sender string, game uint) ([]string, *ChatResponse) {
+		line := &chatLine{message: &ChatMessage{GameID: game, Room: ChatSpectators, Player: sender, Text: "hi"}, cleaned: "hi", silenced: silenced}
+		response := &ChatResponse{Type: "chat", GameID: game}
+		return cs.say(sender, line, response), response
+	}
+
+	recipients, response := say("sender", 1)
+	if !response.Successful || response.Message == nil || response.Message.ID == 0 {
+		t.Fatalf("the message wasn't stored: %+v", response)
+	}
+	if !slices.Equal(recipients, []string{"listener"}) {
+		t.Errorf("passed on to %v, want only listener", recipients)
+	}
+
+	if recipients, response := say("sender", 2); response.Successful || recipients != nil {
+		t.Errorf("a player not watching could talk to the spectators")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeControl is the time each player starts with and the increment added after each of their moves
+type TimeControl struct {
+	Initial   time.Duration
+	Increment time.Duration
+}
+
+// ParseTimeControl Reads a time control written as minutes+increment seconds, e.g. 3+2
+func ParseTimeControl(s string) (TimeControl, error) {
+	minutes, increment, ok := strings.Cut(s, "+")
+	if !ok {
+		return TimeControl{}, fmt.Errorf("invalid time control: %s, expected minutes+increment", s)
+	}
+
+	m, err := strconv.ParseFloat(minutes, 64)
+	if err != nil || m <= 0 || m > 180 {
+		return TimeControl{}, fmt.Errorf("invalid time control: %s, minutes must be between 0 and 180", s)
+	}
+
+	inc, err := strconv.Atoi(increment)
+	if err != nil || inc < 0 || inc > 180 {
+		return TimeControl{}, fmt.Errorf("invalid time control: %s, increment must be between 0 and 180 seconds", s)
+	}
+
+	return TimeControl{
+		Initial:   time.Duration(m * float64(time.Minute)),
+		Increment: time.Duration(inc) * time.Second,
+	}, nil
+}
+
+func (tc TimeControl) String() string {
+	return strconv.FormatFloat(tc.Initial.Minutes(), 'f', -1, 64) + "+" + strconv.Itoa(int(tc.Increment.Seconds()))
+}
+
+// timed reports whether the game is played with clocks
+func (g *Game) timed() bool {
+	return g.ClockInitial > 0
+}
+
+// startClock Sets both clocks to the time control and starts white's running
+func (g *Game) startClock(tc TimeControl, now time.Time) {
+	g.ClockInitial = tc.Initial.Milliseconds()
+	g.ClockIncrement = tc.Increment.Milliseconds()
+	g.WhiteClock = g.ClockInitial
+	g.BlackClock = g.ClockInitial
+	g.ClockUpdatedAt = now
+}
+
+// timeLeft returns the time on the color's clock, counting the time used so far if it is running
+func (g *Game) timeLeft(color Color, now time.Time) time.Duration {
+	left := g.WhiteClock
+	if color == Black {
+		left = g.BlackClock
+	}
+
+	remaining := time.Duration(left) * time.Millisecond
+	if g.board != nil && g.board.Outcome() == NoOutcome && g.board.Position().Turn() == color {
+		remaining -= now.Sub(g.ClockUpdatedAt)
+	}
+
+	return remaining
+}
+
+// punchClock Stops the color's clock after their move with the time they had left plus the increment,
+// starting the opponent's clock. Correspondence clocks are reset to the full allowance instead.
+func (g *Game) punchClock(color Color, left time.Duration, now time.Time) {
+	clock := max(left.Milliseconds(), 0) + g.ClockIncrement
+	if g.DaysPerMove > 0 {
+		clock = g.ClockInitial
+	}
+	if color == White {
+		g.WhiteClock = clock
+	} else {
+		g.BlackClock = clock
+	}
+
+	g.ClockUpdatedAt = now
+}
+
+// ClockUpdate gives the time left on both clocks of a timed game in milliseconds
+type ClockUpdate struct {
+	GameID  uint   `json:"game_id"`
+	White   int64  `json:"white"`
+	Black   int64  `json:"black"`
+	Running string `json:"running,omitempty"`
+}
+
+func (g *Game) clockUpdate(now time.Time) *ClockUpdate {
+	update := &ClockUpdate{
+		GameID: g.ID,
+		White:  max(g.timeLeft(White, now).Milliseconds(), 0),
+		Black:  max(g.timeLeft(Black, now).Milliseconds(), 0),
+	}
+
+	if g.board.Outcome() == NoOutcome {
+		update.Running = g.board.Position().Turn().Name()
+	}
+
+	return update
+}
+
+// watchClock Schedules a check that ends the game on time if the side to move lets their clock run out
+func (gs *GameService) watchClock(game *Game) {
+	if !game.timed() || game.board.Outcome() != NoOutcome {
+		return
+	}
+
+	plies := len(game.board.Moves())
+	time.AfterFunc(game.timeLeft(game.board.Position().Turn(), time.Now()), func() {
+		gs.checkFlag(game.ID, plies)
+	})
+}
+
+// checkFlag Ends the game on time if nobody has moved since the check was scheduled
+func (gs *GameService) checkFlag(gameID uint, plies int) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	game := &Game{}
+	if gs.db.First(game, gameID).RowsAffected == 0 {
+		return
+	}
+
+	if err := game.loadBoard(); err != nil {
+		log.Println(err)
+		return
+	}
+
+	if game.board.Outcome() != NoOutcome || len(game.board.Moves()) != plies {
+		return
+	}
+
+	turn := game.board.Position().Turn()
+	if game.timeLeft(turn, time.Now()) > 0 {
+		gs.watchClock(game)
+		return
+	}
+
+	gs.flag(game, turn)
+}
+
+// flag Ends the game as a loss on time for the color
+func (gs *GameService) flag(game *Game, color Color) {
+	if color == White {
+		game.WhiteClock = 0
+	} else {
+		game.BlackClock = 0
+	}
+
+	game.board.end(winnerOutcome(color.Other()), Timeout)
+	game.record()
+	gs.db.Save(game)
+
+	gs.EndGame(game)
+}
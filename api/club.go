@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pjebs/jsonerror"
+	"gorm.io/gorm"
+)
+
+const (
+	ClubAdmin  = "admin"
+	ClubMember = "member"
+
+	// A membership is invited by an admin or requested by the player until the other side accepts it
+	MembershipActive    = "active"
+	MembershipInvited   = "invited"
+	MembershipRequested = "requested"
+)
+
+// Club is a group of players who can hold members-only events and play team matches against other clubs
+type Club struct {
+	ID          uint          `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	Name        string        `gorm:"not null;uniqueIndex" json:"name"`
+	Description string        `json:"description"`
+	CreatedBy   string        `gorm:"not null" json:"created_by"`
+	Members     []*Membership `json:"members,omitempty"`
+}
+
+// Membership is a player's place in a club
+type Membership struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ClubID    uint      `gorm:"not null;uniqueIndex:idx_club_player" json:"club_id"`
+	Player    string    `gorm:"not null;uniqueIndex:idx_club_player;index" json:"player"`
+	Role      string    `gorm:"not null;default:member" json:"role"`
+	Status    string    `gorm:"not null" json:"status"`
+}
+
+// clubMember Reports whether the player is an active member of the club, used to restrict events to a club
+func clubMember(db *gorm.DB, clubID uint, player string) bool {
+	return db.Where("club_id = ? AND player = ? AND status = ?", clubID, player, MembershipActive).First(&Membership{}).RowsAffected > 0
+}
+
+// clubAdmin Reports whether the player is an admin of the club
+func clubAdmin(db *gorm.DB, clubID uint, player string) bool {
+	return db.Where("club_id = ? AND player = ? AND status = ? AND role = ?", clubID, player, MembershipActive, ClubAdmin).First(&Membership{}).RowsAffected > 0
+}
+
+// checkClubEvent Checks that an event restricted to a club is organised by one of the club's admins
+func checkClubEvent(db *gorm.DB, clubID uint, organiser string) error {
+	if clubID == 0 || clubAdmin(db, clubID, organiser) {
+		return nil
+	}
+
+	return errors.New("only admins of the club can hold events for its members")
+}
+
+// membersOnly is the error for a player joining an event restricted to a club they're not in
+func membersOnly(clubID uint) map[string]string {
+	return jsonerror.New(119, "Members only", fmt.Sprintf("Only members of club %d can take part", clubID)).Render()
+}
+
+type ClubService struct {
+	db *gorm.DB
+	gs *GameService
+}
+
+func NewClubService(db *gorm.DB, gs *GameService) *ClubService {
+	if err := db.AutoMigrate(&Club{}, &Membership{}, &TeamMatch{}, &TeamBoard{}); err != nil {
+		panic(err)
+	}
+
+	service := &ClubService{db, gs}
+	gs.AddListener(service)
+
+	http.HandleFunc("/clubs", service.HandleClubs)
+	http.HandleFunc("/clubs/join", service.Join)
+	http.HandleFunc("/clubs/leave", service.Leave)
+	http.HandleFunc("/clubs/invite", service.Invite)
+	http.HandleFunc("/clubs/remove", service.Remove)
+	http.HandleFunc("/clubs/promote", service.Promote)
+	http.HandleFunc("/clubs/matches", service.HandleTeamMatches)
+	http.HandleFunc("/clubs/matches/accept", service.AcceptTeamMatch)
+	http.HandleFunc("/clubs/matches/decline", service.DeclineTeamMatch)
+
+	return service
+}
+
+type NewClubRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type ClubResponse struct {
+	Successful bool              `json:"success"`
+	Club       *Club             `json:"club,omitempty"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+type ClubListResponse struct {
+	Successful bool              `json:"success"`
+	Clubs      []*Club           `json:"clubs"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+func clubError(code int, error, message string) *ClubResponse {
+	return &ClubResponse{Error: jsonerror.New(code, error, message).Render()}
+}
+
+// HandleClubs Lists clubs on GET without an id, shows one club with its members on GET with an id,
+// and founds a new club with the user as its admin on POST
+func (cs *ClubService) HandleClubs(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("id") != "" {
+			cs.Show(w, r)
+		} else {
+			cs.List(w, r)
+		}
+	case http.MethodPost:
+		cs.Create(w, r)
+	}
+}
+
+// Create Founds a club with the user as its first admin
+func (cs *ClubService) Create(w http.ResponseWriter, r *http.Request) {
+	user, userErr := cs.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	var request NewClubRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, clubError(1, "Invalid JSON request", err.Error()))
+		return
+	}
+
+	if request.Name == "" {
+		RenderJSONResponse(w, http.StatusBadRequest, clubError(110, "Invalid club", "A club needs a name"))
+		return
+	}
+
+	if cs.db.Where("name = ?", request.Name).First(&Club{}).RowsAffected > 0 {
+		RenderJSONResponse(w, http.StatusBadRequest, clubError(111, "Club name taken", "A club already exists with the name "+request.Name))
+		return
+	}
+
+	club := &Club{Name: request.Name, Description: request.Description, CreatedBy: user.UUID.String()}
+	err := cs.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(club).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&Membership{ClubID: club.ID, Player: club.CreatedBy, Role: ClubAdmin, Status: MembershipActive}).Error
+	})
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, clubError(28, "Internal server error", "Error creating club"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusCreated, &ClubResponse{Successful: true, Club: club})
+}
+
+// List Shows every club
+func (cs *ClubService) List(w http.ResponseWriter, r *http.Request) {
+	var clubs []*Club
+	if err := cs.db.Order("name").Find(&clubs).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &ClubListResponse{Error: jsonerror.New(28, "Internal server error", "Error loading clubs").Render()})
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &ClubListResponse{Successful: true, Clubs: clubs})
+}
+
+// Show Gives a club with its members, pending invitations and requests
+func (cs *ClubService) Show(w http.ResponseWriter, r *http.Request) {
+	club, errResponse, status := cs.findClub(r.URL.Query().Get("id"))
+	if errResponse != nil {
+		RenderJSONResponse(w, status, errResponse)
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &ClubResponse{Successful: true, Club: club})
+}
+
+// findClub Loads a club by its id with its memberships
+func (cs *ClubService) findClub(rawID string) (*Club, *ClubResponse, int) {
+	id, err := strconv.ParseUint(rawID, 10, 64)
+	if err != nil {
+		return nil, clubError(112, "Club not found", "Invalid club id: "+rawID), http.StatusBadRequest
+	}
+
+	club := &Club{}
+	if cs.db.Preload("Members", func(db *gorm.DB) *gorm.DB {
+		return db.Order("created_at")
+	}).First(club, id).RowsAffected == 0 {
+		return nil, clubError(112, "Club not found", fmt.Sprintf("Club does not exist with given ID: %d", id)), http.StatusNotFound
+	}
+
+	return club, nil, http.StatusOK
+}
+
+// membership finds the player's membership of the club, nil if they have none
+func (c *Club) membership(player string) *Membership {
+	for _, membership := range c.Members {
+		if membership.Player == player {
+			return membership
+		}
+	}
+
+	return nil
+}
+
+// authenticatedClub Authenticates the user and loads the club they are acting on
+func (cs *ClubService) authenticatedClub(w http.ResponseWriter, r *http.Request) (*User, *Club, bool) {
+	if r.Method != http.MethodPost {
+		return nil, nil, false
+	}
+
+	user, userErr := cs.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return nil, nil, false
+	}
+
+	club, errResponse, status := cs.findClub(r.URL.Query().Get("id"))
+	if errResponse != nil {
+		RenderJSONResponse(w, status, errResponse)
+		return nil, nil, false
+	}
+
+	return user, club, true
+}
+
+// adminAction Authenticates a club admin and finds the player named by the player query parameter
+func (cs *ClubService) adminAction(w http.ResponseWriter, r *http.Request) (*Club, string, *Membership, bool) {
+	user, club, ok := cs.authenticatedClub(w, r)
+	if !ok {
+		return nil, "", nil, false
+	}
+
+	if admin := club.membership(user.UUID.String()); admin == nil || admin.Status != MembershipActive || admin.Role != ClubAdmin {
+		RenderJSONResponse(w, http.StatusForbidden, clubError(113, "Not a club admin", "Only admins of the club can do this"))
+		return nil, "", nil, false
+	}
+
+	player := r.URL.Query().Get("player")
+	if _, err := cs.gs.us.GetUser(player); err != nil {
+		RenderJSONResponse(w, http.StatusNotFound, clubError(114, "Player not found", "No player with given UUID: "+player))
+		return nil, "", nil, false
+	}
+
+	return club, player, club.membership(player), true
+}
+
+// Join Asks to join a club, or accepts an invitation to it
+func (cs *ClubService) Join(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	user, club, ok := cs.authenticatedClub(w, r)
+	if !ok {
+		return
+	}
+
+	membership := club.membership(user.UUID.String())
+	switch {
+	case membership == nil:
+		membership = &Membership{ClubID: club.ID, Player: user.UUID.String(), Role: ClubMember, Status: MembershipRequested}
+	case membership.Status == MembershipInvited:
+		membership.Status = MembershipActive
+	default:
+		RenderJSONResponse(w, http.StatusBadRequest, clubError(115, "Already a member", "You are already a member of this club or have asked to join"))
+		return
+	}
+
+	cs.saveMembership(w, club, membership)
+}
+
+// Invite Invites a player to the club, or accepts their request to join. Only admins can invite.
+func (cs *ClubService) Invite(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	club, player, membership, ok := cs.adminAction(w, r)
+	if !ok {
+		return
+	}
+
+	switch {
+	case membership == nil:
+		membership = &Membership{ClubID: club.ID, Player: player, Role: ClubMember, Status: MembershipInvited}
+	case membership.Status == MembershipRequested:
+		membership.Status = MembershipActive
+	default:
+		RenderJSONResponse(w, http.StatusBadRequest, clubError(115, "Already a member", "The player is already a member of this club or has been invited"))
+		return
+	}
+
+	cs.saveMembership(w, club, membership)
+}
+
+// saveMembership Stores a new or changed membership and tells the player
+func (cs *ClubService) saveMembership(w http.ResponseWriter, club *Club, membership *Membership) {
+	if err := cs.db.Save(membership).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, clubError(28, "Internal server error", "Error saving membership"))
+		return
+	}
+
+	cs.gs.mu.Lock()
+	cs.gs.send(membership.Player, &broadcastMessage{Type: "club_membership", Payload: membership})
+	cs.gs.mu.Unlock()
+
+	RenderJSONResponse(w, http.StatusOK, &ClubResponse{Successful: true})
+}
+
+// Leave Leaves a club, declines an invitation or withdraws a request to join. The last admin cannot leave.
+func (cs *ClubService) Leave(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	user, club, ok := cs.authenticatedClub(w, r)
+	if !ok {
+		return
+	}
+
+	membership := club.membership(user.UUID.String())
+	if membership == nil {
+		RenderJSONResponse(w, http.StatusBadRequest, clubError(116, "Not a member", "You are not a member of this club"))
+		return
+	}
+
+	if err := cs.removeMembership(club, membership); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, clubError(117, "Club needs an admin", err.Error()))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &ClubResponse{Successful: true})
+}
+
+// Remove Removes a member from the club, or turns down their request to join. Only admins can remove members.
+func (cs *ClubService) Remove(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	club, _, membership, ok := cs.adminAction(w, r)
+	if !ok {
+		return
+	}
+
+	if membership == nil {
+		RenderJSONResponse(w, http.StatusBadRequest, clubError(116, "Not a member", "The player is not a member of this club"))
+		return
+	}
+
+	if err := cs.removeMembership(club, membership); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, clubError(117, "Club needs an admin", err.Error()))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &ClubResponse{Successful: true})
+}
+
+// removeMembership Deletes a membership unless it belongs to the club's last admin
+func (cs *ClubService) removeMembership(club *Club, membership *Membership) error {
+	if membership.Role == ClubAdmin && membership.Status == MembershipActive {
+		admins := 0
+		for _, other := range club.Members {
+			if other.Role == ClubAdmin && other.Status == MembershipActive {
+				admins++
+			}
+		}
+
+		if admins <= 1 {
+			return errors.New("the last admin of a club cannot leave it, promote another member first")
+		}
+	}
+
+	return cs.db.Delete(membership).Error
+}
+
+// Promote Makes an active member an admin of the club. Only admins can promote members.
+func (cs *ClubService) Promote(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	_, _, membership, ok := cs.adminAction(w, r)
+	if !ok {
+		return
+	}
+
+	if membership == nil || membership.Status != MembershipActive {
+		RenderJSONResponse(w, http.StatusBadRequest, clubError(116, "Not a member", "Only active members can become admins"))
+		return
+	}
+
+	membership.Role = ClubAdmin
+	if err := cs.db.Save(membership).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, clubError(28, "Internal server error", "Error saving membership"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &ClubResponse{Successful: true})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pjebs/jsonerror"
+)
+
+// resumeClocks Restarts the flag checks of unfinished timed games, which are lost when the server restarts.
+// Correspondence games rely on this to time out players who never come back.
+func (gs *GameService) resumeClocks() {
+	var games []*Game
+	if err := gs.db.Where("clock_initial > 0 AND result = ?", NoOutcome.String()).Find(&games).Error; err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, game := range games {
+		if err := game.loadBoard(); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		gs.watchClock(game)
+	}
+}
+
+// deadline returns when the side to move runs out of time in a correspondence game
+func (g *Game) deadline(now time.Time) time.Time {
+	return now.Add(g.timeLeft(g.board.Position().Turn(), now))
+}
+
+type yourMoveEmail struct {
+	Name     string
+	Opponent string
+	GameID   uint
+	LastMove string
+	Deadline string
+}
+
+// notifyTurn Emails the side to move of a correspondence game that it is their turn, and leaves them a notification
+func (gs *GameService) notifyTurn(game *Game) {
+	if game.DaysPerMove == 0 || game.board.Outcome() != NoOutcome {
+		return
+	}
+
+	turn := game.board.Position().Turn()
+	player, opponent := game.PlayerWhite, game.PlayerBlack
+	if turn == Black {
+		player, opponent = opponent, player
+	}
+
+	data := yourMoveEmail{
+		GameID:   game.ID,
+		LastMove: game.lastMove(),
+		Deadline: game.deadline(time.Now()).UTC().Format("Monday 2 January 15:04 MST"),
+	}
+
+	text := fmt.Sprintf("It is your move in game %d", game.ID)
+	if data.LastMove != "" {
+		text += " after " + data.LastMove
+	}
+	gs.notify(&Notification{Player: player, Kind: NotifyYourTurn, Text: text, GameID: game.ID})
+
+	// Sending email is slow, so it happens outside of the move
+	go func() {
+		user, err := gs.us.GetUser(player)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		other, err := gs.us.GetUser(opponent)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		data.Name = user.FirstName
+		data.Opponent = other.FirstName + " " + other.LastName
+
+		if err := gs.us.SendEmail(user.Email, fmt.Sprintf("Your move against %s", data.Opponent), "your-move.tmpl", data); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+// SubmitMove Plays a move sent over REST, so correspondence players don't need an open /events connection.
+// The body takes the same fields as a move socket message.
+func (gs *GameService) SubmitMove(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodPost {
+		return
+	}
+
+	user, userErr := gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"), ScopeGamePlay)
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	var message map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, &MoveResponse{false, jsonerror.New(1, "Invalid JSON request", err.Error()).Render()})
+		return
+	}
+
+	response, status := gs.PlayMove(user, message)
+	RenderJSONResponse(w, status, response)
+}
+
+// TurnGame is a game waiting for the player's move
+type TurnGame struct {
+	*Game
+	FEN      string     `json:"fen"`
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+type MyTurnResponse struct {
+	Successful bool              `json:"success"`
+	Games      []*TurnGame       `json:"games"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+// MyTurn Lists the unfinished games, live or correspondence, where it is the player's move
+func (gs *GameService) MyTurn(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodGet {
+		return
+	}
+
+	user, userErr := gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"), ScopeGamePlay)
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	uuid := user.UUID.String()
+
+	var games []*Game
+	if err := gs.db.Where("(player_white = ? OR player_black = ?) AND result = ?", uuid, uuid, NoOutcome.String()).Order("clock_updated_at").Find(&games).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &MyTurnResponse{Error: jsonerror.New(28, "Internal server error", "Error loading games").Render()})
+		return
+	}
+
+	now := time.Now()
+	turnGames := make([]*TurnGame, 0, len(games))
+	for _, game := range games {
+		if err := game.loadBoard(); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if game.board.Outcome() != NoOutcome || game.board.Position().Turn() != game.getColor(uuid) {
+			continue
+		}
+
+		turnGame := &TurnGame{Game: game, FEN: game.board.FEN()}
+		if game.timed() {
+			deadline := game.deadline(now)
+			turnGame.Deadline = &deadline
+		}
+
+		turnGames = append(turnGames, turnGame)
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &MyTurnResponse{Successful: true, Games: turnGames})
+}
@@ -3,15 +3,17 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"math"
 	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/notnil/chess"
 	"github.com/pjebs/jsonerror"
 	"github.com/scizorman/go-ndjson"
 	"github.com/unrolled/render"
@@ -36,25 +38,117 @@ type Game struct {
 	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
 	PlayerWhite string
 	PlayerBlack string
+	Variant     string `gorm:"not null;default:standard"`
 	PGN         string
-	board       *chess.Game
+	// Result is the PGN result of the game, * while it is being played
+	Result string `gorm:"not null;default:*"`
+	// DaysPerMove is the time each side has for every move of a correspondence game, zero for live games
+	DaysPerMove int
+	// Clocks are kept in milliseconds, a ClockInitial of zero means the game is untimed.
+	// ClockUpdatedAt is when the clock of the side to move started running.
+	ClockInitial   int64
+	ClockIncrement int64
+	WhiteClock     int64
+	BlackClock     int64
+	ClockUpdatedAt time.Time
+	// LinkedGameID is the partner board of a Bughouse game
+	LinkedGameID uint
+	// SimulID is the simul the game is a board of
+	SimulID uint `gorm:"index"`
+	// ArenaID is the arena tournament the game was paired in
+	ArenaID uint `gorm:"index"`
+	// SwissID is the Swiss tournament the game is a round of
+	SwissID uint `gorm:"index"`
+	// TournamentID is the round-robin or knockout tournament the game was scheduled in
+	TournamentID uint `gorm:"index"`
+	// TeamMatchID is the club team match the game is a board of
+	TeamMatchID uint `gorm:"index"`
+	board       *Board
 }
 
-func (g Game) getColor(uuid string) chess.Color {
+func (g Game) getColor(uuid string) Color {
 	if g.PlayerWhite == uuid {
-		return chess.White
+		return White
 	} else if g.PlayerBlack == uuid {
-		return chess.Black
+		return Black
 	}
 
-	return chess.NoColor
+	return NoColor
 }
 
+// record Stores the state of the board in the game's PGN and result
+func (g *Game) record() {
+	g.PGN = g.board.String()
+	g.Result = g.board.Outcome().String()
+}
+
+// lastMove Returns the last move played in algebraic notation, empty before the first move
+func (g *Game) lastMove() string {
+	moves := g.board.Moves()
+	if len(moves) == 0 {
+		return ""
+	}
+
+	positions := g.board.positions
+	return AlgebraicNotation{}.Encode(positions[len(positions)-2], moves[len(moves)-1])
+}
+
+// loadBoard Rebuilds the board from the stored PGN, which carries any custom starting position in its SetUp/FEN tags
+func (g *Game) loadBoard() error {
+	if g.board != nil {
+		return nil
+	}
+
+	if len(g.PGN) == 0 {
+		g.board = NewBoard(StartingPosition())
+		return nil
+	}
+
+	board, err := ParsePGN(g.PGN)
+	if err != nil {
+		return err
+	}
+
+	g.board = board
+	return nil
+}
+
+// maxLiveGames is how many live games a player can have at once, correspondence games don't count
+const maxLiveGames = 20
+
 type dataStream struct {
-	conn              *websocket.Conn
-	broadcast         chan interface{}
-	activeGame        *Game
-	lastBoardPosition string
+	conn      *websocket.Conn
+	broadcast chan interface{}
+	// games are the unfinished games the player is in, by ID, holding the latest board of each
+	games map[uint]*Game
+	// lastActive is when the player last sent a message over the stream
+	lastActive time.Time
+	// session is the login the stream was opened with, revoking it closes the stream
+	session string
+}
+
+// deliver Queues a message without waiting, so a sender holding the game service lock is never held up by one
+// player. A stream whose queue is full isn't keeping up, or its write pump has stopped, so it is closed and its
+// read pump unregisters it.
+func (ds *dataStream) deliver(message interface{}) {
+	select {
+	case ds.broadcast <- message:
+	default:
+		log.Println("Closing event stream that is not keeping up")
+		ds.conn.Close()
+	}
+}
+
+// liveGames counts the player's games that are not played by correspondence
+func (ds *dataStream) liveGames() int {
+	live := 0
+	for _, game := range ds.games {
+		if game.DaysPerMove == 0 {
+			live++
+		}
+	}
+
+	return live
 }
 
 type socketMessage struct {
@@ -62,16 +156,28 @@ type socketMessage struct {
 	Payload map[string]interface{} `json:"payload"`
 }
 
+// broadcastMessage is an event sent over /events, tagged with the game it belongs to so clients can run several boards
 type broadcastMessage struct {
 	Type    string      `json:"type"`
+	GameID  uint        `json:"game_id,omitempty"`
 	Payload interface{} `json:"payload"`
 }
 
-func (gs *GameService) readPump(user *User) {
-	ds := gs.streams[user.UUID.String()]
+func (gs *GameService) readPump(ds *dataStream, user *User) {
 	defer func(conn *websocket.Conn) {
 		conn.Close()
-		delete(gs.streams, user.UUID.String())
+
+		gs.mu.Lock()
+		// A newer connection from the same player replaces this one and must stay
+		if gs.streams[user.UUID.String()] == ds {
+			delete(gs.streams, user.UUID.String())
+			gs.stopWatching(user.UUID.String())
+
+			for _, listener := range gs.streamListeners {
+				listener.StreamClosed(user.UUID.String())
+			}
+		}
+		gs.mu.Unlock()
 	}(ds.conn)
 
 	if err := ds.conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
@@ -88,27 +194,41 @@ func (gs *GameService) readPump(user *User) {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Println(err)
 			} else if errors.As(err, &syntaxError) {
-				ds.broadcast <- jsonerror.New(1, "Invalid JSON request", syntaxError.Error())
+				ds.deliver(jsonerror.New(1, "Invalid JSON request", syntaxError.Error()))
 				continue
 			}
 
 			break
 		}
 
+		gs.mu.Lock()
+		ds.lastActive = time.Now()
+		gs.mu.Unlock()
+
 		switch message.Type {
 		case "move":
 			gs.Move(user, message.Payload)
 		case "position":
-			gs.RetrieveLastPositionFEN(user)
+			gs.RetrieveLastPositionFEN(user, message.Payload)
+		case "watch":
+			gs.Watch(user, message.Payload)
+		case "unwatch":
+			gs.Unwatch(user, message.Payload)
+		default:
+			if handler := gs.handlers[message.Type]; handler != nil {
+				handler(user, message.Payload)
+			}
 		}
 	}
 }
 
-func (gs *GameService) writePump(user *User) {
-	ds := gs.streams[user.UUID.String()]
-
+func (gs *GameService) writePump(ds *dataStream) {
 	ticker := time.NewTicker(pingPeriod)
-	defer ds.conn.Close()
+	// Closing the connection ends the read pump, which unregisters the stream so nothing more is queued for it
+	defer func() {
+		ticker.Stop()
+		ds.conn.Close()
+	}()
 
 	for {
 		select {
@@ -134,9 +254,50 @@ func (gs *GameService) writePump(user *User) {
 type GameService struct {
 	db           *gorm.DB
 	us           *UserService
-	gameRequests chan string
+	gameRequests chan *GameRequest
 	streams      map[string]*dataStream
 	upgrader     websocket.Upgrader
+	// mu serialises changes to games, since a Bughouse move also changes the partner board and clocks run out in the background
+	mu              sync.Mutex
+	listeners       []GameListener
+	streamListeners []StreamListener
+	// spectators are the players watching each unfinished game, by game ID
+	spectators map[uint]map[string]bool
+	handlers   map[string]SocketHandler
+}
+
+// GameListener follows the games played on the server, letting other services such as simuls react to
+// their boards. Listeners are called while the game service lock is held and must not take it again.
+type GameListener interface {
+	GameStarted(game *Game)
+	GameMoved(game *Game)
+	GameEnded(game *Game)
+}
+
+// AddListener Registers a listener to be told about every move and result
+func (gs *GameService) AddListener(listener GameListener) {
+	gs.listeners = append(gs.listeners, listener)
+}
+
+// StreamListener is told when a player connects to or disconnects from /events, while the game service
+// lock is held
+type StreamListener interface {
+	StreamOpened(uuid string)
+	StreamClosed(uuid string)
+}
+
+// AddStreamListener Registers a listener to be told about players connecting and disconnecting
+func (gs *GameService) AddStreamListener(listener StreamListener) {
+	gs.streamListeners = append(gs.streamListeners, listener)
+}
+
+// SocketHandler answers a message sent over /events. Handlers are called without the game service lock held.
+type SocketHandler func(user *User, payload map[string]interface{})
+
+// HandleMessage Registers the handler for socket messages of the given type, letting other services such
+// as chat take messages from clients
+func (gs *GameService) HandleMessage(messageType string, handler SocketHandler) {
+	gs.handlers[messageType] = handler
 }
 
 func NewGameService(db *gorm.DB, us *UserService) *GameService {
@@ -150,17 +311,44 @@ func NewGameService(db *gorm.DB, us *UserService) *GameService {
 				return true
 			},
 		},
-		streams: make(map[string]*dataStream),
+		streams:      make(map[string]*dataStream),
+		spectators:   make(map[uint]map[string]bool),
+		handlers:     make(map[string]SocketHandler),
+		gameRequests: make(chan *GameRequest, 100),
 	}
 
+	us.AddSessionListener(service)
 	go service.Matchmaker()
+	service.resumeClocks()
 
 	http.HandleFunc("/matchmaking", service.NewGame)
 	http.HandleFunc("/events", service.EventManager)
+	http.HandleFunc("/games/move", service.SubmitMove)
+	http.HandleFunc("/games/my-turn", service.MyTurn)
 
 	return service
 }
 
+// SessionRevoked Closes the player's event stream if it was opened with the revoked session, its read pump then
+// cleans up as for any other disconnect
+func (gs *GameService) SessionRevoked(session *Session) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	if ds := gs.streams[session.UserUUID.String()]; ds != nil && ds.session == session.ID.String() {
+		if err := ds.conn.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// send Queues a message for the player if they are connected
+func (gs *GameService) send(uuid string, message interface{}) {
+	if ds := gs.streams[uuid]; ds != nil {
+		ds.deliver(message)
+	}
+}
+
 func JSONError(w http.ResponseWriter, status, code int, error string, message string) {
 	err := render.New().JSON(w, status, jsonerror.New(code, error, message).Render())
 	if err != nil {
@@ -186,55 +374,261 @@ func RenderNDJSONResponse(w http.ResponseWriter, status int, response interface{
 }
 
 type NewGameResponse struct {
-	Successful bool `json:"success"`
+	Successful bool              `json:"success"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+// GameRequest is a player waiting in matchmaking for a game with the given setup
+type GameRequest struct {
+	UUID  string
+	Setup GameSetup
+	// Leave takes the player out of every pool instead, such as when their account is deleted
+	Leave bool
 }
 
 func (gs *GameService) NewGame(w http.ResponseWriter, r *http.Request) {
 	SetCors(&w)
-	w.WriteHeader(http.StatusOK)
 
-	user, userErr := gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	user, userErr := gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"), ScopeGamePlay)
 
 	if userErr != nil {
 		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
 		return
 	}
 
-	gs.gameRequests <- user.UUID.String()
+	setup, err := ParseGameSetup(r.URL.Query())
+	if err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, &NewGameResponse{
+			false,
+			jsonerror.New(41, "Invalid game setup", err.Error()).Render(),
+		})
+		return
+	}
+
+	if setup.ClubID != 0 && !clubMember(gs.db, setup.ClubID, user.UUID.String()) {
+		RenderJSONResponse(w, http.StatusForbidden, &NewGameResponse{false, membersOnly(setup.ClubID)})
+		return
+	}
+
+	gs.gameRequests <- &GameRequest{user.UUID.String(), *setup, false}
 
 	RenderJSONResponse(w, http.StatusOK, NewGameResponse{Successful: true})
 }
 
+// ParseGameSetup Reads the variant, position, fen, time_control and days query parameters of a matchmaking request
+func ParseGameSetup(query url.Values) (*GameSetup, error) {
+	setup := &GameSetup{
+		Variant:          query.Get("variant"),
+		Chess960Position: RandomChess960Position,
+		FEN:              query.Get("fen"),
+	}
+
+	if setup.Variant == "" {
+		setup.Variant = VariantStandard
+	}
+
+	if position := query.Get("position"); position != "" {
+		n, err := strconv.Atoi(position)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chess960 position: %s", position)
+		}
+		setup.Chess960Position = n
+	}
+
+	if days := query.Get("days"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return nil, fmt.Errorf("invalid days per move: %s", days)
+		}
+		setup.DaysPerMove = n
+	}
+
+	if club := query.Get("club"); club != "" {
+		id, err := strconv.ParseUint(club, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid club: %s", club)
+		}
+		setup.ClubID = uint(id)
+	}
+
+	if timeControl := query.Get("time_control"); timeControl != "" {
+		tc, err := ParseTimeControl(timeControl)
+		if err != nil {
+			return nil, err
+		}
+		setup.TimeControl = tc
+	} else if setup.Variant == VariantBughouse && setup.DaysPerMove == 0 {
+		setup.TimeControl = defaultBughouseTimeControl
+	}
+
+	return setup, setup.Validate()
+}
+
+// available Reports whether the player is connected and has room for another live game
+func (gs *GameService) available(uuid string) bool {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	return gs.streams[uuid] != nil && gs.streams[uuid].liveGames() < maxLiveGames
+}
+
+// track Records the latest state of an unfinished game on the streams of its connected players
+func (gs *GameService) track(game *Game) {
+	for _, player := range []string{game.PlayerWhite, game.PlayerBlack} {
+		if stream := gs.streams[player]; stream != nil {
+			stream.games[game.ID] = game
+		}
+	}
+}
+
+// untrack Removes a finished game from the streams of its players and sends its spectators away
+func (gs *GameService) untrack(game *Game) {
+	for _, player := range []string{game.PlayerWhite, game.PlayerBlack} {
+		if stream := gs.streams[player]; stream != nil {
+			delete(stream.games, game.ID)
+		}
+	}
+	delete(gs.spectators, game.ID)
+}
+
+// canPair Reports whether the request can be paired now, correspondence players need not be online
+func (gs *GameService) canPair(request *GameRequest) bool {
+	return request.Setup.DaysPerMove > 0 || gs.available(request.UUID)
+}
+
 func (gs *GameService) Matchmaker() {
-	gs.gameRequests = make(chan string, 100)
 	defer close(gs.gameRequests)
 
-	for {
-		players := []string{<-gs.gameRequests, <-gs.gameRequests}
-		game := &Game{
-			PlayerWhite: players[0],
-			PlayerBlack: players[1],
-			PGN:         "",
+	// Players wait in a separate pool for every setup so they are only paired on the game they asked for
+	waiting := make(map[string][]*GameRequest)
+
+	for request := range gs.gameRequests {
+		if request.Leave {
+			for key, queue := range waiting {
+				waiting[key] = slices.DeleteFunc(queue, func(other *GameRequest) bool { return other.UUID == request.UUID })
+			}
+			continue
 		}
 
-		switch {
-		case players[0] == players[1]:
-			gs.gameRequests <- players[0]
-		case gs.streams[players[0]] == nil && gs.streams[players[1]] == nil:
-		case gs.streams[players[0]] == nil || gs.streams[players[0]].activeGame != nil:
-			gs.gameRequests <- players[1]
-		case gs.streams[players[1]] == nil || gs.streams[players[1]].activeGame != nil:
-			gs.gameRequests <- players[0]
-		default:
-			gs.db.Create(game)
-			for _, player := range players {
-				gs.streams[player].broadcast <- &broadcastMessage{"game_start", game}
-				gs.streams[player].activeGame = game
+		if !gs.canPair(request) {
+			continue
+		}
+
+		key := request.Setup.key()
+		queue := waiting[key][:0]
+		for _, other := range waiting[key] {
+			if other.UUID != request.UUID && gs.canPair(other) {
+				queue = append(queue, other)
 			}
 		}
+		queue = append(queue, request)
+
+		players := gs.matchPlayers(queue, request.Setup.Players())
+		if players == nil {
+			waiting[key] = queue
+			continue
+		}
+
+		delete(waiting, key)
+		for _, other := range queue {
+			if !slices.Contains(players, other) {
+				waiting[key] = append(waiting[key], other)
+			}
+		}
+
+		if request.Setup.Variant == VariantBughouse {
+			gs.StartBughouse(players)
+		} else {
+			gs.StartGame(players[0], players[1])
+		}
 	}
 }
 
+// matchPlayers Picks the players for a game from a queue ending with the newest request: the newest together
+// with the longest waiting players, in queue order, leaving out anyone blocked by or blocking one of the others.
+// Nil if there aren't enough players who can meet.
+func (gs *GameService) matchPlayers(queue []*GameRequest, count int) []*GameRequest {
+	newest := queue[len(queue)-1]
+	players := []*GameRequest{newest}
+
+	for _, candidate := range queue[:len(queue)-1] {
+		if len(players) == count {
+			break
+		}
+
+		if !slices.ContainsFunc(players, func(player *GameRequest) bool { return blocked(gs.db, player.UUID, candidate.UUID) }) {
+			players = append(players, candidate)
+		}
+	}
+
+	if len(players) < count {
+		return nil
+	}
+
+	// The newest request goes last as it came last
+	return append(players[1:], newest)
+}
+
+// createGame Stores a new game between the two players with its clocks started
+func (gs *GameService) createGame(white, black string, setup *GameSetup, now time.Time) (*Game, error) {
+	board, err := setup.NewBoard()
+	if err != nil {
+		return nil, err
+	}
+
+	game := &Game{
+		PlayerWhite: white,
+		PlayerBlack: black,
+		Variant:     setup.Variant,
+		PGN:         board.String(),
+		Result:      board.Outcome().String(),
+		DaysPerMove: setup.DaysPerMove,
+		board:       board,
+	}
+
+	switch {
+	case setup.DaysPerMove > 0:
+		game.startClock(TimeControl{Initial: time.Duration(setup.DaysPerMove) * 24 * time.Hour}, now)
+	case setup.TimeControl.Initial > 0:
+		game.startClock(setup.TimeControl, now)
+	}
+
+	if err := gs.db.Create(game).Error; err != nil {
+		return nil, err
+	}
+
+	return game, nil
+}
+
+// StartGame Creates the game for two matched players and notifies both of them
+func (gs *GameService) StartGame(white, black *GameRequest) {
+	game, err := gs.createGame(white.UUID, black.UUID, &white.Setup, time.Now())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	gs.announceGame(game)
+}
+
+// announceGame Sends a new game to both players, tracks it on their streams and starts its clock
+func (gs *GameService) announceGame(game *Game) {
+	for _, player := range []string{game.PlayerWhite, game.PlayerBlack} {
+		gs.send(player, &broadcastMessage{"game_start", game.ID, game})
+	}
+	gs.track(game)
+
+	for _, listener := range gs.listeners {
+		listener.GameStarted(game)
+	}
+
+	gs.watchClock(game)
+	gs.notifyTurn(game)
+}
+
 type AuthenticationRequest struct {
 	Email       string `json:"email"`
 	AccessToken string `json:"access_token"`
@@ -264,7 +658,7 @@ func (gs *GameService) EventManager(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, userErr := gs.us.AuthenticateRequest(request.Email, request.AccessToken)
+	user, session, userErr := gs.us.AuthenticateSession(request.Email, request.AccessToken, ScopeGamePlay)
 	if userErr != nil {
 		err = conn.WriteJSON(userErr)
 		if err != nil {
@@ -274,11 +668,34 @@ func (gs *GameService) EventManager(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	gs.streams[user.UUID.String()] = &dataStream{conn, make(chan interface{}, 10), nil, chess.StartingPosition().String()}
-	gs.streams[user.UUID.String()].broadcast <- &AuthenticationResponse{true}
+	ds := &dataStream{conn, make(chan interface{}, 64), make(map[uint]*Game), time.Now(), session}
+
+	// Games already under way, such as correspondence games, are followed from the moment the player connects
+	var games []*Game
+	uuid := user.UUID.String()
+	if err := gs.db.Where("(player_white = ? OR player_black = ?) AND result = ?", uuid, uuid, NoOutcome.String()).Find(&games).Error; err != nil {
+		log.Println(err)
+	}
 
-	go gs.readPump(user)
-	go gs.writePump(user)
+	for _, game := range games {
+		if err := game.loadBoard(); err != nil {
+			log.Println(err)
+			continue
+		}
+		ds.games[game.ID] = game
+	}
+
+	gs.mu.Lock()
+	gs.streams[uuid] = ds
+	for _, listener := range gs.streamListeners {
+		listener.StreamOpened(uuid)
+	}
+	gs.mu.Unlock()
+
+	ds.deliver(&AuthenticationResponse{true})
+
+	go gs.readPump(ds, user)
+	go gs.writePump(ds)
 }
 
 type MoveRequest struct {
@@ -290,6 +707,7 @@ type MoveRequest struct {
 }
 
 type GameOutcome struct {
+	GameID    uint   `json:"game_id"`
 	Result    string `json:"result"`
 	IsDraw    bool   `json:"is_draw"`
 	Winner    string `json:"winner,omitempty"`
@@ -303,24 +721,69 @@ type MoveResponse struct {
 	Error      map[string]string `json:"error,omitempty"`
 }
 
+// moveAck tags the response to a socket move with its game, so clients playing several boards can match them up
+type moveAck struct {
+	*MoveResponse
+	GameID uint `json:"game_id,omitempty"`
+}
+
 type GameRetrievalResponse struct {
 	Successful bool   `json:"success"`
 	Type       string `json:"type"`
+	GameID     uint   `json:"game_id,omitempty"`
 	FEN        string `json:"fen"`
 }
 
-func (gs *GameService) RetrieveLastPositionFEN(user *User) {
+// RetrieveLastPositionFEN Sends the position of the game named by game_id, or of every game the player is in
+// when it is left out. A player without games gets the standard starting position.
+func (gs *GameService) RetrieveLastPositionFEN(user *User, message map[string]interface{}) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
 	ds := gs.streams[user.UUID.String()]
+	if ds == nil {
+		return
+	}
+
+	if gameID, ok := message["game_id"].(float64); ok {
+		game, ok := ds.games[uint(gameID)]
+		if !ok {
+			// Finished games are no longer tracked but can still be looked at by their players
+			game = &Game{}
+			if gs.db.First(game, uint(gameID)).RowsAffected == 0 || game.getColor(user.UUID.String()) == NoColor || game.loadBoard() != nil {
+				ds.deliver(&GameRetrievalResponse{false, "game_board", uint(gameID), ""})
+				return
+			}
+		}
 
-	ds.broadcast <- &GameRetrievalResponse{true, "game_board", ds.lastBoardPosition}
+		ds.deliver(&GameRetrievalResponse{true, "game_board", game.ID, game.board.FEN()})
+		return
+	}
+
+	if len(ds.games) == 0 {
+		ds.deliver(&GameRetrievalResponse{true, "game_board", 0, StartingFEN})
+		return
+	}
+
+	for _, game := range ds.games {
+		ds.deliver(&GameRetrievalResponse{true, "game_board", game.ID, game.board.FEN()})
+	}
 }
 
 func (gs *GameService) Move(user *User, message map[string]interface{}) {
-	ds := gs.streams[user.UUID.String()]
+	response, _ := gs.PlayMove(user, message)
+	gameID, _ := message["game_id"].(float64)
 
+	gs.mu.Lock()
+	gs.send(user.UUID.String(), &moveAck{response, uint(gameID)})
+	gs.mu.Unlock()
+}
+
+// parseMoveRequest Reads a move from a socket message payload or a REST request body
+func parseMoveRequest(message map[string]interface{}) (*MoveRequest, *MoveResponse) {
 	moveRequest := &MoveRequest{}
 
-	var notationOk, gameIDOk, drawOk, resignOk, notationTypeOK bool
+	var notationOk, gameIDOk, notationTypeOK bool
 
 	moveRequest.Notation, notationOk = message["notation"].(string)
 	moveRequest.notationType, notationTypeOK = message["notation_type"].(string)
@@ -330,171 +793,212 @@ func (gs *GameService) Move(user *User, message map[string]interface{}) {
 
 	gameID, gameIDOk := message["game_id"].(float64)
 	moveRequest.GameID = int64(math.Floor(gameID))
-	moveRequest.RequestDraw, drawOk = message["request_draw"].(bool)
-	moveRequest.Resign, resignOk = message["resign"].(bool)
+	moveRequest.RequestDraw, _ = message["request_draw"].(bool)
+	moveRequest.Resign, _ = message["resign"].(bool)
 
 	if !notationOk {
-		ds.broadcast <- &MoveResponse{
+		return nil, &MoveResponse{
 			false,
 			jsonerror.New(62, "Move request improperly formatted.", "Failed to parse notation.").Render(),
 		}
-		return
 	}
 
 	if !gameIDOk {
-		ds.broadcast <- &MoveResponse{
+		return nil, &MoveResponse{
 			false,
 			jsonerror.New(62, "Move request improperly formatted.", "Failed to parse game_id.").Render(),
 		}
 	}
 
-	if !drawOk {
-		ds.broadcast <- &MoveResponse{
-			false,
-			jsonerror.New(62, "Move request improperly formatted.", "Failed to parse request_draw.").Render(),
-		}
-	}
+	return moveRequest, nil
+}
 
-	if !resignOk {
-		ds.broadcast <- &MoveResponse{
-			false,
-			jsonerror.New(62, "Move request improperly formatted.", "Failed to parse resign.").Render(),
-		}
+// PlayMove Plays a move for the user and tells everyone following the game, returning the response for
+// the user together with the HTTP status it maps to
+func (gs *GameService) PlayMove(user *User, message map[string]interface{}) (*MoveResponse, int) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	moveRequest, parseErr := parseMoveRequest(message)
+	if parseErr != nil {
+		return parseErr, http.StatusBadRequest
 	}
 
 	game := &Game{}
 	if gs.db.First(&game, moveRequest.GameID).RowsAffected == 0 {
 		log.Println("Game does not exist with given ID: ", moveRequest.GameID)
-		ds.broadcast <- &MoveResponse{
+		return &MoveResponse{
 			false,
 			jsonerror.New(61, "Game does not exist with given ID.", "Game does not exist with given ID: "+strconv.FormatInt(moveRequest.GameID, 10)).Render(),
-		}
-		return
+		}, http.StatusNotFound
 	}
 
-	if game.board == nil && len(game.PGN) != 0 {
-		pgn, err := chess.PGN(strings.NewReader(game.PGN))
-		if err != nil {
-			ds.broadcast <- &MoveResponse{
-				false,
-				jsonerror.New(28, "Internal server error", "Error parsing game data").Render(),
-			}
-		}
-
-		game.board = chess.NewGame(pgn, chess.UseNotation(chess.AlgebraicNotation{}))
-	} else if len(game.PGN) == 0 {
-		game.board = chess.NewGame(chess.UseNotation(chess.AlgebraicNotation{}))
+	if err := game.loadBoard(); err != nil {
+		log.Println(err)
+		return &MoveResponse{
+			false,
+			jsonerror.New(28, "Internal server error", "Error parsing game data").Render(),
+		}, http.StatusInternalServerError
 	}
 
-	var color chess.Color
+	var color Color
 
-	if color = game.getColor(user.UUID.String()); color == chess.NoColor {
-		ds.broadcast <- &MoveResponse{false, jsonerror.New(60, "Game does not belong to you", "Game does not belong to you").Render()}
-		return
+	if color = game.getColor(user.UUID.String()); color == NoColor {
+		return &MoveResponse{false, jsonerror.New(60, "Game does not belong to you", "Game does not belong to you").Render()}, http.StatusForbidden
 	}
 
 	if game.board.Position().Turn() != color {
-		ds.broadcast <- &MoveResponse{false, jsonerror.New(59, "It is not your turn", "It is not your turn").Render()}
-		return
+		return &MoveResponse{false, jsonerror.New(59, "It is not your turn", "It is not your turn").Render()}, http.StatusBadRequest
 	}
 
-	var decoder chess.Notation
-
-	switch moveRequest.notationType {
-	case "uci":
-		decoder = chess.UCINotation{}
-	case "long algebraic":
-		decoder = chess.LongAlgebraicNotation{}
-	default:
-		decoder = chess.AlgebraicNotation{}
+	now := time.Now()
+	left := game.timeLeft(color, now)
+	if game.timed() && left <= 0 {
+		gs.flag(game, color)
+		return &MoveResponse{false, jsonerror.New(63, "Out of time", "Your clock ran out before the move").Render()}, http.StatusBadRequest
 	}
 
+	decoder := NotationFor(moveRequest.notationType)
+
 	move, err := decoder.Decode(game.board.Position(), moveRequest.Notation)
 
 	if err != nil {
-		ds.broadcast <- &MoveResponse{
+		return &MoveResponse{
 			false,
 			jsonerror.New(58, "Illegal move", err.Error()).Render(),
-		}
-		return
+		}, http.StatusBadRequest
 	}
 
 	// For later sending to other clients
-	moveRequest.Notation = chess.AlgebraicNotation{}.Encode(game.board.Position(), move)
+	moveRequest.Notation = AlgebraicNotation{}.Encode(game.board.Position(), move)
+	captured := game.board.Position().capturedPiece(move)
 
 	err = game.board.Move(move)
 	if err != nil {
-		ds.broadcast <- &MoveResponse{false, jsonerror.New(58, "Illegal move", err.Error()).Render()}
-		return
+		return &MoveResponse{false, jsonerror.New(58, "Illegal move", err.Error()).Render()}, http.StatusBadRequest
+	}
+
+	if game.timed() {
+		game.punchClock(color, left, now)
 	}
 
-	game.PGN = game.board.String()
+	game.record()
 
 	gs.db.Save(game)
 
-	ds.broadcast <- &MoveResponse{true, nil}
-	for _, player := range []string{game.PlayerWhite, game.PlayerBlack} {
-		gs.streams[player].broadcast <- &broadcastMessage{Type: "move", Payload: moveRequest}
-		gs.streams[player].activeGame = game
-		gs.streams[player].lastBoardPosition = game.board.FEN()
+	linked, err := gs.linkedGame(game)
+	if err != nil {
+		log.Println(err)
 	}
 
-	if game.board.Outcome() == chess.NoOutcome {
-		return
+	if linked != nil && captured != NoPiece {
+		gs.passToPartner(game, linked, captured)
+	}
+
+	for _, player := range gs.audience(game, linked) {
+		gs.send(player, &broadcastMessage{Type: "move", GameID: game.ID, Payload: moveRequest})
 	}
+	gs.track(game)
+
+	gs.sendGameState(game, linked)
 
-	var opponentUUID string
+	for _, listener := range gs.listeners {
+		listener.GameMoved(game)
+	}
 
-	if color == chess.White {
-		opponentUUID = game.PlayerBlack
+	if game.board.Outcome() == NoOutcome {
+		gs.watchClock(game)
+		gs.notifyTurn(game)
 	} else {
-		opponentUUID = game.PlayerWhite
+		gs.EndGame(game)
 	}
 
-	opponentStream := gs.streams[opponentUUID]
+	return &MoveResponse{true, nil}, http.StatusOK
+}
+
+// sendGameState Sends the pockets of drop variant games and the clocks of timed games to everyone following the game
+func (gs *GameService) sendGameState(game, linked *Game) {
+	var messages []*broadcastMessage
+	if game.board.Position().hasPockets() {
+		messages = append(messages, &broadcastMessage{"pockets", game.ID, game.pocketUpdate()})
+	}
 
-	opponent, err := gs.us.GetUser(opponentUUID)
+	if game.timed() {
+		messages = append(messages, &broadcastMessage{"clock", game.ID, game.clockUpdate(time.Now())})
+	}
+
+	for _, player := range gs.audience(game, linked) {
+		for _, message := range messages {
+			gs.send(player, message)
+		}
+	}
+}
+
+// EndGame Rates a finished game and sends the result to its players. In Bughouse the partner board
+// ends with the same team result and neither board is rated.
+func (gs *GameService) EndGame(game *Game) {
+	linked, err := gs.linkedGame(game)
 	if err != nil {
-		panic(err)
+		log.Println(err)
 	}
 
 	gameResult := &GameOutcome{
+		GameID: game.ID,
 		Result: game.board.Outcome().String(),
 		Method: game.board.Method().String(),
-		IsDraw: false,
+		IsDraw: game.board.Outcome() == Draw,
 	}
 
 	switch game.board.Outcome() {
-	case chess.WhiteWon:
-		if color == chess.White {
-			gameResult.Winner = user.UUID.String()
-			gameResult.Loser = opponentUUID
-			gs.UpdateELO(user, opponent, 1.0)
-		} else {
-			gameResult.Winner = opponentUUID
-			gameResult.Loser = user.UUID.String()
-			gs.UpdateELO(opponent, user, 1.0)
-		}
-	case chess.BlackWon:
-		if color == chess.Black {
-			gameResult.Winner = user.UUID.String()
-			gameResult.Loser = opponentUUID
-			gs.UpdateELO(user, opponent, 1.0)
-		} else {
-			gameResult.Winner = opponentUUID
-			gameResult.Loser = user.UUID.String()
-			gs.UpdateELO(opponent, user, 1.0)
-		}
-	case chess.Draw:
-		gameResult.IsDraw = true
-		gs.UpdateELO(user, opponent, 0.5)
+	case WhiteWon:
+		gameResult.Winner, gameResult.Loser = game.PlayerWhite, game.PlayerBlack
+	case BlackWon:
+		gameResult.Winner, gameResult.Loser = game.PlayerBlack, game.PlayerWhite
+	}
+
+	if linked == nil {
+		gs.rateGame(game)
+	}
+
+	for _, player := range gs.audience(game, linked) {
+		gs.send(player, &broadcastMessage{Type: "game_result", GameID: game.ID, Payload: gameResult})
 	}
+	gs.untrack(game)
 
-	ds.broadcast <- &broadcastMessage{Type: "game_result", Payload: gameResult}
-	opponentStream.broadcast <- &broadcastMessage{Type: "game_result", Payload: gameResult}
+	for _, listener := range gs.listeners {
+		listener.GameEnded(game)
+	}
 
-	ds.activeGame = nil
-	opponentStream.activeGame = nil
+	if linked != nil && linked.board.Outcome() == NoOutcome {
+		linked.board.end(teamOutcome(game.board.Outcome()), PartnerGameOver)
+		linked.record()
+		gs.db.Save(linked)
+		gs.EndGame(linked)
+	}
+}
+
+// rateGame Updates the ELO of both players from the result of the game
+func (gs *GameService) rateGame(game *Game) {
+	white, err := gs.us.GetUser(game.PlayerWhite)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	black, err := gs.us.GetUser(game.PlayerBlack)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	switch game.board.Outcome() {
+	case WhiteWon:
+		gs.UpdateELO(white, black, 1.0)
+	case BlackWon:
+		gs.UpdateELO(black, white, 1.0)
+	case Draw:
+		gs.UpdateELO(white, black, 0.5)
+	}
 }
 
 // CalculateProbability Calculates probability for u1 to win the game
@@ -3,15 +3,18 @@ module checkers
 go 1.23
 
 require (
+	github.com/coreos/go-oidc/v3 v3.11.0
+	github.com/go-jose/go-jose/v4 v4.0.2
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/joho/godotenv v1.5.1
-	github.com/notnil/chess v1.10.0
 	github.com/pjebs/jsonerror v0.0.0-20190614034432-63ef9a8df848
 	github.com/scizorman/go-ndjson v0.0.0-20200902005011-1d92486df71e
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/unrolled/render v1.7.0
 	golang.org/x/crypto v0.32.0
+	golang.org/x/oauth2 v0.21.0
 	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df
 	gorm.io/driver/postgres v1.5.7
 	gorm.io/driver/sqlite v1.5.7
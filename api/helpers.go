@@ -1,9 +1,26 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"os"
+	"strings"
+)
 
 func SetCors(w *http.ResponseWriter) {
 	(*w).Header().Set("Access-Control-Allow-Origin", "*")
 	(*w).Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
 	(*w).Header().Set("Access-Control-Allow-Headers", "*")
 }
+
+// EmailsFromEnv Reads a comma separated list of emails from an environment variable, such as the users
+// allowed to moderate, as a lowercase set
+func EmailsFromEnv(name string) map[string]bool {
+	emails := make(map[string]bool)
+	for _, email := range strings.Split(os.Getenv(name), ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			emails[strings.ToLower(email)] = true
+		}
+	}
+
+	return emails
+}
@@ -39,7 +39,19 @@ func main() {
 		os.Getenv("PUBLIC_KEY_PATH"),
 	)
 
-	NewGameService(db, userService)
+	gameService := NewGameService(db, userService)
+	NewSimulService(db, gameService)
+	NewArenaService(db, gameService)
+	NewSwissService(db, gameService)
+	NewTournamentService(db, gameService)
+	NewClubService(db, gameService)
+	NewChatService(db, gameService)
+	NewSocialService(db, gameService)
+	NewPresenceService(db, gameService)
+	NewNotificationService(db, gameService)
+	NewWebhookService(db, gameService)
+	NewAccountService(db, gameService)
+	NewOAuthService(db, gameService)
 
 	err = http.ListenAndServe(":8080", nil)
 	if err != nil {
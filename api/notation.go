@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Notation encodes and decodes moves in a position
+type Notation interface {
+	Encode(pos *Position, m *Move) string
+	Decode(pos *Position, s string) (*Move, error)
+}
+
+// NotationFor Looks up a notation by the name clients send in move requests
+func NotationFor(name string) Notation {
+	switch name {
+	case "uci":
+		return UCINotation{}
+	case "long algebraic":
+		return LongAlgebraicNotation{}
+	default:
+		return AlgebraicNotation{}
+	}
+}
+
+// UCINotation e.g. e2e4, e7e8q, N@f3. Castling is encoded as e1g1 in standard games
+// and as the king capturing its rook (e1h1) in Chess960 games.
+type UCINotation struct{}
+
+func (UCINotation) Encode(pos *Position, m *Move) string {
+	if m.Drop != NoPieceType {
+		return dropNotation(m)
+	}
+
+	to := m.To
+	if m.Castle && (pos == nil || !pos.chess960) {
+		file := 6
+		if m.To.File() < m.From.File() {
+			file = 2
+		}
+		to = NewSquare(file, m.From.Rank())
+	}
+
+	s := m.From.String() + to.String()
+	if m.Promotion != NoPieceType {
+		s += string(pieceLetters[m.Promotion])
+	}
+
+	return s
+}
+
+func (UCINotation) Decode(pos *Position, s string) (*Move, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) == 4 && s[1] == '@' {
+		return decodeByEncodings(pos, s)
+	}
+
+	if len(s) != 4 && len(s) != 5 {
+		return nil, fmt.Errorf("invalid uci move: %s", s)
+	}
+
+	from, err := ParseSquare(s[0:2])
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := ParseSquare(s[2:4])
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Move{From: from, To: to}
+	if len(s) == 5 {
+		if m.Promotion = pieceTypeFromLetter(s[4]); m.Promotion == NoPieceType {
+			return nil, fmt.Errorf("invalid uci promotion: %s", s)
+		}
+	}
+
+	legal := pos.ValidMoves()
+	for _, valid := range legal {
+		if !valid.Castle && *valid == *m {
+			return valid, nil
+		}
+	}
+
+	// Castling may be given as the king taking its rook or, in standard chess, as the king's destination
+	for _, valid := range legal {
+		if !valid.Castle || valid.From != from || m.Promotion != NoPieceType {
+			continue
+		}
+
+		if valid.To == to || (!pos.chess960 && UCINotation{}.Encode(pos, valid) == s) {
+			return valid, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrIllegalMove, s)
+}
+
+// AlgebraicNotation e.g. e4, Nxf3, O-O, e8=Q+, N@f3
+type AlgebraicNotation struct{}
+
+func (AlgebraicNotation) Encode(pos *Position, m *Move) string {
+	return sanWithoutCheck(pos, pos.ValidMoves(), m, false) + checkSuffix(pos, m)
+}
+
+func (AlgebraicNotation) Decode(pos *Position, s string) (*Move, error) {
+	return decodeByEncodings(pos, s)
+}
+
+// LongAlgebraicNotation e.g. e2e4, Ng1xf3, O-O, e7e8=Q
+type LongAlgebraicNotation struct{}
+
+func (LongAlgebraicNotation) Encode(pos *Position, m *Move) string {
+	return sanWithoutCheck(pos, nil, m, true) + checkSuffix(pos, m)
+}
+
+func (LongAlgebraicNotation) Decode(pos *Position, s string) (*Move, error) {
+	return decodeByEncodings(pos, s)
+}
+
+// sanWithoutCheck writes a move in SAN, or with the full origin square when long is set.
+// The legal moves of the position are needed to disambiguate SAN.
+func sanWithoutCheck(pos *Position, legal []*Move, m *Move, long bool) string {
+	if m.Castle {
+		if m.To.File() < m.From.File() {
+			return "O-O-O"
+		}
+		return "O-O"
+	}
+
+	if m.Drop != NoPieceType {
+		return dropNotation(m)
+	}
+
+	p := pos.Piece(m.From)
+	capture := pos.Piece(m.To) != NoPiece || (p.Type == Pawn && m.From.File() != m.To.File())
+
+	var sb strings.Builder
+	if p.Type != Pawn {
+		sb.WriteByte(Piece{p.Type, White}.Letter())
+	}
+
+	switch {
+	case long:
+		sb.WriteString(m.From.String())
+	case p.Type == Pawn:
+		if capture {
+			sb.WriteByte(byte('a' + m.From.File()))
+		}
+	default:
+		sb.WriteString(disambiguation(pos, legal, m))
+	}
+
+	if capture {
+		sb.WriteByte('x')
+	}
+
+	sb.WriteString(m.To.String())
+
+	if m.Promotion != NoPieceType {
+		sb.WriteByte('=')
+		sb.WriteByte(Piece{m.Promotion, White}.Letter())
+	}
+
+	return sb.String()
+}
+
+// disambiguation returns the file, rank or square needed to tell the move apart from others
+func disambiguation(pos *Position, legal []*Move, m *Move) string {
+	p := pos.Piece(m.From)
+	var sameFile, sameRank, ambiguous bool
+
+	for _, other := range legal {
+		if other.Castle || other.From == m.From || other.To != m.To || pos.Piece(other.From) != p {
+			continue
+		}
+
+		ambiguous = true
+		if other.From.File() == m.From.File() {
+			sameFile = true
+		}
+		if other.From.Rank() == m.From.Rank() {
+			sameRank = true
+		}
+	}
+
+	switch {
+	case !ambiguous:
+		return ""
+	case !sameFile:
+		return string(rune('a' + m.From.File()))
+	case !sameRank:
+		return string(rune('1' + m.From.Rank()))
+	}
+
+	return m.From.String()
+}
+
+// dropNotation writes a drop as the piece letter, @ and the square, e.g. N@f3 or P@e4
+func dropNotation(m *Move) string {
+	return string(Piece{m.Drop, White}.Letter()) + "@" + m.To.String()
+}
+
+func checkSuffix(pos *Position, m *Move) string {
+	next := pos.Play(m)
+	if !next.InCheck() {
+		return ""
+	}
+
+	if len(next.ValidMoves()) == 0 {
+		return "#"
+	}
+
+	return "+"
+}
+
+// normalizeNotation strips annotations so that e.g. "Nf3+!" and "0-0" compare equal to "Nf3" and "O-O"
+func normalizeNotation(s string) string {
+	s = strings.TrimSpace(s)
+	s = strings.ReplaceAll(s, "0", "O")
+	s = strings.TrimSuffix(s, "e.p.")
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '+', '#', '!', '?', '=', '-', ' ':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// decodeByEncodings matches the string against every way a legal move can be written in SAN or LAN
+func decodeByEncodings(pos *Position, s string) (*Move, error) {
+	target := normalizeNotation(s)
+	if target == "" {
+		return nil, fmt.Errorf("invalid move notation: %q", s)
+	}
+
+	legal := pos.ValidMoves()
+	for _, m := range legal {
+		for _, encoding := range moveEncodings(pos, legal, m) {
+			if normalizeNotation(encoding) == target {
+				return m, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrIllegalMove, s)
+}
+
+func moveEncodings(pos *Position, legal []*Move, m *Move) []string {
+	san := sanWithoutCheck(pos, legal, m, false)
+	switch {
+	case m.Castle:
+		return []string{san}
+	case m.Drop == Pawn:
+		// Pawn drops are also written without the letter, and UCI writes drops in lower case
+		return []string{san, san[1:], strings.ToLower(san)}
+	case m.Drop != NoPieceType:
+		return []string{san, strings.ToLower(san)}
+	}
+
+	encodings := []string{san, sanWithoutCheck(pos, legal, m, true)}
+	p := pos.Piece(m.From)
+	if p.Type == Pawn {
+		return encodings
+	}
+
+	// Over-specified disambiguation is still accepted
+	capture := ""
+	if pos.Piece(m.To) != NoPiece {
+		capture = "x"
+	}
+	letter := string(Piece{p.Type, White}.Letter())
+	for _, from := range []string{string(rune('a' + m.From.File())), string(rune('1' + m.From.Rank()))} {
+		encodings = append(encodings, letter+from+capture+m.To.String())
+	}
+
+	// Captures are sometimes written without the x
+	if capture != "" {
+		for _, e := range encodings {
+			encodings = append(encodings, strings.Replace(e, "x", "", 1))
+		}
+	}
+
+	return encodings
+}
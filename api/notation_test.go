@@ -0,0 +1,96 @@
+package main
+
+import "testing"
+
+func TestEncodeMove(t *testing.T) {
+	tests := []struct {
+		name                 string
+		fen                  string
+		uci                  string
+		san, long, canonical string
+	}{
+		{"pawn push", StartingFEN, "e2e4", "e4", "e2e4", "e2e4"},
+		{"knight", StartingFEN, "g1f3", "Nf3", "Ng1f3", "g1f3"},
+		{"pawn capture", "4k3/8/8/3p4/4P3/8/8/4K3 w - - 0 1", "e4d5", "exd5", "e4xd5", "e4d5"},
+		{"en passant", "4k3/8/8/3pP3/8/8/8/4K3 w - d6 0 1", "e5d6", "exd6", "e5xd6", "e5d6"},
+		{"told apart by file", "4k3/8/8/8/8/8/8/1N2KN2 w - - 0 1", "b1d2", "Nbd2", "Nb1d2", "b1d2"},
+		{"told apart by rank", "4k3/8/8/R7/8/8/8/R3K3 w - - 0 1", "a1a3", "R1a3", "Ra1a3", "a1a3"},
+		{"told apart by square", "4k3/8/8/8/8/Q7/8/Q1Q1K3 w - - 0 1", "a1b2", "Qa1b2", "Qa1b2", "a1b2"},
+		{"promotion with check", "7k/4P3/8/8/8/8/8/K7 w - - 0 1", "e7e8q", "e8=Q+", "e7e8=Q+", "e7e8q"},
+		{"underpromotion", "7k/4P3/8/8/8/8/8/K7 w - - 0 1", "e7e8n", "e8=N", "e7e8=N", "e7e8n"},
+		{"checkmate", "6k1/5ppp/8/8/8/8/8/R5K1 w - - 0 1", "a1a8", "Ra8#", "Ra1a8#", "a1a8"},
+		{"castling", "r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1", "e1g1", "O-O", "O-O", "e1g1"},
+		{"long castling", "r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1", "e1c1", "O-O-O", "O-O-O", "e1c1"},
+		{"chess960 castling", "4k3/8/8/8/8/8/8/RK6 w A - 0 1", "b1a1", "O-O-O", "O-O-O", "b1a1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pos, err := ParseFEN(tt.fen)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := UCINotation{}.Decode(pos, tt.uci)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, encoding := range []struct {
+				notation Notation
+				want     string
+			}{
+				{AlgebraicNotation{}, tt.san},
+				{LongAlgebraicNotation{}, tt.long},
+				{UCINotation{}, tt.canonical},
+			} {
+				if got := encoding.notation.Encode(pos, m); got != encoding.want {
+					t.Errorf("%T gave %s, want %s", encoding.notation, got, encoding.want)
+				}
+			}
+		})
+	}
+}
+
+// TestNotationRoundTrip Checks that every legal move reads back as itself in each notation
+func TestNotationRoundTrip(t *testing.T) {
+	tests := []struct {
+		variant string
+		fen     string
+	}{
+		{VariantStandard, StartingFEN},
+		{VariantStandard, "r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1"},
+		{VariantStandard, "r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 w kq - 0 1"},
+		{VariantStandard, "4k3/8/8/8/8/Q7/8/Q1Q1K3 w - - 0 1"},
+		{VariantChess960, "bqnb1rkr/pp3ppp/3ppn2/2p5/5P2/P2P4/NPP1P1PP/BQ1BNRKR w HFhf - 2 9"},
+		{VariantChess960, "4k3/8/8/8/8/8/8/1R3KR1 w GB - 0 1"},
+		{VariantCrazyhouse, "2k5/8/8/8/8/8/8/4K3[QRBNPqrbnp] w - - 0 1"},
+	}
+
+	notations := []Notation{AlgebraicNotation{}, LongAlgebraicNotation{}, UCINotation{}}
+	for _, tt := range tests {
+		variant, err := VariantFor(tt.variant)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pos, err := ParseVariantFEN(variant, tt.fen)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.fen, err)
+		}
+
+		for _, m := range pos.ValidMoves() {
+			for _, notation := range notations {
+				encoded := notation.Encode(pos, m)
+				decoded, err := notation.Decode(pos, encoded)
+				if err != nil {
+					t.Errorf("%s: %T %s: %v", tt.fen, notation, encoded, err)
+					continue
+				}
+				if *decoded != *m {
+					t.Errorf("%s: %T %s read back as %s, want %s", tt.fen, notation, encoded, decoded, m)
+				}
+			}
+		}
+	}
+}
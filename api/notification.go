@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pjebs/jsonerror"
+	"gorm.io/gorm"
+)
+
+const (
+	NotifyChallenge       = "challenge"
+	NotifyTournamentStart = "tournament_start"
+	// NotifyTournamentPaused is sent when a round of a tournament couldn't be paired
+	NotifyTournamentPaused = "tournament_paused"
+	NotifyYourTurn         = "your_turn"
+	NotifyFriendRequest    = "friend_request"
+	NotifyFriendAccepted   = "friend_accepted"
+	NotifyModeration       = "moderation"
+
+	notificationPageSize = 50
+)
+
+// Notification is something a player should hear about even if they weren't connected when it happened
+type Notification struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Player    string    `gorm:"not null;index" json:"-"`
+	Kind      string    `gorm:"not null" json:"kind"`
+	Text      string    `gorm:"not null" json:"text"`
+	// GameID is the game the notification is about, Link the endpoint showing anything else such as a tournament
+	GameID uint   `json:"game_id,omitempty"`
+	Link   string `json:"link,omitempty"`
+	Read   bool   `gorm:"not null;default:false;index" json:"read"`
+}
+
+// notify Stores a notification for the player and sends it to them if they are connected, the lock must be held
+func (gs *GameService) notify(notification *Notification) {
+	if err := gs.db.Create(notification).Error; err != nil {
+		log.Println(err)
+		return
+	}
+
+	gs.send(notification.Player, &broadcastMessage{Type: "notification", GameID: notification.GameID, Payload: notification})
+}
+
+// notifyAll Sends the same notification to each of the players, the lock must be held
+func (gs *GameService) notifyAll(players []string, kind, text, link string) {
+	for _, player := range players {
+		gs.notify(&Notification{Player: player, Kind: kind, Text: text, Link: link})
+	}
+}
+
+type NotificationService struct {
+	db *gorm.DB
+	gs *GameService
+}
+
+func NewNotificationService(db *gorm.DB, gs *GameService) *NotificationService {
+	if err := db.AutoMigrate(&Notification{}); err != nil {
+		panic(err)
+	}
+
+	service := &NotificationService{db, gs}
+
+	http.HandleFunc("/notifications", service.ListNotifications)
+	http.HandleFunc("/notifications/read", service.MarkRead)
+
+	return service
+}
+
+type NotificationsResponse struct {
+	Successful    bool              `json:"success"`
+	Unread        int64             `json:"unread"`
+	Notifications []*Notification   `json:"notifications"`
+	Error         map[string]string `json:"error,omitempty"`
+}
+
+type NotificationResponse struct {
+	Successful bool              `json:"success"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+// ListNotifications Gives the user's latest notifications, newest first, with the number still unread. With
+// unread=true only unread notifications are listed and before= pages back from a notification id.
+func (ns *NotificationService) ListNotifications(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodGet {
+		return
+	}
+
+	user, userErr := ns.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	response := &NotificationsResponse{Successful: true, Notifications: []*Notification{}}
+	query := ns.db.Where("player = ?", user.UUID.String()).Session(&gorm.Session{})
+	if err := query.Model(&Notification{}).Where("read = ?", false).Count(&response.Unread).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &NotificationsResponse{Error: jsonerror.New(28, "Internal server error", "Error loading notifications").Render()})
+		return
+	}
+
+	if r.URL.Query().Get("unread") == "true" {
+		query = query.Where("read = ?", false)
+	}
+
+	if before := r.URL.Query().Get("before"); before != "" {
+		id, err := strconv.ParseUint(before, 10, 64)
+		if err != nil {
+			RenderJSONResponse(w, http.StatusBadRequest, &NotificationsResponse{Error: jsonerror.New(151, "Notification not found", "Invalid notification id: "+before).Render()})
+			return
+		}
+		query = query.Where("id < ?", id)
+	}
+
+	if err := query.Order("id desc").Limit(notificationPageSize).Find(&response.Notifications).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &NotificationsResponse{Error: jsonerror.New(28, "Internal server error", "Error loading notifications").Render()})
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, response)
+}
+
+// MarkRead Marks one of the user's notifications as read, or all of them when no id is given
+func (ns *NotificationService) MarkRead(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodPost {
+		return
+	}
+
+	user, userErr := ns.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	query := ns.db.Model(&Notification{}).Where("player = ? AND read = ?", user.UUID.String(), false)
+	if rawID := r.URL.Query().Get("id"); rawID != "" {
+		id, err := strconv.ParseUint(rawID, 10, 64)
+		if err != nil {
+			RenderJSONResponse(w, http.StatusBadRequest, &NotificationResponse{Error: jsonerror.New(151, "Notification not found", "Invalid notification id: "+rawID).Render()})
+			return
+		}
+
+		if ns.db.Where("id = ? AND player = ?", id, user.UUID.String()).First(&Notification{}).RowsAffected == 0 {
+			RenderJSONResponse(w, http.StatusNotFound, &NotificationResponse{Error: jsonerror.New(151, "Notification not found", fmt.Sprintf("Notification does not exist with given ID: %d", id)).Render()})
+			return
+		}
+		query = query.Where("id = ?", id)
+	}
+
+	if err := query.Update("read", true).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &NotificationResponse{Error: jsonerror.New(28, "Internal server error", "Error marking notifications read").Render()})
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &NotificationResponse{Successful: true})
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pjebs/jsonerror"
+	"gorm.io/gorm"
+)
+
+const (
+	ScopeGamePlay       = "game:play"
+	ScopeProfileRead    = "profile:read"
+	ScopeChallengeWrite = "challenge:write"
+
+	oauthCodeLifetime = 10 * time.Minute
+	maxRedirectURIs   = 10
+)
+
+// oauthScopes are the scopes apps can ask for, in the order they are shown on the consent screen
+var oauthScopes = []string{ScopeProfileRead, ScopeGamePlay, ScopeChallengeWrite}
+
+// oauthScopeDescriptions tell the user what each scope lets an app do
+var oauthScopeDescriptions = map[string]string{
+	ScopeProfileRead:    "See your profile",
+	ScopeGamePlay:       "Play games for you: join matchmaking, follow your games and make moves",
+	ScopeChallengeWrite: "Challenge other clubs to team matches for the clubs you run",
+}
+
+var errOAuthCodeUsed = errors.New("authorization code already used")
+
+// OAuthApp is a third-party app registered by a user, which other users can authorize to act for them
+type OAuthApp struct {
+	ClientID     string    `gorm:"primaryKey" json:"client_id"`
+	CreatedAt    time.Time `json:"created_at"`
+	Owner        uuid.UUID `gorm:"not null;index;type:uuid" json:"-"`
+	Name         string    `gorm:"not null" json:"name"`
+	RedirectURIs []string  `gorm:"serializer:json" json:"redirect_uris"`
+	// Public apps, such as ones running in a browser or on a phone, can't keep a secret and rely on PKCE alone
+	Public     bool   `gorm:"not null;default:false" json:"public"`
+	SecretHash string `json:"-"`
+	// ClientSecret is only shown when the app is registered
+	ClientSecret string `gorm:"-" json:"client_secret,omitempty"`
+}
+
+// OAuthCode is an authorization code given to an app once the user allowed it, only its hash is kept
+type OAuthCode struct {
+	Hash        string    `gorm:"primaryKey"`
+	ClientID    string    `gorm:"not null"`
+	UserUUID    uuid.UUID `gorm:"not null;index;type:uuid"`
+	RedirectURI string    `gorm:"not null"`
+	Scopes      string    `gorm:"not null"`
+	// Challenge is the PKCE code challenge, the app has to show the verifier it was made from
+	Challenge string    `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+type NewOAuthAppRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Public       bool     `json:"public"`
+}
+
+type OAuthAppResponse struct {
+	Successful bool              `json:"success"`
+	App        *OAuthApp         `json:"app,omitempty"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+type OAuthAppListResponse struct {
+	Successful bool              `json:"success"`
+	Apps       []*OAuthApp       `json:"apps"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+// OAuthTokenResponse is the token endpoint's answer, shaped as RFC 6749 asks so OAuth client libraries can read it
+type OAuthTokenResponse struct {
+	AccessToken      string `json:"access_token,omitempty"`
+	TokenType        string `json:"token_type,omitempty"`
+	ExpiresIn        int    `json:"expires_in,omitempty"`
+	RefreshToken     string `json:"refresh_token,omitempty"`
+	Scope            string `json:"scope,omitempty"`
+	UUID             string `json:"uuid,omitempty"`
+	Error            string `json:"error,omitempty"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func oauthAppError(code int, error, message string) *OAuthAppResponse {
+	return &OAuthAppResponse{Error: jsonerror.New(code, error, message).Render()}
+}
+
+type OAuthService struct {
+	db *gorm.DB
+	gs *GameService
+}
+
+func NewOAuthService(db *gorm.DB, gs *GameService) *OAuthService {
+	if err := db.AutoMigrate(&OAuthApp{}, &OAuthCode{}); err != nil {
+		panic(err)
+	}
+
+	service := &OAuthService{db, gs}
+
+	http.HandleFunc("/oauth/apps", service.HandleApps)
+	http.HandleFunc("/oauth/apps/{id}", service.DeleteApp)
+	http.HandleFunc("/oauth/authorize", service.Authorize)
+	http.HandleFunc("/oauth/token", service.Token)
+
+	return service
+}
+
+// hasScope Reports whether the space separated scopes granted include one of the scopes wanted
+func hasScope(granted string, wanted []string) bool {
+	for _, scope := range strings.Fields(granted) {
+		if slices.Contains(wanted, scope) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scopeError Turns down a scoped token, of an app or a personal one, unless it was granted one of the scopes the
+// endpoint takes
+func scopeError(granted string, scopes []string) *NewUserResponse {
+	if len(scopes) == 0 {
+		return NewUserError(42, "Insufficient scope", "Scoped tokens can't use this endpoint")
+	}
+
+	if !hasScope(granted, scopes) {
+		return NewUserError(42, "Insufficient scope", "This endpoint needs the scope "+strings.Join(scopes, " or "))
+	}
+
+	return nil
+}
+
+// parseScopes Checks the space separated scopes an app asked for, giving them back in a set order
+func parseScopes(scope string) (string, bool) {
+	asked := strings.Fields(scope)
+	if len(asked) == 0 {
+		return "", false
+	}
+
+	for _, scope := range asked {
+		if !slices.Contains(oauthScopes, scope) {
+			return "", false
+		}
+	}
+
+	var scopes []string
+	for _, scope := range oauthScopes {
+		if slices.Contains(asked, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return strings.Join(scopes, " "), true
+}
+
+// validRedirectURI Checks a redirect URI an app registers. It has to be absolute without a fragment, and plain
+// http is only allowed back to the user's own machine. Apps on phones may use their own reverse domain scheme.
+func validRedirectURI(raw string) bool {
+	uri, err := url.Parse(raw)
+	if err != nil || uri.Fragment != "" || uri.Scheme == "" {
+		return false
+	}
+
+	switch uri.Scheme {
+	case "https":
+		return uri.Host != ""
+	case "http":
+		host := uri.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		return strings.Contains(uri.Scheme, ".")
+	}
+}
+
+// withParams Adds the parameters to the query of the redirect URI
+func withParams(redirectURI string, params url.Values) string {
+	uri, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+
+	query := uri.Query()
+	for key, values := range params {
+		for _, value := range values {
+			if value != "" {
+				query.Add(key, value)
+			}
+		}
+	}
+	uri.RawQuery = query.Encode()
+
+	return uri.String()
+}
+
+// HandleApps Lists the apps the user registered on GET and registers a new one on POST
+func (oas *OAuthService) HandleApps(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	switch r.Method {
+	case http.MethodGet:
+		oas.ListApps(w, r)
+	case http.MethodPost:
+		oas.CreateApp(w, r)
+	}
+}
+
+// ListApps Gives the apps the user registered, without their secrets
+func (oas *OAuthService) ListApps(w http.ResponseWriter, r *http.Request) {
+	user, userErr := oas.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	apps := make([]*OAuthApp, 0)
+	if err := oas.db.Where("owner = ?", user.UUID).Order("created_at").Find(&apps).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &OAuthAppListResponse{Error: jsonerror.New(28, "Internal server error", "Error loading apps").Render()})
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &OAuthAppListResponse{Successful: true, Apps: apps})
+}
+
+// CreateApp Registers an app with the redirect URIs users may be sent back to, returning its client id and, unless
+// it is public, the client secret
+func (oas *OAuthService) CreateApp(w http.ResponseWriter, r *http.Request) {
+	user, userErr := oas.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	request := &NewOAuthAppRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, oauthAppError(1, "Invalid JSON request", err.Error()))
+		return
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len(request.Name) > 64 {
+		RenderJSONResponse(w, http.StatusBadRequest, oauthAppError(170, "Invalid app", "Apps need a name of at most 64 characters"))
+		return
+	}
+
+	if len(request.RedirectURIs) == 0 || len(request.RedirectURIs) > maxRedirectURIs {
+		RenderJSONResponse(w, http.StatusBadRequest, oauthAppError(170, "Invalid app", fmt.Sprintf("Apps need between 1 and %d redirect URIs", maxRedirectURIs)))
+		return
+	}
+
+	for _, uri := range request.RedirectURIs {
+		if !validRedirectURI(uri) {
+			RenderJSONResponse(w, http.StatusBadRequest, oauthAppError(170, "Invalid app", fmt.Sprintf("Redirect URI %q must be https, http to localhost or a reverse domain scheme, without a fragment", uri)))
+			return
+		}
+	}
+
+	clientID, err := GenerateVerificationToken()
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, oauthAppError(28, "Internal server error", "Error registering app"))
+		return
+	}
+
+	app := &OAuthApp{ClientID: clientID[:32], Owner: user.UUID, Name: request.Name, RedirectURIs: request.RedirectURIs, Public: request.Public}
+	if !app.Public {
+		if app.ClientSecret, err = GenerateVerificationToken(); err != nil {
+			log.Println(err)
+			RenderJSONResponse(w, http.StatusInternalServerError, oauthAppError(28, "Internal server error", "Error registering app"))
+			return
+		}
+		app.SecretHash = hashToken(app.ClientSecret)
+	}
+
+	if err := oas.db.Create(app).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, oauthAppError(28, "Internal server error", "Error registering app"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusCreated, &OAuthAppResponse{Successful: true, App: app})
+}
+
+// DeleteApp Removes one of the user's apps, ending every session it was authorized for
+func (oas *OAuthService) DeleteApp(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodDelete {
+		return
+	}
+
+	user, userErr := oas.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	app := &OAuthApp{}
+	if oas.db.First(app, "client_id = ? AND owner = ?", r.PathValue("id"), user.UUID).RowsAffected == 0 {
+		RenderJSONResponse(w, http.StatusNotFound, oauthAppError(171, "App not found", "You have no app with this client id"))
+		return
+	}
+
+	err := oas.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("client_id = ?", app.ClientID).Delete(&OAuthCode{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Delete(app).Error
+	})
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, oauthAppError(28, "Internal server error", "Error deleting app"))
+		return
+	}
+
+	if err := oas.gs.us.RevokeAppSessions([]string{app.ClientID}, time.Now()); err != nil {
+		log.Println(err)
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &OAuthAppResponse{Successful: true})
+}
+
+// Authorize Shows the consent screen for an app on GET, and once the user signs in and allows it sends them back
+// to the app with an authorization code on POST. Only the authorization code flow with S256 PKCE is supported.
+func (oas *OAuthService) Authorize(w http.ResponseWriter, r *http.Request) {
+	var params url.Values
+	switch r.Method {
+	case http.MethodGet:
+		params = r.URL.Query()
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			renderLoginFailure(w, "the authorization request couldn't be read.")
+			return
+		}
+		params = r.PostForm
+	default:
+		return
+	}
+
+	// Until the redirect URI is known to be the app's, nothing can be sent back to it
+	app := &OAuthApp{}
+	if oas.db.First(app, "client_id = ?", params.Get("client_id")).RowsAffected == 0 {
+		renderLoginFailure(w, "the app asking isn't registered.")
+		return
+	}
+
+	redirectURI := params.Get("redirect_uri")
+	if redirectURI == "" && len(app.RedirectURIs) == 1 {
+		redirectURI = app.RedirectURIs[0]
+	}
+	if !slices.Contains(app.RedirectURIs, redirectURI) {
+		renderLoginFailure(w, "the address the app wants you sent back to isn't registered with it.")
+		return
+	}
+
+	state := params.Get("state")
+	fail := func(code, description string) {
+		http.Redirect(w, r, withParams(redirectURI, url.Values{"error": {code}, "error_description": {description}, "state": {state}}), http.StatusFound)
+	}
+
+	if r.Method == http.MethodGet && params.Get("response_type") != "code" {
+		fail("unsupported_response_type", "Only the authorization code flow is supported")
+		return
+	}
+
+	scope, ok := parseScopes(params.Get("scope"))
+	if !ok {
+		fail("invalid_scope", "Scopes must be some of "+strings.Join(oauthScopes, " "))
+		return
+	}
+
+	challenge := params.Get("code_challenge")
+	if challenge == "" || params.Get("code_challenge_method") != "S256" {
+		fail("invalid_request", "PKCE with the S256 code challenge method is required")
+		return
+	}
+
+	consent := func(email, message string) {
+		descriptions := make([]string, 0)
+		for _, scope := range strings.Fields(scope) {
+			descriptions = append(descriptions, oauthScopeDescriptions[scope])
+		}
+
+		RenderErrorTemplate(w, "oauth-consent", map[string]interface{}{
+			"App":           app.Name,
+			"Scopes":        descriptions,
+			"ClientID":      app.ClientID,
+			"RedirectURI":   redirectURI,
+			"Scope":         scope,
+			"State":         state,
+			"CodeChallenge": challenge,
+			"Email":         email,
+			"Error":         message,
+		})
+	}
+
+	if r.Method == http.MethodGet {
+		consent("", "")
+		return
+	}
+
+	if params.Get("decision") != "allow" {
+		fail("access_denied", "The user didn't allow the app")
+		return
+	}
+
+	// Users who signed up through a provider have no password to sign in with here until they set one with
+	// a reset link, the message says so without telling whether the email has an account
+	email := strings.ToLower(strings.TrimSpace(params.Get("email")))
+	user := &User{}
+	if oas.db.First(user, "email = ?", email).RowsAffected == 0 || len(user.Password) == 0 ||
+		!bytes.Equal(HashPassword(params.Get("password"), user.UUID.String()), user.Password) {
+		consent(email, "The email or password is wrong. If you signed up with another provider, set a password with Forgot password first.")
+		return
+	}
+
+	// Codes are counted against the same per-user limit as /login/2fa, so the consent screen gives no more guesses
+	if oas.gs.us.TwoFactorEnabled(user) {
+		switch err := oas.gs.us.checkTwoFactor(user, params.Get("code"), true); {
+		case errors.Is(err, errCodesLocked):
+			consent(email, codesLockedMessage+".")
+			return
+		case errors.Is(err, errCodeRejected):
+			consent(email, "The two-factor code is wrong or was already used.")
+			return
+		case err != nil:
+			log.Println(err)
+			consent(email, "The two-factor code couldn't be checked, please try again.")
+			return
+		}
+	}
+
+	code, err := GenerateVerificationToken()
+	if err != nil {
+		log.Println(err)
+		fail("server_error", "Error making the authorization code")
+		return
+	}
+
+	stored := &OAuthCode{
+		Hash:        hashToken(code),
+		ClientID:    app.ClientID,
+		UserUUID:    user.UUID,
+		RedirectURI: redirectURI,
+		Scopes:      scope,
+		Challenge:   challenge,
+		ExpiresAt:   time.Now().Add(oauthCodeLifetime),
+	}
+	if err := oas.db.Create(stored).Error; err != nil {
+		log.Println(err)
+		fail("server_error", "Error saving the authorization code")
+		return
+	}
+
+	http.Redirect(w, r, withParams(redirectURI, url.Values{"code": {code}, "state": {state}}), http.StatusFound)
+}
+
+// Token Swaps an authorization code, or a refresh token, for an access token and a new refresh token. Apps
+// with a secret authenticate with HTTP basic auth or client_id and client_secret in the form.
+func (oas *OAuthService) Token(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodPost {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if err := r.ParseForm(); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, &OAuthTokenResponse{Error: "invalid_request", ErrorDescription: err.Error()})
+		return
+	}
+
+	clientID, secret, basic := r.BasicAuth()
+	if !basic {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	app := &OAuthApp{}
+	if oas.db.First(app, "client_id = ?", clientID).RowsAffected == 0 ||
+		(!app.Public && subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(app.SecretHash)) != 1) {
+		RenderJSONResponse(w, http.StatusUnauthorized, &OAuthTokenResponse{Error: "invalid_client", ErrorDescription: "Unknown client or wrong client secret"})
+		return
+	}
+
+	var user *User
+	var session *Session
+	var tokens *SessionTokens
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code, codeUser, response := oas.redeemCode(app, r.PostForm)
+		if response != nil {
+			RenderJSONResponse(w, http.StatusBadRequest, response)
+			return
+		}
+
+		id, err := uuid.NewRandom()
+		if err == nil {
+			user = codeUser
+			session = &Session{ID: id, UserUUID: user.UUID, Device: app.Name, IP: clientIP(r), ClientID: app.ClientID, Scopes: code.Scopes}
+			tokens, err = oas.gs.us.createSession(user, session)
+		}
+		if err != nil {
+			log.Println(err)
+			RenderJSONResponse(w, http.StatusInternalServerError, &OAuthTokenResponse{Error: "server_error", ErrorDescription: "Error starting the session"})
+			return
+		}
+	case "refresh_token":
+		var userErr *NewUserResponse
+		var err error
+		user, session, tokens, userErr, err = oas.gs.us.rotateRefreshToken(r.PostForm.Get("refresh_token"), app.ClientID, r)
+		if err != nil {
+			log.Println(err)
+			RenderJSONResponse(w, http.StatusInternalServerError, &OAuthTokenResponse{Error: "server_error", ErrorDescription: "Error rotating the refresh token"})
+			return
+		}
+		if userErr != nil {
+			RenderJSONResponse(w, http.StatusBadRequest, &OAuthTokenResponse{Error: "invalid_grant", ErrorDescription: userErr.Error["message"]})
+			return
+		}
+	default:
+		RenderJSONResponse(w, http.StatusBadRequest, &OAuthTokenResponse{Error: "unsupported_grant_type", ErrorDescription: "Grant type must be authorization_code or refresh_token"})
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &OAuthTokenResponse{
+		AccessToken:  tokens.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(time.Until(tokens.Expiry).Seconds()),
+		RefreshToken: tokens.RefreshToken,
+		Scope:        session.Scopes,
+		UUID:         user.UUID.String(),
+	})
+}
+
+// redeemCode Uses up an authorization code of the app, checking it was sent back to the same redirect URI with
+// the PKCE verifier its challenge was made from
+func (oas *OAuthService) redeemCode(app *OAuthApp, form url.Values) (*OAuthCode, *User, *OAuthTokenResponse) {
+	invalid := &OAuthTokenResponse{Error: "invalid_grant", ErrorDescription: "The authorization code is wrong, expired or was already used"}
+
+	// The code is deleted as it is read, so two requests with it can't both get tokens
+	code := &OAuthCode{}
+	err := oas.db.Transaction(func(tx *gorm.DB) error {
+		if tx.First(code, "hash = ? AND client_id = ?", hashToken(form.Get("code")), app.ClientID).RowsAffected == 0 {
+			return errOAuthCodeUsed
+		}
+
+		result := tx.Delete(code)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errOAuthCodeUsed
+		}
+
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, errOAuthCodeUsed) {
+			log.Println(err)
+		}
+		return nil, nil, invalid
+	}
+
+	if time.Now().After(code.ExpiresAt) || form.Get("redirect_uri") != code.RedirectURI {
+		return nil, nil, invalid
+	}
+
+	sum := sha256.Sum256([]byte(form.Get("code_verifier")))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(code.Challenge)) != 1 {
+		return nil, nil, &OAuthTokenResponse{Error: "invalid_grant", ErrorDescription: "The code verifier doesn't match the code challenge"}
+	}
+
+	user := &User{}
+	if oas.db.First(user, "uuid = ?", code.UserUUID).RowsAffected == 0 {
+		return nil, nil, invalid
+	}
+
+	return code, user, nil
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+const (
+	// oidcLoginLifetime is how long someone has to sign in at the provider
+	oidcLoginLifetime = 10 * time.Minute
+	oidcTimeout       = 10 * time.Second
+)
+
+var errOIDCLoginUsed = errors.New("login already finished")
+
+// OIDCProvider is an OpenID Connect provider users can sign in with, set up from OIDC_PROVIDERS. Its endpoints
+// are discovered from the issuer on first use.
+type OIDCProvider struct {
+	Name         string `json:"name"`
+	DisplayName  string `json:"display_name"`
+	issuer       string
+	clientID     string
+	clientSecret string
+	scopes       []string
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// OIDCIdentity links an account at a provider to a user
+type OIDCIdentity struct {
+	ID        uint      `gorm:"primarykey"`
+	Provider  string    `gorm:"not null;uniqueIndex:idx_oidc_subject"`
+	Subject   string    `gorm:"not null;uniqueIndex:idx_oidc_subject"`
+	UserUUID  uuid.UUID `gorm:"not null;index;type:uuid"`
+	Email     string
+	CreatedAt time.Time
+}
+
+// OIDCLogin is a sign in waiting for the provider to send the user back, keyed by the hash of its state
+type OIDCLogin struct {
+	Hash        string    `gorm:"primaryKey"`
+	Provider    string    `gorm:"not null"`
+	Verifier    string    `gorm:"not null"`
+	Nonce       string    `gorm:"not null"`
+	RedirectURL string    `gorm:"not null"`
+	ExpiresAt   time.Time `gorm:"not null;index"`
+}
+
+// oidcClaims are the ID token claims used to find or create the user
+type oidcClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+}
+
+type OIDCProvidersResponse struct {
+	Successful bool            `json:"success"`
+	Providers  []*OIDCProvider `json:"providers"`
+}
+
+// loadOIDCProviders Reads the providers named in OIDC_PROVIDERS. Each name needs OIDC_<NAME>_ISSUER,
+// OIDC_<NAME>_CLIENT_ID and OIDC_<NAME>_CLIENT_SECRET, and may set OIDC_<NAME>_DISPLAY_NAME and
+// OIDC_<NAME>_SCOPES.
+func loadOIDCProviders() map[string]*OIDCProvider {
+	providers := make(map[string]*OIDCProvider)
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		provider := &OIDCProvider{
+			Name:         name,
+			DisplayName:  os.Getenv(prefix + "DISPLAY_NAME"),
+			issuer:       os.Getenv(prefix + "ISSUER"),
+			clientID:     os.Getenv(prefix + "CLIENT_ID"),
+			clientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		}
+
+		if provider.issuer == "" || provider.clientID == "" {
+			log.Printf("OIDC provider %s needs %sISSUER and %sCLIENT_ID, skipping it", name, prefix, prefix)
+			continue
+		}
+
+		if provider.DisplayName == "" {
+			provider.DisplayName = name
+		}
+
+		if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+			provider.scopes = append([]string{oidc.ScopeOpenID}, strings.Fields(strings.ReplaceAll(scopes, ",", " "))...)
+		}
+
+		providers[name] = provider
+	}
+
+	return providers
+}
+
+// discover Gives the provider's endpoints, fetching its discovery document the first time. A provider that
+// couldn't be reached is tried again on the next sign in.
+func (p *OIDCProvider) discover() (*oidc.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.provider == nil {
+		// The provider keeps the context to fetch its keys later, so it mustn't be one that ends with the request
+		provider, err := oidc.NewProvider(oidc.ClientContext(context.Background(), &http.Client{Timeout: oidcTimeout}), p.issuer)
+		if err != nil {
+			return nil, err
+		}
+
+		p.provider = provider
+	}
+
+	return p.provider, nil
+}
+
+// config Gives the OAuth2 config of the provider sending users back to redirectURL
+func (p *OIDCProvider) config(provider *oidc.Provider, redirectURL string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.clientID,
+		ClientSecret: p.clientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirectURL,
+		Scopes:       p.scopes,
+	}
+}
+
+// oidcProvider Finds the provider named in the path, showing the failure page if there isn't one
+func (service *UserService) oidcProvider(w http.ResponseWriter, r *http.Request) (*OIDCProvider, bool) {
+	provider, ok := service.oidcProviders[r.PathValue("provider")]
+	if !ok {
+		renderLoginFailure(w, "there is no sign in provider with this name.")
+	}
+
+	return provider, ok
+}
+
+// renderLoginFailure Shows the page for a sign in or an app authorization that failed
+func renderLoginFailure(w http.ResponseWriter, reason string) {
+	RenderErrorTemplate(w, "login-failed", struct{ Error string }{reason})
+}
+
+// OIDCProviders Lists the providers users can sign in with
+func (service *UserService) OIDCProviders(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodGet {
+		return
+	}
+
+	providers := make([]*OIDCProvider, 0, len(service.oidcProviders))
+	for _, provider := range service.oidcProviders {
+		providers = append(providers, provider)
+	}
+	slices.SortFunc(providers, func(a, b *OIDCProvider) int { return strings.Compare(a.Name, b.Name) })
+
+	RenderJSONResponse(w, http.StatusOK, &OIDCProvidersResponse{Successful: true, Providers: providers})
+}
+
+// StartOIDCLogin Sends the browser to the provider to sign in, with PKCE and a nonce for the ID token
+func (service *UserService) StartOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		return
+	}
+
+	provider, ok := service.oidcProvider(w, r)
+	if !ok {
+		return
+	}
+
+	discovered, err := provider.discover()
+	if err != nil {
+		log.Println(err)
+		renderLoginFailure(w, fmt.Sprintf("we couldn't reach %s.", provider.DisplayName))
+		return
+	}
+
+	state, err := GenerateVerificationToken()
+	if err != nil {
+		log.Println(err)
+		renderLoginFailure(w, "of an internal server error.")
+		return
+	}
+
+	nonce, err := GenerateVerificationToken()
+	if err != nil {
+		log.Println(err)
+		renderLoginFailure(w, "of an internal server error.")
+		return
+	}
+
+	login := &OIDCLogin{
+		Hash:        hashToken(state),
+		Provider:    provider.Name,
+		Verifier:    oauth2.GenerateVerifier(),
+		Nonce:       nonce,
+		RedirectURL: fmt.Sprintf("https://%s/oidc/%s/callback", r.Host, provider.Name),
+		ExpiresAt:   time.Now().Add(oidcLoginLifetime),
+	}
+
+	if err := service.db.Create(login).Error; err != nil {
+		log.Println(err)
+		renderLoginFailure(w, "of an internal server error.")
+		return
+	}
+
+	config := provider.config(discovered, login.RedirectURL)
+	http.Redirect(w, r, config.AuthCodeURL(state, oauth2.S256ChallengeOption(login.Verifier), oidc.Nonce(nonce)), http.StatusFound)
+}
+
+// OIDCCallback Finishes a sign in once the provider sends the browser back. The ID token is checked, then the
+// user linked to the account at the provider is logged in. An account that isn't linked yet is linked to the
+// user with the same email if the provider verified it, or gets a new user.
+//
+// The browser is sent on to OIDC_RETURN_URL with the access token, expiry and uuid in the fragment, and the
+// refresh token in its cookie as with /login. Users with two-factor authentication get two_factor_required
+// and a challenge for /login/2fa instead.
+func (service *UserService) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		return
+	}
+
+	provider, ok := service.oidcProvider(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		renderLoginFailure(w, fmt.Sprintf("%s turned down the sign in (%s).", provider.DisplayName, reason))
+		return
+	}
+
+	// The login is deleted as it is read, so the state can't be used twice
+	login := &OIDCLogin{}
+	err := service.db.Transaction(func(tx *gorm.DB) error {
+		if tx.First(login, "hash = ? AND provider = ?", hashToken(query.Get("state")), provider.Name).RowsAffected == 0 {
+			return errOIDCLoginUsed
+		}
+
+		result := tx.Delete(login)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errOIDCLoginUsed
+		}
+
+		return nil
+	})
+	if errors.Is(err, errOIDCLoginUsed) || (err == nil && time.Now().After(login.ExpiresAt)) {
+		renderLoginFailure(w, "the sign in link is wrong, was already used or has expired.")
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		renderLoginFailure(w, "of an internal server error.")
+		return
+	}
+
+	discovered, err := provider.discover()
+	if err != nil {
+		log.Println(err)
+		renderLoginFailure(w, fmt.Sprintf("we couldn't reach %s.", provider.DisplayName))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(oidc.ClientContext(r.Context(), &http.Client{Timeout: oidcTimeout}), oidcTimeout)
+	defer cancel()
+
+	token, err := provider.config(discovered, login.RedirectURL).Exchange(ctx, query.Get("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		log.Println(err)
+		renderLoginFailure(w, fmt.Sprintf("%s didn't accept the sign in.", provider.DisplayName))
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		renderLoginFailure(w, fmt.Sprintf("%s didn't send an ID token.", provider.DisplayName))
+		return
+	}
+
+	idToken, err := discovered.Verifier(&oidc.Config{ClientID: provider.clientID}).Verify(ctx, rawIDToken)
+	if err != nil || idToken.Nonce != login.Nonce {
+		if err != nil {
+			log.Println(err)
+		}
+		renderLoginFailure(w, fmt.Sprintf("the ID token from %s isn't valid.", provider.DisplayName))
+		return
+	}
+
+	claims := &oidcClaims{}
+	if err := idToken.Claims(claims); err != nil {
+		log.Println(err)
+		renderLoginFailure(w, fmt.Sprintf("the ID token from %s isn't valid.", provider.DisplayName))
+		return
+	}
+
+	user, reason := service.oidcUser(provider, idToken.Subject, claims)
+	if user == nil {
+		renderLoginFailure(w, reason)
+		return
+	}
+
+	fragment := url.Values{"uuid": {user.UUID.String()}}
+	if service.TwoFactorEnabled(user) {
+		challenge, err := service.newLoginChallenge(user)
+		if err != nil {
+			log.Println(err)
+			renderLoginFailure(w, "of an internal server error.")
+			return
+		}
+
+		fragment.Set("two_factor_required", "true")
+		fragment.Set("challenge", challenge)
+	} else {
+		session, tokens, err := service.StartSession(user, r)
+		if err != nil {
+			log.Println(err)
+			renderLoginFailure(w, "of an internal server error.")
+			return
+		}
+
+		setRefreshCookie(w, r, tokens.RefreshToken, session.ExpiresAt)
+		fragment.Set("access_token", tokens.AccessToken)
+		fragment.Set("expiry", tokens.Expiry.Format(time.RFC3339))
+	}
+
+	returnURL := os.Getenv("OIDC_RETURN_URL")
+	if returnURL == "" {
+		returnURL = "/"
+	}
+
+	http.Redirect(w, r, returnURL+"#"+fragment.Encode(), http.StatusFound)
+}
+
+// oidcUser Finds the user linked to the account at the provider, linking or creating one the first time.
+// Without a user the reason is given.
+func (service *UserService) oidcUser(provider *OIDCProvider, subject string, claims *oidcClaims) (*User, string) {
+	identity := &OIDCIdentity{}
+	if service.db.First(identity, "provider = ? AND subject = ?", provider.Name, subject).RowsAffected > 0 {
+		user := &User{}
+		if service.db.First(user, "uuid = ?", identity.UserUUID).RowsAffected == 0 {
+			return nil, "the account it is linked to was deleted."
+		}
+
+		return user, ""
+	}
+
+	// Emails the provider hasn't verified could belong to someone else, so they can't be linked or used
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, fmt.Sprintf("%s hasn't verified your email.", provider.DisplayName)
+	}
+
+	email := strings.ToLower(strings.TrimSpace(claims.Email))
+	user := &User{}
+	created := false
+	err := service.db.Transaction(func(tx *gorm.DB) error {
+		if tx.First(user, "email = ?", email).RowsAffected == 0 {
+			id, err := uuid.NewRandom()
+			if err != nil {
+				return err
+			}
+
+			firstName, lastName := claims.GivenName, claims.FamilyName
+			if firstName == "" {
+				firstName, lastName, _ = strings.Cut(claims.Name, " ")
+			}
+			if firstName == "" {
+				firstName, _, _ = strings.Cut(email, "@")
+			}
+
+			// Without a password the user can only sign in through the provider, until they reset it
+			user = &User{UUID: id, FirstName: firstName, LastName: lastName, Password: []byte{}, ELO: 1200, Email: email}
+			if err := tx.Create(user).Error; err != nil {
+				return err
+			}
+			created = true
+		}
+
+		return tx.Create(&OIDCIdentity{Provider: provider.Name, Subject: subject, UserUUID: user.UUID, Email: email}).Error
+	})
+	if err != nil {
+		log.Println(err)
+		return nil, "of an internal server error."
+	}
+
+	if created {
+		for _, listener := range service.listeners {
+			listener.UserVerified(user)
+		}
+	}
+
+	return user, ""
+}
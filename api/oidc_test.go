@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+)
+
+// oidcGrant is what a code handed out by the stand-in issuer was given for
+type oidcGrant struct {
+	challenge string
+	nonce     string
+	subject   string
+	claims    oidcClaims
+}
+
+// oidcIssuer is a local OpenID Connect provider with discovery, keys and a token endpoint that checks PKCE.
+// Signing in at it is skipped, codes are handed out by authorize instead.
+type oidcIssuer struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+
+	mu     sync.Mutex
+	grants map[string]*oidcGrant
+}
+
+func newOIDCIssuer(t *testing.T) *oidcIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &oidcIssuer{key: key, clientID: "checkers", grants: make(map[string]*oidcGrant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/keys", issuer.keys)
+	mux.HandleFunc("/token", issuer.token)
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+
+	return issuer
+}
+
+func (issuer *oidcIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	base := issuer.server.URL
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                base,
+		"authorization_endpoint":                base + "/authorize",
+		"token_endpoint":                        base + "/token",
+		"jwks_uri":                              base + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (issuer *oidcIssuer) keys(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &issuer.key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+	}})
+}
+
+// authorize Hands out a code for the sign in the authorization URL was made for
+func (issuer *oidcIssuer) authorize(t *testing.T, authURL *url.URL, grant *oidcGrant) string {
+	t.Helper()
+
+	query := authURL.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("sign in without an S256 code challenge: %s", authURL)
+	}
+	if query.Get("nonce") == "" {
+		t.Fatalf("sign in without a nonce: %s", authURL)
+	}
+
+	grant.challenge = query.Get("code_challenge")
+	if grant.nonce == "" {
+		grant.nonce = query.Get("nonce")
+	}
+
+	code := uuid.NewString()
+	issuer.mu.Lock()
+	issuer.grants[code] = grant
+	issuer.mu.Unlock()
+
+	return code
+}
+
+func (issuer *oidcIssuer) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	issuer.mu.Lock()
+	grant, ok := issuer.grants[r.PostForm.Get("code")]
+	delete(issuer.grants, r.PostForm.Get("code"))
+	issuer.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            issuer.server.URL,
+		"sub":            grant.subject,
+		"aud":            issuer.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          grant.nonce,
+		"email":          grant.claims.Email,
+		"email_verified": grant.claims.EmailVerified,
+		"given_name":     grant.claims.GivenName,
+		"family_name":    grant.claims.FamilyName,
+	})
+	idToken.Header["kid"] = "test"
+
+	signed, err := idToken.SignedString(issuer.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "opaque",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     signed,
+	})
+}
+
+// newTestOIDCService Makes a user service that can only sign in with the stand-in issuer, named test
+func newTestOIDCService(t *testing.T, issuer *oidcIssuer) *UserService {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &UserService{
+		db:         newTestDB(t, &User{}, &OIDCIdentity{}, &OIDCLogin{}, &Session{}, &RefreshToken{}, &RevokedToken{}, &TwoFactor{}, &PersonalToken{}),
+		privateKey: key,
+		publicKey:  &key.PublicKey,
+		oidcProviders: map[string]*OIDCProvider{"test": {
+			Name:        "test",
+			DisplayName: "Test",
+			issuer:      issuer.server.URL,
+			clientID:    issuer.clientID,
+			scopes:      []string{"openid", "email", "profile"},
+		}},
+	}
+}
+
+// startTestOIDCLogin Starts a sign in, giving the URL the browser is sent to at the provider
+func startTestOIDCLogin(t *testing.T, service *UserService) *url.URL {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/oidc/test/login", nil)
+	r.SetPathValue("provider", "test")
+	w := httptest.NewRecorder()
+	service.StartOIDCLogin(w, r)
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("starting the sign in gave %d: %s", w.Code, w.Body)
+	}
+
+	authURL, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return authURL
+}
+
+// finishTestOIDCLogin Sends the browser back from the provider with the code and state given
+func finishTestOIDCLogin(service *UserService, code, state string) *httptest.ResponseRecorder {
+	query := url.Values{"code": {code}, "state": {state}}
+	r := httptest.NewRequest(http.MethodGet, "/oidc/test/callback?"+query.Encode(), nil)
+	r.SetPathValue("provider", "test")
+	w := httptest.NewRecorder()
+	service.OIDCCallback(w, r)
+
+	return w
+}
+
+// testOIDCLogin Signs in at the issuer with the grant given from start to finish
+func testOIDCLogin(t *testing.T, service *UserService, issuer *oidcIssuer, grant *oidcGrant) *httptest.ResponseRecorder {
+	t.Helper()
+
+	authURL := startTestOIDCLogin(t, service)
+	code := issuer.authorize(t, authURL, grant)
+
+	return finishTestOIDCLogin(service, code, authURL.Query().Get("state"))
+}
+
+func assertSignedIn(t *testing.T, w *httptest.ResponseRecorder) {
+	t.Helper()
+
+	if w.Code != http.StatusFound || !strings.Contains(w.Header().Get("Location"), "access_token=") {
+		t.Fatalf("got %d to %q, want a redirect with an access token: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+}
+
+func assertLoginFailed(t *testing.T, w *httptest.ResponseRecorder, reason string) {
+	t.Helper()
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), reason) {
+		t.Fatalf("got %d to %q, want the failure page saying %q: %s", w.Code, w.Header().Get("Location"), reason, w.Body)
+	}
+}
+
+func countRows(t *testing.T, service *UserService, model interface{}) int64 {
+	t.Helper()
+
+	var count int64
+	if err := service.db.Model(model).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+func TestOIDCCreatesUser(t *testing.T) {
+	issuer := newOIDCIssuer(t)
+	service := newTestOIDCService(t, issuer)
+	grant := func() *oidcGrant {
+		return &oidcGrant{subject: "ada", claims: oidcClaims{Email: "ada@example.com", EmailVerified: true, GivenName: "Ada", FamilyName: "Lovelace"}}
+	}
+
+	assertSignedIn(t, testOIDCLogin(t, service, issuer, grant()))
+
+	user := &User{}
+	if service.db.First(user, "email = ?", "ada@example.com").RowsAffected == 0 {
+		t.Fatal("no user was created")
+	}
+	if user.FirstName != "Ada" || user.LastName != "Lovelace" {
+		t.Errorf("user is named %s %s, want Ada Lovelace", user.FirstName, user.LastName)
+	}
+
+	// Signing in again logs in the same user
+	assertSignedIn(t, testOIDCLogin(t, service, issuer, grant()))
+	if users := countRows(t, service, &User{}); users != 1 {
+		t.Errorf("got %d users after signing in twice, want 1", users)
+	}
+}
+
+func TestOIDCLinksVerifiedEmail(t *testing.T) {
+	issuer := newOIDCIssuer(t)
+	service := newTestOIDCService(t, issuer)
+
+	existing := &User{UUID: uuid.New(), FirstName: "Ada", Email: "ada@example.com", Password: []byte{}, ELO: 1200}
+	if err := service.db.Create(existing).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	assertSignedIn(t, testOIDCLogin(t, service, issuer, &oidcGrant{subject: "ada", claims: oidcClaims{Email: "Ada@Example.com", EmailVerified: true}}))
+
+	identity := &OIDCIdentity{}
+	if service.db.First(identity, "provider = ? AND subject = ?", "test", "ada").RowsAffected == 0 {
+		t.Fatal("the account wasn't linked")
+	}
+	if identity.UserUUID != existing.UUID {
+		t.Errorf("linked to %s, want the user with the email %s", identity.UserUUID, existing.UUID)
+	}
+	if users := countRows(t, service, &User{}); users != 1 {
+		t.Errorf("got %d users, want the existing one only", users)
+	}
+}
+
+func TestOIDCRefusesUnverifiedEmail(t *testing.T) {
+	issuer := newOIDCIssuer(t)
+	service := newTestOIDCService(t, issuer)
+
+	existing := &User{UUID: uuid.New(), FirstName: "Ada", Email: "ada@example.com", Password: []byte{}, ELO: 1200}
+	if err := service.db.Create(existing).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, claims := range []oidcClaims{{Email: "ada@example.com"}, {Email: "grace@example.com"}, {}} {
+		w := testOIDCLogin(t, service, issuer, &oidcGrant{subject: "mallory", claims: claims})
+		assertLoginFailed(t, w, "hasn&#39;t verified your email")
+	}
+
+	if identities := countRows(t, service, &OIDCIdentity{}); identities != 0 {
+		t.Errorf("got %d linked accounts, want none", identities)
+	}
+	if users := countRows(t, service, &User{}); users != 1 {
+		t.Errorf("got %d users, want the existing one only", users)
+	}
+}
+
+func TestOIDCState(t *testing.T) {
+	issuer := newOIDCIssuer(t)
+	service := newTestOIDCService(t, issuer)
+	grant := &oidcGrant{subject: "ada", claims: oidcClaims{Email: "ada@example.com", EmailVerified: true}}
+
+	authURL := startTestOIDCLogin(t, service)
+	code := issuer.authorize(t, authURL, grant)
+
+	assertLoginFailed(t, finishTestOIDCLogin(service, code, "forged"), "the sign in link is wrong")
+
+	state := authURL.Query().Get("state")
+	assertSignedIn(t, finishTestOIDCLogin(service, code, state))
+
+	// The state is used up, even with a fresh code from the provider
+	code = issuer.authorize(t, authURL, grant)
+	assertLoginFailed(t, finishTestOIDCLogin(service, code, state), "the sign in link is wrong")
+}
+
+func TestOIDCExpiredState(t *testing.T) {
+	issuer := newOIDCIssuer(t)
+	service := newTestOIDCService(t, issuer)
+
+	authURL := startTestOIDCLogin(t, service)
+	code := issuer.authorize(t, authURL, &oidcGrant{subject: "ada", claims: oidcClaims{Email: "ada@example.com", EmailVerified: true}})
+
+	if err := service.db.Model(&OIDCLogin{}).Where("1 = 1").Update("expires_at", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	assertLoginFailed(t, finishTestOIDCLogin(service, code, authURL.Query().Get("state")), "the sign in link is wrong")
+}
+
+func TestOIDCPKCE(t *testing.T) {
+	issuer := newOIDCIssuer(t)
+	service := newTestOIDCService(t, issuer)
+
+	authURL := startTestOIDCLogin(t, service)
+	code := issuer.authorize(t, authURL, &oidcGrant{subject: "ada", claims: oidcClaims{Email: "ada@example.com", EmailVerified: true}})
+
+	// A verifier other than the one the challenge was made from is turned down by the provider
+	if err := service.db.Model(&OIDCLogin{}).Where("1 = 1").Update("verifier", oauth2.GenerateVerifier()).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	assertLoginFailed(t, finishTestOIDCLogin(service, code, authURL.Query().Get("state")), "didn&#39;t accept the sign in")
+	if users := countRows(t, service, &User{}); users != 0 {
+		t.Errorf("got %d users, want none", users)
+	}
+}
+
+func TestOIDCNonce(t *testing.T) {
+	issuer := newOIDCIssuer(t)
+	service := newTestOIDCService(t, issuer)
+
+	w := testOIDCLogin(t, service, issuer, &oidcGrant{nonce: "replayed", subject: "ada", claims: oidcClaims{Email: "ada@example.com", EmailVerified: true}})
+
+	assertLoginFailed(t, w, "the ID token from Test isn&#39;t valid")
+	if users := countRows(t, service, &User{}); users != 0 {
+		t.Errorf("got %d users, want none", users)
+	}
+}
+
+// changeTestPassword Asks to change the password of the user with the access token given
+func changeTestPassword(service *UserService, email, accessToken string, request *ChangePasswordRequest) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(request)
+	r := httptest.NewRequest(http.MethodPost, "/password/change?email="+url.QueryEscape(email), bytes.NewReader(body))
+	r.Header.Set("Authorization", accessToken)
+	w := httptest.NewRecorder()
+	service.ChangePassword(w, r)
+
+	return w
+}
+
+func TestOIDCUserWithoutPassword(t *testing.T) {
+	issuer := newOIDCIssuer(t)
+	service := newTestOIDCService(t, issuer)
+
+	w := testOIDCLogin(t, service, issuer, &oidcGrant{subject: "ada", claims: oidcClaims{Email: "ada@example.com", EmailVerified: true}})
+	assertSignedIn(t, w)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fragment, err := url.ParseQuery(location.Fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken := fragment.Get("access_token")
+
+	// A session signed in a while ago can't stand in for the password
+	if err := service.db.Model(&Session{}).Where("1 = 1").Update("created_at", time.Now().Add(-recentSignIn-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if w := changeTestPassword(service, "ada@example.com", accessToken, &ChangePasswordRequest{Password: "correct horse"}); w.Code != http.StatusForbidden {
+		t.Fatalf("changing the password from an old session gave %d, want 403: %s", w.Code, w.Body)
+	}
+
+	// Signing in again at the provider lets the user set a first password
+	if err := service.db.Model(&Session{}).Where("1 = 1").Update("created_at", time.Now()).Error; err != nil {
+		t.Fatal(err)
+	}
+	if w := changeTestPassword(service, "ada@example.com", accessToken, &ChangePasswordRequest{Password: "correct horse"}); w.Code != http.StatusOK {
+		t.Fatalf("setting a first password after signing in gave %d, want 200: %s", w.Code, w.Body)
+	}
+
+	// From then on the password is asked for, however recent the sign in
+	request := &ChangePasswordRequest{CurrentPassword: "wrong password", Password: "battery staple"}
+	if w := changeTestPassword(service, "ada@example.com", accessToken, request); w.Code != http.StatusForbidden {
+		t.Fatalf("changing the password with a wrong one gave %d, want 403: %s", w.Code, w.Body)
+	}
+
+	request.CurrentPassword = "correct horse"
+	if w := changeTestPassword(service, "ada@example.com", accessToken, request); w.Code != http.StatusOK {
+		t.Fatalf("changing the password gave %d, want 200: %s", w.Code, w.Body)
+	}
+}
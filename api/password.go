@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	passwordResetLifetime = time.Hour
+	// Asking for another reset within passwordResetCooldown doesn't send another email
+	passwordResetCooldown = time.Minute
+
+	minPasswordLength = 8
+)
+
+var errPasswordResetUsed = errors.New("password reset already used")
+
+// PasswordReset is an emailed link to choose a new password, only the hash of its token is kept
+type PasswordReset struct {
+	Hash      string    `gorm:"primaryKey"`
+	UserUUID  uuid.UUID `gorm:"not null;index;type:uuid"`
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    sql.NullTime
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// ForgotPassword Emails a link to reset the password if the email belongs to a user. The response is the same
+// either way, so it can't be used to find out who has an account.
+func (service *UserService) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodPost {
+		return
+	}
+
+	request := &ForgotPasswordRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, NewUserError(1, "Invalid JSON request", err.Error()))
+		return
+	}
+
+	user := &User{}
+	if service.db.First(user, "email = ?", strings.ToLower(strings.TrimSpace(request.Email))).RowsAffected > 0 {
+		if err := service.startPasswordReset(user, r.Host); err != nil {
+			log.Println(err)
+		}
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &NewUserResponse{Successful: true})
+}
+
+// startPasswordReset Replaces any earlier reset link of the user with a new one and emails it to them
+func (service *UserService) startPasswordReset(user *User, host string) error {
+	now := time.Now()
+	if service.db.Where("user_uuid = ? AND created_at > ?", user.UUID, now.Add(-passwordResetCooldown)).First(&PasswordReset{}).RowsAffected > 0 {
+		return nil
+	}
+
+	token, err := GenerateVerificationToken()
+	if err != nil {
+		return err
+	}
+
+	err = service.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_uuid = ?", user.UUID).Delete(&PasswordReset{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&PasswordReset{Hash: hashToken(token), UserUUID: user.UUID, ExpiresAt: now.Add(passwordResetLifetime)}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	data := map[string]string{
+		"Name": user.FirstName,
+		"Link": fmt.Sprintf("https://%s/password/reset?token=%s", host, token),
+	}
+
+	// Sent in the background so the response takes as long as for an unknown email
+	go func() {
+		if err := service.SendEmail(user.Email, "Reset your password", "reset-password-email.tmpl", data); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	return nil
+}
+
+// ResetPassword Shows the form to choose a new password on GET. On POST it sets the new password, answering
+// a JSON request with JSON and the form with a page.
+func (service *UserService) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	switch r.Method {
+	case http.MethodGet:
+		renderResetForm(w, r.URL.Query().Get("token"), "")
+	case http.MethodPost:
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			request := &ResetPasswordRequest{}
+			if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+				RenderJSONResponse(w, http.StatusBadRequest, NewUserError(1, "Invalid JSON request", err.Error()))
+				return
+			}
+
+			if _, status, errResponse := service.resetPassword(request.Token, request.Password); errResponse != nil {
+				RenderJSONResponse(w, status, errResponse)
+				return
+			}
+
+			RenderJSONResponse(w, http.StatusOK, &NewUserResponse{Successful: true})
+			return
+		}
+
+		token := r.PostFormValue("token")
+		user, _, errResponse := service.resetPassword(token, r.PostFormValue("password"))
+		if errResponse != nil {
+			renderResetForm(w, token, errResponse.Error["message"])
+			return
+		}
+
+		RenderErrorTemplate(w, "password-changed", map[string]string{"Name": user.FirstName})
+	}
+}
+
+func renderResetForm(w http.ResponseWriter, token, message string) {
+	RenderErrorTemplate(w, "reset-password", map[string]interface{}{
+		"Token":     token,
+		"Error":     message,
+		"MinLength": minPasswordLength,
+	})
+}
+
+// resetPassword Uses up a reset token to set the user's new password, ending all their sessions
+func (service *UserService) resetPassword(token, password string) (*User, int, *NewUserResponse) {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return nil, http.StatusBadRequest, NewUserError(23, "Password too short", fmt.Sprintf("The password must have at least %d characters", minPasswordLength))
+	}
+
+	now := time.Now()
+	invalid := NewUserError(22, "Invalid reset link", "This reset link is invalid or has expired. Please ask for a new one.")
+
+	reset := &PasswordReset{}
+	if token == "" || service.db.First(reset, "hash = ?", hashToken(token)).RowsAffected == 0 || reset.UsedAt.Valid || now.After(reset.ExpiresAt) {
+		return nil, http.StatusBadRequest, invalid
+	}
+
+	user := &User{}
+	if service.db.First(user, "uuid = ?", reset.UserUUID).RowsAffected == 0 {
+		return nil, http.StatusBadRequest, invalid
+	}
+
+	err := service.db.Transaction(func(tx *gorm.DB) error {
+		// The link works once even if it is used twice at the same time
+		result := tx.Model(&PasswordReset{}).Where("hash = ? AND used_at IS NULL", reset.Hash).Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errPasswordResetUsed
+		}
+
+		user.Password = HashPassword(password, user.UUID.String())
+		return tx.Model(user).Update("password", user.Password).Error
+	})
+	if errors.Is(err, errPasswordResetUsed) {
+		return nil, http.StatusBadRequest, invalid
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, http.StatusInternalServerError, NewUserError(28, "Internal server error", "Error changing password")
+	}
+
+	if err := service.RevokeSessions(user.UUID, "", now); err != nil {
+		log.Println(err)
+		return nil, http.StatusInternalServerError, NewUserError(28, "Internal server error", "Your password was changed but not every session could be ended")
+	}
+
+	return user, http.StatusOK, nil
+}
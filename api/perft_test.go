@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+// perft Counts the leaf nodes of the legal move tree to the given depth, the standard way to check move generation
+func perft(pos *Position, depth int) int {
+	if depth == 0 {
+		return 1
+	}
+
+	moves := pos.ValidMoves()
+	if depth == 1 {
+		return len(moves)
+	}
+
+	nodes := 0
+	for _, m := range moves {
+		nodes += perft(pos.Play(m), depth-1)
+	}
+
+	return nodes
+}
+
+// TestPerft Checks the rules engine against node counts for each variant, nodes[i] being the count at depth i+1.
+// The start positions use published counts, the small endgames are counted by hand so that the games ending
+// early by each variant's own rule shows up in the totals.
+func TestPerft(t *testing.T) {
+	tests := []struct {
+		name    string
+		variant string
+		fen     string
+		nodes   []int
+	}{
+		{"start", VariantStandard, StartingFEN, []int{20, 400, 8902, 197281}},
+		{"kiwipete", VariantStandard, "r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1", []int{48, 2039, 97862}},
+		{"rook endgame", VariantStandard, "8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1", []int{14, 191, 2812, 43238}},
+		{"promotions", VariantStandard, "r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 w kq - 0 1", []int{6, 264, 9467}},
+		{"discovered checks", VariantStandard, "rnbq1k1r/pp1Pbppp/2p5/8/2B5/8/PPP1NnPP/RNBQK2R w KQ - 1 8", []int{44, 1486, 62379}},
+		{"castling hf", VariantChess960, "bqnb1rkr/pp3ppp/3ppn2/2p5/5P2/P2P4/NPP1P1PP/BQ1BNRKR w HFhf - 2 9", []int{21, 528, 12189}},
+		{"castling he", VariantChess960, "2nnrbkr/p1qppppp/8/1ppb4/6PP/3PP3/PPP2P2/BQNNRBKR w HEhe - 1 9", []int{21, 807, 18002}},
+		{"castling ge", VariantChess960, "b1q1rrkb/pppppppp/3nn3/8/P7/1PPP4/4PPPP/BQNNRKRB w GE - 1 9", []int{20, 479, 10471}},
+		{"start", VariantKingOfTheHill, StartingFEN, []int{20, 400, 8902, 197281}},
+		// Stepping onto d4 or e4 ends the game, leaving black without a reply
+		{"king reaches the hill", VariantKingOfTheHill, "8/8/8/8/8/4K3/8/k7 w - - 0 1", []int{8, 18}},
+		{"start", VariantThreeCheck, StartingFEN, []int{20, 400, 8902, 197281}},
+		// With one check left Ra8+ wins at once, where in standard chess black would have three king moves
+		{"last check", VariantThreeCheck, "4k3/8/8/8/8/8/8/R3K3 w - - 1+3 0 1", []int{15, 65}},
+		{"start", VariantAntichess, antichessFEN, []int{20, 400, 8067, 153299}},
+		// Rb1 blocks the pawn, and black wins by having no move
+		{"stalemated", VariantAntichess, "8/8/8/8/8/8/1p6/R7 w - - 0 1", []int{14, 65}},
+		{"start", VariantAtomic, StartingFEN, []int{20, 400, 8902, 197326}},
+		// Rxd8 explodes the black king next to the knight
+		{"king explodes", VariantAtomic, "3nk3/8/8/8/8/8/8/3RK3 w - - 0 1", []int{14, 93}},
+		{"start", VariantHorde, hordeFEN, []int{8, 128, 1274, 23310}},
+		// Taking the last pawn ends the game, and a rook in front of it leaves white stalemated
+		{"last pawn", VariantHorde, "r6k/8/8/8/8/8/P7/8 w - - 0 1", []int{2, 27, 23}},
+		{"start", VariantRacingKings, racingKingsFEN, []int{21, 421, 11264, 296242}},
+		// Once white reaches the eighth rank black gets one move to draw by reaching it too, then the race is over
+		{"race to the eighth rank", VariantRacingKings, "8/1k4K1/8/8/8/8/8/8 w - - 0 1", []int{8, 64, 170}},
+		{"start", VariantCrazyhouse, crazyhouseFEN, []int{20, 400, 8902, 197281}},
+		{"full pockets", VariantCrazyhouse, "2k5/8/8/8/8/8/8/4K3[QRBNPqrbnp] w - - 0 1", []int{301, 75353}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.variant+"/"+tt.name, func(t *testing.T) {
+			variant, err := VariantFor(tt.variant)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pos, err := ParseVariantFEN(variant, tt.fen)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, want := range tt.nodes {
+				if testing.Short() && want > 100000 {
+					continue
+				}
+
+				if got := perft(pos, i+1); got != want {
+					t.Errorf("depth %d: got %d nodes, want %d", i+1, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pjebs/jsonerror"
+)
+
+const (
+	// personalTokenPrefix tells personal tokens apart from access tokens, and makes them easy to find if leaked
+	personalTokenPrefix = "chk_"
+	maxPersonalTokens   = 50
+	// lastUsedPrecision is how often using a token is written down, so busy scripts don't write on every request
+	lastUsedPrecision = time.Minute
+)
+
+// PersonalToken is a long lived token a user makes for their own scripts and bots, limited to some scopes like
+// an app. Only its hash is kept.
+type PersonalToken struct {
+	ID         uuid.UUID  `gorm:"primaryKey;type:uuid" json:"id"`
+	UserUUID   uuid.UUID  `gorm:"not null;index;type:uuid" json:"-"`
+	Name       string     `gorm:"not null" json:"name"`
+	Scopes     string     `gorm:"not null" json:"scopes"`
+	Hash       string     `gorm:"not null;uniqueIndex" json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// ExpiresAt is when the token stops working, it never does when nil
+	ExpiresAt *time.Time `json:"expires_at"`
+	// Token is only shown when the token is made
+	Token string `gorm:"-" json:"token,omitempty"`
+}
+
+type NewPersonalTokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresInDays is how long the token works for, forever when 0
+	ExpiresInDays int `json:"expires_in_days"`
+}
+
+type PersonalTokenResponse struct {
+	Successful bool              `json:"success"`
+	Token      *PersonalToken    `json:"token,omitempty"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+type PersonalTokenListResponse struct {
+	Successful bool              `json:"success"`
+	Tokens     []*PersonalToken  `json:"tokens"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+func personalTokenError(code int, error, message string) *PersonalTokenResponse {
+	return &PersonalTokenResponse{Error: jsonerror.New(code, error, message).Render()}
+}
+
+// authenticatePersonalToken Checks a personal token like AuthenticateSession checks an access token. The token's
+// id stands in for the session, so revoking it closes any event stream it opened.
+func (service *UserService) authenticatePersonalToken(email, token string, scopes []string) (*User, string, *NewUserResponse) {
+	stored := &PersonalToken{}
+	if service.db.First(stored, "hash = ?", hashToken(token)).RowsAffected == 0 {
+		return nil, "", NewUserError(15, "Invalid token", "Personal token not found. It may have been revoked.")
+	}
+
+	now := time.Now()
+	if stored.ExpiresAt != nil && now.After(*stored.ExpiresAt) {
+		return nil, "", NewUserError(15, "Personal token is expired", "Personal token is expired")
+	}
+
+	if userErr := scopeError(stored.Scopes, scopes); userErr != nil {
+		return nil, "", userErr
+	}
+
+	query := service.db.Where("uuid = ?", stored.UserUUID)
+	if email != "" {
+		query = query.Where("email = ?", email)
+	}
+
+	user := &User{}
+	if query.First(user).Error != nil {
+		return nil, "", NewUserError(17, "User not found.", "User not found with provided email or has incorrect access token.")
+	}
+
+	err := service.db.Model(stored).Where("last_used_at IS NULL OR last_used_at < ?", now.Add(-lastUsedPrecision)).Update("last_used_at", now).Error
+	if err != nil {
+		log.Println(err)
+	}
+
+	return user, stored.ID.String(), nil
+}
+
+// HandlePersonalTokens Lists the user's personal tokens on GET and makes a new one on POST. Only the user's own
+// logins can, so a token can't be used to make more.
+func (service *UserService) HandlePersonalTokens(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	switch r.Method {
+	case http.MethodGet:
+		service.ListPersonalTokens(w, r)
+	case http.MethodPost:
+		service.CreatePersonalToken(w, r)
+	}
+}
+
+// ListPersonalTokens Gives the user's personal tokens with when they were last used, without the tokens themselves
+func (service *UserService) ListPersonalTokens(w http.ResponseWriter, r *http.Request) {
+	user, userErr := service.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	tokens := make([]*PersonalToken, 0)
+	if err := service.db.Where("user_uuid = ?", user.UUID).Order("created_at").Find(&tokens).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &PersonalTokenListResponse{Error: jsonerror.New(28, "Internal server error", "Error loading personal tokens").Render()})
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &PersonalTokenListResponse{Successful: true, Tokens: tokens})
+}
+
+// CreatePersonalToken Makes a personal token with a name and scopes, returning it for the only time
+func (service *UserService) CreatePersonalToken(w http.ResponseWriter, r *http.Request) {
+	user, userErr := service.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	request := &NewPersonalTokenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, personalTokenError(1, "Invalid JSON request", err.Error()))
+		return
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len(request.Name) > 64 {
+		RenderJSONResponse(w, http.StatusBadRequest, personalTokenError(43, "Invalid personal token", "Personal tokens need a name of at most 64 characters"))
+		return
+	}
+
+	scopes, ok := parseScopes(strings.Join(request.Scopes, " "))
+	if !ok {
+		RenderJSONResponse(w, http.StatusBadRequest, personalTokenError(43, "Invalid personal token", "Scopes must be some of "+strings.Join(oauthScopes, ", ")))
+		return
+	}
+
+	if request.ExpiresInDays < 0 {
+		RenderJSONResponse(w, http.StatusBadRequest, personalTokenError(43, "Invalid personal token", "expires_in_days can't be negative"))
+		return
+	}
+
+	var count int64
+	if err := service.db.Model(&PersonalToken{}).Where("user_uuid = ?", user.UUID).Count(&count).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, personalTokenError(28, "Internal server error", "Error making personal token"))
+		return
+	}
+	if count >= maxPersonalTokens {
+		RenderJSONResponse(w, http.StatusConflict, personalTokenError(43, "Too many personal tokens", fmt.Sprintf("You can have at most %d personal tokens, revoke one first", maxPersonalTokens)))
+		return
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, personalTokenError(28, "Internal server error", "Error making personal token"))
+		return
+	}
+
+	secret, err := GenerateVerificationToken()
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, personalTokenError(28, "Internal server error", "Error making personal token"))
+		return
+	}
+
+	token := &PersonalToken{ID: id, UserUUID: user.UUID, Name: request.Name, Scopes: scopes, Token: personalTokenPrefix + secret}
+	token.Hash = hashToken(token.Token)
+	if request.ExpiresInDays > 0 {
+		expires := time.Now().AddDate(0, 0, request.ExpiresInDays)
+		token.ExpiresAt = &expires
+	}
+
+	if err := service.db.Create(token).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, personalTokenError(28, "Internal server error", "Error saving personal token"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusCreated, &PersonalTokenResponse{Successful: true, Token: token})
+}
+
+// RevokePersonalToken Deletes one of the user's personal tokens, closing any event stream it opened
+func (service *UserService) RevokePersonalToken(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodDelete {
+		return
+	}
+
+	user, userErr := service.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	token := &PersonalToken{}
+	if service.db.First(token, "id = ? AND user_uuid = ?", r.PathValue("id"), user.UUID).RowsAffected == 0 {
+		RenderJSONResponse(w, http.StatusNotFound, personalTokenError(44, "Personal token not found", "You have no personal token with this id"))
+		return
+	}
+
+	if err := service.db.Delete(token).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, personalTokenError(28, "Internal server error", "Error revoking personal token"))
+		return
+	}
+
+	revoked := &Session{ID: token.ID, UserUUID: user.UUID}
+	for _, listener := range service.sessionListeners {
+		listener.SessionRevoked(revoked)
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &PersonalTokenResponse{Successful: true})
+}
+
+// revokePersonalTokens Deletes every personal token of the user but the one given by except, which may be empty,
+// closing the event streams they opened
+func (service *UserService) revokePersonalTokens(user uuid.UUID, except string) error {
+	var tokens []*PersonalToken
+	query := service.db.Where("user_uuid = ?", user)
+	if except != "" {
+		query = query.Where("id <> ?", except)
+	}
+
+	if err := query.Find(&tokens).Error; err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		if err := service.db.Delete(token).Error; err != nil {
+			return err
+		}
+
+		revoked := &Session{ID: token.ID, UserUUID: user}
+		for _, listener := range service.sessionListeners {
+			listener.SessionRevoked(revoked)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,1028 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Square is an index into the board, a1 = 0, b1 = 1, ..., h8 = 63.
+type Square int8
+
+const NoSquare Square = -1
+
+func NewSquare(file, rank int) Square {
+	if file < 0 || file > 7 || rank < 0 || rank > 7 {
+		return NoSquare
+	}
+
+	return Square(rank*8 + file)
+}
+
+func ParseSquare(s string) (Square, error) {
+	if len(s) != 2 || s[0] < 'a' || s[0] > 'h' || s[1] < '1' || s[1] > '8' {
+		return NoSquare, fmt.Errorf("invalid square: %s", s)
+	}
+
+	return NewSquare(int(s[0]-'a'), int(s[1]-'1')), nil
+}
+
+func (sq Square) File() int {
+	return int(sq) & 7
+}
+
+func (sq Square) Rank() int {
+	return int(sq) >> 3
+}
+
+func (sq Square) String() string {
+	if sq == NoSquare {
+		return "-"
+	}
+
+	return string([]byte{byte('a' + sq.File()), byte('1' + sq.Rank())})
+}
+
+type Color int8
+
+const (
+	NoColor Color = iota
+	White
+	Black
+)
+
+func (c Color) Other() Color {
+	switch c {
+	case White:
+		return Black
+	case Black:
+		return White
+	}
+
+	return NoColor
+}
+
+func (c Color) String() string {
+	switch c {
+	case White:
+		return "w"
+	case Black:
+		return "b"
+	}
+
+	return "-"
+}
+
+// Name returns the full name of the color, as used in PGN and socket messages
+func (c Color) Name() string {
+	switch c {
+	case White:
+		return "white"
+	case Black:
+		return "black"
+	}
+
+	return ""
+}
+
+// backRank returns the rank the pieces of the color start on
+func (c Color) backRank() int {
+	if c == Black {
+		return 7
+	}
+
+	return 0
+}
+
+// forward returns the rank direction pawns of the color move in
+func (c Color) forward() int {
+	if c == Black {
+		return -1
+	}
+
+	return 1
+}
+
+type PieceType int8
+
+const (
+	NoPieceType PieceType = iota
+	King
+	Queen
+	Rook
+	Bishop
+	Knight
+	Pawn
+)
+
+var pieceLetters = map[PieceType]byte{King: 'k', Queen: 'q', Rook: 'r', Bishop: 'b', Knight: 'n', Pawn: 'p'}
+
+func pieceTypeFromLetter(c byte) PieceType {
+	for pt, letter := range pieceLetters {
+		if letter == c || letter == c+('a'-'A') {
+			return pt
+		}
+	}
+
+	return NoPieceType
+}
+
+type Piece struct {
+	Type  PieceType
+	Color Color
+}
+
+var NoPiece = Piece{}
+
+// Letter returns the FEN letter of the piece, upper case for white
+func (p Piece) Letter() byte {
+	letter, ok := pieceLetters[p.Type]
+	if !ok {
+		return ' '
+	}
+
+	if p.Color == White {
+		return letter - ('a' - 'A')
+	}
+
+	return letter
+}
+
+type Side int8
+
+const (
+	KingSide Side = iota
+	QueenSide
+)
+
+// Move is a single move on the board. Castling moves are stored as the king
+// capturing its own rook so that Chess960 castling is unambiguous, and drops
+// of a piece from the pocket have no From square.
+type Move struct {
+	From      Square
+	To        Square
+	Promotion PieceType
+	Castle    bool
+	Drop      PieceType
+}
+
+func (m *Move) String() string {
+	return UCINotation{}.Encode(nil, m)
+}
+
+// Position is a full description of the board at a single point in the game
+type Position struct {
+	board      [64]Piece
+	turn       Color
+	castling   [3][2]Square
+	enPassant  Square
+	halfMoves  int
+	moveNumber int
+	chess960   bool
+	checks     [3]int
+	variant    Variant
+	// pockets hold the pieces each color can drop in Crazyhouse and Bughouse
+	pockets [3][7]int
+	// promoted marks the squares of promoted pieces, which go back to the pocket as pawns when captured
+	promoted uint64
+}
+
+func squareBit(sq Square) uint64 {
+	if sq == NoSquare {
+		return 0
+	}
+
+	return 1 << uint(sq)
+}
+
+const StartingFEN = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"
+
+func StartingPosition() *Position {
+	pos, _ := ParseFEN(StartingFEN)
+	return pos
+}
+
+func emptyPosition() *Position {
+	pos := &Position{turn: White, enPassant: NoSquare, moveNumber: 1}
+	for c := range pos.castling {
+		pos.castling[c] = [2]Square{NoSquare, NoSquare}
+	}
+
+	return pos
+}
+
+// ParseFEN Parses a FEN string, castling rights may be given as KQkq, Shredder-FEN or X-FEN
+func ParseFEN(fen string) (*Position, error) {
+	fields := strings.Fields(fen)
+	if len(fields) < 4 || len(fields) > 6 {
+		return nil, fmt.Errorf("invalid fen: expected 4 to 6 fields, got %d", len(fields))
+	}
+
+	pos := emptyPosition()
+
+	// Drop variants add the pockets in brackets or as a ninth rank, e.g. RNBQKBNR[Nq] or RNBQKBNR/Nq
+	placement := fields[0]
+	pocket := ""
+	if i := strings.IndexByte(placement, '['); i >= 0 {
+		if !strings.HasSuffix(placement, "]") {
+			return nil, fmt.Errorf("invalid fen: unterminated pocket in %q", placement)
+		}
+		placement, pocket = placement[:i], placement[i+1:len(placement)-1]
+	} else if strings.Count(placement, "/") == 8 {
+		i := strings.LastIndexByte(placement, '/')
+		placement, pocket = placement[:i], placement[i+1:]
+	}
+
+	if err := pos.parsePocket(pocket); err != nil {
+		return nil, err
+	}
+
+	ranks := strings.Split(placement, "/")
+	if len(ranks) != 8 {
+		return nil, fmt.Errorf("invalid fen: expected 8 ranks, got %d", len(ranks))
+	}
+
+	for i, rankStr := range ranks {
+		rank := 7 - i
+		file := 0
+		for j := 0; j < len(rankStr); j++ {
+			c := rankStr[j]
+			if c >= '1' && c <= '8' {
+				file += int(c - '0')
+				continue
+			}
+
+			pt := pieceTypeFromLetter(c)
+			if pt == NoPieceType || file > 7 {
+				return nil, fmt.Errorf("invalid fen: bad rank %q", rankStr)
+			}
+
+			color := Black
+			if c >= 'A' && c <= 'Z' {
+				color = White
+			}
+
+			pos.board[NewSquare(file, rank)] = Piece{pt, color}
+			if j+1 < len(rankStr) && rankStr[j+1] == '~' {
+				pos.promoted |= squareBit(NewSquare(file, rank))
+				j++
+			}
+			file++
+		}
+
+		if file != 8 {
+			return nil, fmt.Errorf("invalid fen: rank %q does not have 8 files", rankStr)
+		}
+	}
+
+	switch fields[1] {
+	case "w":
+		pos.turn = White
+	case "b":
+		pos.turn = Black
+	default:
+		return nil, fmt.Errorf("invalid fen: bad side to move %q", fields[1])
+	}
+
+	if err := pos.parseCastling(fields[2]); err != nil {
+		return nil, err
+	}
+
+	if fields[3] != "-" {
+		sq, err := ParseSquare(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid fen: bad en passant square %q", fields[3])
+		}
+		pos.enPassant = sq
+	}
+
+	if len(fields) > 4 {
+		halfMoves, err := strconv.Atoi(fields[4])
+		if err != nil || halfMoves < 0 {
+			return nil, fmt.Errorf("invalid fen: bad half move clock %q", fields[4])
+		}
+		pos.halfMoves = halfMoves
+	}
+
+	if len(fields) > 5 {
+		moveNumber, err := strconv.Atoi(fields[5])
+		if err != nil || moveNumber < 1 {
+			return nil, fmt.Errorf("invalid fen: bad move number %q", fields[5])
+		}
+		pos.moveNumber = moveNumber
+	}
+
+	return pos, nil
+}
+
+func (pos *Position) parsePocket(pocket string) error {
+	for i := 0; i < len(pocket); i++ {
+		c := pocket[i]
+		pt := pieceTypeFromLetter(c)
+		if pt == NoPieceType || pt == King {
+			return fmt.Errorf("invalid fen: bad pocket %q", pocket)
+		}
+
+		color := Black
+		if c >= 'A' && c <= 'Z' {
+			color = White
+		}
+
+		pos.pockets[color][pt]++
+	}
+
+	return nil
+}
+
+func (pos *Position) parseCastling(field string) error {
+	if field == "-" {
+		return nil
+	}
+
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		color := White
+		if c >= 'a' && c <= 'z' {
+			color = Black
+			c -= 'a' - 'A'
+		}
+
+		king := pos.kingSquare(color)
+		if king == NoSquare || king.Rank() != color.backRank() {
+			return fmt.Errorf("invalid fen: castling rights for %s without a king on the back rank", color.Name())
+		}
+
+		var rook Square
+		switch {
+		case c == 'K':
+			rook = pos.outermostRook(color, KingSide)
+		case c == 'Q':
+			rook = pos.outermostRook(color, QueenSide)
+		case c >= 'A' && c <= 'H':
+			rook = NewSquare(int(c-'A'), color.backRank())
+			if pos.board[rook] != (Piece{Rook, color}) {
+				rook = NoSquare
+			}
+		default:
+			return fmt.Errorf("invalid fen: bad castling rights %q", field)
+		}
+
+		if rook == NoSquare {
+			return fmt.Errorf("invalid fen: castling rights %q without a matching rook", string(field[i]))
+		}
+
+		side := KingSide
+		if rook.File() < king.File() {
+			side = QueenSide
+		}
+
+		if pos.castling[color][side] != NoSquare {
+			return fmt.Errorf("invalid fen: duplicate castling rights %q", field)
+		}
+
+		pos.castling[color][side] = rook
+		if rook.File() != 7 && rook.File() != 0 || king.File() != 4 {
+			pos.chess960 = true
+		}
+	}
+
+	return nil
+}
+
+// outermostRook finds the rook furthest from the king on the given side of the back rank
+func (pos *Position) outermostRook(color Color, side Side) Square {
+	king := pos.kingSquare(color)
+	if king == NoSquare {
+		return NoSquare
+	}
+
+	rank := color.backRank()
+	if side == KingSide {
+		for file := 7; file > king.File(); file-- {
+			if pos.board[NewSquare(file, rank)] == (Piece{Rook, color}) {
+				return NewSquare(file, rank)
+			}
+		}
+	} else {
+		for file := 0; file < king.File(); file++ {
+			if pos.board[NewSquare(file, rank)] == (Piece{Rook, color}) {
+				return NewSquare(file, rank)
+			}
+		}
+	}
+
+	return NoSquare
+}
+
+func (pos *Position) castlingString() string {
+	var sb strings.Builder
+	for _, color := range []Color{White, Black} {
+		for _, side := range []Side{KingSide, QueenSide} {
+			rook := pos.castling[color][side]
+			if rook == NoSquare {
+				continue
+			}
+
+			var c byte
+			switch {
+			case rook == pos.outermostRook(color, side) && side == KingSide:
+				c = 'K'
+			case rook == pos.outermostRook(color, side):
+				c = 'Q'
+			default:
+				c = byte('A' + rook.File())
+			}
+
+			if color == Black {
+				c += 'a' - 'A'
+			}
+
+			sb.WriteByte(c)
+		}
+	}
+
+	if sb.Len() == 0 {
+		return "-"
+	}
+
+	return sb.String()
+}
+
+func (pos *Position) boardString() string {
+	var sb strings.Builder
+	for rank := 7; rank >= 0; rank-- {
+		empty := 0
+		for file := 0; file < 8; file++ {
+			p := pos.board[NewSquare(file, rank)]
+			if p == NoPiece {
+				empty++
+				continue
+			}
+
+			if empty > 0 {
+				sb.WriteString(strconv.Itoa(empty))
+				empty = 0
+			}
+			sb.WriteByte(p.Letter())
+			if pos.hasPockets() && pos.promoted&squareBit(NewSquare(file, rank)) != 0 {
+				sb.WriteByte('~')
+			}
+		}
+
+		if empty > 0 {
+			sb.WriteString(strconv.Itoa(empty))
+		}
+
+		if rank > 0 {
+			sb.WriteByte('/')
+		}
+	}
+
+	if pos.hasPockets() {
+		sb.WriteByte('[')
+		for _, color := range []Color{White, Black} {
+			for pt := Queen; pt <= Pawn; pt++ {
+				sb.WriteString(strings.Repeat(string(Piece{pt, color}.Letter()), pos.pockets[color][pt]))
+			}
+		}
+		sb.WriteByte(']')
+	}
+
+	return sb.String()
+}
+
+// Pocket returns the pieces the color holds for dropping, keyed by their upper case letter
+func (pos *Position) Pocket(color Color) map[string]int {
+	pocket := make(map[string]int)
+	for pt := Queen; pt <= Pawn; pt++ {
+		if n := pos.pockets[color][pt]; n > 0 {
+			pocket[string(Piece{pt, White}.Letter())] = n
+		}
+	}
+
+	return pocket
+}
+
+// hasEmptyPockets reports whether neither side holds a piece to drop
+func (pos *Position) hasEmptyPockets() bool {
+	return pos.pockets == [3][7]int{}
+}
+
+// String returns the FEN of the position, with the remaining checks of each side in three-check games
+func (pos *Position) String() string {
+	if _, ok := pos.Variant().(threeCheckVariant); ok {
+		return fmt.Sprintf("%s %s %s %s %d+%d %d %d", pos.boardString(), pos.turn, pos.castlingString(), pos.enPassant,
+			threeCheckLimit-pos.checks[White], threeCheckLimit-pos.checks[Black], pos.halfMoves, pos.moveNumber)
+	}
+
+	return fmt.Sprintf("%s %s %s %s %d %d", pos.boardString(), pos.turn, pos.castlingString(), pos.enPassant, pos.halfMoves, pos.moveNumber)
+}
+
+// key identifies the position for repetition detection
+func (pos *Position) key() string {
+	enPassant := NoSquare
+	if pos.enPassant != NoSquare {
+		for _, m := range pos.ValidMoves() {
+			if m.To == pos.enPassant && pos.Piece(m.From).Type == Pawn {
+				enPassant = pos.enPassant
+				break
+			}
+		}
+	}
+
+	return fmt.Sprintf("%s %s %s %s %v", pos.boardString(), pos.turn, pos.castlingString(), enPassant, pos.checks)
+}
+
+// Variant returns the rules the position is played under
+func (pos *Position) Variant() Variant {
+	if pos.variant == nil {
+		return standardVariant{}
+	}
+
+	return pos.variant
+}
+
+// hasPockets reports whether the variant lets captured pieces be dropped back on the board
+func (pos *Position) hasPockets() bool {
+	_, ok := pos.Variant().(pocketVariant)
+	return ok
+}
+
+func (pos *Position) Turn() Color {
+	return pos.turn
+}
+
+func (pos *Position) Piece(sq Square) Piece {
+	if sq == NoSquare {
+		return NoPiece
+	}
+
+	return pos.board[sq]
+}
+
+func (pos *Position) HalfMoveClock() int {
+	return pos.halfMoves
+}
+
+func (pos *Position) copy() *Position {
+	cp := *pos
+	return &cp
+}
+
+func (pos *Position) kingSquare(color Color) Square {
+	for sq := Square(0); sq < 64; sq++ {
+		if pos.board[sq] == (Piece{King, color}) {
+			return sq
+		}
+	}
+
+	return NoSquare
+}
+
+var (
+	knightOffsets   = [][2]int{{1, 2}, {2, 1}, {2, -1}, {1, -2}, {-1, -2}, {-2, -1}, {-2, 1}, {-1, 2}}
+	kingOffsets     = [][2]int{{1, 0}, {1, 1}, {0, 1}, {-1, 1}, {-1, 0}, {-1, -1}, {0, -1}, {1, -1}}
+	rookDirections  = [][2]int{{1, 0}, {0, 1}, {-1, 0}, {0, -1}}
+	bishopDirection = [][2]int{{1, 1}, {-1, 1}, {-1, -1}, {1, -1}}
+)
+
+func offset(sq Square, df, dr int) Square {
+	return NewSquare(sq.File()+df, sq.Rank()+dr)
+}
+
+// IsAttacked Reports whether the square is attacked by any piece of the given color
+func (pos *Position) IsAttacked(sq Square, by Color) bool {
+	for _, o := range knightOffsets {
+		if t := offset(sq, o[0], o[1]); t != NoSquare && pos.board[t] == (Piece{Knight, by}) {
+			return true
+		}
+	}
+
+	for _, o := range kingOffsets {
+		if t := offset(sq, o[0], o[1]); t != NoSquare && pos.board[t] == (Piece{King, by}) {
+			return true
+		}
+	}
+
+	for _, df := range []int{-1, 1} {
+		if t := offset(sq, df, -by.forward()); t != NoSquare && pos.board[t] == (Piece{Pawn, by}) {
+			return true
+		}
+	}
+
+	for _, d := range rookDirections {
+		if p := pos.firstPiece(sq, d); p.Color == by && (p.Type == Rook || p.Type == Queen) {
+			return true
+		}
+	}
+
+	for _, d := range bishopDirection {
+		if p := pos.firstPiece(sq, d); p.Color == by && (p.Type == Bishop || p.Type == Queen) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// firstPiece returns the first piece found walking from sq in the given direction
+func (pos *Position) firstPiece(sq Square, d [2]int) Piece {
+	for t := offset(sq, d[0], d[1]); t != NoSquare; t = offset(t, d[0], d[1]) {
+		if pos.board[t] != NoPiece {
+			return pos.board[t]
+		}
+	}
+
+	return NoPiece
+}
+
+// InCheck Reports whether the side to move is in check
+func (pos *Position) InCheck() bool {
+	return pos.Variant().InCheck(pos)
+}
+
+// kingAttacked reports whether the king of the given color is attacked, false if it has no king
+func (pos *Position) kingAttacked(color Color) bool {
+	king := pos.kingSquare(color)
+	return king != NoSquare && pos.IsAttacked(king, color.Other())
+}
+
+// pseudoLegalMoves generates every move that obeys piece movement, ignoring checks. Pawns promote to
+// any of the given pieces, and castling is generated only when unsafe is set, which reports whether
+// the king may not stand on or pass through a square.
+func (pos *Position) pseudoLegalMoves(promotions []PieceType, unsafe func(sq Square) bool) []*Move {
+	moves := make([]*Move, 0, 48)
+	us := pos.turn
+
+	for sq := Square(0); sq < 64; sq++ {
+		p := pos.board[sq]
+		if p.Color != us {
+			continue
+		}
+
+		switch p.Type {
+		case Pawn:
+			moves = pos.appendPawnMoves(moves, sq, promotions)
+		case Knight:
+			moves = pos.appendStepMoves(moves, sq, knightOffsets)
+		case King:
+			moves = pos.appendStepMoves(moves, sq, kingOffsets)
+		case Bishop:
+			moves = pos.appendSlideMoves(moves, sq, bishopDirection)
+		case Rook:
+			moves = pos.appendSlideMoves(moves, sq, rookDirections)
+		case Queen:
+			moves = pos.appendSlideMoves(moves, sq, rookDirections)
+			moves = pos.appendSlideMoves(moves, sq, bishopDirection)
+		}
+	}
+
+	if unsafe == nil {
+		return moves
+	}
+
+	return append(moves, pos.castleMoves(unsafe)...)
+}
+
+// attackedBy returns an unsafe square check for castling where any attack by the color counts
+func (pos *Position) attackedBy(color Color) func(sq Square) bool {
+	return func(sq Square) bool {
+		return pos.IsAttacked(sq, color)
+	}
+}
+
+func (pos *Position) appendStepMoves(moves []*Move, from Square, offsets [][2]int) []*Move {
+	for _, o := range offsets {
+		to := offset(from, o[0], o[1])
+		if to != NoSquare && pos.board[to].Color != pos.turn {
+			moves = append(moves, &Move{From: from, To: to})
+		}
+	}
+
+	return moves
+}
+
+func (pos *Position) appendSlideMoves(moves []*Move, from Square, directions [][2]int) []*Move {
+	for _, d := range directions {
+		for to := offset(from, d[0], d[1]); to != NoSquare; to = offset(to, d[0], d[1]) {
+			if pos.board[to].Color == pos.turn {
+				break
+			}
+
+			moves = append(moves, &Move{From: from, To: to})
+			if pos.board[to] != NoPiece {
+				break
+			}
+		}
+	}
+
+	return moves
+}
+
+var promotionPieces = []PieceType{Queen, Rook, Bishop, Knight}
+
+func (pos *Position) appendPawnMoves(moves []*Move, from Square, promotions []PieceType) []*Move {
+	us := pos.turn
+	forward := us.forward()
+	lastRank := us.Other().backRank()
+
+	add := func(to Square) {
+		if to.Rank() == lastRank {
+			for _, pt := range promotions {
+				moves = append(moves, &Move{From: from, To: to, Promotion: pt})
+			}
+			return
+		}
+		moves = append(moves, &Move{From: from, To: to})
+	}
+
+	if to := offset(from, 0, forward); to != NoSquare && pos.board[to] == NoPiece {
+		add(to)
+
+		// Pawns may also move two squares from the first rank, which only happens in Horde
+		if from.Rank() == us.backRank()+forward || from.Rank() == us.backRank() {
+			if to2 := offset(to, 0, forward); to2 != NoSquare && pos.board[to2] == NoPiece {
+				add(to2)
+			}
+		}
+	}
+
+	for _, df := range []int{-1, 1} {
+		to := offset(from, df, forward)
+		if to == NoSquare {
+			continue
+		}
+
+		if pos.board[to].Color == us.Other() || to == pos.enPassant {
+			add(to)
+		}
+	}
+
+	return moves
+}
+
+// castleMoves generates castling moves using Chess960 rules, which also cover standard chess
+func (pos *Position) castleMoves(unsafe func(sq Square) bool) []*Move {
+	var moves []*Move
+	us := pos.turn
+
+	king := pos.kingSquare(us)
+	if king == NoSquare || unsafe(king) {
+		return nil
+	}
+
+	for _, side := range []Side{KingSide, QueenSide} {
+		rook := pos.castling[us][side]
+		if rook == NoSquare || pos.board[rook] != (Piece{Rook, us}) {
+			continue
+		}
+
+		kingTo, rookTo := castleSquares(us, side)
+		if !pos.castlePathClear(king, rook, kingTo, rookTo) {
+			continue
+		}
+
+		safe := true
+		for _, sq := range squaresBetween(king, kingTo, true) {
+			if unsafe(sq) {
+				safe = false
+				break
+			}
+		}
+
+		if safe {
+			moves = append(moves, &Move{From: king, To: rook, Castle: true})
+		}
+	}
+
+	return moves
+}
+
+// castleSquares returns the destination of the king and rook when castling
+func castleSquares(color Color, side Side) (Square, Square) {
+	rank := color.backRank()
+	if side == KingSide {
+		return NewSquare(6, rank), NewSquare(5, rank)
+	}
+
+	return NewSquare(2, rank), NewSquare(3, rank)
+}
+
+// castlePathClear checks that every square the king and rook travel over is empty except for themselves
+func (pos *Position) castlePathClear(king, rook, kingTo, rookTo Square) bool {
+	for _, path := range [][]Square{squaresBetween(king, kingTo, true), squaresBetween(rook, rookTo, true)} {
+		for _, sq := range path {
+			if sq != king && sq != rook && pos.board[sq] != NoPiece {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// squaresBetween returns the squares on a rank from a to b, excluding a and optionally including b
+func squaresBetween(a, b Square, inclusive bool) []Square {
+	var squares []Square
+	if a == b {
+		return nil
+	}
+
+	step := 1
+	if b < a {
+		step = -1
+	}
+
+	for sq := int(a) + step; sq != int(b); sq += step {
+		squares = append(squares, Square(sq))
+	}
+
+	if inclusive {
+		squares = append(squares, b)
+	}
+
+	return squares
+}
+
+// Update returns the position after the move without validating it
+func (pos *Position) Update(m *Move) *Position {
+	next := pos.copy()
+	us := pos.turn
+	moving := pos.Piece(m.From)
+	captured := pos.board[m.To]
+	if m.Drop != NoPieceType {
+		moving = Piece{m.Drop, us}
+		next.pockets[us][m.Drop]--
+	}
+
+	next.promoted &^= squareBit(m.From) | squareBit(m.To)
+
+	next.enPassant = NoSquare
+	next.turn = us.Other()
+	if us == Black {
+		next.moveNumber++
+	}
+
+	if moving.Type == Pawn || (captured != NoPiece && !m.Castle) {
+		next.halfMoves = 0
+	} else {
+		next.halfMoves++
+	}
+
+	switch {
+	case m.Drop != NoPieceType:
+		next.board[m.To] = moving
+	case m.Castle:
+		side := KingSide
+		if m.To.File() < m.From.File() {
+			side = QueenSide
+		}
+
+		kingTo, rookTo := castleSquares(us, side)
+		next.board[m.From] = NoPiece
+		next.board[m.To] = NoPiece
+		next.board[kingTo] = Piece{King, us}
+		next.board[rookTo] = Piece{Rook, us}
+	case moving.Type == Pawn && m.To == pos.enPassant:
+		next.board[NewSquare(m.To.File(), m.From.Rank())] = NoPiece
+		next.board[m.From] = NoPiece
+		next.board[m.To] = moving
+	default:
+		next.board[m.From] = NoPiece
+		if m.Promotion != NoPieceType {
+			next.board[m.To] = Piece{m.Promotion, us}
+		} else {
+			next.board[m.To] = moving
+		}
+
+		if m.Promotion != NoPieceType || pos.promoted&squareBit(m.From) != 0 {
+			next.promoted |= squareBit(m.To)
+		}
+
+		// Only a double step from the usual starting rank can be taken en passant
+		if moving.Type == Pawn && m.From.Rank() == us.backRank()+us.forward() && m.To.Rank() == m.From.Rank()+2*us.forward() {
+			next.enPassant = NewSquare(m.From.File(), (m.From.Rank()+m.To.Rank())/2)
+		}
+	}
+
+	if moving.Type == King {
+		next.castling[us] = [2]Square{NoSquare, NoSquare}
+	}
+
+	next.clearLostCastlingRights()
+
+	return next
+}
+
+// clearLostCastlingRights drops castling rights whose king or rook has left its square
+func (pos *Position) clearLostCastlingRights() {
+	for _, color := range []Color{White, Black} {
+		king := pos.kingSquare(color)
+		for side, rook := range pos.castling[color] {
+			if rook == NoSquare {
+				continue
+			}
+
+			if king == NoSquare || king.Rank() != color.backRank() || pos.board[rook] != (Piece{Rook, color}) {
+				pos.castling[color][side] = NoSquare
+			}
+		}
+	}
+}
+
+// Play returns the position after the move under the position's variant rules
+func (pos *Position) Play(m *Move) *Position {
+	return pos.Variant().Play(pos, m)
+}
+
+// ValidMoves returns every legal move in the position
+func (pos *Position) ValidMoves() []*Move {
+	return pos.Variant().LegalMoves(pos)
+}
+
+// isCapture reports whether the move takes an opponent's piece, including en passant
+func (pos *Position) isCapture(m *Move) bool {
+	if m.Castle || m.Drop != NoPieceType {
+		return false
+	}
+
+	return pos.board[m.To] != NoPiece || (pos.board[m.From].Type == Pawn && m.To == pos.enPassant)
+}
+
+// capturedPiece returns the piece the move takes as it goes to a pocket, promoted pieces turning back into pawns
+func (pos *Position) capturedPiece(m *Move) Piece {
+	switch {
+	case !pos.isCapture(m):
+		return NoPiece
+	case pos.board[m.To] == NoPiece:
+		// En passant
+		return Piece{Pawn, pos.turn.Other()}
+	case pos.promoted&squareBit(m.To) != 0:
+		return Piece{Pawn, pos.board[m.To].Color}
+	}
+
+	return pos.board[m.To]
+}
+
+// dropMoves generates every drop from the pocket of the side to move onto an empty square,
+// pawns cannot be dropped on the first or last rank
+func (pos *Position) dropMoves() []*Move {
+	var moves []*Move
+	for pt := Queen; pt <= Pawn; pt++ {
+		if pos.pockets[pos.turn][pt] == 0 {
+			continue
+		}
+
+		for sq := Square(0); sq < 64; sq++ {
+			if pos.board[sq] != NoPiece || (pt == Pawn && (sq.Rank() == 0 || sq.Rank() == 7)) {
+				continue
+			}
+
+			moves = append(moves, &Move{From: NoSquare, To: sq, Drop: pt})
+		}
+	}
+
+	return moves
+}
+
+var ErrIllegalMove = errors.New("illegal move")
+
+// legalMove returns the legal move matching m, so callers cannot smuggle in made-up flags
+func (pos *Position) legalMove(m *Move) (*Move, error) {
+	for _, valid := range pos.ValidMoves() {
+		if *valid == *m {
+			return valid, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrIllegalMove, m)
+}
+
+// hasInsufficientMaterial reports whether neither side can possibly deliver checkmate
+func (pos *Position) hasInsufficientMaterial() bool {
+	var minors []Square
+	for sq := Square(0); sq < 64; sq++ {
+		switch pos.board[sq].Type {
+		case NoPieceType, King:
+		case Bishop, Knight:
+			minors = append(minors, sq)
+		default:
+			return false
+		}
+	}
+
+	if len(minors) <= 1 {
+		return true
+	}
+
+	// Any number of bishops that all live on the same colour cannot mate
+	squareColor := (minors[0].File() + minors[0].Rank()) % 2
+	for _, sq := range minors {
+		if pos.board[sq].Type != Bishop || (sq.File()+sq.Rank())%2 != squareColor {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFENRoundTrip(t *testing.T) {
+	tests := []struct {
+		fen  string
+		want string
+	}{
+		{StartingFEN, StartingFEN},
+		{"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1", ""},
+		{"rnbqkbnr/pppp1ppp/8/4p3/4P3/8/PPPP1PPP/RNBQKBNR w KQkq e6 0 2", ""},
+		{"8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1", ""},
+		// Rooks that are the outermost on their side are written K and Q, as X-FEN does
+		{"bqnb1rkr/pp3ppp/3ppn2/2p5/5P2/P2P4/NPP1P1PP/BQ1BNRKR w HFhf - 2 9", "bqnb1rkr/pp3ppp/3ppn2/2p5/5P2/P2P4/NPP1P1PP/BQ1BNRKR w KQkq - 2 9"},
+		// An inner rook needs its file to tell it from the outer one
+		{"4k3/8/8/8/8/8/8/R1R1K2R w KC - 0 1", ""},
+	}
+
+	for _, tt := range tests {
+		want := tt.want
+		if want == "" {
+			want = tt.fen
+		}
+
+		pos, err := ParseFEN(tt.fen)
+		if err != nil {
+			t.Errorf("%s: %v", tt.fen, err)
+			continue
+		}
+		if got := pos.String(); got != want {
+			t.Errorf("%s was written back as %s, want %s", tt.fen, got, want)
+		}
+	}
+}
+
+func TestChess960Positions(t *testing.T) {
+	// The start positions with well known numbers in the Scharnagl numbering
+	known := map[int]string{0: "BBQNNRKR", 518: "RNBQKBNR", 959: "RKRNNQBB"}
+
+	seen := make(map[string]int)
+	for n := 0; n < 960; n++ {
+		pos := Chess960Position(n)
+
+		var backRank strings.Builder
+		var bishops, rooks []int
+		king := -1
+		for file := 0; file < 8; file++ {
+			white, black := pos.Piece(NewSquare(file, 0)), pos.Piece(NewSquare(file, 7))
+			if white.Color != White || black != (Piece{white.Type, Black}) {
+				t.Fatalf("position %d: the back ranks don't mirror each other on file %d", n, file)
+			}
+			if pos.Piece(NewSquare(file, 1)) != (Piece{Pawn, White}) || pos.Piece(NewSquare(file, 6)) != (Piece{Pawn, Black}) {
+				t.Fatalf("position %d: missing a pawn on file %d", n, file)
+			}
+
+			backRank.WriteByte(white.Letter())
+			switch white.Type {
+			case Bishop:
+				bishops = append(bishops, file)
+			case Rook:
+				rooks = append(rooks, file)
+			case King:
+				king = file
+			}
+		}
+
+		setup := backRank.String()
+		if other, ok := seen[setup]; ok {
+			t.Fatalf("positions %d and %d are both %s", other, n, setup)
+		}
+		seen[setup] = n
+
+		if want, ok := known[n]; ok && setup != want {
+			t.Errorf("position %d is %s, want %s", n, setup, want)
+		}
+		if len(bishops) != 2 || bishops[0]%2 == bishops[1]%2 {
+			t.Errorf("position %d (%s) doesn't have bishops on both colors", n, setup)
+		}
+		if len(rooks) != 2 || king < rooks[0] || king > rooks[1] {
+			t.Errorf("position %d (%s) doesn't have the king between the rooks", n, setup)
+		}
+		if pos.castlingString() != "KQkq" {
+			t.Errorf("position %d (%s) has castling rights %s, want KQkq", n, setup, pos.castlingString())
+		}
+	}
+}
+
+func TestChess960Castling(t *testing.T) {
+	tests := []struct {
+		name string
+		fen  string
+		move string
+		// want is the position after castling, empty when the move must be refused
+		want string
+	}{
+		{"king next to its rook in the corner", "4k3/8/8/8/8/8/8/RK6 w A - 0 1", "b1a1", "4k3/8/8/8/8/8/8/2KR4 b - - 1 1"},
+		{"king already on its square", "4k3/8/8/8/8/8/8/6KR w K - 0 1", "g1h1", "4k3/8/8/8/8/8/8/5RK1 b - - 1 1"},
+		{"rook already on its square", "4k3/8/8/8/8/8/8/3RK3 w D - 0 1", "e1d1", "4k3/8/8/8/8/8/8/2KR4 b - - 1 1"},
+		{"king side with rights on both sides", "4k3/8/8/8/8/8/8/1R3KR1 w GB - 0 1", "f1g1", "4k3/8/8/8/8/8/8/1R3RK1 b - - 1 1"},
+		{"queen side with rights on both sides", "4k3/8/8/8/8/8/8/1R3KR1 w GB - 0 1", "f1b1", "4k3/8/8/8/8/8/8/2KR2R1 b - - 1 1"},
+		{"standard castling as the king's move", "r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1", "e1g1", "r3k2r/8/8/8/8/8/8/R4RK1 b kq - 1 1"},
+		{"standard castling as taking the rook", "r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1", "e1h1", "r3k2r/8/8/8/8/8/8/R4RK1 b kq - 1 1"},
+		{"the rook's square is taken", "4k3/8/8/8/8/8/8/RK1N4 w A - 0 1", "b1a1", ""},
+		{"the king's square is attacked", "2r1k3/8/8/8/8/8/8/RK6 w A - 0 1", "b1a1", ""},
+		{"out of check", "4k3/8/8/8/8/8/8/RK4r1 w A - 0 1", "b1a1", ""},
+		{"the king passes an attacked square", "3rk3/8/8/8/8/8/8/2K4R w H - 0 1", "c1h1", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pos, err := ParseFEN(tt.fen)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := UCINotation{}.Decode(pos, tt.move)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("%s was allowed", tt.move)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !m.Castle {
+				t.Fatalf("%s isn't castling", tt.move)
+			}
+
+			if got := pos.Play(m).String(); got != tt.want {
+				t.Errorf("castling gave %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSetupPosition(t *testing.T) {
+	tests := []struct {
+		name  string
+		fen   string
+		valid bool
+	}{
+		{"king and pawn", "4k3/8/8/8/8/8/4P3/4K3 w - - 0 1", true},
+		{"en passant", "4k3/8/8/8/4P3/8/8/4K3 b - e3 0 1", true},
+		{"castling", "r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1", true},
+		{"two kings", "4k3/8/8/8/8/8/4P3/3KK3 w - - 0 1", false},
+		{"no king", "4k3/8/8/8/8/8/4P3/8 w - - 0 1", false},
+		{"pawn on the back rank", "4k2P/8/8/8/8/8/8/4K3 w - - 0 1", false},
+		{"the side not to move is in check", "4k3/8/8/8/8/8/8/4R1K1 w - - 0 1", false},
+		{"en passant square taken", "4k3/8/8/8/8/4P3/8/4K3 b - e3 0 1", false},
+		{"en passant without a pawn", "4k3/8/8/8/8/8/8/4K2R b - e3 0 1", false},
+		{"castling with the king off its square", "4k3/8/8/8/8/8/8/R4K1R w KQ - 0 1", false},
+		{"checkmate", "k7/1Q6/1K6/8/8/8/8/8 b - - 0 1", false},
+		{"stalemate", "k7/8/1QK5/8/8/8/8/8 b - - 0 1", false},
+		{"bare kings", "4k3/8/8/8/8/8/8/4K3 w - - 0 1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pos, err := ParseFEN(tt.fen)
+			if err == nil {
+				err = ValidateSetupPosition(pos)
+			}
+
+			if (err == nil) != tt.valid {
+				t.Errorf("got %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
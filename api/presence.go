@@ -0,0 +1,256 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pjebs/jsonerror"
+	"gorm.io/gorm"
+)
+
+const (
+	PresenceOffline = "offline"
+	PresenceOnline  = "online"
+	PresenceIdle    = "idle"
+	PresencePlaying = "playing"
+
+	// Connected players who send nothing for idleAfter are idle
+	idleAfter    = 5 * time.Minute
+	presenceTick = 15 * time.Second
+
+	maxPresencePlayers = 100
+)
+
+// Presence is whether a player is connected and what they are doing, kept so offline players show when they were last seen
+type Presence struct {
+	Player    string    `gorm:"primaryKey" json:"player"`
+	UpdatedAt time.Time `json:"-"`
+	Status    string    `gorm:"not null;default:offline" json:"status"`
+	// LastSeen is when the player last connected or sent a message
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type PresenceService struct {
+	db *gorm.DB
+	gs *GameService
+	// presences are the players known not to be offline, guarded by the game service lock
+	presences map[string]*Presence
+}
+
+func NewPresenceService(db *gorm.DB, gs *GameService) *PresenceService {
+	if err := db.AutoMigrate(&Presence{}); err != nil {
+		panic(err)
+	}
+
+	// Nobody is connected to a server that has just started
+	if err := db.Model(&Presence{}).Where("status <> ?", PresenceOffline).Update("status", PresenceOffline).Error; err != nil {
+		log.Println(err)
+	}
+
+	service := &PresenceService{db, gs, make(map[string]*Presence)}
+	gs.AddListener(service)
+	gs.AddStreamListener(service)
+	go service.scheduler()
+
+	http.HandleFunc("/presence", service.GetPresence)
+
+	return service
+}
+
+type PresenceResponse struct {
+	Successful bool              `json:"success"`
+	Presence   []*Presence       `json:"presence"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+// status Works out what a player is doing from their stream, the lock must be held
+func (ps *PresenceService) status(uuid string, now time.Time) string {
+	ds := ps.gs.streams[uuid]
+	switch {
+	case ds == nil:
+		return PresenceOffline
+	case ds.liveGames() > 0:
+		return PresencePlaying
+	case now.Sub(ds.lastActive) >= idleAfter:
+		return PresenceIdle
+	default:
+		return PresenceOnline
+	}
+}
+
+// update Records the player's presence and tells their friends and followers when it changed, the lock must be held
+func (ps *PresenceService) update(uuid string, now time.Time) {
+	presence := ps.presences[uuid]
+	if presence == nil {
+		presence = &Presence{Player: uuid, Status: PresenceOffline}
+	}
+
+	if ds := ps.gs.streams[uuid]; ds != nil {
+		presence.LastSeen = ds.lastActive
+	}
+
+	status := ps.status(uuid, now)
+	if status == presence.Status {
+		return
+	}
+
+	presence.Status = status
+	if status == PresenceOffline {
+		presence.LastSeen = now
+		delete(ps.presences, uuid)
+	} else {
+		ps.presences[uuid] = presence
+	}
+
+	if err := ps.db.Save(presence).Error; err != nil {
+		log.Println(err)
+	}
+
+	audience, err := friendsAndFollowers(ps.db, uuid)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// The cached presence keeps changing after the event is queued
+	event := *presence
+	for _, player := range audience {
+		ps.gs.send(player, &broadcastMessage{Type: "presence", Payload: &event})
+	}
+}
+
+func (ps *PresenceService) StreamOpened(uuid string) {
+	ps.update(uuid, time.Now())
+}
+
+func (ps *PresenceService) StreamClosed(uuid string) {
+	ps.update(uuid, time.Now())
+}
+
+// GameStarted Marks both players of a live game as playing
+func (ps *PresenceService) GameStarted(game *Game) {
+	now := time.Now()
+	ps.update(game.PlayerWhite, now)
+	ps.update(game.PlayerBlack, now)
+}
+
+// GameMoved Keeps the presence of both players up to date, their games may have been tracked before they connected
+func (ps *PresenceService) GameMoved(game *Game) {
+	now := time.Now()
+	ps.update(game.PlayerWhite, now)
+	ps.update(game.PlayerBlack, now)
+}
+
+// GameEnded Marks both players as no longer playing once their last live game is over
+func (ps *PresenceService) GameEnded(game *Game) {
+	now := time.Now()
+	ps.update(game.PlayerWhite, now)
+	ps.update(game.PlayerBlack, now)
+}
+
+// scheduler Catches players going idle
+func (ps *PresenceService) scheduler() {
+	for range time.Tick(presenceTick) {
+		now := time.Now()
+
+		ps.gs.mu.Lock()
+		for uuid := range ps.gs.streams {
+			ps.update(uuid, now)
+		}
+		ps.gs.mu.Unlock()
+	}
+}
+
+// watched Keeps the players whose presence the viewer may see: themselves, their friends and the players they
+// follow, unless either blocked the other
+func watched(db *gorm.DB, viewer string, players []string) ([]string, error) {
+	var friends []*Friendship
+	if err := db.Where("((player = ? AND friend IN ?) OR (friend = ? AND player IN ?)) AND status = ?", viewer, players, viewer, players, FriendAccepted).Find(&friends).Error; err != nil {
+		return nil, err
+	}
+
+	var followed []string
+	if err := db.Model(&Follow{}).Where("player = ? AND followed IN ?", viewer, players).Pluck("followed", &followed).Error; err != nil {
+		return nil, err
+	}
+
+	allowed := map[string]bool{viewer: true}
+	for _, player := range followed {
+		allowed[player] = true
+	}
+	for _, friendship := range friends {
+		allowed[friendship.Player] = true
+		allowed[friendship.Friend] = true
+	}
+
+	visible := make([]string, 0, len(players))
+	for _, player := range players {
+		if allowed[player] && (player == viewer || !blocked(db, viewer, player)) {
+			visible = append(visible, player)
+		}
+	}
+
+	return visible, nil
+}
+
+// GetPresence Gives the presence of the players in the comma separated players query parameter that the user
+// may see, leaving out the others
+func (ps *PresenceService) GetPresence(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodGet {
+		return
+	}
+
+	user, userErr := ps.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	var players []string
+	for _, player := range strings.Split(r.URL.Query().Get("players"), ",") {
+		if player = strings.TrimSpace(player); player != "" {
+			players = append(players, player)
+		}
+	}
+
+	if len(players) == 0 || len(players) > maxPresencePlayers {
+		RenderJSONResponse(w, http.StatusBadRequest, &PresenceResponse{Error: jsonerror.New(150, "Invalid presence request", "Ask for between 1 and 100 players").Render()})
+		return
+	}
+
+	players, err := watched(ps.db, user.UUID.String(), players)
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &PresenceResponse{Error: jsonerror.New(28, "Internal server error", "Error loading presence").Render()})
+		return
+	}
+
+	var stored []*Presence
+	if err := ps.db.Where("player IN ?", players).Find(&stored).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &PresenceResponse{Error: jsonerror.New(28, "Internal server error", "Error loading presence").Render()})
+		return
+	}
+
+	lastSeen := make(map[string]time.Time)
+	for _, presence := range stored {
+		lastSeen[presence.Player] = presence.LastSeen
+	}
+
+	response := &PresenceResponse{Successful: true, Presence: make([]*Presence, len(players))}
+	ps.gs.mu.Lock()
+	for i, player := range players {
+		if presence := ps.presences[player]; presence != nil {
+			response.Presence[i] = &Presence{Player: player, Status: presence.Status, LastSeen: presence.LastSeen}
+		} else {
+			response.Presence[i] = &Presence{Player: player, Status: PresenceOffline, LastSeen: lastSeen[player]}
+		}
+	}
+	ps.gs.mu.Unlock()
+
+	RenderJSONResponse(w, http.StatusOK, response)
+}
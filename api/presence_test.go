@@ -0,0 +1,36 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestWatched(t *testing.T) {
+	db := newTestDB(t, &Friendship{}, &Follow{}, &Block{})
+
+	rows := []interface{}{
+		&Friendship{Player: "viewer", Friend: "friend", Status: FriendAccepted},
+		&Friendship{Player: "asked", Friend: "viewer", Status: FriendRequested},
+		&Friendship{Player: "blocker", Friend: "viewer", Status: FriendAccepted},
+		&Follow{Player: "viewer", Followed: "followed"},
+		&Follow{Player: "follower", Followed: "viewer"},
+		&Follow{Player: "viewer", Followed: "blocked"},
+		&Block{Player: "blocker", Blocked: "viewer"},
+		&Block{Player: "viewer", Blocked: "blocked"},
+	}
+	for _, row := range rows {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	players := []string{"viewer", "friend", "asked", "blocker", "followed", "follower", "blocked", "stranger"}
+	got, err := watched(db, "viewer", players)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"viewer", "friend", "followed"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
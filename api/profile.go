@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	maxNameLength        = 50
+	maxDisplayNameLength = 30
+	maxBioLength         = 500
+	maxAvatarLength      = 500
+
+	emailChangeLifetime = 24 * time.Hour
+)
+
+var errEmailTaken = errors.New("email taken")
+
+// Profile is what a user tells other players about themselves, besides their name
+type Profile struct {
+	UserUUID    uuid.UUID `gorm:"primaryKey;type:uuid" json:"-"`
+	UpdatedAt   time.Time `json:"-"`
+	DisplayName string    `json:"display_name"`
+	Bio         string    `json:"bio"`
+	// Country is an ISO 3166-1 alpha-2 code and Avatar the URL of a picture
+	Country string `json:"country"`
+	Avatar  string `json:"avatar"`
+}
+
+// EmailChange is a new email waiting to be confirmed from its own inbox, only the hash of its token is kept
+type EmailChange struct {
+	Hash      string    `gorm:"primaryKey"`
+	UserUUID  uuid.UUID `gorm:"not null;index;type:uuid"`
+	Email     string    `gorm:"not null"`
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+// ProfileView is a user's profile as shown to them, or without the email to anyone else
+type ProfileView struct {
+	UUID      string    `json:"uuid"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Email     string    `json:"email,omitempty"`
+	ELO       int       `json:"elo"`
+	CreatedAt time.Time `json:"created_at"`
+	*Profile
+}
+
+type ProfileResponse struct {
+	Successful bool              `json:"success"`
+	Profile    *ProfileView      `json:"profile,omitempty"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+// UpdateProfileRequest changes only the fields that are given
+type UpdateProfileRequest struct {
+	FirstName   *string `json:"first_name"`
+	LastName    *string `json:"last_name"`
+	DisplayName *string `json:"display_name"`
+	Bio         *string `json:"bio"`
+	Country     *string `json:"country"`
+	Avatar      *string `json:"avatar"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	Password        string `json:"password"`
+}
+
+type ChangeEmailRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+func profileError(code int, error, message string) *ProfileResponse {
+	return &ProfileResponse{Error: NewUserError(code, error, message).Error}
+}
+
+// loadProfile Gives the user's profile, which is empty until they first edit it
+func (service *UserService) loadProfile(user *User) (*ProfileView, error) {
+	profile := &Profile{UserUUID: user.UUID}
+	if err := service.db.Where("user_uuid = ?", user.UUID).Limit(1).Find(profile).Error; err != nil {
+		return nil, err
+	}
+
+	return &ProfileView{
+		UUID:      user.UUID.String(),
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Email:     user.Email,
+		ELO:       user.ELO,
+		CreatedAt: user.CreatedAt,
+		Profile:   profile,
+	}, nil
+}
+
+// HandleProfile Gives the user's own profile on GET and edits it on POST
+func (service *UserService) HandleProfile(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		return
+	}
+
+	// Apps may read the profile but not edit it
+	var scopes []string
+	if r.Method == http.MethodGet {
+		scopes = []string{ScopeProfileRead}
+	}
+
+	user, userErr := service.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"), scopes...)
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		request := &UpdateProfileRequest{}
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			RenderJSONResponse(w, http.StatusBadRequest, profileError(1, "Invalid JSON request", err.Error()))
+			return
+		}
+
+		if errResponse := service.updateProfile(user, request); errResponse != nil {
+			RenderJSONResponse(w, http.StatusBadRequest, errResponse)
+			return
+		}
+	}
+
+	view, err := service.loadProfile(user)
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, profileError(28, "Internal server error", "Error loading profile"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &ProfileResponse{Successful: true, Profile: view})
+}
+
+// updateProfile Checks and saves the fields of the request that were given
+func (service *UserService) updateProfile(user *User, request *UpdateProfileRequest) *ProfileResponse {
+	view, err := service.loadProfile(user)
+	if err != nil {
+		log.Println(err)
+		return profileError(28, "Internal server error", "Error loading profile")
+	}
+	profile := view.Profile
+
+	invalid := func(message string) *ProfileResponse {
+		return profileError(24, "Invalid profile", message)
+	}
+
+	if request.FirstName != nil {
+		if user.FirstName = strings.TrimSpace(*request.FirstName); user.FirstName == "" || utf8.RuneCountInString(user.FirstName) > maxNameLength {
+			return invalid(fmt.Sprintf("The first name must have between 1 and %d characters", maxNameLength))
+		}
+	}
+
+	if request.LastName != nil {
+		if user.LastName = strings.TrimSpace(*request.LastName); user.LastName == "" || utf8.RuneCountInString(user.LastName) > maxNameLength {
+			return invalid(fmt.Sprintf("The last name must have between 1 and %d characters", maxNameLength))
+		}
+	}
+
+	if request.DisplayName != nil {
+		if profile.DisplayName = strings.TrimSpace(*request.DisplayName); utf8.RuneCountInString(profile.DisplayName) > maxDisplayNameLength {
+			return invalid(fmt.Sprintf("The display name can have at most %d characters", maxDisplayNameLength))
+		}
+	}
+
+	if request.Bio != nil {
+		if profile.Bio = strings.TrimSpace(*request.Bio); utf8.RuneCountInString(profile.Bio) > maxBioLength {
+			return invalid(fmt.Sprintf("The bio can have at most %d characters", maxBioLength))
+		}
+	}
+
+	if request.Country != nil {
+		if profile.Country = strings.ToUpper(strings.TrimSpace(*request.Country)); !validCountry(profile.Country) {
+			return invalid("The country must be a two letter ISO 3166-1 code")
+		}
+	}
+
+	if request.Avatar != nil {
+		if profile.Avatar = strings.TrimSpace(*request.Avatar); !validAvatar(profile.Avatar) {
+			return invalid(fmt.Sprintf("The avatar must be an https URL of at most %d characters", maxAvatarLength))
+		}
+	}
+
+	err = service.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Updates(map[string]interface{}{"first_name": user.FirstName, "last_name": user.LastName}).Error; err != nil {
+			return err
+		}
+
+		return tx.Save(profile).Error
+	})
+	if err != nil {
+		log.Println(err)
+		return profileError(28, "Internal server error", "Error saving profile")
+	}
+
+	return nil
+}
+
+// validCountry Reports whether the country is empty or looks like an ISO 3166-1 alpha-2 code
+func validCountry(country string) bool {
+	if country == "" {
+		return true
+	}
+
+	return len(country) == 2 && country[0] >= 'A' && country[0] <= 'Z' && country[1] >= 'A' && country[1] <= 'Z'
+}
+
+// validAvatar Reports whether the avatar is empty or an https URL
+func validAvatar(avatar string) bool {
+	if avatar == "" {
+		return true
+	}
+
+	parsed, err := url.Parse(avatar)
+	return err == nil && parsed.Scheme == "https" && parsed.Host != "" && len(avatar) <= maxAvatarLength
+}
+
+// PublicProfile Gives anyone the profile of a player, without their email
+func (service *UserService) PublicProfile(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodGet {
+		return
+	}
+
+	user := &User{}
+	if service.db.First(user, "uuid = ?", r.PathValue("uuid")).RowsAffected == 0 {
+		RenderJSONResponse(w, http.StatusNotFound, profileError(26, "Player not found", "No player with given UUID: "+r.PathValue("uuid")))
+		return
+	}
+
+	view, err := service.loadProfile(user)
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, profileError(28, "Internal server error", "Error loading profile"))
+		return
+	}
+	view.Email = ""
+
+	RenderJSONResponse(w, http.StatusOK, &ProfileResponse{Successful: true, Profile: view})
+}
+
+// ChangePassword Sets a new password once the current one is confirmed, logging out every other session
+func (service *UserService) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodPost {
+		return
+	}
+
+	user, sessionID, userErr := service.AuthenticateSession(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	request := &ChangePasswordRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, NewUserError(1, "Invalid JSON request", err.Error()))
+		return
+	}
+
+	if userErr := service.confirmIdentity(user, sessionID, request.CurrentPassword); userErr != nil {
+		RenderJSONResponse(w, http.StatusForbidden, userErr)
+		return
+	}
+
+	if utf8.RuneCountInString(request.Password) < minPasswordLength {
+		RenderJSONResponse(w, http.StatusBadRequest, NewUserError(23, "Password too short", fmt.Sprintf("The password must have at least %d characters", minPasswordLength)))
+		return
+	}
+
+	if err := service.db.Model(user).Update("password", HashPassword(request.Password, user.UUID.String())).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, NewUserError(28, "Internal server error", "Error changing password"))
+		return
+	}
+
+	if err := service.RevokeSessions(user.UUID, sessionID, time.Now()); err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, NewUserError(28, "Internal server error", "Your password was changed but not every session could be ended"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &NewUserResponse{Successful: true})
+}
+
+// ChangeEmail Sends a link to the new email once the password is confirmed, the email only changes when the
+// link is opened
+func (service *UserService) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodPost {
+		return
+	}
+
+	user, sessionID, userErr := service.AuthenticateSession(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	request := &ChangeEmailRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, NewUserError(1, "Invalid JSON request", err.Error()))
+		return
+	}
+
+	if userErr := service.confirmIdentity(user, sessionID, request.Password); userErr != nil {
+		RenderJSONResponse(w, http.StatusForbidden, userErr)
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(request.Email))
+	if _, err := mail.ParseAddress(email); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, NewUserError(32, "Invalid email", err.Error()))
+		return
+	}
+
+	if service.EmailExists(email) {
+		RenderJSONResponse(w, http.StatusConflict, NewUserError(33, "Account already exists with email", "Account already exists with email: "+email))
+		return
+	}
+
+	token, err := GenerateVerificationToken()
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, NewUserError(28, "Internal server error", "Error creating link"))
+		return
+	}
+
+	// Only the latest change asked for can be confirmed
+	err = service.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_uuid = ?", user.UUID).Delete(&EmailChange{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&EmailChange{Hash: hashToken(token), UserUUID: user.UUID, Email: email, ExpiresAt: time.Now().Add(emailChangeLifetime)}).Error
+	})
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, NewUserError(28, "Internal server error", "Error saving email change"))
+		return
+	}
+
+	data := map[string]string{
+		"Name": user.FirstName,
+		"Link": fmt.Sprintf("https://%s/email/verify?token=%s", r.Host, token),
+	}
+
+	go func() {
+		if err := service.SendEmail(email, "Confirm your new email", "change-email.tmpl", data); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	RenderJSONResponse(w, http.StatusOK, &NewUserResponse{Successful: true})
+}
+
+// VerifyEmailChange Switches the user to their new email when they open the link sent to it
+func (service *UserService) VerifyEmailChange(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodGet {
+		return
+	}
+
+	change := &EmailChange{}
+	user := &User{}
+	if service.db.First(change, "hash = ?", hashToken(r.URL.Query().Get("token"))).RowsAffected == 0 || service.db.First(user, "uuid = ?", change.UserUUID).RowsAffected == 0 {
+		RenderErrorTemplate(w, "email-changed", map[string]string{"Error": "we couldn't find your link in our database."})
+		return
+	}
+
+	if time.Now().After(change.ExpiresAt) {
+		RenderErrorTemplate(w, "email-changed", map[string]string{"Name": user.FirstName, "Error": "too much time has passed since the email was sent."})
+		return
+	}
+
+	err := service.db.Transaction(func(tx *gorm.DB) error {
+		if tx.First(&User{}, "email = ?", change.Email).RowsAffected > 0 {
+			return errEmailTaken
+		}
+
+		if err := tx.Model(user).Update("email", change.Email).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("user_uuid = ?", user.UUID).Delete(&EmailChange{}).Error
+	})
+	if errors.Is(err, errEmailTaken) {
+		RenderErrorTemplate(w, "email-changed", map[string]string{"Name": user.FirstName, "Error": "an account with this email already exists."})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		ShowError(w)
+		return
+	}
+
+	RenderErrorTemplate(w, "email-changed", map[string]string{"Name": user.FirstName, "Email": change.Email})
+}
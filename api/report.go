@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pjebs/jsonerror"
+)
+
+const (
+	ReportOpen     = "open"
+	ReportResolved = "resolved"
+
+	maxReportLength = 500
+)
+
+// Report is a complaint about a player's behaviour in a game, which lets moderators read the game's chat
+type Report struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	GameID     uint      `gorm:"not null;index" json:"game_id"`
+	Reporter   string    `gorm:"not null" json:"reporter"`
+	Reported   string    `gorm:"not null;index" json:"reported"`
+	Reason     string    `gorm:"not null" json:"reason"`
+	Status     string    `gorm:"not null;default:open" json:"status"`
+	ResolvedBy string    `json:"resolved_by,omitempty"`
+	// Chat is every message said in the game, only shown to moderators
+	Chat []*ChatMessage `gorm:"-" json:"chat,omitempty"`
+}
+
+type NewReportRequest struct {
+	GameID uint   `json:"game_id"`
+	Player string `json:"player"`
+	Reason string `json:"reason"`
+}
+
+// ResolveReportRequest optionally carries a message from the moderator to the reported player
+type ResolveReportRequest struct {
+	Message string `json:"message"`
+}
+
+type ReportResponse struct {
+	Successful bool              `json:"success"`
+	Report     *Report           `json:"report,omitempty"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+type ReportListResponse struct {
+	Successful bool              `json:"success"`
+	Reports    []*Report         `json:"reports"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+func reportError(code int, error, message string) *ReportResponse {
+	return &ReportResponse{Error: jsonerror.New(code, error, message).Render()}
+}
+
+// moderator Reports whether the user is one of the moderators named in MODERATORS
+func (cs *ChatService) moderator(user *User) bool {
+	return cs.moderators[strings.ToLower(user.Email)]
+}
+
+// HandleReports Files a report on POST, and for moderators lists open reports on GET without an id or
+// shows one report with the game's chat log on GET with an id
+func (cs *ChatService) HandleReports(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		return
+	}
+
+	user, userErr := cs.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost:
+		cs.FileReport(w, r, user)
+	case !cs.moderator(user):
+		RenderJSONResponse(w, http.StatusForbidden, reportError(137, "Not a moderator", "Only moderators can read reports"))
+	case r.URL.Query().Get("id") != "":
+		cs.ShowReport(w, r)
+	default:
+		cs.ListReports(w, r)
+	}
+}
+
+// FileReport Reports a player of a game, or someone who talked in its chat
+func (cs *ChatService) FileReport(w http.ResponseWriter, r *http.Request, user *User) {
+	request := &NewReportRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, reportError(1, "Invalid JSON request", err.Error()))
+		return
+	}
+
+	request.Reason = strings.TrimSpace(request.Reason)
+	if request.Reason == "" || utf8.RuneCountInString(request.Reason) > maxReportLength {
+		RenderJSONResponse(w, http.StatusBadRequest, reportError(136, "Invalid report", fmt.Sprintf("The reason must have between 1 and %d characters", maxReportLength)))
+		return
+	}
+
+	if request.Player == user.UUID.String() {
+		RenderJSONResponse(w, http.StatusBadRequest, reportError(136, "Invalid report", "You cannot report yourself"))
+		return
+	}
+
+	game := &Game{}
+	if cs.db.First(game, request.GameID).RowsAffected == 0 {
+		RenderJSONResponse(w, http.StatusNotFound, reportError(61, "Game does not exist with given ID.", fmt.Sprintf("Game does not exist with given ID: %d", request.GameID)))
+		return
+	}
+
+	if game.getColor(request.Player) == NoColor && cs.db.Where("game_id = ? AND player = ?", game.ID, request.Player).First(&ChatMessage{}).RowsAffected == 0 {
+		RenderJSONResponse(w, http.StatusBadRequest, reportError(136, "Invalid report", "The player neither played nor talked in this game"))
+		return
+	}
+
+	report := &Report{GameID: game.ID, Reporter: user.UUID.String(), Reported: request.Player, Reason: request.Reason, Status: ReportOpen}
+	if err := cs.db.Create(report).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, reportError(28, "Internal server error", "Error saving report"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &ReportResponse{Successful: true, Report: report})
+}
+
+func (cs *ChatService) ListReports(w http.ResponseWriter, r *http.Request) {
+	var reports []*Report
+	if err := cs.db.Where("status = ?", ReportOpen).Order("created_at").Find(&reports).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &ReportListResponse{Error: jsonerror.New(28, "Internal server error", "Error loading reports").Render()})
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &ReportListResponse{Successful: true, Reports: reports})
+}
+
+// ShowReport Gives a report with the chat of its game, in both rooms and unfiltered
+func (cs *ChatService) ShowReport(w http.ResponseWriter, r *http.Request) {
+	report, errResponse, status := cs.findReport(r.URL.Query().Get("id"))
+	if errResponse != nil {
+		RenderJSONResponse(w, status, errResponse)
+		return
+	}
+
+	if err := cs.db.Where("game_id = ?", report.GameID).Order("created_at").Find(&report.Chat).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, reportError(28, "Internal server error", "Error loading chat"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &ReportResponse{Successful: true, Report: report})
+}
+
+// findReport Loads a report by its id
+func (cs *ChatService) findReport(rawID string) (*Report, *ReportResponse, int) {
+	id, err := strconv.ParseUint(rawID, 10, 64)
+	if err != nil {
+		return nil, reportError(138, "Report not found", "Invalid report id: "+rawID), http.StatusBadRequest
+	}
+
+	report := &Report{}
+	if cs.db.First(report, id).RowsAffected == 0 {
+		return nil, reportError(138, "Report not found", fmt.Sprintf("Report does not exist with given ID: %d", id)), http.StatusNotFound
+	}
+
+	return report, nil, http.StatusOK
+}
+
+// ResolveReport Closes a report once a moderator has dealt with it, telling the reporter and passing any
+// message from the moderator on to the reported player
+func (cs *ChatService) ResolveReport(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodPost {
+		return
+	}
+
+	user, userErr := cs.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	if !cs.moderator(user) {
+		RenderJSONResponse(w, http.StatusForbidden, reportError(137, "Not a moderator", "Only moderators can resolve reports"))
+		return
+	}
+
+	report, errResponse, status := cs.findReport(r.URL.Query().Get("id"))
+	if errResponse != nil {
+		RenderJSONResponse(w, status, errResponse)
+		return
+	}
+
+	request := &ResolveReportRequest{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			RenderJSONResponse(w, http.StatusBadRequest, reportError(1, "Invalid JSON request", err.Error()))
+			return
+		}
+	}
+
+	report.Status = ReportResolved
+	report.ResolvedBy = user.UUID.String()
+	if err := cs.db.Save(report).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, reportError(28, "Internal server error", "Error saving report"))
+		return
+	}
+
+	cs.gs.mu.Lock()
+	cs.gs.notify(&Notification{Player: report.Reporter, Kind: NotifyModeration, Text: "A moderator has dealt with your report, thank you", GameID: report.GameID})
+	if message := strings.TrimSpace(request.Message); message != "" {
+		cs.gs.notify(&Notification{Player: report.Reported, Kind: NotifyModeration, Text: message, GameID: report.GameID})
+	}
+	cs.gs.mu.Unlock()
+
+	RenderJSONResponse(w, http.StatusOK, &ReportResponse{Successful: true, Report: report})
+}
@@ -0,0 +1,628 @@
+package main
+
+// standardVariant is the normal rules of chess, other variants embed it and override what they change
+type standardVariant struct{}
+
+func (standardVariant) Name() string {
+	return VariantStandard
+}
+
+func (standardVariant) PGNName() string {
+	return "Standard"
+}
+
+func (standardVariant) StartingPosition() *Position {
+	return StartingPosition()
+}
+
+func (standardVariant) LegalMoves(pos *Position) []*Move {
+	return royalLegalMoves(pos, pos.pseudoLegalMoves(promotionPieces, pos.attackedBy(pos.turn.Other())), pos.Update)
+}
+
+func (standardVariant) Play(pos *Position, m *Move) *Position {
+	return pos.Update(m)
+}
+
+func (standardVariant) InCheck(pos *Position) bool {
+	return pos.kingAttacked(pos.turn)
+}
+
+func (standardVariant) Result(pos *Position, legal []*Move) (Outcome, Method) {
+	if outcome, method := mateOrStalemate(pos, legal); outcome != NoOutcome {
+		return outcome, method
+	}
+
+	if pos.hasInsufficientMaterial() {
+		return Draw, InsufficientMaterial
+	}
+
+	return NoOutcome, NoMethod
+}
+
+// royalLegalMoves keeps the moves that do not leave the mover's king attacked
+func royalLegalMoves(pos *Position, pseudo []*Move, play func(m *Move) *Position) []*Move {
+	moves := make([]*Move, 0, len(pseudo))
+	for _, m := range pseudo {
+		if !play(m).kingAttacked(pos.turn) {
+			moves = append(moves, m)
+		}
+	}
+
+	return moves
+}
+
+// mateOrStalemate ends the game when the side to move has no legal moves
+func mateOrStalemate(pos *Position, legal []*Move) (Outcome, Method) {
+	if len(legal) > 0 {
+		return NoOutcome, NoMethod
+	}
+
+	if pos.InCheck() {
+		return winnerOutcome(pos.turn.Other()), Checkmate
+	}
+
+	return Draw, Stalemate
+}
+
+// variantPosition parses a FEN known to be valid for the variant
+func variantPosition(variant Variant, fen string) *Position {
+	pos, err := ParseVariantFEN(variant, fen)
+	if err != nil {
+		panic(err)
+	}
+
+	return pos
+}
+
+// onlyKings reports whether every piece on the board is a king
+func (pos *Position) onlyKings() bool {
+	for sq := Square(0); sq < 64; sq++ {
+		if pt := pos.board[sq].Type; pt != NoPieceType && pt != King {
+			return false
+		}
+	}
+
+	return true
+}
+
+// kingOfTheHillVariant is won by checkmate or by bringing the king to one of the four centre squares
+type kingOfTheHillVariant struct {
+	standardVariant
+}
+
+func (kingOfTheHillVariant) Name() string {
+	return VariantKingOfTheHill
+}
+
+func (kingOfTheHillVariant) PGNName() string {
+	return "King of the Hill"
+}
+
+func (v kingOfTheHillVariant) StartingPosition() *Position {
+	return variantPosition(v, StartingFEN)
+}
+
+func (v kingOfTheHillVariant) LegalMoves(pos *Position) []*Move {
+	if v.kingOnHill(pos) != NoColor {
+		return nil
+	}
+
+	return v.standardVariant.LegalMoves(pos)
+}
+
+func (v kingOfTheHillVariant) Result(pos *Position, legal []*Move) (Outcome, Method) {
+	if color := v.kingOnHill(pos); color != NoColor {
+		return winnerOutcome(color), KingOfTheHill
+	}
+
+	// A lone king can still walk to the hill, so material is never insufficient
+	return mateOrStalemate(pos, legal)
+}
+
+// kingOnHill returns the color whose king stands on d4, e4, d5 or e5
+func (kingOfTheHillVariant) kingOnHill(pos *Position) Color {
+	for _, sq := range []Square{NewSquare(3, 3), NewSquare(4, 3), NewSquare(3, 4), NewSquare(4, 4)} {
+		if p := pos.board[sq]; p.Type == King {
+			return p.Color
+		}
+	}
+
+	return NoColor
+}
+
+const threeCheckLimit = 3
+
+// threeCheckVariant is won by checkmate or by giving check three times
+type threeCheckVariant struct {
+	standardVariant
+}
+
+func (threeCheckVariant) Name() string {
+	return VariantThreeCheck
+}
+
+func (threeCheckVariant) PGNName() string {
+	return "Three-check"
+}
+
+func (v threeCheckVariant) StartingPosition() *Position {
+	return variantPosition(v, StartingFEN)
+}
+
+func (v threeCheckVariant) LegalMoves(pos *Position) []*Move {
+	if v.checkWinner(pos) != NoColor {
+		return nil
+	}
+
+	return v.standardVariant.LegalMoves(pos)
+}
+
+func (threeCheckVariant) Play(pos *Position, m *Move) *Position {
+	next := pos.Update(m)
+	if next.kingAttacked(next.turn) {
+		next.checks[pos.turn]++
+	}
+
+	return next
+}
+
+func (v threeCheckVariant) Result(pos *Position, legal []*Move) (Outcome, Method) {
+	if color := v.checkWinner(pos); color != NoColor {
+		return winnerOutcome(color), ThreeChecks
+	}
+
+	if outcome, method := mateOrStalemate(pos, legal); outcome != NoOutcome {
+		return outcome, method
+	}
+
+	// Any piece can still give checks, only bare kings cannot
+	if pos.onlyKings() {
+		return Draw, InsufficientMaterial
+	}
+
+	return NoOutcome, NoMethod
+}
+
+func (threeCheckVariant) checkWinner(pos *Position) Color {
+	for _, color := range []Color{White, Black} {
+		if pos.checks[color] >= threeCheckLimit {
+			return color
+		}
+	}
+
+	return NoColor
+}
+
+// antichessVariant is won by losing every piece or being stalemated. Captures are compulsory,
+// the king is an ordinary piece that pawns may also promote to, and there is no castling.
+type antichessVariant struct {
+	standardVariant
+}
+
+var antichessPromotionPieces = []PieceType{Queen, Rook, Bishop, Knight, King}
+
+func (antichessVariant) Name() string {
+	return VariantAntichess
+}
+
+func (antichessVariant) PGNName() string {
+	return "Antichess"
+}
+
+const antichessFEN = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w - - 0 1"
+
+func (v antichessVariant) StartingPosition() *Position {
+	return variantPosition(v, antichessFEN)
+}
+
+func (antichessVariant) LegalMoves(pos *Position) []*Move {
+	moves := pos.pseudoLegalMoves(antichessPromotionPieces, nil)
+
+	captures := make([]*Move, 0, len(moves))
+	for _, m := range moves {
+		if pos.isCapture(m) {
+			captures = append(captures, m)
+		}
+	}
+
+	if len(captures) > 0 {
+		return captures
+	}
+
+	return moves
+}
+
+func (antichessVariant) InCheck(*Position) bool {
+	return false
+}
+
+func (v antichessVariant) Result(pos *Position, legal []*Move) (Outcome, Method) {
+	if pos.countColor(pos.turn) == 0 {
+		return winnerOutcome(pos.turn), AllPiecesLost
+	}
+
+	if len(legal) == 0 {
+		return winnerOutcome(pos.turn), Stalemate
+	}
+
+	if v.bishopsCannotMeet(pos) {
+		return Draw, InsufficientMaterial
+	}
+
+	return NoOutcome, NoMethod
+}
+
+// bishopsCannotMeet reports whether each side only has bishops, all on squares of the opposite colour to
+// the other side's bishops, so neither can ever capture
+func (antichessVariant) bishopsCannotMeet(pos *Position) bool {
+	squareColors := [3]map[int]bool{White: {}, Black: {}}
+	for sq := Square(0); sq < 64; sq++ {
+		p := pos.board[sq]
+		if p == NoPiece {
+			continue
+		}
+		if p.Type != Bishop {
+			return false
+		}
+		squareColors[p.Color][(sq.File()+sq.Rank())%2] = true
+	}
+
+	if len(squareColors[White]) != 1 || len(squareColors[Black]) != 1 {
+		return false
+	}
+
+	for squareColor := range squareColors[White] {
+		return !squareColors[Black][squareColor]
+	}
+
+	return false
+}
+
+// countColor counts the pieces of the color on the board
+func (pos *Position) countColor(color Color) int {
+	count := 0
+	for sq := Square(0); sq < 64; sq++ {
+		if pos.board[sq].Color == color {
+			count++
+		}
+	}
+
+	return count
+}
+
+// atomicVariant makes every capture explode, removing the capturing piece and every piece other
+// than pawns around the capture square. Exploding the opponent's king wins the game.
+type atomicVariant struct {
+	standardVariant
+}
+
+func (atomicVariant) Name() string {
+	return VariantAtomic
+}
+
+func (atomicVariant) PGNName() string {
+	return "Atomic"
+}
+
+func (v atomicVariant) StartingPosition() *Position {
+	return variantPosition(v, StartingFEN)
+}
+
+func (v atomicVariant) LegalMoves(pos *Position) []*Move {
+	us := pos.turn
+	if pos.kingSquare(us) == NoSquare || pos.kingSquare(us.Other()) == NoSquare {
+		return nil
+	}
+
+	// The king may castle next to the opponent's king since it can never be captured there
+	enemyKing := pos.kingSquare(us.Other())
+	unsafe := func(sq Square) bool {
+		return !adjacent(sq, enemyKing) && pos.IsAttacked(sq, us.Other())
+	}
+
+	var moves []*Move
+	for _, m := range pos.pseudoLegalMoves(promotionPieces, unsafe) {
+		next := v.Play(pos, m)
+		switch {
+		case next.kingSquare(us) == NoSquare:
+		case next.kingSquare(us.Other()) == NoSquare:
+			moves = append(moves, m)
+		case !v.kingInCheck(next, us):
+			moves = append(moves, m)
+		}
+	}
+
+	return moves
+}
+
+func (atomicVariant) Play(pos *Position, m *Move) *Position {
+	next := pos.Update(m)
+	if !pos.isCapture(m) {
+		return next
+	}
+
+	next.board[m.To] = NoPiece
+	for _, o := range kingOffsets {
+		if sq := offset(m.To, o[0], o[1]); sq != NoSquare && next.board[sq].Type != Pawn {
+			next.board[sq] = NoPiece
+		}
+	}
+
+	next.clearLostCastlingRights()
+
+	return next
+}
+
+func (v atomicVariant) InCheck(pos *Position) bool {
+	return v.kingInCheck(pos, pos.turn)
+}
+
+// kingInCheck ignores attacks while the kings touch, as capturing the king would explode both of them
+func (atomicVariant) kingInCheck(pos *Position, color Color) bool {
+	king, enemyKing := pos.kingSquare(color), pos.kingSquare(color.Other())
+	if king == NoSquare || (enemyKing != NoSquare && adjacent(king, enemyKing)) {
+		return false
+	}
+
+	return pos.IsAttacked(king, color.Other())
+}
+
+func (atomicVariant) Result(pos *Position, legal []*Move) (Outcome, Method) {
+	for _, color := range []Color{White, Black} {
+		if pos.kingSquare(color) == NoSquare {
+			return winnerOutcome(color.Other()), KingExploded
+		}
+	}
+
+	if outcome, method := mateOrStalemate(pos, legal); outcome != NoOutcome {
+		return outcome, method
+	}
+
+	if pos.onlyKings() {
+		return Draw, InsufficientMaterial
+	}
+
+	return NoOutcome, NoMethod
+}
+
+func adjacent(a, b Square) bool {
+	if a == NoSquare || b == NoSquare || a == b {
+		return false
+	}
+
+	df, dr := a.File()-b.File(), a.Rank()-b.Rank()
+	return df >= -1 && df <= 1 && dr >= -1 && dr <= 1
+}
+
+// hordeVariant pits white's 36 pawns against black's normal army. White has no king and loses
+// once all of its pieces are captured, black must be checkmated as usual.
+type hordeVariant struct {
+	standardVariant
+}
+
+const hordeFEN = "rnbqkbnr/pppppppp/8/1PP2PP1/PPPPPPPP/PPPPPPPP/PPPPPPPP/PPPPPPPP w kq - 0 1"
+
+func (hordeVariant) Name() string {
+	return VariantHorde
+}
+
+func (hordeVariant) PGNName() string {
+	return "Horde"
+}
+
+func (v hordeVariant) StartingPosition() *Position {
+	return variantPosition(v, hordeFEN)
+}
+
+func (v hordeVariant) LegalMoves(pos *Position) []*Move {
+	if pos.countColor(White) == 0 {
+		return nil
+	}
+
+	return v.standardVariant.LegalMoves(pos)
+}
+
+func (hordeVariant) Result(pos *Position, legal []*Move) (Outcome, Method) {
+	if pos.countColor(White) == 0 {
+		return BlackWon, AllPiecesLost
+	}
+
+	return mateOrStalemate(pos, legal)
+}
+
+// racingKingsVariant is a race to bring the king to the eighth rank. Nobody may give check, and if
+// white gets there first black has one move to draw by reaching it too.
+type racingKingsVariant struct {
+	standardVariant
+}
+
+const racingKingsFEN = "8/8/8/8/8/8/krbnNBRK/qrbnNBRQ w - - 0 1"
+
+func (racingKingsVariant) Name() string {
+	return VariantRacingKings
+}
+
+func (racingKingsVariant) PGNName() string {
+	return "Racing Kings"
+}
+
+func (v racingKingsVariant) StartingPosition() *Position {
+	return variantPosition(v, racingKingsFEN)
+}
+
+func (v racingKingsVariant) LegalMoves(pos *Position) []*Move {
+	if v.raceOver(pos) {
+		return nil
+	}
+
+	return v.movesWithoutCheck(pos)
+}
+
+// movesWithoutCheck removes moves that give check from the standard legal moves
+func (racingKingsVariant) movesWithoutCheck(pos *Position) []*Move {
+	var moves []*Move
+	for _, m := range (standardVariant{}).LegalMoves(pos) {
+		if !pos.Update(m).kingAttacked(pos.turn.Other()) {
+			moves = append(moves, m)
+		}
+	}
+
+	return moves
+}
+
+func (v racingKingsVariant) Result(pos *Position, legal []*Move) (Outcome, Method) {
+	if v.raceOver(pos) {
+		white, black := v.kingHome(pos, White), v.kingHome(pos, Black)
+		switch {
+		case white && black:
+			return Draw, BackRankReached
+		case white:
+			return WhiteWon, BackRankReached
+		default:
+			return BlackWon, BackRankReached
+		}
+	}
+
+	return mateOrStalemate(pos, legal)
+}
+
+// raceOver reports whether a king has reached the eighth rank and black cannot answer by also getting there
+func (v racingKingsVariant) raceOver(pos *Position) bool {
+	white, black := v.kingHome(pos, White), v.kingHome(pos, Black)
+	switch {
+	case black:
+		return true
+	case !white:
+		return false
+	case pos.turn == White:
+		return true
+	}
+
+	for _, m := range v.movesWithoutCheck(pos) {
+		if pos.board[m.From].Type == King && m.To.Rank() == 7 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (racingKingsVariant) kingHome(pos *Position, color Color) bool {
+	king := pos.kingSquare(color)
+	return king != NoSquare && king.Rank() == 7
+}
+
+// pocketVariant is implemented by the drop variants, whose positions carry pockets and promoted pieces in their FEN
+type pocketVariant interface {
+	Variant
+	dropsCaptures()
+}
+
+// crazyhouseVariant plays standard chess, except captured pieces change sides and go to the capturer's
+// pocket, from where they can be dropped on any empty square instead of moving
+type crazyhouseVariant struct {
+	standardVariant
+}
+
+const crazyhouseFEN = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR[] w KQkq - 0 1"
+
+func (crazyhouseVariant) dropsCaptures() {}
+
+func (crazyhouseVariant) Name() string {
+	return VariantCrazyhouse
+}
+
+func (crazyhouseVariant) PGNName() string {
+	return "Crazyhouse"
+}
+
+func (v crazyhouseVariant) StartingPosition() *Position {
+	return variantPosition(v, crazyhouseFEN)
+}
+
+func (v crazyhouseVariant) LegalMoves(pos *Position) []*Move {
+	moves := v.standardVariant.LegalMoves(pos)
+
+	// A drop cannot expose the king, so drops only need checking when they must block a check
+	if !pos.kingAttacked(pos.turn) {
+		return append(moves, pos.dropMoves()...)
+	}
+
+	return append(moves, royalLegalMoves(pos, pos.dropMoves(), pos.Update)...)
+}
+
+func (crazyhouseVariant) Play(pos *Position, m *Move) *Position {
+	next := pos.Update(m)
+	if captured := pos.capturedPiece(m); captured != NoPiece {
+		next.pockets[pos.turn][captured.Type]++
+	}
+
+	return next
+}
+
+func (crazyhouseVariant) Result(pos *Position, legal []*Move) (Outcome, Method) {
+	if outcome, method := mateOrStalemate(pos, legal); outcome != NoOutcome {
+		return outcome, method
+	}
+
+	// Any captured piece can come back, so only bare kings with nothing in hand cannot mate
+	if pos.onlyKings() && pos.hasEmptyPockets() {
+		return Draw, InsufficientMaterial
+	}
+
+	return NoOutcome, NoMethod
+}
+
+// bughouseVariant is Crazyhouse on two linked boards played by teams of two. Captured pieces go
+// to the partner's pocket on the other board, which the game service passes on with Board.AddToPocket.
+type bughouseVariant struct {
+	crazyhouseVariant
+}
+
+func (bughouseVariant) Name() string {
+	return VariantBughouse
+}
+
+func (bughouseVariant) PGNName() string {
+	return "Bughouse"
+}
+
+func (v bughouseVariant) StartingPosition() *Position {
+	return variantPosition(v, crazyhouseFEN)
+}
+
+func (bughouseVariant) Play(pos *Position, m *Move) *Position {
+	return pos.Update(m)
+}
+
+func (v bughouseVariant) Result(pos *Position, legal []*Move) (Outcome, Method) {
+	if len(legal) > 0 {
+		return NoOutcome, NoMethod
+	}
+
+	// A player without moves waits for their partner to send a piece unless no drop could ever help,
+	// and a stalemated player simply waits while their clock runs
+	if pos.InCheck() && !v.dropCouldBlock(pos) {
+		return winnerOutcome(pos.turn.Other()), Checkmate
+	}
+
+	return NoOutcome, NoMethod
+}
+
+// dropCouldBlock reports whether a piece dropped on some empty square would end the check
+func (bughouseVariant) dropCouldBlock(pos *Position) bool {
+	for sq := Square(0); sq < 64; sq++ {
+		if pos.board[sq] != NoPiece {
+			continue
+		}
+
+		// The blocker's own moves don't matter, only that it stands in the way
+		blocked := pos.copy()
+		blocked.board[sq] = Piece{Knight, pos.turn}
+		if !blocked.kingAttacked(pos.turn) {
+			return true
+		}
+	}
+
+	return false
+}
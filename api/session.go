@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pjebs/jsonerror"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	refreshCookie        = "refresh_token"
+	accessTokenLifetime  = time.Hour
+	refreshTokenLifetime = 7 * 24 * time.Hour
+	sessionCleanupTick   = time.Hour
+	// recentSignIn is how long after signing in a user without a password can do what otherwise needs it
+	recentSignIn = 10 * time.Minute
+)
+
+var errRefreshTokenReused = errors.New("refresh token reused")
+
+// Session is one login of a user, lasting for as long as its refresh token keeps being rotated
+type Session struct {
+	ID         uuid.UUID    `gorm:"primaryKey;type:uuid" json:"id"`
+	UserUUID   uuid.UUID    `gorm:"not null;index;type:uuid" json:"-"`
+	CreatedAt  time.Time    `json:"created_at"`
+	LastUsedAt time.Time    `json:"last_used_at"`
+	ExpiresAt  time.Time    `gorm:"not null;index" json:"expires_at"`
+	RevokedAt  sql.NullTime `json:"-"`
+	// Device is the user agent that logged in and IP the address it last refreshed from
+	Device string `json:"device"`
+	IP     string `json:"ip"`
+	// ClientID is the OAuth app the session was authorized for and Scopes what it may do, both are empty for
+	// the user's own logins which may do anything
+	ClientID string `gorm:"index" json:"client_id,omitempty"`
+	Scopes   string `json:"scopes,omitempty"`
+	// Current marks the session the listing was asked for with
+	Current bool `gorm:"-" json:"current"`
+}
+
+// RefreshToken is one of the tokens a session has been given, only its hash is kept. Rotated tokens are kept
+// with UsedAt set so that one coming back, which means it was stolen, can end the whole session.
+type RefreshToken struct {
+	Hash      string    `gorm:"primaryKey"`
+	SessionID uuid.UUID `gorm:"not null;index;type:uuid"`
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    sql.NullTime
+	// AccessTokenID is the id of the access token given out with this refresh token
+	AccessTokenID string `gorm:"index"`
+}
+
+// RevokedToken lists an access token that must be turned down before it expires, such as one from a session
+// that was logged out
+type RevokedToken struct {
+	JTI       string    `gorm:"primaryKey"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+// SessionListener is told when a session is revoked, so anything it opened such as an event stream can be closed.
+// Listeners are called without any lock held.
+type SessionListener interface {
+	SessionRevoked(session *Session)
+}
+
+// AddSessionListener Registers a listener to be told about revoked sessions
+func (service *UserService) AddSessionListener(listener SessionListener) {
+	service.sessionListeners = append(service.sessionListeners, listener)
+}
+
+// SessionTokens are the tokens given out on login and on every refresh
+type SessionTokens struct {
+	AccessToken  string
+	Expiry       time.Time
+	RefreshToken string
+}
+
+type RefreshTokenResponse struct {
+	Successful  bool      `json:"success"`
+	AccessToken string    `json:"access_token"`
+	Expiry      time.Time `json:"expiry"`
+	UUID        string    `json:"uuid"`
+}
+
+type SessionsResponse struct {
+	Successful bool              `json:"success"`
+	Sessions   []*Session        `json:"sessions"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+// hashToken Hashes a refresh token for storage, they are random enough not to need a salt
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// clientIP Gives the address a request came from, trusting a proxy's X-Forwarded-For since it is only shown
+// to the user in their list of sessions
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// setRefreshCookie Gives the client its refresh token in a cookie scripts can't read
+func setRefreshCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// StartSession Creates a session for the user on the device making the request, with its first tokens
+func (service *UserService) StartSession(user *User, r *http.Request) (*Session, *SessionTokens, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session := &Session{ID: id, UserUUID: user.UUID, Device: r.UserAgent(), IP: clientIP(r)}
+	tokens, err := service.createSession(user, session)
+
+	return session, tokens, err
+}
+
+// confirmIdentity Checks the password before a change to the account. Users who signed up through an OpenID
+// Connect provider have no password until they set one with a reset link, so instead their session must be one
+// of their own logins, not an app's, started within recentSignIn.
+func (service *UserService) confirmIdentity(user *User, sessionID, password string) *NewUserResponse {
+	if len(user.Password) > 0 {
+		if !bytes.Equal(HashPassword(password, user.UUID.String()), user.Password) {
+			return NewUserError(25, "Wrong password", "The password is wrong")
+		}
+		return nil
+	}
+
+	session := &Session{}
+	if service.db.First(session, "id = ? AND user_uuid = ? AND client_id = ?", sessionID, user.UUID, "").RowsAffected == 0 ||
+		time.Since(session.CreatedAt) > recentSignIn {
+		return NewUserError(46, "Sign in again", fmt.Sprintf("Your account has no password, sign in again in the last %d minutes or set a password with /password/forgot", int(recentSignIn.Minutes())))
+	}
+
+	return nil
+}
+
+// createSession Stores a new session with its first tokens
+func (service *UserService) createSession(user *User, session *Session) (*SessionTokens, error) {
+	now := time.Now()
+	session.LastUsedAt = now
+	session.ExpiresAt = now.Add(refreshTokenLifetime)
+
+	var tokens *SessionTokens
+	err := service.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(session).Error; err != nil {
+			return err
+		}
+
+		var err error
+		tokens, err = service.issueTokens(tx, user, session, now)
+		return err
+	})
+
+	return tokens, err
+}
+
+// issueTokens Signs an access token and stores a new refresh token for the session, keeping the session alive
+// as long as the refresh token
+func (service *UserService) issueTokens(tx *gorm.DB, user *User, session *Session, now time.Time) (*SessionTokens, error) {
+	refreshToken, err := GenerateVerificationToken()
+	if err != nil {
+		return nil, err
+	}
+
+	tokenID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, expiry, err := service.GenerateAccessToken(user, session, tokenID.String())
+	if err != nil {
+		return nil, err
+	}
+
+	session.LastUsedAt = now
+	session.ExpiresAt = now.Add(refreshTokenLifetime)
+	if err := tx.Create(&RefreshToken{Hash: hashToken(refreshToken), SessionID: session.ID, ExpiresAt: session.ExpiresAt, AccessTokenID: tokenID.String()}).Error; err != nil {
+		return nil, err
+	}
+
+	if err := tx.Model(session).Updates(map[string]interface{}{"last_used_at": now, "expires_at": session.ExpiresAt, "ip": session.IP}).Error; err != nil {
+		return nil, err
+	}
+
+	return &SessionTokens{accessToken, expiry, refreshToken}, nil
+}
+
+// RevokeSession Ends a session, none of its refresh tokens can be used again and its access tokens are listed
+// as revoked until they expire
+func (service *UserService) RevokeSession(session *Session, now time.Time) error {
+	err := service.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Session{}).Where("id = ? AND revoked_at IS NULL", session.ID).Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+
+		var live []*RefreshToken
+		if err := tx.Where("session_id = ? AND created_at > ? AND access_token_id <> ''", session.ID, now.Add(-accessTokenLifetime)).Find(&live).Error; err != nil {
+			return err
+		}
+
+		revoked := make([]*RevokedToken, len(live))
+		for i, token := range live {
+			revoked[i] = &RevokedToken{JTI: token.AccessTokenID, ExpiresAt: token.CreatedAt.Add(accessTokenLifetime)}
+		}
+
+		if len(revoked) == 0 {
+			return nil
+		}
+
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&revoked).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	session.RevokedAt = sql.NullTime{Time: now, Valid: true}
+	for _, listener := range service.sessionListeners {
+		listener.SessionRevoked(session)
+	}
+
+	return nil
+}
+
+// RevokeSessions Ends every session and personal token of the user but the one given by except, which may be
+// empty, such as when their password changes
+func (service *UserService) RevokeSessions(user uuid.UUID, except string, now time.Time) error {
+	var sessions []*Session
+	query := service.db.Where("user_uuid = ? AND revoked_at IS NULL", user)
+	if except != "" {
+		query = query.Where("id <> ?", except)
+	}
+
+	if err := query.Find(&sessions).Error; err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if err := service.RevokeSession(session, now); err != nil {
+			return err
+		}
+	}
+
+	return service.revokePersonalTokens(user, except)
+}
+
+// RevokeAppSessions Ends the sessions of every user who authorized the apps, such as when an app is deleted
+func (service *UserService) RevokeAppSessions(clientIDs []string, now time.Time) error {
+	if len(clientIDs) == 0 {
+		return nil
+	}
+
+	var sessions []*Session
+	if err := service.db.Where("client_id IN ? AND revoked_at IS NULL", clientIDs).Find(&sessions).Error; err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if err := service.RevokeSession(session, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RefreshToken Swaps the refresh token in the cookie for a new one and a new access token. Using a refresh
+// token that was already swapped ends its session.
+func (service *UserService) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodPost {
+		return
+	}
+
+	cookie, err := r.Cookie(refreshCookie)
+	if err != nil || cookie.Value == "" {
+		RenderJSONResponse(w, http.StatusUnauthorized, NewUserError(18, "Invalid refresh token", "No refresh token was sent"))
+		return
+	}
+
+	user, session, tokens, userErr, err := service.rotateRefreshToken(cookie.Value, "", r)
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, NewUserError(28, "Internal server error", "Error rotating refresh token"))
+		return
+	}
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	setRefreshCookie(w, r, tokens.RefreshToken, session.ExpiresAt)
+	RenderJSONResponse(w, http.StatusOK, &RefreshTokenResponse{true, tokens.AccessToken, tokens.Expiry, user.UUID.String()})
+}
+
+// rotateRefreshToken Swaps a refresh token of a session authorized for the OAuth app clientID, empty for the
+// user's own logins, for a new one and a new access token. A token that can't be swapped gives the reason why.
+func (service *UserService) rotateRefreshToken(token, clientID string, r *http.Request) (*User, *Session, *SessionTokens, *NewUserResponse, error) {
+	now := time.Now()
+	stored := &RefreshToken{}
+	if service.db.First(stored, "hash = ?", hashToken(token)).RowsAffected == 0 {
+		return nil, nil, nil, NewUserError(18, "Invalid refresh token", "Refresh token not found. Please login again."), nil
+	}
+
+	session := &Session{}
+	if service.db.First(session, "id = ?", stored.SessionID).RowsAffected == 0 || session.RevokedAt.Valid || session.ClientID != clientID {
+		return nil, nil, nil, NewUserError(18, "Invalid refresh token", "This session has ended. Please login again."), nil
+	}
+
+	if stored.UsedAt.Valid {
+		return nil, nil, nil, service.reuseDetected(session, now), nil
+	}
+
+	if now.After(stored.ExpiresAt) {
+		return nil, nil, nil, NewUserError(19, "Refresh token is expired", "Refresh token is expired. Please login again."), nil
+	}
+
+	user := &User{}
+	if service.db.First(user, "uuid = ?", session.UserUUID).RowsAffected == 0 {
+		return nil, nil, nil, NewUserError(17, "User not found.", "The user of this session no longer exists."), nil
+	}
+
+	var tokens *SessionTokens
+	err := service.db.Transaction(func(tx *gorm.DB) error {
+		// Two requests racing with the same token can't both rotate it, the second one counts as reuse
+		result := tx.Model(&RefreshToken{}).Where("hash = ? AND used_at IS NULL", stored.Hash).Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRefreshTokenReused
+		}
+
+		var err error
+		session.IP = clientIP(r)
+		tokens, err = service.issueTokens(tx, user, session, now)
+		return err
+	})
+	if errors.Is(err, errRefreshTokenReused) {
+		return nil, nil, nil, service.reuseDetected(session, now), nil
+	}
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	return user, session, tokens, nil, nil
+}
+
+// reuseDetected Ends a session whose rotated refresh token came back, whoever sent it may have stolen it
+func (service *UserService) reuseDetected(session *Session, now time.Time) *NewUserResponse {
+	log.Printf("refresh token reused in session %s, revoking it", session.ID)
+	if err := service.RevokeSession(session, now); err != nil {
+		log.Println(err)
+	}
+
+	return NewUserError(20, "Refresh token reused", "This refresh token was already used, so the session has been ended. Please login again.")
+}
+
+// sessionCleaner Deletes sessions, with their refresh tokens, revoked access tokens, password resets, email
+// changes, login challenges, unfinished OIDC sign ins and unused OAuth authorization codes once they have expired
+func (service *UserService) sessionCleaner() {
+	for range time.Tick(sessionCleanupTick) {
+		now := time.Now()
+
+		err := service.db.Transaction(func(tx *gorm.DB) error {
+			expired := tx.Model(&Session{}).Select("id").Where("expires_at < ?", now)
+			if err := tx.Where("session_id IN (?)", expired).Delete(&RefreshToken{}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Where("expires_at < ?", now).Delete(&Session{}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Where("expires_at < ?", now).Delete(&RevokedToken{}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Where("expires_at < ?", now).Delete(&PasswordReset{}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Where("expires_at < ?", now).Delete(&EmailChange{}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Where("expires_at < ?", now).Delete(&LoginChallenge{}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Where("expires_at < ?", now).Delete(&OIDCLogin{}).Error; err != nil {
+				return err
+			}
+
+			return tx.Where("expires_at < ?", now).Delete(&OAuthCode{}).Error
+		})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Logout Ends the session the access token belongs to and forgets its refresh token
+func (service *UserService) Logout(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodPost {
+		return
+	}
+
+	user, sessionID, userErr := service.AuthenticateSession(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	session := &Session{}
+	if service.db.First(session, "id = ? AND user_uuid = ?", sessionID, user.UUID).RowsAffected > 0 {
+		if err := service.RevokeSession(session, time.Now()); err != nil {
+			log.Println(err)
+			RenderJSONResponse(w, http.StatusInternalServerError, NewUserError(28, "Internal server error", "Error ending session"))
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: refreshCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+	RenderJSONResponse(w, http.StatusOK, &NewUserResponse{Successful: true})
+}
+
+// ListSessions Gives the user's sessions that are still going, most recently used first
+func (service *UserService) ListSessions(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodGet {
+		return
+	}
+
+	user, sessionID, userErr := service.AuthenticateSession(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	response := &SessionsResponse{Successful: true, Sessions: []*Session{}}
+	if err := service.db.Where("user_uuid = ? AND revoked_at IS NULL AND expires_at > ?", user.UUID, time.Now()).Order("last_used_at desc").Find(&response.Sessions).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &SessionsResponse{Error: jsonerror.New(28, "Internal server error", "Error loading sessions").Render()})
+		return
+	}
+
+	for _, session := range response.Sessions {
+		session.Current = session.ID.String() == sessionID
+	}
+
+	RenderJSONResponse(w, http.StatusOK, response)
+}
+
+// DeleteSession Revokes one of the user's sessions, logging that device out
+func (service *UserService) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodDelete {
+		return
+	}
+
+	user, userErr := service.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	session := &Session{}
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil || service.db.First(session, "id = ? AND user_uuid = ? AND revoked_at IS NULL", id, user.UUID).RowsAffected == 0 {
+		RenderJSONResponse(w, http.StatusNotFound, NewUserError(21, "Session not found", "No session with given ID: "+r.PathValue("id")))
+		return
+	}
+
+	if err := service.RevokeSession(session, time.Now()); err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, NewUserError(28, "Internal server error", "Error ending session"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &NewUserResponse{Successful: true})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type recordingSessionListener struct {
+	revoked []*Session
+}
+
+func (l *recordingSessionListener) SessionRevoked(session *Session) {
+	l.revoked = append(l.revoked, session)
+}
+
+func TestRevokeSessionsEndsPersonalTokens(t *testing.T) {
+	service := &UserService{db: newTestDB(t, &Session{}, &RefreshToken{}, &RevokedToken{}, &PersonalToken{})}
+	listener := &recordingSessionListener{}
+	service.AddSessionListener(listener)
+
+	user, other := uuid.New(), uuid.New()
+	kept, revoked, othersToken := uuid.New(), uuid.New(), uuid.New()
+	for i, token := range []*PersonalToken{
+		{ID: kept, UserUUID: user},
+		{ID: revoked, UserUUID: user},
+		{ID: othersToken, UserUUID: other},
+	} {
+		token.Name, token.Scopes, token.Hash = "script", "", uuid.NewString()
+		if err := service.db.Create(token).Error; err != nil {
+			t.Fatalf("token %d: %v", i, err)
+		}
+	}
+
+	if err := service.RevokeSessions(user, kept.String(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range map[uuid.UUID]bool{kept: true, revoked: false, othersToken: true} {
+		var count int64
+		service.db.Model(&PersonalToken{}).Where("id = ?", id).Count(&count)
+		if (count == 1) != want {
+			t.Errorf("token %s left: %v, want %v", id, count == 1, want)
+		}
+	}
+
+	if len(listener.revoked) != 1 || listener.revoked[0].ID != revoked {
+		t.Errorf("listeners were told about %v, want only %s", listener.revoked, revoked)
+	}
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pjebs/jsonerror"
+	"gorm.io/gorm"
+)
+
+const (
+	SimulOpen     = "open"
+	SimulStarted  = "started"
+	SimulFinished = "finished"
+
+	// HostColorRandom gives the host a random color on each board
+	HostColorRandom = "random"
+
+	maxSimulPlayers = 100
+)
+
+// Simul is a simultaneous exhibition where the host plays every participant at once
+type Simul struct {
+	ID          uint       `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Host        string     `gorm:"not null;index" json:"host"`
+	Name        string     `gorm:"not null" json:"name"`
+	Variant     string     `gorm:"not null;default:standard" json:"variant"`
+	MaxPlayers  int        `gorm:"not null" json:"max_players"`
+	HostColor   string     `gorm:"not null;default:white" json:"host_color"`
+	TimeControl string     `json:"time_control,omitempty"`
+	Status      string     `gorm:"not null;default:open" json:"status"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	// Wins, Draws and Losses are the host's score once the simul is over
+	Wins         int                 `json:"wins"`
+	Draws        int                 `json:"draws"`
+	Losses       int                 `json:"losses"`
+	Participants []*SimulParticipant `json:"participants,omitempty"`
+}
+
+// SimulParticipant is a player who joined a simul, with the game they play once it starts
+type SimulParticipant struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"joined_at"`
+	SimulID   uint      `gorm:"not null;index" json:"-"`
+	Player    string    `gorm:"not null" json:"player"`
+	GameID    uint      `json:"game_id,omitempty"`
+}
+
+// setup returns how every board of the simul starts
+func (s *Simul) setup() (*GameSetup, error) {
+	setup := &GameSetup{Variant: s.Variant, Chess960Position: RandomChess960Position}
+	if s.TimeControl != "" {
+		tc, err := ParseTimeControl(s.TimeControl)
+		if err != nil {
+			return nil, err
+		}
+		setup.TimeControl = tc
+	}
+
+	return setup, setup.Validate()
+}
+
+// hostColor picks the host's color on the next board
+func (s *Simul) hostColor() Color {
+	switch s.HostColor {
+	case White.Name():
+		return White
+	case Black.Name():
+		return Black
+	}
+
+	return Color(1 + rand.Intn(2))
+}
+
+type SimulService struct {
+	db *gorm.DB
+	gs *GameService
+}
+
+func NewSimulService(db *gorm.DB, gs *GameService) *SimulService {
+	if err := db.AutoMigrate(&Simul{}, &SimulParticipant{}); err != nil {
+		panic(err)
+	}
+
+	service := &SimulService{db, gs}
+	gs.AddListener(service)
+
+	http.HandleFunc("/simuls", service.HandleSimuls)
+	http.HandleFunc("/simuls/join", service.Join)
+	http.HandleFunc("/simuls/leave", service.Leave)
+	http.HandleFunc("/simuls/start", service.Start)
+
+	return service
+}
+
+type NewSimulRequest struct {
+	Name        string `json:"name"`
+	Variant     string `json:"variant"`
+	MaxPlayers  int    `json:"max_players"`
+	HostColor   string `json:"host_color"`
+	TimeControl string `json:"time_control"`
+}
+
+type SimulResponse struct {
+	Successful bool              `json:"success"`
+	Simul      *Simul            `json:"simul,omitempty"`
+	Boards     []*SimulBoard     `json:"boards,omitempty"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+type SimulListResponse struct {
+	Successful bool              `json:"success"`
+	Simuls     []*Simul          `json:"simuls"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+func simulError(code int, error, message string) *SimulResponse {
+	return &SimulResponse{Error: jsonerror.New(code, error, message).Render()}
+}
+
+// HandleSimuls Lists open simuls on GET without an id, shows one simul with its boards on GET with an id,
+// and opens a new simul hosted by the user on POST
+func (ss *SimulService) HandleSimuls(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("id") != "" {
+			ss.Show(w, r)
+		} else {
+			ss.List(w, r)
+		}
+	case http.MethodPost:
+		ss.Create(w, r)
+	}
+}
+
+// Create Opens a simul hosted by the user for others to join
+func (ss *SimulService) Create(w http.ResponseWriter, r *http.Request) {
+	user, userErr := ss.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	var request NewSimulRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, simulError(1, "Invalid JSON request", err.Error()))
+		return
+	}
+
+	simul := &Simul{
+		Host:        user.UUID.String(),
+		Name:        request.Name,
+		Variant:     request.Variant,
+		MaxPlayers:  request.MaxPlayers,
+		HostColor:   request.HostColor,
+		TimeControl: request.TimeControl,
+		Status:      SimulOpen,
+	}
+
+	if simul.Variant == "" {
+		simul.Variant = VariantStandard
+	}
+
+	if simul.HostColor == "" {
+		simul.HostColor = White.Name()
+	}
+
+	if err := simul.validate(); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, simulError(76, "Invalid simul settings", err.Error()))
+		return
+	}
+
+	if err := ss.db.Create(simul).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, simulError(28, "Internal server error", "Error creating simul"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusCreated, &SimulResponse{Successful: true, Simul: simul})
+}
+
+func (s *Simul) validate() error {
+	switch {
+	case s.Name == "":
+		return errors.New("a simul needs a name")
+	case s.MaxPlayers < 1 || s.MaxPlayers > maxSimulPlayers:
+		return fmt.Errorf("max_players must be between 1 and %d", maxSimulPlayers)
+	case s.HostColor != White.Name() && s.HostColor != Black.Name() && s.HostColor != HostColorRandom:
+		return fmt.Errorf("host_color must be white, black or random, got %s", s.HostColor)
+	case s.Variant == VariantBughouse || s.Variant == VariantFromPosition:
+		return fmt.Errorf("simuls cannot be played as %s", s.Variant)
+	}
+
+	_, err := s.setup()
+	return err
+}
+
+// List Shows the simuls that can still be joined
+func (ss *SimulService) List(w http.ResponseWriter, r *http.Request) {
+	var simuls []*Simul
+	if err := ss.db.Preload("Participants").Where("status = ?", SimulOpen).Order("created_at").Find(&simuls).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &SimulListResponse{Error: jsonerror.New(28, "Internal server error", "Error loading simuls").Render()})
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &SimulListResponse{Successful: true, Simuls: simuls})
+}
+
+// Show Gives a simul with the state of every board, the host's dashboard outside of /events
+func (ss *SimulService) Show(w http.ResponseWriter, r *http.Request) {
+	simul, errResponse, status := ss.findSimul(r)
+	if errResponse != nil {
+		RenderJSONResponse(w, status, errResponse)
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &SimulResponse{Successful: true, Simul: simul, Boards: ss.boards(simul, nil)})
+}
+
+// findSimul Loads the simul named by the id query parameter together with its participants
+func (ss *SimulService) findSimul(r *http.Request) (*Simul, *SimulResponse, int) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		return nil, simulError(70, "Simul not found", "Invalid simul id: "+r.URL.Query().Get("id")), http.StatusBadRequest
+	}
+
+	simul := &Simul{}
+	if ss.db.Preload("Participants").First(simul, id).RowsAffected == 0 {
+		return nil, simulError(70, "Simul not found", fmt.Sprintf("Simul does not exist with given ID: %d", id)), http.StatusNotFound
+	}
+
+	return simul, nil, http.StatusOK
+}
+
+// authenticatedSimul Authenticates the user and loads the simul they are acting on
+func (ss *SimulService) authenticatedSimul(w http.ResponseWriter, r *http.Request) (*User, *Simul, bool) {
+	if r.Method != http.MethodPost {
+		return nil, nil, false
+	}
+
+	user, userErr := ss.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return nil, nil, false
+	}
+
+	simul, errResponse, status := ss.findSimul(r)
+	if errResponse != nil {
+		RenderJSONResponse(w, status, errResponse)
+		return nil, nil, false
+	}
+
+	return user, simul, true
+}
+
+// Join Adds the user to an open simul
+func (ss *SimulService) Join(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	user, simul, ok := ss.authenticatedSimul(w, r)
+	if !ok {
+		return
+	}
+
+	player := user.UUID.String()
+	switch {
+	case simul.Status != SimulOpen:
+		RenderJSONResponse(w, http.StatusBadRequest, simulError(72, "Simul is not open", "The simul has already started"))
+		return
+	case simul.Host == player:
+		RenderJSONResponse(w, http.StatusBadRequest, simulError(77, "Cannot join your own simul", "The host plays every board already"))
+		return
+	case len(simul.Participants) >= simul.MaxPlayers:
+		RenderJSONResponse(w, http.StatusBadRequest, simulError(73, "Simul is full", fmt.Sprintf("The simul is limited to %d players", simul.MaxPlayers)))
+		return
+	case blocked(ss.db, simul.Host, player):
+		RenderJSONResponse(w, http.StatusForbidden, &SimulResponse{Error: blockedError()})
+		return
+	}
+
+	for _, participant := range simul.Participants {
+		if participant.Player == player {
+			RenderJSONResponse(w, http.StatusBadRequest, simulError(74, "Already joined", "You have already joined this simul"))
+			return
+		}
+	}
+
+	participant := &SimulParticipant{SimulID: simul.ID, Player: player}
+	if err := ss.db.Create(participant).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, simulError(28, "Internal server error", "Error joining simul"))
+		return
+	}
+
+	simul.Participants = append(simul.Participants, participant)
+	ss.gs.mu.Lock()
+	ss.gs.send(simul.Host, &broadcastMessage{Type: "simul_join", Payload: simul})
+	ss.gs.mu.Unlock()
+
+	RenderJSONResponse(w, http.StatusOK, &SimulResponse{Successful: true, Simul: simul})
+}
+
+// Leave Removes the user from a simul that has not started yet
+func (ss *SimulService) Leave(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	user, simul, ok := ss.authenticatedSimul(w, r)
+	if !ok {
+		return
+	}
+
+	if simul.Status != SimulOpen {
+		RenderJSONResponse(w, http.StatusBadRequest, simulError(72, "Simul is not open", "The simul has already started"))
+		return
+	}
+
+	result := ss.db.Where("simul_id = ? AND player = ?", simul.ID, user.UUID.String()).Delete(&SimulParticipant{})
+	if result.RowsAffected == 0 {
+		RenderJSONResponse(w, http.StatusBadRequest, simulError(78, "Not a participant", "You have not joined this simul"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &SimulResponse{Successful: true})
+}
+
+// Start Creates a game between the host and every participant, only the host can start the simul
+func (ss *SimulService) Start(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	user, simul, ok := ss.authenticatedSimul(w, r)
+	if !ok {
+		return
+	}
+
+	switch {
+	case simul.Host != user.UUID.String():
+		RenderJSONResponse(w, http.StatusForbidden, simulError(71, "Not the host", "Only the host can start the simul"))
+		return
+	case simul.Status != SimulOpen:
+		RenderJSONResponse(w, http.StatusBadRequest, simulError(72, "Simul is not open", "The simul has already started"))
+		return
+	case len(simul.Participants) == 0:
+		RenderJSONResponse(w, http.StatusBadRequest, simulError(75, "No participants", "Nobody has joined the simul yet"))
+		return
+	}
+
+	setup, err := simul.setup()
+	if err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, simulError(76, "Invalid simul settings", err.Error()))
+		return
+	}
+
+	now := time.Now()
+	var games []*Game
+	for _, participant := range simul.Participants {
+		white, black := simul.Host, participant.Player
+		if simul.hostColor() == Black {
+			white, black = black, white
+		}
+
+		game, err := ss.gs.createGame(white, black, setup, now)
+		if err != nil {
+			log.Println(err)
+			RenderJSONResponse(w, http.StatusInternalServerError, simulError(28, "Internal server error", "Error creating simul games"))
+			return
+		}
+
+		game.SimulID = simul.ID
+		participant.GameID = game.ID
+		ss.db.Save(game)
+		ss.db.Save(participant)
+		games = append(games, game)
+	}
+
+	simul.Status = SimulStarted
+	simul.StartedAt = &now
+	ss.db.Save(simul)
+
+	ss.gs.mu.Lock()
+	for _, game := range games {
+		ss.gs.announceGame(game)
+	}
+	ss.gs.send(simul.Host, &broadcastMessage{Type: "simul_start", Payload: &SimulResponse{Successful: true, Simul: simul, Boards: ss.boards(simul, nil)}})
+	ss.gs.mu.Unlock()
+
+	RenderJSONResponse(w, http.StatusOK, &SimulResponse{Successful: true, Simul: simul})
+}
+
+// SimulBoard is the state of one board of a simul as the host sees it
+type SimulBoard struct {
+	GameID     uint   `json:"game_id"`
+	Opponent   string `json:"opponent"`
+	HostColor  string `json:"host_color"`
+	FEN        string `json:"fen"`
+	HostToMove bool   `json:"host_to_move"`
+	Result     string `json:"result"`
+	WhiteClock int64  `json:"white_clock,omitempty"`
+	BlackClock int64  `json:"black_clock,omitempty"`
+}
+
+func (s *Simul) board(game *Game, now time.Time) *SimulBoard {
+	hostColor := game.getColor(s.Host)
+	board := &SimulBoard{
+		GameID:     game.ID,
+		Opponent:   game.PlayerWhite,
+		HostColor:  hostColor.Name(),
+		FEN:        game.board.FEN(),
+		HostToMove: game.board.Outcome() == NoOutcome && game.board.Position().Turn() == hostColor,
+		Result:     game.board.Outcome().String(),
+	}
+
+	if hostColor == White {
+		board.Opponent = game.PlayerBlack
+	}
+
+	if game.timed() {
+		clock := game.clockUpdate(now)
+		board.WhiteClock, board.BlackClock = clock.White, clock.Black
+	}
+
+	return board
+}
+
+// boards Loads the state of every board of the simul, using the given game in place of its stored copy
+func (ss *SimulService) boards(simul *Simul, current *Game) []*SimulBoard {
+	var games []*Game
+	if err := ss.db.Where("simul_id = ?", simul.ID).Order("id").Find(&games).Error; err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	now := time.Now()
+	boards := make([]*SimulBoard, 0, len(games))
+	for _, game := range games {
+		if current != nil && game.ID == current.ID {
+			game = current
+		} else if err := game.loadBoard(); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		boards = append(boards, simul.board(game, now))
+	}
+
+	return boards
+}
+
+// GameStarted Simul boards need nothing when they start, they are announced by the service that made them
+func (ss *SimulService) GameStarted(*Game) {}
+
+// GameMoved Sends the host the new state of the board
+func (ss *SimulService) GameMoved(game *Game) {
+	if game.SimulID == 0 {
+		return
+	}
+
+	simul := &Simul{}
+	if ss.db.First(simul, game.SimulID).RowsAffected == 0 {
+		return
+	}
+
+	ss.gs.send(simul.Host, &broadcastMessage{"simul_board", game.ID, simul.board(game, time.Now())})
+}
+
+// GameEnded Sends the host the result of the board, and once every board is over records the host's
+// score and sends the summary of the simul
+func (ss *SimulService) GameEnded(game *Game) {
+	if game.SimulID == 0 {
+		return
+	}
+
+	simul := &Simul{}
+	if ss.db.First(simul, game.SimulID).RowsAffected == 0 || simul.Status != SimulStarted {
+		return
+	}
+
+	ss.gs.send(simul.Host, &broadcastMessage{"simul_board", game.ID, simul.board(game, time.Now())})
+
+	boards := ss.boards(simul, game)
+	simul.Wins, simul.Draws, simul.Losses = 0, 0, 0
+	for _, board := range boards {
+		switch board.Result {
+		case NoOutcome.String():
+			return
+		case Draw.String():
+			simul.Draws++
+		case winnerOutcome(White).String():
+			if board.HostColor == White.Name() {
+				simul.Wins++
+			} else {
+				simul.Losses++
+			}
+		default:
+			if board.HostColor == Black.Name() {
+				simul.Wins++
+			} else {
+				simul.Losses++
+			}
+		}
+	}
+
+	now := time.Now()
+	simul.Status = SimulFinished
+	simul.FinishedAt = &now
+	ss.db.Save(simul)
+
+	summary := &broadcastMessage{Type: "simul_result", Payload: &SimulResponse{Successful: true, Simul: simul, Boards: boards}}
+	ss.gs.send(simul.Host, summary)
+
+	var participants []*SimulParticipant
+	ss.db.Where("simul_id = ?", simul.ID).Find(&participants)
+	for _, participant := range participants {
+		ss.gs.send(participant.Player, summary)
+	}
+}
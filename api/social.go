@@ -0,0 +1,441 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/pjebs/jsonerror"
+	"gorm.io/gorm"
+)
+
+const (
+	FriendRequested = "requested"
+	FriendAccepted  = "accepted"
+)
+
+// Friendship is a friend request from Player to Friend, which makes them friends both ways once accepted
+type Friendship struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Player    string `gorm:"not null;uniqueIndex:idx_friendship;index"`
+	Friend    string `gorm:"not null;uniqueIndex:idx_friendship;index"`
+	Status    string `gorm:"not null"`
+}
+
+// Follow is a player following another, which needs no approval
+type Follow struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	Player    string `gorm:"not null;uniqueIndex:idx_follow;index"`
+	Followed  string `gorm:"not null;uniqueIndex:idx_follow;index"`
+}
+
+// Block keeps the blocked player from being paired against, challenging or chatting with the player
+type Block struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	Player    string `gorm:"not null;uniqueIndex:idx_block;index"`
+	Blocked   string `gorm:"not null;uniqueIndex:idx_block;index"`
+}
+
+// blocked Reports whether either player has blocked the other
+func blocked(db *gorm.DB, player, other string) bool {
+	return db.Where("(player = ? AND blocked = ?) OR (player = ? AND blocked = ?)", player, other, other, player).First(&Block{}).RowsAffected > 0
+}
+
+// friendsAndFollowers Returns everyone who is friends with or follows the player, each once
+func friendsAndFollowers(db *gorm.DB, player string) ([]string, error) {
+	var friendships []*Friendship
+	if err := db.Where("(player = ? OR friend = ?) AND status = ?", player, player, FriendAccepted).Find(&friendships).Error; err != nil {
+		return nil, err
+	}
+
+	var players []string
+	if err := db.Model(&Follow{}).Where("followed = ?", player).Pluck("player", &players).Error; err != nil {
+		return nil, err
+	}
+
+	for _, friendship := range friendships {
+		friend := friendship.Friend
+		if friend == player {
+			friend = friendship.Player
+		}
+
+		if !slices.Contains(players, friend) {
+			players = append(players, friend)
+		}
+	}
+
+	return players, nil
+}
+
+// blockedError is the error for a player acting on someone when either has blocked the other
+func blockedError() map[string]string {
+	return jsonerror.New(143, "Blocked", "You cannot do this with a player who blocked you or whom you blocked").Render()
+}
+
+type SocialService struct {
+	db *gorm.DB
+	gs *GameService
+}
+
+func NewSocialService(db *gorm.DB, gs *GameService) *SocialService {
+	if err := db.AutoMigrate(&Friendship{}, &Follow{}, &Block{}); err != nil {
+		panic(err)
+	}
+
+	service := &SocialService{db, gs}
+
+	http.HandleFunc("/friends", service.ListFriends)
+	http.HandleFunc("/friends/request", service.RequestFriend)
+	http.HandleFunc("/friends/remove", service.RemoveFriend)
+	http.HandleFunc("/follows", service.ListFollows)
+	http.HandleFunc("/follows/follow", service.FollowPlayer)
+	http.HandleFunc("/follows/unfollow", service.UnfollowPlayer)
+	http.HandleFunc("/blocks", service.ListBlocks)
+	http.HandleFunc("/blocks/block", service.BlockPlayer)
+	http.HandleFunc("/blocks/unblock", service.UnblockPlayer)
+
+	return service
+}
+
+// Friend is one of the player's friends with whether they are online and the games they are playing
+type Friend struct {
+	Player    string `json:"player"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	ELO       int    `json:"elo"`
+	Online    bool   `json:"online"`
+	Games     []uint `json:"games"`
+}
+
+type FriendsResponse struct {
+	Successful bool      `json:"success"`
+	Friends    []*Friend `json:"friends"`
+	// Incoming are the players asking to be the user's friend, Outgoing those the user asked
+	Incoming []string          `json:"incoming"`
+	Outgoing []string          `json:"outgoing"`
+	Error    map[string]string `json:"error,omitempty"`
+}
+
+type FollowsResponse struct {
+	Successful bool              `json:"success"`
+	Following  []string          `json:"following"`
+	Followers  []string          `json:"followers"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+type BlocksResponse struct {
+	Successful bool              `json:"success"`
+	Blocked    []string          `json:"blocked"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+type SocialResponse struct {
+	Successful bool              `json:"success"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+func socialError(code int, error, message string) *SocialResponse {
+	return &SocialResponse{Error: jsonerror.New(code, error, message).Render()}
+}
+
+// authenticated Authenticates the user for a request with the given method
+func (ss *SocialService) authenticated(w http.ResponseWriter, r *http.Request, method string) (*User, bool) {
+	if r.Method != method {
+		return nil, false
+	}
+
+	user, userErr := ss.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// authenticatedPlayer Authenticates the user and finds the other player named by the player query parameter
+func (ss *SocialService) authenticatedPlayer(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	user, ok := ss.authenticated(w, r, http.MethodPost)
+	if !ok {
+		return "", "", false
+	}
+
+	player := r.URL.Query().Get("player")
+	if _, err := ss.gs.us.GetUser(player); err != nil || player == user.UUID.String() {
+		RenderJSONResponse(w, http.StatusNotFound, socialError(140, "Player not found", "No other player with given UUID: "+player))
+		return "", "", false
+	}
+
+	return user.UUID.String(), player, true
+}
+
+// friendship Finds the friendship or friend request between two players in either direction, nil if there is none
+func (ss *SocialService) friendship(player, other string) *Friendship {
+	friendship := &Friendship{}
+	if ss.db.Where("(player = ? AND friend = ?) OR (player = ? AND friend = ?)", player, other, other, player).First(friendship).RowsAffected == 0 {
+		return nil
+	}
+
+	return friendship
+}
+
+// ListFriends Gives the user's friends with their online status and current games, and pending friend requests
+func (ss *SocialService) ListFriends(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	user, ok := ss.authenticated(w, r, http.MethodGet)
+	if !ok {
+		return
+	}
+
+	var friendships []*Friendship
+	uuid := user.UUID.String()
+	if err := ss.db.Where("player = ? OR friend = ?", uuid, uuid).Order("created_at").Find(&friendships).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &FriendsResponse{Error: jsonerror.New(28, "Internal server error", "Error loading friends").Render()})
+		return
+	}
+
+	response := &FriendsResponse{Successful: true, Friends: []*Friend{}, Incoming: []string{}, Outgoing: []string{}}
+	for _, friendship := range friendships {
+		switch {
+		case friendship.Status == FriendAccepted && friendship.Player == uuid:
+			response.Friends = append(response.Friends, &Friend{Player: friendship.Friend})
+		case friendship.Status == FriendAccepted:
+			response.Friends = append(response.Friends, &Friend{Player: friendship.Player})
+		case friendship.Player == uuid:
+			response.Outgoing = append(response.Outgoing, friendship.Friend)
+		default:
+			response.Incoming = append(response.Incoming, friendship.Player)
+		}
+	}
+
+	for _, friend := range response.Friends {
+		if details, err := ss.gs.us.GetUser(friend.Player); err == nil {
+			friend.FirstName, friend.LastName, friend.ELO = details.FirstName, details.LastName, details.ELO
+		}
+
+		friend.Games = []uint{}
+		if err := ss.db.Model(&Game{}).Where("(player_white = ? OR player_black = ?) AND result = ?", friend.Player, friend.Player, NoOutcome.String()).Order("id").Pluck("id", &friend.Games).Error; err != nil {
+			log.Println(err)
+		}
+	}
+
+	ss.gs.mu.Lock()
+	for _, friend := range response.Friends {
+		friend.Online = ss.gs.streams[friend.Player] != nil
+	}
+	ss.gs.mu.Unlock()
+
+	RenderJSONResponse(w, http.StatusOK, response)
+}
+
+// RequestFriend Asks a player to be the user's friend, or accepts their request if they already asked
+func (ss *SocialService) RequestFriend(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	uuid, player, ok := ss.authenticatedPlayer(w, r)
+	if !ok {
+		return
+	}
+
+	if blocked(ss.db, uuid, player) {
+		RenderJSONResponse(w, http.StatusForbidden, &SocialResponse{Error: blockedError()})
+		return
+	}
+
+	friendship := ss.friendship(uuid, player)
+	kind, text := NotifyFriendRequest, "%s asked to be your friend"
+	switch {
+	case friendship == nil:
+		friendship = &Friendship{Player: uuid, Friend: player, Status: FriendRequested}
+	case friendship.Status == FriendRequested && friendship.Friend == uuid:
+		friendship.Status = FriendAccepted
+		kind, text = NotifyFriendAccepted, "%s accepted your friend request"
+	default:
+		RenderJSONResponse(w, http.StatusBadRequest, socialError(141, "Already friends", "You are already friends with this player or have asked to be"))
+		return
+	}
+
+	if err := ss.db.Save(friendship).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, socialError(28, "Internal server error", "Error saving friend request"))
+		return
+	}
+
+	name := uuid
+	if user, err := ss.gs.us.GetUser(uuid); err == nil {
+		name = user.FirstName + " " + user.LastName
+	}
+
+	ss.gs.mu.Lock()
+	ss.gs.notify(&Notification{Player: player, Kind: kind, Text: fmt.Sprintf(text, name), Link: "/friends"})
+	ss.gs.mu.Unlock()
+
+	RenderJSONResponse(w, http.StatusOK, &SocialResponse{Successful: true})
+}
+
+// RemoveFriend Unfriends a player, or declines or withdraws a friend request
+func (ss *SocialService) RemoveFriend(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	uuid, player, ok := ss.authenticatedPlayer(w, r)
+	if !ok {
+		return
+	}
+
+	friendship := ss.friendship(uuid, player)
+	if friendship == nil {
+		RenderJSONResponse(w, http.StatusBadRequest, socialError(142, "Not friends", "You are not friends with this player"))
+		return
+	}
+
+	if err := ss.db.Delete(friendship).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, socialError(28, "Internal server error", "Error removing friend"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &SocialResponse{Successful: true})
+}
+
+// ListFollows Gives the players the user follows and the players following them
+func (ss *SocialService) ListFollows(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	user, ok := ss.authenticated(w, r, http.MethodGet)
+	if !ok {
+		return
+	}
+
+	response := &FollowsResponse{Successful: true, Following: []string{}, Followers: []string{}}
+	uuid := user.UUID.String()
+	if err := ss.db.Model(&Follow{}).Where("player = ?", uuid).Order("created_at").Pluck("followed", &response.Following).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &FollowsResponse{Error: jsonerror.New(28, "Internal server error", "Error loading follows").Render()})
+		return
+	}
+
+	if err := ss.db.Model(&Follow{}).Where("followed = ?", uuid).Order("created_at").Pluck("player", &response.Followers).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &FollowsResponse{Error: jsonerror.New(28, "Internal server error", "Error loading follows").Render()})
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, response)
+}
+
+// FollowPlayer Follows a player who hasn't blocked the user
+func (ss *SocialService) FollowPlayer(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	uuid, player, ok := ss.authenticatedPlayer(w, r)
+	if !ok {
+		return
+	}
+
+	if blocked(ss.db, uuid, player) {
+		RenderJSONResponse(w, http.StatusForbidden, &SocialResponse{Error: blockedError()})
+		return
+	}
+
+	follow := &Follow{Player: uuid, Followed: player}
+	if err := ss.db.Where(follow).FirstOrCreate(follow).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, socialError(28, "Internal server error", "Error following player"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &SocialResponse{Successful: true})
+}
+
+// UnfollowPlayer Stops following a player
+func (ss *SocialService) UnfollowPlayer(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	uuid, player, ok := ss.authenticatedPlayer(w, r)
+	if !ok {
+		return
+	}
+
+	if err := ss.db.Where("player = ? AND followed = ?", uuid, player).Delete(&Follow{}).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, socialError(28, "Internal server error", "Error unfollowing player"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &SocialResponse{Successful: true})
+}
+
+// ListBlocks Gives the players the user has blocked
+func (ss *SocialService) ListBlocks(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	user, ok := ss.authenticated(w, r, http.MethodGet)
+	if !ok {
+		return
+	}
+
+	response := &BlocksResponse{Successful: true, Blocked: []string{}}
+	if err := ss.db.Model(&Block{}).Where("player = ?", user.UUID.String()).Order("created_at").Pluck("blocked", &response.Blocked).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &BlocksResponse{Error: jsonerror.New(28, "Internal server error", "Error loading blocks").Render()})
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, response)
+}
+
+// BlockPlayer Blocks a player, ending any friendship and follows between the two
+func (ss *SocialService) BlockPlayer(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	uuid, player, ok := ss.authenticatedPlayer(w, r)
+	if !ok {
+		return
+	}
+
+	err := ss.db.Transaction(func(tx *gorm.DB) error {
+		block := &Block{Player: uuid, Blocked: player}
+		if err := tx.Where(block).FirstOrCreate(block).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("(player = ? AND friend = ?) OR (player = ? AND friend = ?)", uuid, player, player, uuid).Delete(&Friendship{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("(player = ? AND followed = ?) OR (player = ? AND followed = ?)", uuid, player, player, uuid).Delete(&Follow{}).Error
+	})
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, socialError(28, "Internal server error", "Error blocking player"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &SocialResponse{Successful: true})
+}
+
+// UnblockPlayer Lifts a block on a player
+func (ss *SocialService) UnblockPlayer(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	uuid, player, ok := ss.authenticatedPlayer(w, r)
+	if !ok {
+		return
+	}
+
+	if err := ss.db.Where("player = ? AND blocked = ?", uuid, player).Delete(&Block{}).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, socialError(28, "Internal server error", "Error unblocking player"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &SocialResponse{Successful: true})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+
+	"github.com/pjebs/jsonerror"
+)
+
+type SpectateResponse struct {
+	Successful bool              `json:"success"`
+	Type       string            `json:"type"`
+	GameID     uint              `json:"game_id,omitempty"`
+	FEN        string            `json:"fen,omitempty"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+// Watch Joins the spectators of an unfinished game, who are sent its moves, clocks and result and can talk
+// in its spectator chat. Players already follow their own games and the partner board in Bughouse.
+func (gs *GameService) Watch(user *User, message map[string]interface{}) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	uuid := user.UUID.String()
+	gameID, ok := message["game_id"].(float64)
+	if !ok {
+		gs.send(uuid, &SpectateResponse{Type: "watch", Error: jsonerror.New(62, "Watch request improperly formatted.", "Failed to parse game_id.").Render()})
+		return
+	}
+
+	game := &Game{}
+	if gs.db.First(game, uint(gameID)).RowsAffected == 0 || game.Result != NoOutcome.String() {
+		gs.send(uuid, &SpectateResponse{Type: "watch", GameID: uint(gameID), Error: jsonerror.New(61, "Game does not exist with given ID.", "No game is being played with given ID").Render()})
+		return
+	}
+
+	if err := game.loadBoard(); err != nil {
+		log.Println(err)
+		gs.send(uuid, &SpectateResponse{Type: "watch", GameID: game.ID, Error: jsonerror.New(28, "Internal server error", "Error parsing game data").Render()})
+		return
+	}
+
+	linked, err := gs.linkedGame(game)
+	if err != nil {
+		log.Println(err)
+	}
+
+	for _, player := range gs.audience(game, linked) {
+		if player == uuid {
+			gs.send(uuid, &SpectateResponse{Type: "watch", GameID: game.ID, Error: jsonerror.New(64, "Already following the game", "You are already following this game").Render()})
+			return
+		}
+	}
+
+	if gs.spectators[game.ID] == nil {
+		gs.spectators[game.ID] = make(map[string]bool)
+	}
+	gs.spectators[game.ID][uuid] = true
+
+	gs.send(uuid, &SpectateResponse{Successful: true, Type: "watch", GameID: game.ID, FEN: game.board.FEN()})
+}
+
+// Unwatch Leaves the spectators of a game
+func (gs *GameService) Unwatch(user *User, message map[string]interface{}) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	gameID, _ := message["game_id"].(float64)
+	delete(gs.spectators[uint(gameID)], user.UUID.String())
+
+	gs.send(user.UUID.String(), &SpectateResponse{Successful: true, Type: "unwatch", GameID: uint(gameID)})
+}
+
+// stopWatching Removes a player who disconnected from every game they were watching
+func (gs *GameService) stopWatching(uuid string) {
+	for gameID, spectators := range gs.spectators {
+		delete(spectators, uuid)
+		if len(spectators) == 0 {
+			delete(gs.spectators, gameID)
+		}
+	}
+}
@@ -0,0 +1,899 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pjebs/jsonerror"
+	"gorm.io/gorm"
+)
+
+const (
+	SwissScheduled = "scheduled"
+	SwissStarted   = "started"
+	// SwissPaused tournaments have a round that couldn't be paired, pairing is tried again until it works, the
+	// organiser steps in or it is forced
+	SwissPaused   = "paused"
+	SwissFinished = "finished"
+
+	swissTick      = 5 * time.Second
+	maxSwissRounds = 20
+	// swissPauseRetry is how often a paused tournament is tried again, since blocks and withdrawals can change
+	swissPauseRetry = time.Minute
+	// swissPauseLimit is how long a tournament stays paused before the round is paired with forced byes
+	swissPauseLimit = 24 * time.Hour
+)
+
+// Swiss is a tournament of a fixed number of rounds where players meet others with the same score
+type Swiss struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	CreatedBy   string    `gorm:"not null" json:"created_by"`
+	Name        string    `gorm:"not null" json:"name"`
+	Variant     string    `gorm:"not null;default:standard" json:"variant"`
+	TimeControl string    `json:"time_control,omitempty"`
+	DaysPerMove int       `json:"days,omitempty"`
+	Rounds      int       `gorm:"not null" json:"rounds"`
+	// ClubID restricts the tournament to members of a club
+	ClubID uint `gorm:"index" json:"club_id,omitempty"`
+	// RoundInterval is the least number of minutes between the start of two rounds, a round never starts
+	// before every game of the one before is over
+	RoundInterval int        `json:"round_interval"`
+	StartsAt      time.Time  `gorm:"index" json:"starts_at"`
+	NextRoundAt   time.Time  `json:"next_round_at"`
+	CurrentRound  int        `json:"current_round"`
+	Status        string     `gorm:"not null;default:scheduled;index" json:"status"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	// PairingError is why the tournament is paused
+	PairingError string          `json:"pairing_error,omitempty"`
+	PausedAt     *time.Time      `json:"paused_at,omitempty"`
+	Players      []*SwissPlayer  `json:"players,omitempty"`
+	Pairings     []*SwissPairing `json:"pairings,omitempty"`
+}
+
+// SwissPlayer is a player's standing in a Swiss tournament, their starting number is given by rating when it starts
+type SwissPlayer struct {
+	ID              uint      `gorm:"primarykey" json:"-"`
+	SwissID         uint      `gorm:"not null;index" json:"-"`
+	Player          string    `gorm:"not null" json:"player"`
+	Name            string    `json:"name"`
+	Rating          int       `json:"rating"`
+	StartNumber     int       `json:"start_number,omitempty"`
+	Points          float64   `json:"points"`
+	Buchholz        float64   `json:"buchholz"`
+	SonnebornBerger float64   `json:"sonneborn_berger"`
+	Rank            int       `json:"rank,omitempty"`
+	Withdrawn       bool      `json:"withdrawn"`
+	CreatedAt       time.Time `json:"joined_at"`
+}
+
+// SwissPairing is a board of a Swiss round, a bye has no black player and scores white a point
+type SwissPairing struct {
+	ID      uint   `gorm:"primarykey" json:"-"`
+	SwissID uint   `gorm:"not null;index" json:"-"`
+	Round   int    `gorm:"not null" json:"round"`
+	Board   int    `gorm:"not null" json:"board"`
+	White   string `gorm:"not null" json:"white"`
+	Black   string `json:"black,omitempty"`
+	Bye     bool   `json:"bye,omitempty"`
+	GameID  uint   `gorm:"index" json:"game_id,omitempty"`
+	Result  string `gorm:"not null;default:*" json:"result"`
+}
+
+func (s *Swiss) setup() (*GameSetup, error) {
+	setup := &GameSetup{Variant: s.Variant, Chess960Position: RandomChess960Position, DaysPerMove: s.DaysPerMove}
+	if s.TimeControl != "" {
+		tc, err := ParseTimeControl(s.TimeControl)
+		if err != nil {
+			return nil, err
+		}
+		setup.TimeControl = tc
+	}
+
+	return setup, setup.Validate()
+}
+
+func (s *Swiss) validate() error {
+	switch {
+	case s.Name == "":
+		return errors.New("a swiss tournament needs a name")
+	case s.Rounds < 1 || s.Rounds > maxSwissRounds:
+		return fmt.Errorf("rounds must be between 1 and %d", maxSwissRounds)
+	case s.RoundInterval < 0:
+		return errors.New("round_interval cannot be negative")
+	case s.Variant == VariantBughouse || s.Variant == VariantFromPosition:
+		return fmt.Errorf("swiss tournaments cannot be played as %s", s.Variant)
+	}
+
+	_, err := s.setup()
+	return err
+}
+
+// swissRecords Rebuilds every player's history from the pairings of the rounds played so far
+func swissRecords(players []*SwissPlayer, pairings []*SwissPairing, rounds int) []*swissRecord {
+	records := make([]*swissRecord, len(players))
+	byPlayer := make(map[string]*swissRecord, len(players))
+	for i, player := range players {
+		records[i] = &swissRecord{player: player, rounds: make([]swissRound, rounds)}
+		byPlayer[player.Player] = records[i]
+	}
+
+	for _, pairing := range pairings {
+		white := byPlayer[pairing.White]
+		if white == nil || pairing.Round < 1 || pairing.Round > rounds {
+			continue
+		}
+
+		n := pairing.Round - 1
+		if pairing.Bye {
+			white.rounds[n] = swissRound{bye: true, points: 1, finished: true}
+			continue
+		}
+
+		black := byPlayer[pairing.Black]
+		if black == nil {
+			continue
+		}
+
+		finished := pairing.Result != NoOutcome.String()
+		var points float64
+		switch Outcome(pairing.Result) {
+		case WhiteWon:
+			points = 1
+		case Draw:
+			points = 0.5
+		}
+
+		white.rounds[n] = swissRound{opponent: black, color: White, points: points, played: true, finished: finished}
+		black.rounds[n] = swissRound{opponent: white, color: Black, points: 1 - points, played: true, finished: finished}
+		if !finished {
+			white.rounds[n].points, black.rounds[n].points = 0, 0
+		}
+	}
+
+	for _, record := range records {
+		for _, round := range record.rounds {
+			record.score += round.points
+		}
+	}
+
+	return records
+}
+
+// rankSwissPlayers Sorts players by points, then Buchholz, then Sonneborn-Berger, then rating
+func rankSwissPlayers(players []*SwissPlayer) {
+	sort.SliceStable(players, func(i, j int) bool {
+		a, b := players[i], players[j]
+		switch {
+		case a.Points != b.Points:
+			return a.Points > b.Points
+		case a.Buchholz != b.Buchholz:
+			return a.Buchholz > b.Buchholz
+		case a.SonnebornBerger != b.SonnebornBerger:
+			return a.SonnebornBerger > b.SonnebornBerger
+		case a.Rating != b.Rating:
+			return a.Rating > b.Rating
+		}
+		return a.StartNumber < b.StartNumber
+	})
+}
+
+type SwissService struct {
+	db *gorm.DB
+	gs *GameService
+	// mu serialises pairing rounds and finishing tournaments between the scheduler and the organiser
+	mu sync.Mutex
+}
+
+func NewSwissService(db *gorm.DB, gs *GameService) *SwissService {
+	if err := db.AutoMigrate(&Swiss{}, &SwissPlayer{}, &SwissPairing{}); err != nil {
+		panic(err)
+	}
+
+	service := &SwissService{db: db, gs: gs}
+	gs.AddListener(service)
+	go service.scheduler()
+
+	http.HandleFunc("/swiss", service.HandleSwiss)
+	http.HandleFunc("/swiss/join", service.Join)
+	http.HandleFunc("/swiss/withdraw", service.Withdraw)
+	http.HandleFunc("/swiss/resume", service.Resume)
+	http.HandleFunc("/swiss/finish", service.Finish)
+	http.HandleFunc("/swiss/trf", service.ExportTRF)
+
+	return service
+}
+
+type NewSwissRequest struct {
+	Name          string    `json:"name"`
+	Variant       string    `json:"variant"`
+	ClubID        uint      `json:"club_id"`
+	TimeControl   string    `json:"time_control"`
+	DaysPerMove   int       `json:"days"`
+	Rounds        int       `json:"rounds"`
+	RoundInterval int       `json:"round_interval"`
+	StartsAt      time.Time `json:"starts_at"`
+}
+
+type SwissResponse struct {
+	Successful bool              `json:"success"`
+	Swiss      *Swiss            `json:"swiss,omitempty"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+type SwissListResponse struct {
+	Successful bool              `json:"success"`
+	Swiss      []*Swiss          `json:"swiss"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+func swissError(code int, error, message string) *SwissResponse {
+	return &SwissResponse{Error: jsonerror.New(code, error, message).Render()}
+}
+
+// HandleSwiss Lists unfinished Swiss tournaments on GET without an id, shows one with its standings and
+// pairings on GET with an id, and schedules a new one on POST
+func (ss *SwissService) HandleSwiss(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("id") != "" {
+			ss.Show(w, r)
+		} else {
+			ss.List(w, r)
+		}
+	case http.MethodPost:
+		ss.Create(w, r)
+	}
+}
+
+// Create Schedules a Swiss tournament, players can join until it starts
+func (ss *SwissService) Create(w http.ResponseWriter, r *http.Request) {
+	user, userErr := ss.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	var request NewSwissRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, swissError(1, "Invalid JSON request", err.Error()))
+		return
+	}
+
+	swiss := &Swiss{
+		CreatedBy:     user.UUID.String(),
+		Name:          request.Name,
+		Variant:       request.Variant,
+		ClubID:        request.ClubID,
+		TimeControl:   request.TimeControl,
+		DaysPerMove:   request.DaysPerMove,
+		Rounds:        request.Rounds,
+		RoundInterval: request.RoundInterval,
+		StartsAt:      request.StartsAt,
+		Status:        SwissScheduled,
+	}
+
+	if swiss.Variant == "" {
+		swiss.Variant = VariantStandard
+	}
+
+	if swiss.StartsAt.IsZero() {
+		swiss.StartsAt = time.Now()
+	}
+
+	if err := swiss.validate(); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, swissError(90, "Invalid swiss settings", err.Error()))
+		return
+	}
+
+	if err := checkClubEvent(ss.db, swiss.ClubID, swiss.CreatedBy); err != nil {
+		RenderJSONResponse(w, http.StatusForbidden, swissError(113, "Not a club admin", err.Error()))
+		return
+	}
+
+	if err := ss.db.Create(swiss).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, swissError(28, "Internal server error", "Error creating swiss tournament"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusCreated, &SwissResponse{Successful: true, Swiss: swiss})
+}
+
+// List Shows the Swiss tournaments that are scheduled or being played
+func (ss *SwissService) List(w http.ResponseWriter, r *http.Request) {
+	var swiss []*Swiss
+	if err := ss.db.Where("status <> ?", SwissFinished).Order("starts_at").Find(&swiss).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &SwissListResponse{Error: jsonerror.New(28, "Internal server error", "Error loading swiss tournaments").Render()})
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &SwissListResponse{Successful: true, Swiss: swiss})
+}
+
+// Show Gives a Swiss tournament with its players in standings order and the pairings of every round
+func (ss *SwissService) Show(w http.ResponseWriter, r *http.Request) {
+	swiss, errResponse, status := ss.findSwiss(r.URL.Query().Get("id"))
+	if errResponse != nil {
+		RenderJSONResponse(w, status, errResponse)
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &SwissResponse{Successful: true, Swiss: swiss})
+}
+
+// findSwiss Loads a Swiss tournament by its id with its players ranked and its pairings by round and board
+func (ss *SwissService) findSwiss(rawID string) (*Swiss, *SwissResponse, int) {
+	id, err := strconv.ParseUint(rawID, 10, 64)
+	if err != nil {
+		return nil, swissError(91, "Swiss tournament not found", "Invalid swiss id: "+rawID), http.StatusBadRequest
+	}
+
+	swiss := &Swiss{}
+	result := ss.db.Preload("Players").Preload("Pairings", func(db *gorm.DB) *gorm.DB {
+		return db.Order("round, board")
+	}).First(swiss, id)
+	if result.RowsAffected == 0 {
+		return nil, swissError(91, "Swiss tournament not found", fmt.Sprintf("Swiss tournament does not exist with given ID: %d", id)), http.StatusNotFound
+	}
+
+	rankSwissPlayers(swiss.Players)
+	return swiss, nil, http.StatusOK
+}
+
+// authenticatedSwiss Authenticates the user and loads the Swiss tournament they are acting on
+func (ss *SwissService) authenticatedSwiss(w http.ResponseWriter, r *http.Request) (*User, *Swiss, bool) {
+	if r.Method != http.MethodPost {
+		return nil, nil, false
+	}
+
+	user, userErr := ss.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return nil, nil, false
+	}
+
+	swiss, errResponse, status := ss.findSwiss(r.URL.Query().Get("id"))
+	if errResponse != nil {
+		RenderJSONResponse(w, status, errResponse)
+		return nil, nil, false
+	}
+
+	return user, swiss, true
+}
+
+// Join Enters the user in a Swiss tournament that hasn't started, with their current rating
+func (ss *SwissService) Join(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	user, swiss, ok := ss.authenticatedSwiss(w, r)
+	if !ok {
+		return
+	}
+
+	if swiss.Status != SwissScheduled {
+		RenderJSONResponse(w, http.StatusBadRequest, swissError(92, "Swiss tournament has started", "Players can only join before the first round"))
+		return
+	}
+
+	if swiss.ClubID != 0 && !clubMember(ss.db, swiss.ClubID, user.UUID.String()) {
+		RenderJSONResponse(w, http.StatusForbidden, &SwissResponse{Error: membersOnly(swiss.ClubID)})
+		return
+	}
+
+	for _, player := range swiss.Players {
+		if player.Player == user.UUID.String() {
+			RenderJSONResponse(w, http.StatusBadRequest, swissError(93, "Already joined", "You have already joined this swiss tournament"))
+			return
+		}
+	}
+
+	player := &SwissPlayer{
+		SwissID: swiss.ID,
+		Player:  user.UUID.String(),
+		Name:    user.LastName + ", " + user.FirstName,
+		Rating:  user.ELO,
+	}
+	if err := ss.db.Create(player).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, swissError(28, "Internal server error", "Error joining swiss tournament"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &SwissResponse{Successful: true})
+}
+
+// Withdraw Leaves the user out of the rounds still to be paired, a game they are playing goes on
+func (ss *SwissService) Withdraw(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	user, swiss, ok := ss.authenticatedSwiss(w, r)
+	if !ok {
+		return
+	}
+
+	if swiss.Status == SwissFinished {
+		RenderJSONResponse(w, http.StatusBadRequest, swissError(95, "Swiss tournament is over", "The swiss tournament has already finished"))
+		return
+	}
+
+	result := ss.db.Model(&SwissPlayer{}).Where("swiss_id = ? AND player = ?", swiss.ID, user.UUID.String()).Update("withdrawn", true)
+	if result.RowsAffected == 0 {
+		RenderJSONResponse(w, http.StatusBadRequest, swissError(94, "Not in the swiss tournament", "You have not joined this swiss tournament"))
+		return
+	}
+
+	// One player fewer may be enough for the round to be paired, so it is tried again on the next tick
+	if swiss.Status == SwissPaused {
+		ss.db.Model(swiss).Update("next_round_at", time.Now())
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &SwissResponse{Successful: true})
+}
+
+// pausedSwiss Authenticates the organiser and loads their paused Swiss tournament, the lock must be held so
+// that the scheduler doesn't pair it meanwhile
+func (ss *SwissService) pausedSwiss(w http.ResponseWriter, r *http.Request) (*Swiss, bool) {
+	user, swiss, ok := ss.authenticatedSwiss(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	switch {
+	case swiss.CreatedBy != user.UUID.String():
+		RenderJSONResponse(w, http.StatusForbidden, swissError(96, "Not the organiser", "Only the creator can resume or finish the swiss tournament"))
+		return nil, false
+	case swiss.Status != SwissPaused:
+		RenderJSONResponse(w, http.StatusBadRequest, swissError(97, "Swiss tournament isn't paused", "Only a paused swiss tournament can be resumed or finished early"))
+		return nil, false
+	}
+
+	return swiss, true
+}
+
+// Resume Pairs the round a paused Swiss tournament is stuck on, giving byes to the lowest ranked players,
+// whether or not they had one, until the others can be paired
+func (ss *SwissService) Resume(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	swiss, ok := ss.pausedSwiss(w, r)
+	if !ok {
+		return
+	}
+
+	ss.startRound(swiss, true)
+	if swiss.Status == SwissPaused {
+		RenderJSONResponse(w, http.StatusInternalServerError, swissError(28, "Internal server error", "Error pairing swiss round"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &SwissResponse{Successful: true})
+}
+
+// Finish Ends a paused Swiss tournament early, ranking the players on the rounds played
+func (ss *SwissService) Finish(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	swiss, ok := ss.pausedSwiss(w, r)
+	if !ok {
+		return
+	}
+
+	ss.finish(swiss)
+
+	RenderJSONResponse(w, http.StatusOK, &SwissResponse{Successful: true, Swiss: swiss})
+}
+
+// scheduler Starts Swiss tournaments when they are due and pairs each round once the one before is over.
+// Paused tournaments are tried again every so often, and paired with forced byes once they have been
+// paused for too long.
+func (ss *SwissService) scheduler() {
+	for range time.Tick(swissTick) {
+		ss.schedule(time.Now())
+	}
+}
+
+// schedule Moves on every Swiss tournament that is due at now
+func (ss *SwissService) schedule(now time.Time) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	var due []*Swiss
+	if err := ss.db.Where("(status = ? AND starts_at <= ?) OR status IN ?", SwissScheduled, now, []string{SwissStarted, SwissPaused}).Find(&due).Error; err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, swiss := range due {
+		var playing int64
+		ss.db.Model(&SwissPairing{}).Where("swiss_id = ? AND round = ? AND result = ?", swiss.ID, swiss.CurrentRound, NoOutcome.String()).Count(&playing)
+
+		switch {
+		case swiss.Status == SwissScheduled:
+			ss.start(swiss)
+		case playing > 0 || now.Before(swiss.NextRoundAt):
+			// The round is still being played, or a paused tournament isn't due to be tried again
+		case swiss.CurrentRound >= swiss.Rounds:
+			ss.finish(swiss)
+		default:
+			force := swiss.Status == SwissPaused && swiss.PausedAt != nil && !now.Before(swiss.PausedAt.Add(swissPauseLimit))
+			ss.startRound(swiss, force)
+		}
+	}
+}
+
+// start Gives the players their starting numbers by rating and pairs the first round
+func (ss *SwissService) start(swiss *Swiss) {
+	var players []*SwissPlayer
+	if err := ss.db.Where("swiss_id = ?", swiss.ID).Order("rating desc, created_at").Find(&players).Error; err != nil {
+		log.Println(err)
+		return
+	}
+
+	for i, player := range players {
+		player.StartNumber = i + 1
+		ss.db.Model(player).Update("start_number", player.StartNumber)
+	}
+
+	swiss.Status = SwissStarted
+	ss.db.Save(swiss)
+
+	var uuids []string
+	for _, player := range players {
+		uuids = append(uuids, player.Player)
+	}
+
+	ss.gs.mu.Lock()
+	ss.gs.notifyAll(uuids, NotifyTournamentStart, fmt.Sprintf("The Swiss tournament %s has started", swiss.Name), fmt.Sprintf("/swiss?id=%d", swiss.ID))
+	ss.gs.mu.Unlock()
+
+	ss.startRound(swiss, false)
+}
+
+// startRound Pairs the next round among the players who haven't withdrawn and starts its games. The
+// tournament is paused when the round cannot be paired, unless force gives byes until it can.
+func (ss *SwissService) startRound(swiss *Swiss, force bool) {
+	var players []*SwissPlayer
+	var pairings []*SwissPairing
+	if err := ss.db.Where("swiss_id = ?", swiss.ID).Find(&players).Error; err != nil {
+		log.Println(err)
+		return
+	}
+	if err := ss.db.Where("swiss_id = ?", swiss.ID).Find(&pairings).Error; err != nil {
+		log.Println(err)
+		return
+	}
+
+	var active []*swissRecord
+	for _, record := range swissRecords(players, pairings, swiss.CurrentRound) {
+		if !record.player.Withdrawn {
+			active = append(active, record)
+		}
+	}
+
+	if len(active) < 2 {
+		ss.finish(swiss)
+		return
+	}
+
+	if err := ss.markBlocks(active); err != nil {
+		log.Println(err)
+		return
+	}
+
+	var byes []*swissRecord
+	pairs, bye, err := pairSwiss(active)
+	switch {
+	case err == nil && bye != nil:
+		byes = []*swissRecord{bye}
+	case err != nil && force:
+		pairs, byes = forcePairing(active)
+	case err != nil:
+		log.Printf("swiss %d round %d: %v", swiss.ID, swiss.CurrentRound+1, err)
+		ss.pause(swiss, players, fmt.Sprintf("Round %d could not be paired: %v", swiss.CurrentRound+1, err))
+		return
+	}
+
+	setup, err := swiss.setup()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	now := time.Now()
+	round := swiss.CurrentRound + 1
+	var games []*Game
+	var roundPairings []*SwissPairing
+	for board, pair := range pairs {
+		white, black := allocateColors(pair[0], pair[1], board)
+		game, err := ss.gs.createGame(white.player.Player, black.player.Player, setup, now)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		game.SwissID = swiss.ID
+		ss.db.Save(game)
+		games = append(games, game)
+
+		roundPairings = append(roundPairings, &SwissPairing{
+			SwissID: swiss.ID,
+			Round:   round,
+			Board:   board + 1,
+			White:   white.player.Player,
+			Black:   black.player.Player,
+			GameID:  game.ID,
+			Result:  NoOutcome.String(),
+		})
+	}
+
+	for i, bye := range byes {
+		roundPairings = append(roundPairings, &SwissPairing{
+			SwissID: swiss.ID,
+			Round:   round,
+			Board:   len(pairs) + i + 1,
+			White:   bye.player.Player,
+			Bye:     true,
+			Result:  WhiteWon.String(),
+		})
+	}
+
+	if err := ss.db.Create(roundPairings).Error; err != nil {
+		log.Println(err)
+		return
+	}
+
+	swiss.CurrentRound = round
+	swiss.NextRoundAt = now.Add(time.Duration(swiss.RoundInterval) * time.Minute)
+	swiss.Status = SwissStarted
+	swiss.PairingError = ""
+	swiss.PausedAt = nil
+	ss.db.Save(swiss)
+	ss.refresh(swiss, false)
+
+	ss.gs.mu.Lock()
+	defer ss.gs.mu.Unlock()
+
+	for _, game := range games {
+		ss.gs.announceGame(game)
+	}
+
+	message := &broadcastMessage{Type: "swiss_round", Payload: map[string]interface{}{"swiss_id": swiss.ID, "round": round, "pairings": roundPairings}}
+	for _, player := range players {
+		ss.gs.send(player.Player, message)
+	}
+}
+
+// markBlocks Keeps players who blocked each other from being paired together
+func (ss *SwissService) markBlocks(records []*swissRecord) error {
+	byPlayer := make(map[string]*swissRecord, len(records))
+	uuids := make([]string, 0, len(records))
+	for _, record := range records {
+		byPlayer[record.player.Player] = record
+		uuids = append(uuids, record.player.Player)
+	}
+
+	var blocks []*Block
+	if err := ss.db.Where("player IN ? AND blocked IN ?", uuids, uuids).Find(&blocks).Error; err != nil {
+		return err
+	}
+
+	for _, block := range blocks {
+		player, other := byPlayer[block.Player], byPlayer[block.Blocked]
+		for _, pair := range [][2]*swissRecord{{player, other}, {other, player}} {
+			if pair[0].avoid == nil {
+				pair[0].avoid = make(map[*swissRecord]bool)
+			}
+			pair[0].avoid[pair[1]] = true
+		}
+	}
+
+	return nil
+}
+
+// pause Stops pairing the tournament and tells the organiser and the players why, rather than ending it
+// with rounds left. The round is tried again after swissPauseRetry, or at once when a player withdraws,
+// and they are only told the first time.
+func (ss *SwissService) pause(swiss *Swiss, players []*SwissPlayer, reason string) {
+	now := time.Now()
+	swiss.NextRoundAt = now.Add(swissPauseRetry)
+	swiss.PairingError = reason
+	if swiss.Status == SwissPaused {
+		ss.db.Save(swiss)
+		return
+	}
+
+	swiss.Status = SwissPaused
+	swiss.PausedAt = &now
+	ss.db.Save(swiss)
+
+	uuids := []string{swiss.CreatedBy}
+	for _, player := range players {
+		if player.Player != swiss.CreatedBy {
+			uuids = append(uuids, player.Player)
+		}
+	}
+
+	ss.gs.mu.Lock()
+	defer ss.gs.mu.Unlock()
+
+	ss.gs.notifyAll(uuids, NotifyTournamentPaused, fmt.Sprintf("The Swiss tournament %s is paused. %s", swiss.Name, reason), fmt.Sprintf("/swiss?id=%d", swiss.ID))
+}
+
+// refresh Recomputes the points and tiebreaks of every player, ranking them when final is set
+func (ss *SwissService) refresh(swiss *Swiss, final bool) []*SwissPlayer {
+	var players []*SwissPlayer
+	var pairings []*SwissPairing
+	if err := ss.db.Where("swiss_id = ?", swiss.ID).Find(&players).Error; err != nil {
+		log.Println(err)
+		return nil
+	}
+	if err := ss.db.Where("swiss_id = ?", swiss.ID).Find(&pairings).Error; err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	for _, record := range swissRecords(players, pairings, swiss.CurrentRound) {
+		record.player.Points = record.score
+		record.player.Buchholz = record.buchholz(swiss.Rounds)
+		record.player.SonnebornBerger = record.sonnebornBerger()
+	}
+
+	rankSwissPlayers(players)
+	for i, player := range players {
+		columns := []string{"points", "buchholz", "sonneborn_berger"}
+		if final {
+			player.Rank = i + 1
+			columns = append(columns, "rank")
+		}
+
+		ss.db.Model(player).Select(columns).Updates(player)
+	}
+
+	return players
+}
+
+// finish Ranks the players on points and tiebreaks and sends the final standings
+func (ss *SwissService) finish(swiss *Swiss) {
+	players := ss.refresh(swiss, true)
+
+	now := time.Now()
+	swiss.Status = SwissFinished
+	swiss.FinishedAt = &now
+	ss.db.Save(swiss)
+
+	ss.gs.mu.Lock()
+	defer ss.gs.mu.Unlock()
+
+	swiss.Players = players
+	message := &broadcastMessage{Type: "swiss_result", Payload: swiss}
+	for _, player := range players {
+		ss.gs.send(player.Player, message)
+	}
+}
+
+// GameStarted Swiss games need nothing when they start, they are announced by the service that made them
+func (ss *SwissService) GameStarted(*Game) {}
+
+// GameMoved Swiss games need nothing on a move
+func (ss *SwissService) GameMoved(*Game) {}
+
+// GameEnded Records the result on the game's pairing and updates the standings
+func (ss *SwissService) GameEnded(game *Game) {
+	if game.SwissID == 0 {
+		return
+	}
+
+	ss.db.Model(&SwissPairing{}).Where("game_id = ?", game.ID).Update("result", game.board.Outcome().String())
+
+	swiss := &Swiss{}
+	if ss.db.First(swiss, game.SwissID).RowsAffected == 0 {
+		return
+	}
+
+	ss.refresh(swiss, false)
+}
+
+// ExportTRF Writes the crosstable of a Swiss tournament in the FIDE Tournament Report File format
+func (ss *SwissService) ExportTRF(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	swiss, errResponse, status := ss.findSwiss(r.URL.Query().Get("id"))
+	if errResponse != nil {
+		RenderJSONResponse(w, status, errResponse)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"swiss-%d.trf\"", swiss.ID))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte(swiss.TRF())); err != nil {
+		log.Println(err)
+	}
+}
+
+// TRF Writes the tournament as a FIDE TRF-16 report, one 001 line per player in starting number order
+func (s *Swiss) TRF() string {
+	var sb strings.Builder
+	sb.WriteString("012 " + s.Name + "\n")
+	sb.WriteString("042 " + s.StartsAt.Format("2006/01/02") + "\n")
+	if s.FinishedAt != nil {
+		sb.WriteString("052 " + s.FinishedAt.Format("2006/01/02") + "\n")
+	}
+	sb.WriteString(fmt.Sprintf("062 %d\n", len(s.Players)))
+	sb.WriteString("092 Individual: Swiss-System (Dutch)\n")
+	if s.TimeControl != "" {
+		sb.WriteString("122 " + s.TimeControl + "\n")
+	} else if s.DaysPerMove > 0 {
+		sb.WriteString(fmt.Sprintf("122 %d days per move\n", s.DaysPerMove))
+	}
+	sb.WriteString(fmt.Sprintf("XXR %d\n", s.Rounds))
+
+	// Players come ranked from findSwiss, the rank of an unfinished tournament is the current standing
+	rank := make(map[string]int, len(s.Players))
+	startNumber := make(map[string]int, len(s.Players))
+	for i, player := range s.Players {
+		rank[player.Player] = i + 1
+		startNumber[player.Player] = player.StartNumber
+	}
+
+	players := append([]*SwissPlayer(nil), s.Players...)
+	sort.SliceStable(players, func(i, j int) bool {
+		return players[i].StartNumber < players[j].StartNumber
+	})
+
+	for _, player := range players {
+		sb.WriteString(fmt.Sprintf("001 %4d %1s%3s %-33.33s %4d %3s %11s %10s %4.1f %4d",
+			player.StartNumber, "", "", player.Name, player.Rating, "", "", "", player.Points, rank[player.Player]))
+
+		for round := 1; round <= s.CurrentRound; round++ {
+			sb.WriteString("  " + trfRound(s.Pairings, round, player.Player, startNumber))
+		}
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+// trfRound Writes the player's round as the opponent's starting number, the player's color and the result
+func trfRound(pairings []*SwissPairing, round int, player string, startNumber map[string]int) string {
+	for _, pairing := range pairings {
+		if pairing.Round != round || (pairing.White != player && pairing.Black != player) {
+			continue
+		}
+
+		if pairing.Bye {
+			return "0000 - U"
+		}
+
+		color, opponent := "w", pairing.Black
+		points := map[string]string{"1-0": "1", "0-1": "0", "1/2-1/2": "=", "*": " "}
+		if pairing.Black == player {
+			color, opponent = "b", pairing.White
+			points["1-0"], points["0-1"] = "0", "1"
+		}
+
+		return fmt.Sprintf("%4d %s %s", startNumber[opponent], color, points[pairing.Result])
+	}
+
+	// Players who withdrew score nothing in the rounds they missed
+	return "0000 - Z"
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// colorRecord Makes a player who has had the colors given, against nobody in particular
+func colorRecord(name string, colors ...Color) *swissRecord {
+	record := &swissRecord{player: &SwissPlayer{Player: name}}
+	for _, color := range colors {
+		record.rounds = append(record.rounds, swissRound{color: color, played: true, finished: true})
+	}
+
+	return record
+}
+
+func TestAllocateColors(t *testing.T) {
+	W, B := White, Black
+	tests := []struct {
+		name  string
+		a, b  []Color
+		board int
+		white string
+	}{
+		{"first round, odd board", nil, nil, 0, "a"},
+		{"first round, even board", nil, nil, 1, "b"},
+		{"only b has a preference", nil, []Color{W}, 0, "a"},
+		{"only b has a preference for white", nil, []Color{B}, 0, "b"},
+		{"preferences differ", []Color{B}, []Color{W}, 0, "a"},
+		{"preferences differ the other way", []Color{W}, []Color{B}, 0, "b"},
+		{"stronger preference wins", []Color{W}, []Color{W, W}, 0, "a"},
+		{"absolute preference beats a mild one", []Color{W, W}, []Color{W}, 0, "b"},
+		{"the latest round the colors differed decides", []Color{W, B, B, W}, []Color{B, W, B, W}, 0, "a"},
+		{"the same history favours the higher ranked player", []Color{B, W}, []Color{B, W}, 0, "b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := colorRecord("a", tt.a...), colorRecord("b", tt.b...)
+			if white, _ := allocateColors(a, b, tt.board); white.player.Player != tt.white {
+				t.Errorf("%s got white, want %s", white.player.Player, tt.white)
+			}
+		})
+	}
+}
+
+// testSwissPlayers Makes players rated from 2000 down, in starting number order
+func testSwissPlayers(n int) []*SwissPlayer {
+	players := make([]*SwissPlayer, n)
+	for i := range players {
+		players[i] = &SwissPlayer{Player: fmt.Sprintf("p%d", i+1), Rating: 2000 - 50*i, StartNumber: i + 1}
+	}
+
+	return players
+}
+
+// playSwiss Pairs the rounds given one after another, the higher rated player winning every game
+func playSwiss(t *testing.T, players []*SwissPlayer, rounds int) []*SwissPairing {
+	t.Helper()
+
+	rating := make(map[string]int, len(players))
+	for _, player := range players {
+		rating[player.Player] = player.Rating
+	}
+
+	var pairings []*SwissPairing
+	for round := 1; round <= rounds; round++ {
+		pairs, bye, err := pairSwiss(swissRecords(players, pairings, round-1))
+		if err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+
+		for board, pair := range pairs {
+			white, black := allocateColors(pair[0], pair[1], board)
+			result := BlackWon.String()
+			if rating[white.player.Player] > rating[black.player.Player] {
+				result = WhiteWon.String()
+			}
+
+			pairings = append(pairings, &SwissPairing{Round: round, Board: board + 1, White: white.player.Player, Black: black.player.Player, Result: result})
+		}
+
+		if bye != nil {
+			pairings = append(pairings, &SwissPairing{Round: round, Board: len(pairs) + 1, White: bye.player.Player, Bye: true, Result: WhiteWon.String()})
+		}
+	}
+
+	return pairings
+}
+
+func TestPairSwissNoRepeats(t *testing.T) {
+	tests := []struct {
+		players, rounds int
+	}{
+		{4, 3},
+		{6, 5},
+		{8, 5},
+		{10, 7},
+		{16, 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d players %d rounds", tt.players, tt.rounds), func(t *testing.T) {
+			players := testSwissPlayers(tt.players)
+			pairings := playSwiss(t, players, tt.rounds)
+
+			met := make(map[[2]string]int)
+			for _, pairing := range pairings {
+				key := [2]string{pairing.White, pairing.Black}
+				if key[0] > key[1] {
+					key[0], key[1] = key[1], key[0]
+				}
+				if met[key]++; met[key] > 1 {
+					t.Errorf("%s and %s met twice", key[0], key[1])
+				}
+			}
+
+			for _, record := range swissRecords(players, pairings, tt.rounds) {
+				difference := 0
+				for _, color := range record.colors() {
+					if color == White {
+						difference++
+					} else {
+						difference--
+					}
+				}
+				if difference < -2 || difference > 2 {
+					t.Errorf("%s has a color difference of %d", record.player.Player, difference)
+				}
+			}
+		})
+	}
+}
+
+func TestPairSwissByeRotation(t *testing.T) {
+	tests := []struct {
+		players, rounds int
+	}{
+		{3, 3},
+		{5, 4},
+		{7, 5},
+		{9, 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d players %d rounds", tt.players, tt.rounds), func(t *testing.T) {
+			players := testSwissPlayers(tt.players)
+			pairings := playSwiss(t, players, tt.rounds)
+
+			byes := make(map[string]int)
+			for _, pairing := range pairings {
+				if !pairing.Bye {
+					continue
+				}
+
+				if byes[pairing.White]++; byes[pairing.White] > 1 {
+					t.Errorf("%s got a second bye in round %d", pairing.White, pairing.Round)
+				}
+				if pairing.Round == 1 && pairing.White != players[len(players)-1].Player {
+					t.Errorf("the first bye went to %s, want the lowest rated player", pairing.White)
+				}
+			}
+
+			if len(byes) != tt.rounds {
+				t.Errorf("%d players had byes, want one a round", len(byes))
+			}
+		})
+	}
+}
+
+func TestPairSwissUnpairable(t *testing.T) {
+	tests := []struct {
+		name    string
+		players int
+		played  [][2]int
+		byes    []int
+		blocks  [][2]int
+		// forced is the number of byes forcePairing gives
+		forced int
+	}{
+		{"two players who met", 2, [][2]int{{0, 1}}, nil, nil, 2},
+		{"two players who blocked each other", 2, nil, nil, [][2]int{{0, 1}}, 2},
+		{"everyone had a bye", 3, [][2]int{{0, 1}}, []int{0, 1, 2}, nil, 1},
+		{"the player without a bye can't take it", 3, [][2]int{{0, 1}, {1, 2}}, []int{1, 2}, nil, 1},
+		{"four players with one who met everyone", 4, [][2]int{{0, 1}, {0, 2}, {0, 3}}, nil, nil, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records := swissRecords(testSwissPlayers(tt.players), nil, len(tt.played)+len(tt.byes))
+			round := 0
+			for _, pair := range tt.played {
+				a, b := records[pair[0]], records[pair[1]]
+				a.rounds[round] = swissRound{opponent: b, color: White, played: true, finished: true}
+				b.rounds[round] = swissRound{opponent: a, color: Black, played: true, finished: true}
+				round++
+			}
+			for _, player := range tt.byes {
+				records[player].rounds[round] = swissRound{bye: true, points: 1, finished: true}
+				round++
+			}
+			for _, pair := range tt.blocks {
+				a, b := records[pair[0]], records[pair[1]]
+				a.avoid = map[*swissRecord]bool{b: true}
+				b.avoid = map[*swissRecord]bool{a: true}
+			}
+
+			if _, _, err := pairSwiss(records); !errors.Is(err, ErrNoPairing) {
+				t.Fatalf("got %v, want ErrNoPairing", err)
+			}
+
+			pairs, byes := forcePairing(records)
+			if len(byes) != tt.forced || 2*len(pairs)+len(byes) != tt.players {
+				t.Errorf("forced %d pairs and %d byes, want %d byes", len(pairs), len(byes), tt.forced)
+			}
+			for _, pair := range pairs {
+				if !compatible(pair[0], pair[1], false) {
+					t.Errorf("forced %s against %s, who can't meet", pair[0].player.Player, pair[1].player.Player)
+				}
+			}
+		})
+	}
+}
+
+// newTestSwissService Makes a Swiss service without its handlers or scheduler, for a tournament of two players
+// who have already met in the first of three rounds
+func newTestSwissService(t *testing.T) (*SwissService, *Swiss) {
+	t.Helper()
+
+	db := newTestDB(t, &Swiss{}, &SwissPlayer{}, &SwissPairing{}, &Notification{}, &Block{})
+	ss := &SwissService{db: db, gs: &GameService{db: db}}
+
+	swiss := &Swiss{CreatedBy: "organiser", Name: "Stuck", Variant: VariantStandard, DaysPerMove: 1, Rounds: 3, CurrentRound: 1, Status: SwissStarted}
+	if err := db.Create(swiss).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, player := range testSwissPlayers(2) {
+		player.SwissID = swiss.ID
+		if err := db.Create(player).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Create(&SwissPairing{SwissID: swiss.ID, Round: 1, Board: 1, White: "p1", Black: "p2", GameID: 1, Result: WhiteWon.String()}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return ss, swiss
+}
+
+func (ss *SwissService) testSwiss(t *testing.T, id uint) *Swiss {
+	t.Helper()
+
+	swiss := &Swiss{}
+	if err := ss.db.First(swiss, id).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return swiss
+}
+
+func TestSwissPause(t *testing.T) {
+	ss, swiss := newTestSwissService(t)
+	now := time.Now()
+
+	ss.schedule(now)
+	paused := ss.testSwiss(t, swiss.ID)
+	if paused.Status != SwissPaused || paused.PairingError == "" || paused.PausedAt == nil || paused.CurrentRound != 1 {
+		t.Fatalf("tournament is %s in round %d with error %q, want paused in round 1", paused.Status, paused.CurrentRound, paused.PairingError)
+	}
+
+	var notified int64
+	ss.db.Model(&Notification{}).Where("kind = ?", NotifyTournamentPaused).Count(&notified)
+	if notified != 3 {
+		t.Errorf("%d notifications, want the organiser and both players told", notified)
+	}
+
+	// Trying again, whether too early or when due, doesn't tell anyone twice
+	ss.schedule(now.Add(swissPauseRetry / 2))
+	ss.schedule(now.Add(swissPauseRetry + time.Second))
+	ss.db.Model(&Notification{}).Where("kind = ?", NotifyTournamentPaused).Count(&notified)
+	if notified != 3 {
+		t.Errorf("%d notifications after trying again, want 3", notified)
+	}
+	if retried := ss.testSwiss(t, swiss.ID); retried.Status != SwissPaused || !retried.NextRoundAt.After(now.Add(swissPauseRetry)) {
+		t.Errorf("tournament is %s and tried again at %v, want paused and put off", retried.Status, retried.NextRoundAt)
+	}
+
+	// Left paused for too long the round is paired with byes
+	ss.schedule(paused.PausedAt.Add(swissPauseLimit))
+	resumed := ss.testSwiss(t, swiss.ID)
+	if resumed.Status != SwissStarted || resumed.PairingError != "" || resumed.PausedAt != nil || resumed.CurrentRound != 2 {
+		t.Fatalf("tournament is %s in round %d with error %q, want started in round 2", resumed.Status, resumed.CurrentRound, resumed.PairingError)
+	}
+
+	var byes int64
+	ss.db.Model(&SwissPairing{}).Where("swiss_id = ? AND round = 2 AND bye = ?", swiss.ID, true).Count(&byes)
+	if byes != 2 {
+		t.Errorf("round 2 has %d byes, want 2", byes)
+	}
+}
+
+func TestSwissPauseFinish(t *testing.T) {
+	ss, swiss := newTestSwissService(t)
+
+	ss.schedule(time.Now())
+	paused := ss.testSwiss(t, swiss.ID)
+	if paused.Status != SwissPaused {
+		t.Fatalf("tournament is %s, want paused", paused.Status)
+	}
+
+	ss.finish(paused)
+	finished := ss.testSwiss(t, swiss.ID)
+	if finished.Status != SwissFinished || finished.FinishedAt == nil {
+		t.Fatalf("tournament is %s, want finished", finished.Status)
+	}
+
+	var winner SwissPlayer
+	ss.db.First(&winner, "swiss_id = ? AND rank = 1", swiss.ID)
+	if winner.Player != "p1" || winner.Points != 1 {
+		t.Errorf("%s won with %v points, want p1 with 1", winner.Player, winner.Points)
+	}
+
+	// Finished tournaments are left alone
+	ss.schedule(time.Now().Add(swissPauseLimit))
+	if ss.testSwiss(t, swiss.ID).CurrentRound != 1 {
+		t.Error("a finished tournament was paired")
+	}
+}
+
+func TestSwissTRF(t *testing.T) {
+	startsAt := time.Date(2024, 3, 9, 18, 0, 0, 0, time.UTC)
+	finishedAt := startsAt.Add(2 * time.Hour)
+	swiss := &Swiss{
+		Name:         "Spring Swiss",
+		TimeControl:  "5+3",
+		Rounds:       2,
+		CurrentRound: 2,
+		StartsAt:     startsAt,
+		FinishedAt:   &finishedAt,
+		// Ranked as findSwiss gives them
+		Players: []*SwissPlayer{
+			{Player: "c", Name: "Hopper, Grace", Rating: 1800, StartNumber: 3, Points: 1.5},
+			{Player: "a", Name: "Lovelace, Ada", Rating: 2000, StartNumber: 1, Points: 1.5},
+			{Player: "b", Name: "Babbage, Charles", Rating: 1900, StartNumber: 2, Points: 0},
+		},
+		Pairings: []*SwissPairing{
+			{Round: 1, Board: 1, White: "a", Black: "b", Result: WhiteWon.String()},
+			{Round: 1, Board: 2, White: "c", Bye: true, Result: WhiteWon.String()},
+			{Round: 2, Board: 1, White: "c", Black: "a", Result: Draw.String()},
+		},
+	}
+
+	lines := strings.Split(strings.TrimSuffix(swiss.TRF(), "\n"), "\n")
+	header := []string{
+		"012 Spring Swiss",
+		"042 2024/03/09",
+		"052 2024/03/09",
+		"062 3",
+		"092 Individual: Swiss-System (Dutch)",
+		"122 5+3",
+		"XXR 2",
+	}
+	if len(lines) != len(header)+3 {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(header)+3, strings.Join(lines, "\n"))
+	}
+	for i, want := range header {
+		if lines[i] != want {
+			t.Errorf("line %d is %q, want %q", i+1, lines[i], want)
+		}
+	}
+
+	// The fields of a player line by their columns in TRF-16, counting from one
+	field := func(line string, from, to int) string {
+		if len(line) < to {
+			return ""
+		}
+		return line[from-1 : to]
+	}
+
+	tests := []struct {
+		number, name, rating, points, rank string
+		rounds                             []string
+	}{
+		{"   1", "Lovelace, Ada", "2000", " 1.5", "   2", []string{"   2 w 1", "   3 b ="}},
+		{"   2", "Babbage, Charles", "1900", " 0.0", "   3", []string{"   1 b 0", "0000 - Z"}},
+		{"   3", "Hopper, Grace", "1800", " 1.5", "   1", []string{"0000 - U", "   1 w ="}},
+	}
+
+	for i, tt := range tests {
+		line := lines[len(header)+i]
+		if field(line, 1, 3) != "001" || field(line, 5, 8) != tt.number {
+			t.Errorf("line %q isn't player %s", line, tt.number)
+		}
+		if got := strings.TrimSpace(field(line, 15, 47)); got != tt.name {
+			t.Errorf("player %s is named %q, want %q", tt.number, got, tt.name)
+		}
+		if got := field(line, 49, 52); got != tt.rating {
+			t.Errorf("player %s is rated %q, want %q", tt.number, got, tt.rating)
+		}
+		if got := field(line, 81, 84); got != tt.points {
+			t.Errorf("player %s has %q points, want %q", tt.number, got, tt.points)
+		}
+		if got := field(line, 86, 89); got != tt.rank {
+			t.Errorf("player %s is ranked %q, want %q", tt.number, got, tt.rank)
+		}
+		for round, want := range tt.rounds {
+			start := 92 + 10*round
+			if got := field(line, start, start+7); got != want {
+				t.Errorf("player %s round %d is %q, want %q", tt.number, round+1, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+// maxPairingSteps bounds the search for a pairing so that a round that cannot be paired fails quickly
+const maxPairingSteps = 200000
+
+var ErrNoPairing = errors.New("no valid pairing for the round")
+
+// swissRound is what a player did in one round: a game, a bye or nothing if they were absent
+type swissRound struct {
+	opponent *swissRecord
+	color    Color
+	points   float64
+	bye      bool
+	played   bool
+	finished bool
+}
+
+// swissRecord is a player's history in a Swiss tournament, rebuilt from the pairings of every round
+type swissRecord struct {
+	player *SwissPlayer
+	score  float64
+	rounds []swissRound
+	// group and index place the player in their score group at the start of a round
+	group []*swissRecord
+	index int
+	// avoid are the players this one blocked or was blocked by, whom they never meet
+	avoid map[*swissRecord]bool
+}
+
+func (r *swissRecord) hadBye() bool {
+	for _, round := range r.rounds {
+		if round.bye {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *swissRecord) played(other *swissRecord) bool {
+	for _, round := range r.rounds {
+		if round.opponent == other {
+			return true
+		}
+	}
+
+	return false
+}
+
+// colors lists the colors of the games the player has had, byes and absences are skipped
+func (r *swissRecord) colors() []Color {
+	var colors []Color
+	for _, round := range r.rounds {
+		if round.played {
+			colors = append(colors, round.color)
+		}
+	}
+
+	return colors
+}
+
+// colorPreference returns the color the player should get next and how strongly: 2 when it is
+// absolute (a color difference of two or the same color twice in a row), 1 when the colors are
+// uneven and 0 when the player only wants to alternate
+func (r *swissRecord) colorPreference() (Color, int) {
+	colors := r.colors()
+	if len(colors) == 0 {
+		return NoColor, 0
+	}
+
+	difference := 0
+	for _, color := range colors {
+		if color == White {
+			difference++
+		} else {
+			difference--
+		}
+	}
+
+	last := colors[len(colors)-1]
+	switch {
+	case difference > 1:
+		return Black, 2
+	case difference < -1:
+		return White, 2
+	case len(colors) >= 2 && colors[len(colors)-2] == last:
+		return last.Other(), 2
+	case difference == 1:
+		return Black, 1
+	case difference == -1:
+		return White, 1
+	}
+
+	return last.Other(), 0
+}
+
+// compatible reports whether two players may meet: never twice nor when either blocked the other, and when
+// strict not if both must have the same color
+func compatible(a, b *swissRecord, strict bool) bool {
+	if a.played(b) || a.avoid[b] {
+		return false
+	}
+
+	if !strict {
+		return true
+	}
+
+	colorA, strengthA := a.colorPreference()
+	colorB, strengthB := b.colorPreference()
+	return !(strengthA == 2 && strengthB == 2 && colorA == colorB)
+}
+
+// allocateColors Returns the pair as white and black, a is the higher ranked player and board is the
+// zero-based board number, used to alternate colors in the first round
+func allocateColors(a, b *swissRecord, board int) (*swissRecord, *swissRecord) {
+	colorA, strengthA := a.colorPreference()
+	colorB, strengthB := b.colorPreference()
+
+	var white bool
+	switch {
+	case colorA == NoColor && colorB == NoColor:
+		white = board%2 == 0
+	case colorA == NoColor:
+		white = colorB == Black
+	case colorB == NoColor || colorA != colorB:
+		white = colorA == White
+	case strengthA != strengthB:
+		white = (strengthA > strengthB) == (colorA == White)
+	default:
+		// The colors last differed is where the players go their own way, otherwise the higher ranked player wins
+		white = colorA == White
+		colorsA, colorsB := a.colors(), b.colors()
+		for i, j := len(colorsA)-1, len(colorsB)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+			if colorsA[i] != colorsB[j] {
+				white = colorsA[i] == Black
+				break
+			}
+		}
+	}
+
+	if white {
+		return a, b
+	}
+
+	return b, a
+}
+
+// rankRecords Sorts players into pairing order, by score, then rating, then starting number
+func rankRecords(records []*swissRecord) {
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		if a.player.Rating != b.player.Rating {
+			return a.player.Rating > b.player.Rating
+		}
+		return a.player.StartNumber < b.player.StartNumber
+	})
+}
+
+// pairSwiss Pairs a round in the manner of the Dutch system: players meet others of the same score,
+// the top half of each score group against the bottom half, with players floating to the next group
+// when they can't be paired in their own. When the number of players is odd the lowest ranked player
+// who hasn't had a bye yet gets one. Color constraints are relaxed if the round cannot be paired with them.
+func pairSwiss(records []*swissRecord) ([][2]*swissRecord, *swissRecord, error) {
+	rankRecords(records)
+	groupRecords(records)
+
+	for _, strict := range []bool{true, false} {
+		pairs, bye, err := pairWithBye(records, strict)
+		if err == nil {
+			return pairs, bye, nil
+		}
+	}
+
+	return nil, nil, ErrNoPairing
+}
+
+// forcePairing Pairs a round that pairSwiss couldn't by giving out more byes, whether or not the players had
+// one: the last bye is tried on each player from the bottom up and the others go to the lowest ranked. In the
+// end everyone gets a bye, so it always gives a round.
+func forcePairing(records []*swissRecord) ([][2]*swissRecord, []*swissRecord) {
+	rankRecords(records)
+	groupRecords(records)
+
+	pair := func(records []*swissRecord) ([][2]*swissRecord, bool) {
+		for _, strict := range []bool{true, false} {
+			steps := 0
+			if pairs, ok := pairRemaining(records, strict, &steps); ok {
+				return pairs, true
+			}
+		}
+		return nil, false
+	}
+
+	if len(records)%2 == 0 {
+		if pairs, ok := pair(records); ok {
+			return pairs, nil
+		}
+	}
+
+	for byes := 2 - len(records)%2; byes <= len(records); byes += 2 {
+		rest, lowest := records[:len(records)-byes+1], records[len(records)-byes+1:]
+		for i := len(rest) - 1; i >= 0; i-- {
+			others := append(append([]*swissRecord(nil), rest[:i]...), rest[i+1:]...)
+			if pairs, ok := pair(others); ok {
+				return pairs, append([]*swissRecord{rest[i]}, lowest...)
+			}
+		}
+	}
+
+	return nil, records
+}
+
+// pairWithBye Pairs the players, giving the bye to the lowest ranked player who can take it when their number
+// is odd. Each player tried for the bye gets the whole search budget, so one hard case doesn't rule out the rest.
+func pairWithBye(records []*swissRecord, strict bool) ([][2]*swissRecord, *swissRecord, error) {
+	if len(records)%2 == 0 {
+		steps := 0
+		pairs, ok := pairRemaining(records, strict, &steps)
+		if !ok {
+			return nil, nil, ErrNoPairing
+		}
+		return pairs, nil, nil
+	}
+
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].hadBye() {
+			continue
+		}
+
+		steps := 0
+		rest := append(append([]*swissRecord(nil), records[:i]...), records[i+1:]...)
+		if pairs, ok := pairRemaining(rest, strict, &steps); ok {
+			return pairs, records[i], nil
+		}
+	}
+
+	return nil, nil, ErrNoPairing
+}
+
+// groupRecords Places every player in their score group
+func groupRecords(records []*swissRecord) {
+	for start := 0; start < len(records); {
+		end := start
+		for end < len(records) && records[end].score == records[start].score {
+			end++
+		}
+
+		group := records[start:end]
+		for i, record := range group {
+			record.group = group
+			record.index = i
+		}
+		start = end
+	}
+}
+
+// pairRemaining Pairs the highest ranked player left with the best opponent that still lets everyone
+// else be paired, backtracking when it doesn't
+func pairRemaining(records []*swissRecord, strict bool, steps *int) ([][2]*swissRecord, bool) {
+	if len(records) == 0 {
+		return nil, true
+	}
+
+	if *steps++; *steps > maxPairingSteps {
+		return nil, false
+	}
+
+	top := records[0]
+	for _, opponent := range candidates(top, records[1:]) {
+		if !compatible(top, opponent, strict) {
+			continue
+		}
+
+		rest := make([]*swissRecord, 0, len(records)-2)
+		for _, record := range records[1:] {
+			if record != opponent {
+				rest = append(rest, record)
+			}
+		}
+
+		if pairs, ok := pairRemaining(rest, strict, steps); ok {
+			return append([][2]*swissRecord{{top, opponent}}, pairs...), true
+		}
+	}
+
+	return nil, false
+}
+
+// candidates Orders the possible opponents of a player: closest in score first, and within a score group
+// the player as far down as the top player is from the top, so the top half meets the bottom half
+func candidates(top *swissRecord, others []*swissRecord) []*swissRecord {
+	ordered := append([]*swissRecord(nil), others...)
+	ideal := top.index + len(top.group)/2
+
+	distance := func(r *swissRecord) int {
+		d := r.index - ideal
+		if d < 0 {
+			d = -d
+		}
+		return d
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := ordered[i], ordered[j]
+		da, db := top.score-a.score, top.score-b.score
+		if da < 0 {
+			da = -da
+		}
+		if db < 0 {
+			db = -db
+		}
+		if da != db {
+			return da < db
+		}
+		if a.score == top.score {
+			return distance(a) < distance(b)
+		}
+		return false
+	})
+
+	return ordered
+}
+
+// buchholz Sums the scores of the player's opponents. A round without a game counts as a game against a
+// virtual opponent who drew every remaining round, as in the FIDE rules for unplayed games.
+func (r *swissRecord) buchholz(rounds int) float64 {
+	total := 0.0
+	before := 0.0
+	for n, round := range r.rounds {
+		switch {
+		case round.played:
+			total += round.opponent.score
+		default:
+			total += before + (1 - round.points) + 0.5*float64(rounds-n-1)
+		}
+		before += round.points
+	}
+
+	return total
+}
+
+// sonnebornBerger Sums the scores of the opponents the player beat and half the scores of those they drew
+func (r *swissRecord) sonnebornBerger() float64 {
+	total := 0.0
+	for _, round := range r.rounds {
+		if round.played {
+			total += round.points * round.opponent.score
+		}
+	}
+
+	return total
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pjebs/jsonerror"
+	"gorm.io/gorm"
+)
+
+const (
+	TeamMatchProposed = "proposed"
+	TeamMatchStarted  = "started"
+	TeamMatchFinished = "finished"
+	TeamMatchDeclined = "declined"
+
+	maxTeamBoards = 50
+)
+
+// TeamMatch is a match between two clubs, their members play each other board by board and the
+// points of every board add up to each club's score
+type TeamMatch struct {
+	ID          uint         `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	CreatedBy   string       `gorm:"not null" json:"created_by"`
+	HomeClubID  uint         `gorm:"not null;index" json:"home_club_id"`
+	AwayClubID  uint         `gorm:"not null;index" json:"away_club_id"`
+	Boards      int          `gorm:"not null" json:"boards"`
+	Variant     string       `gorm:"not null;default:standard" json:"variant"`
+	TimeControl string       `json:"time_control,omitempty"`
+	DaysPerMove int          `json:"days,omitempty"`
+	Status      string       `gorm:"not null;default:proposed" json:"status"`
+	HomeScore   float64      `json:"home_score"`
+	AwayScore   float64      `json:"away_score"`
+	FinishedAt  *time.Time   `json:"finished_at,omitempty"`
+	Lineup      []*TeamBoard `json:"lineup,omitempty"`
+}
+
+// TeamBoard is one board of a team match, the home player has white on odd boards
+type TeamBoard struct {
+	ID          uint   `gorm:"primarykey" json:"-"`
+	TeamMatchID uint   `gorm:"not null;index" json:"-"`
+	Board       int    `gorm:"not null" json:"board"`
+	Home        string `gorm:"not null" json:"home"`
+	Away        string `json:"away,omitempty"`
+	GameID      uint   `gorm:"index" json:"game_id,omitempty"`
+	Result      string `gorm:"not null;default:*" json:"result"`
+}
+
+func (m *TeamMatch) setup() (*GameSetup, error) {
+	setup := &GameSetup{Variant: m.Variant, Chess960Position: RandomChess960Position, DaysPerMove: m.DaysPerMove}
+	if m.TimeControl != "" {
+		tc, err := ParseTimeControl(m.TimeControl)
+		if err != nil {
+			return nil, err
+		}
+		setup.TimeControl = tc
+	}
+
+	return setup, setup.Validate()
+}
+
+func (m *TeamMatch) validate() error {
+	switch {
+	case m.HomeClubID == m.AwayClubID:
+		return errors.New("a club cannot play a team match against itself")
+	case m.Boards < 1 || m.Boards > maxTeamBoards:
+		return fmt.Errorf("boards must be between 1 and %d", maxTeamBoards)
+	case m.Variant == VariantBughouse || m.Variant == VariantFromPosition:
+		return fmt.Errorf("team matches cannot be played as %s", m.Variant)
+	}
+
+	_, err := m.setup()
+	return err
+}
+
+// homeWhite reports whether the home player has white on the board
+func (b *TeamBoard) homeWhite() bool {
+	return b.Board%2 == 1
+}
+
+// homePoints is what the board scores for the home club, once it is finished
+func (b *TeamBoard) homePoints() float64 {
+	switch {
+	case b.Result == Draw.String():
+		return 0.5
+	case (b.Result == WhiteWon.String()) == b.homeWhite() && b.Result != NoOutcome.String():
+		return 1
+	}
+
+	return 0
+}
+
+// lineup Checks the players a club fields in a team match, or picks its highest rated members when none are given
+func (cs *ClubService) lineup(clubID uint, requested []string, boards int) ([]string, error) {
+	if len(requested) == 0 {
+		var memberships []*Membership
+		if err := cs.db.Where("club_id = ? AND status = ?", clubID, MembershipActive).Find(&memberships).Error; err != nil {
+			return nil, err
+		}
+
+		var members []*User
+		for _, membership := range memberships {
+			if user, err := cs.gs.us.GetUser(membership.Player); err == nil {
+				members = append(members, user)
+			}
+		}
+		sort.SliceStable(members, func(i, j int) bool {
+			return members[i].ELO > members[j].ELO
+		})
+
+		for _, member := range members {
+			requested = append(requested, member.UUID.String())
+		}
+		if len(requested) > boards {
+			requested = requested[:boards]
+		}
+	}
+
+	if len(requested) != boards {
+		return nil, fmt.Errorf("the club needs %d players for the match, got %d", boards, len(requested))
+	}
+
+	seen := make(map[string]bool, boards)
+	for _, player := range requested {
+		if seen[player] {
+			return nil, fmt.Errorf("%s is in the lineup twice", player)
+		}
+		seen[player] = true
+
+		if !clubMember(cs.db, clubID, player) {
+			return nil, fmt.Errorf("%s is not a member of club %d", player, clubID)
+		}
+	}
+
+	return requested, nil
+}
+
+type NewTeamMatchRequest struct {
+	HomeClubID  uint     `json:"home_club_id"`
+	AwayClubID  uint     `json:"away_club_id"`
+	Boards      int      `json:"boards"`
+	Variant     string   `json:"variant"`
+	TimeControl string   `json:"time_control"`
+	DaysPerMove int      `json:"days"`
+	Lineup      []string `json:"lineup"`
+}
+
+type LineupRequest struct {
+	Lineup []string `json:"lineup"`
+}
+
+type TeamMatchResponse struct {
+	Successful bool              `json:"success"`
+	TeamMatch  *TeamMatch        `json:"team_match,omitempty"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+type TeamMatchListResponse struct {
+	Successful  bool              `json:"success"`
+	TeamMatches []*TeamMatch      `json:"team_matches"`
+	Error       map[string]string `json:"error,omitempty"`
+}
+
+func teamMatchError(code int, error, message string) *TeamMatchResponse {
+	return &TeamMatchResponse{Error: jsonerror.New(code, error, message).Render()}
+}
+
+// HandleTeamMatches Lists a club's team matches on GET with a club, shows one match on GET with an id,
+// and challenges another club on POST
+func (cs *ClubService) HandleTeamMatches(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("id") != "" {
+			cs.ShowTeamMatch(w, r)
+		} else {
+			cs.ListTeamMatches(w, r)
+		}
+	case http.MethodPost:
+		cs.ChallengeClub(w, r)
+	}
+}
+
+// ChallengeClub Proposes a team match to another club with the home club's lineup, only admins of the home club can
+func (cs *ClubService) ChallengeClub(w http.ResponseWriter, r *http.Request) {
+	user, userErr := cs.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"), ScopeChallengeWrite)
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	var request NewTeamMatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, teamMatchError(1, "Invalid JSON request", err.Error()))
+		return
+	}
+
+	match := &TeamMatch{
+		CreatedBy:   user.UUID.String(),
+		HomeClubID:  request.HomeClubID,
+		AwayClubID:  request.AwayClubID,
+		Boards:      request.Boards,
+		Variant:     request.Variant,
+		TimeControl: request.TimeControl,
+		DaysPerMove: request.DaysPerMove,
+		Status:      TeamMatchProposed,
+	}
+
+	if match.Variant == "" {
+		match.Variant = VariantStandard
+	}
+
+	if err := match.validate(); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, teamMatchError(110, "Invalid team match", err.Error()))
+		return
+	}
+
+	if cs.db.First(&Club{}, match.AwayClubID).RowsAffected == 0 {
+		RenderJSONResponse(w, http.StatusNotFound, teamMatchError(112, "Club not found", fmt.Sprintf("Club does not exist with given ID: %d", match.AwayClubID)))
+		return
+	}
+
+	if !clubAdmin(cs.db, match.HomeClubID, user.UUID.String()) {
+		RenderJSONResponse(w, http.StatusForbidden, teamMatchError(113, "Not a club admin", "Only admins of the home club can challenge another club"))
+		return
+	}
+
+	lineup, err := cs.lineup(match.HomeClubID, request.Lineup, match.Boards)
+	if err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, teamMatchError(118, "Invalid lineup", err.Error()))
+		return
+	}
+
+	for i, player := range lineup {
+		match.Lineup = append(match.Lineup, &TeamBoard{Board: i + 1, Home: player, Result: NoOutcome.String()})
+	}
+
+	if err := cs.db.Create(match).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, teamMatchError(28, "Internal server error", "Error creating team match"))
+		return
+	}
+
+	var admins []string
+	if err := cs.db.Model(&Membership{}).Where("club_id = ? AND status = ? AND role = ?", match.AwayClubID, MembershipActive, ClubAdmin).Pluck("player", &admins).Error; err != nil {
+		log.Println(err)
+	}
+
+	home := &Club{}
+	cs.db.First(home, match.HomeClubID)
+
+	cs.gs.mu.Lock()
+	cs.gs.notifyAll(admins, NotifyChallenge, fmt.Sprintf("%s challenged your club to a team match over %d boards", home.Name, match.Boards), fmt.Sprintf("/clubs/matches?id=%d", match.ID))
+	cs.gs.mu.Unlock()
+
+	RenderJSONResponse(w, http.StatusCreated, &TeamMatchResponse{Successful: true, TeamMatch: match})
+}
+
+// ListTeamMatches Shows the team matches a club has played or been challenged to
+func (cs *ClubService) ListTeamMatches(w http.ResponseWriter, r *http.Request) {
+	club := r.URL.Query().Get("club")
+
+	var matches []*TeamMatch
+	if err := cs.db.Where("home_club_id = ? OR away_club_id = ?", club, club).Order("created_at desc").Find(&matches).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &TeamMatchListResponse{Error: jsonerror.New(28, "Internal server error", "Error loading team matches").Render()})
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &TeamMatchListResponse{Successful: true, TeamMatches: matches})
+}
+
+// ShowTeamMatch Gives a team match with every board of its lineup
+func (cs *ClubService) ShowTeamMatch(w http.ResponseWriter, r *http.Request) {
+	match, errResponse, status := cs.findTeamMatch(r.URL.Query().Get("id"))
+	if errResponse != nil {
+		RenderJSONResponse(w, status, errResponse)
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &TeamMatchResponse{Successful: true, TeamMatch: match})
+}
+
+// findTeamMatch Loads a team match by its id with its boards in order
+func (cs *ClubService) findTeamMatch(rawID string) (*TeamMatch, *TeamMatchResponse, int) {
+	id, err := strconv.ParseUint(rawID, 10, 64)
+	if err != nil {
+		return nil, teamMatchError(120, "Team match not found", "Invalid team match id: "+rawID), http.StatusBadRequest
+	}
+
+	match := &TeamMatch{}
+	if cs.db.Preload("Lineup", func(db *gorm.DB) *gorm.DB {
+		return db.Order("board")
+	}).First(match, id).RowsAffected == 0 {
+		return nil, teamMatchError(120, "Team match not found", fmt.Sprintf("Team match does not exist with given ID: %d", id)), http.StatusNotFound
+	}
+
+	return match, nil, http.StatusOK
+}
+
+// awayAdminAction Authenticates an admin of the away club acting on a proposed team match
+func (cs *ClubService) awayAdminAction(w http.ResponseWriter, r *http.Request) (*TeamMatch, bool) {
+	if r.Method != http.MethodPost {
+		return nil, false
+	}
+
+	user, userErr := cs.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return nil, false
+	}
+
+	match, errResponse, status := cs.findTeamMatch(r.URL.Query().Get("id"))
+	if errResponse != nil {
+		RenderJSONResponse(w, status, errResponse)
+		return nil, false
+	}
+
+	switch {
+	case !clubAdmin(cs.db, match.AwayClubID, user.UUID.String()):
+		RenderJSONResponse(w, http.StatusForbidden, teamMatchError(113, "Not a club admin", "Only admins of the challenged club can answer a team match"))
+		return nil, false
+	case match.Status != TeamMatchProposed:
+		RenderJSONResponse(w, http.StatusBadRequest, teamMatchError(110, "Invalid team match", "The team match has already been answered"))
+		return nil, false
+	}
+
+	return match, true
+}
+
+// AcceptTeamMatch Accepts a team match with the away club's lineup and starts a game on every board
+func (cs *ClubService) AcceptTeamMatch(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	match, ok := cs.awayAdminAction(w, r)
+	if !ok {
+		return
+	}
+
+	var request LineupRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			RenderJSONResponse(w, http.StatusBadRequest, teamMatchError(1, "Invalid JSON request", err.Error()))
+			return
+		}
+	}
+
+	lineup, err := cs.lineup(match.AwayClubID, request.Lineup, match.Boards)
+	if err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, teamMatchError(118, "Invalid lineup", err.Error()))
+		return
+	}
+
+	for i, board := range match.Lineup {
+		if board.Home == lineup[i] {
+			RenderJSONResponse(w, http.StatusBadRequest, teamMatchError(118, "Invalid lineup", fmt.Sprintf("%s cannot play against themselves", lineup[i])))
+			return
+		}
+		board.Away = lineup[i]
+	}
+
+	setup, err := match.setup()
+	if err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, teamMatchError(110, "Invalid team match", err.Error()))
+		return
+	}
+
+	now := time.Now()
+	var games []*Game
+	for _, board := range match.Lineup {
+		white, black := board.Home, board.Away
+		if !board.homeWhite() {
+			white, black = black, white
+		}
+
+		game, err := cs.gs.createGame(white, black, setup, now)
+		if err != nil {
+			log.Println(err)
+			RenderJSONResponse(w, http.StatusInternalServerError, teamMatchError(28, "Internal server error", "Error creating team match games"))
+			return
+		}
+
+		game.TeamMatchID = match.ID
+		cs.db.Save(game)
+		board.GameID = game.ID
+		cs.db.Save(board)
+		games = append(games, game)
+	}
+
+	match.Status = TeamMatchStarted
+	cs.db.Save(match)
+
+	cs.gs.mu.Lock()
+	defer cs.gs.mu.Unlock()
+
+	for _, game := range games {
+		cs.gs.announceGame(game)
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &TeamMatchResponse{Successful: true, TeamMatch: match})
+}
+
+// DeclineTeamMatch Turns down a team match
+func (cs *ClubService) DeclineTeamMatch(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	match, ok := cs.awayAdminAction(w, r)
+	if !ok {
+		return
+	}
+
+	match.Status = TeamMatchDeclined
+	cs.db.Save(match)
+
+	RenderJSONResponse(w, http.StatusOK, &TeamMatchResponse{Successful: true})
+}
+
+// GameStarted Team match games need nothing when they start, they are announced by the service that made them
+func (cs *ClubService) GameStarted(*Game) {}
+
+// GameMoved Team match games need nothing on a move
+func (cs *ClubService) GameMoved(*Game) {}
+
+// GameEnded Records the result of a board and adds it to the team scores, sending the final score to
+// every player in the match once all boards are over
+func (cs *ClubService) GameEnded(game *Game) {
+	if game.TeamMatchID == 0 {
+		return
+	}
+
+	cs.db.Model(&TeamBoard{}).Where("game_id = ?", game.ID).Update("result", game.board.Outcome().String())
+
+	match, errResponse, _ := cs.findTeamMatch(strconv.FormatUint(uint64(game.TeamMatchID), 10))
+	if errResponse != nil || match.Status != TeamMatchStarted {
+		return
+	}
+
+	finished := true
+	match.HomeScore, match.AwayScore = 0, 0
+	for _, board := range match.Lineup {
+		if board.Result == NoOutcome.String() {
+			finished = false
+			continue
+		}
+
+		match.HomeScore += board.homePoints()
+		match.AwayScore += 1 - board.homePoints()
+	}
+
+	if finished {
+		now := time.Now()
+		match.Status = TeamMatchFinished
+		match.FinishedAt = &now
+	}
+	cs.db.Omit("Lineup").Save(match)
+
+	if !finished {
+		return
+	}
+
+	message := &broadcastMessage{Type: "team_match_result", Payload: match}
+	for _, board := range match.Lineup {
+		cs.gs.send(board.Home, message)
+		cs.gs.send(board.Away, message)
+	}
+}
@@ -0,0 +1,969 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pjebs/jsonerror"
+	"gorm.io/gorm"
+)
+
+const (
+	RoundRobin = "round_robin"
+	Knockout   = "knockout"
+
+	TournamentOpen     = "open"
+	TournamentStarted  = "started"
+	TournamentFinished = "finished"
+
+	// Knockout matches still level after their games go to rapid playoffs or straight to an armageddon game
+	TiebreakRapid      = "rapid"
+	TiebreakArmageddon = "armageddon"
+
+	StageClassical  = "classical"
+	StageRapid      = "rapid"
+	StageArmageddon = "armageddon"
+
+	// maxRapidPlayoffGames is how many rapid playoff games are played before an armageddon decides the match
+	maxRapidPlayoffGames = 4
+
+	maxTournamentPlayers = 64
+	maxMatchGames        = 8
+
+	// MatchBye is the result of a match where a player goes through or sits out without playing
+	MatchBye = "bye"
+)
+
+var defaultPlayoffTimeControls = map[string]string{
+	TiebreakRapid:      "10+5",
+	TiebreakArmageddon: "5+0",
+}
+
+// Tournament is a round-robin or knockout tournament whose whole schedule is drawn up when it starts
+type Tournament struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	CreatedBy   string    `gorm:"not null" json:"created_by"`
+	Name        string    `gorm:"not null" json:"name"`
+	Type        string    `gorm:"not null" json:"type"`
+	Variant     string    `gorm:"not null;default:standard" json:"variant"`
+	TimeControl string    `json:"time_control,omitempty"`
+	DaysPerMove int       `json:"days,omitempty"`
+	// ClubID restricts the tournament to members of a club
+	ClubID uint `gorm:"index" json:"club_id,omitempty"`
+	// Cycles is 1 for a single and 2 for a double round-robin
+	Cycles int `json:"cycles,omitempty"`
+	// MatchGames is how many games a knockout match has before any playoff
+	MatchGames         int                 `json:"match_games,omitempty"`
+	Tiebreak           string              `json:"tiebreak,omitempty"`
+	PlayoffTimeControl string              `json:"playoff_time_control,omitempty"`
+	Rounds             int                 `json:"rounds"`
+	CurrentRound       int                 `json:"current_round"`
+	Status             string              `gorm:"not null;default:open;index" json:"status"`
+	FinishedAt         *time.Time          `json:"finished_at,omitempty"`
+	Players            []*TournamentPlayer `json:"players,omitempty"`
+	Matches            []*TournamentMatch  `json:"matches,omitempty"`
+}
+
+// TournamentPlayer is a player in a tournament, seeded by rating when it starts
+type TournamentPlayer struct {
+	ID              uint      `gorm:"primarykey" json:"-"`
+	TournamentID    uint      `gorm:"not null;index" json:"-"`
+	Player          string    `gorm:"not null" json:"player"`
+	Name            string    `json:"name"`
+	Rating          int       `json:"rating"`
+	Seed            int       `json:"seed,omitempty"`
+	Points          float64   `json:"points"`
+	SonnebornBerger float64   `json:"sonneborn_berger"`
+	Rank            int       `json:"rank,omitempty"`
+	CreatedAt       time.Time `json:"joined_at"`
+}
+
+// TournamentMatch is a pairing of the schedule. In a round-robin it is a single game, in a knockout it is
+// a match of several games whose winner goes on to the next round. Later knockout rounds start without
+// players, they are filled in as winners come through.
+type TournamentMatch struct {
+	ID           uint   `gorm:"primarykey" json:"id"`
+	TournamentID uint   `gorm:"not null;index" json:"-"`
+	Round        int    `gorm:"not null" json:"round"`
+	Board        int    `gorm:"not null" json:"board"`
+	White        string `json:"white,omitempty"`
+	Black        string `json:"black,omitempty"`
+	Winner       string `json:"winner,omitempty"`
+	// Result is the PGN result of a round-robin game, the side of the winner in a knockout match, or bye
+	Result string            `gorm:"not null;default:*" json:"result"`
+	Games  []*TournamentGame `gorm:"foreignKey:MatchID" json:"games,omitempty"`
+}
+
+// TournamentGame is a game played for a match
+type TournamentGame struct {
+	ID           uint   `gorm:"primarykey" json:"-"`
+	TournamentID uint   `gorm:"not null;index" json:"-"`
+	MatchID      uint   `gorm:"not null;index" json:"-"`
+	GameID       uint   `gorm:"not null;uniqueIndex" json:"game_id"`
+	Stage        string `gorm:"not null" json:"stage"`
+	White        string `gorm:"not null" json:"white"`
+	Black        string `gorm:"not null" json:"black"`
+	Result       string `gorm:"not null;default:*" json:"result"`
+}
+
+func (t *Tournament) setup(stage string) (*GameSetup, error) {
+	setup := &GameSetup{Variant: t.Variant, Chess960Position: RandomChess960Position}
+	timeControl := t.TimeControl
+	if stage == StageClassical {
+		setup.DaysPerMove = t.DaysPerMove
+	} else {
+		timeControl = t.PlayoffTimeControl
+	}
+
+	if timeControl != "" {
+		tc, err := ParseTimeControl(timeControl)
+		if err != nil {
+			return nil, err
+		}
+		setup.TimeControl = tc
+	}
+
+	return setup, setup.Validate()
+}
+
+func (t *Tournament) validate() error {
+	switch {
+	case t.Name == "":
+		return errors.New("a tournament needs a name")
+	case t.Type != RoundRobin && t.Type != Knockout:
+		return fmt.Errorf("type must be round_robin or knockout, got %s", t.Type)
+	case t.Type == RoundRobin && t.Cycles != 1 && t.Cycles != 2:
+		return errors.New("cycles must be 1 for a single or 2 for a double round-robin")
+	case t.Type == Knockout && (t.MatchGames < 1 || t.MatchGames > maxMatchGames):
+		return fmt.Errorf("match_games must be between 1 and %d", maxMatchGames)
+	case t.Type == Knockout && t.Tiebreak != TiebreakRapid && t.Tiebreak != TiebreakArmageddon:
+		return fmt.Errorf("tiebreak must be rapid or armageddon, got %s", t.Tiebreak)
+	case t.Variant == VariantBughouse || t.Variant == VariantFromPosition:
+		return fmt.Errorf("tournaments cannot be played as %s", t.Variant)
+	}
+
+	if _, err := t.setup(StageClassical); err != nil {
+		return err
+	}
+
+	if t.Type == Knockout {
+		if _, err := t.setup(StageRapid); err != nil {
+			return fmt.Errorf("invalid playoff time control: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// score Sums the points each player of the match has made in the finished games of a stage, and counts them
+func (m *TournamentMatch) score(stage string) (white, black float64, games int) {
+	for _, game := range m.Games {
+		if game.Stage != stage || game.Result == NoOutcome.String() {
+			continue
+		}
+
+		games++
+		points := map[string]float64{}
+		switch Outcome(game.Result) {
+		case WhiteWon:
+			points[game.White] = 1
+		case BlackWon:
+			points[game.Black] = 1
+		case Draw:
+			points[game.White], points[game.Black] = 0.5, 0.5
+		}
+
+		white += points[m.White]
+		black += points[m.Black]
+	}
+
+	return white, black, games
+}
+
+// playing reports whether a game of the match is still going on
+func (m *TournamentMatch) playing() bool {
+	for _, game := range m.Games {
+		if game.Result == NoOutcome.String() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decide Works out what happens next in a match with no game going on: the stage and colors of the next
+// game to play, or the result once the match is over. Knockout matches alternate colors, go to rapid
+// playoffs or an armageddon when level. The armageddon is the match's black player's turn to have white,
+// which leaves the other player with draw odds.
+func (t *Tournament) decide(m *TournamentMatch) (stage, white, black, result string) {
+	alternate := func(games int) (string, string) {
+		if games%2 == 0 {
+			return m.White, m.Black
+		}
+		return m.Black, m.White
+	}
+
+	whiteScore, blackScore, games := m.score(StageClassical)
+	matchGames := t.MatchGames
+	if t.Type == RoundRobin {
+		matchGames = 1
+	}
+
+	if games < matchGames {
+		white, black = alternate(games)
+		return StageClassical, white, black, ""
+	}
+
+	switch {
+	case whiteScore > blackScore:
+		return "", "", "", WhiteWon.String()
+	case blackScore > whiteScore:
+		return "", "", "", BlackWon.String()
+	case t.Type == RoundRobin:
+		return "", "", "", Draw.String()
+	}
+
+	if t.Tiebreak == TiebreakRapid {
+		whiteScore, blackScore, games = m.score(StageRapid)
+		switch {
+		case games > 0 && games%2 == 0 && whiteScore > blackScore:
+			return "", "", "", WhiteWon.String()
+		case games > 0 && games%2 == 0 && blackScore > whiteScore:
+			return "", "", "", BlackWon.String()
+		case games < maxRapidPlayoffGames:
+			white, black = alternate(games)
+			return StageRapid, white, black, ""
+		}
+	}
+
+	for _, game := range m.Games {
+		if game.Stage != StageArmageddon || game.Result == NoOutcome.String() {
+			continue
+		}
+
+		winner := game.Black
+		if game.Result == WhiteWon.String() {
+			winner = game.White
+		}
+
+		if winner == m.White {
+			return "", "", "", WhiteWon.String()
+		}
+		return "", "", "", BlackWon.String()
+	}
+
+	return StageArmageddon, m.Black, m.White, ""
+}
+
+type TournamentService struct {
+	db *gorm.DB
+	gs *GameService
+}
+
+func NewTournamentService(db *gorm.DB, gs *GameService) *TournamentService {
+	if err := db.AutoMigrate(&Tournament{}, &TournamentPlayer{}, &TournamentMatch{}, &TournamentGame{}); err != nil {
+		panic(err)
+	}
+
+	service := &TournamentService{db, gs}
+	gs.AddListener(service)
+
+	http.HandleFunc("/tournaments", service.HandleTournaments)
+	http.HandleFunc("/tournaments/join", service.Join)
+	http.HandleFunc("/tournaments/start", service.Start)
+	http.HandleFunc("/tournaments/crosstable", service.Crosstable)
+	http.HandleFunc("/tournaments/bracket", service.Bracket)
+
+	return service
+}
+
+type NewTournamentRequest struct {
+	Name               string `json:"name"`
+	Type               string `json:"type"`
+	Variant            string `json:"variant"`
+	ClubID             uint   `json:"club_id"`
+	TimeControl        string `json:"time_control"`
+	DaysPerMove        int    `json:"days"`
+	Cycles             int    `json:"cycles"`
+	MatchGames         int    `json:"match_games"`
+	Tiebreak           string `json:"tiebreak"`
+	PlayoffTimeControl string `json:"playoff_time_control"`
+}
+
+type TournamentResponse struct {
+	Successful bool              `json:"success"`
+	Tournament *Tournament       `json:"tournament,omitempty"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+type TournamentListResponse struct {
+	Successful  bool              `json:"success"`
+	Tournaments []*Tournament     `json:"tournaments"`
+	Error       map[string]string `json:"error,omitempty"`
+}
+
+func tournamentError(code int, error, message string) *TournamentResponse {
+	return &TournamentResponse{Error: jsonerror.New(code, error, message).Render()}
+}
+
+// HandleTournaments Lists unfinished tournaments on GET without an id, shows one with its players and
+// schedule on GET with an id, and opens a new one on POST
+func (ts *TournamentService) HandleTournaments(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("id") != "" {
+			ts.Show(w, r)
+		} else {
+			ts.List(w, r)
+		}
+	case http.MethodPost:
+		ts.Create(w, r)
+	}
+}
+
+// Create Opens a tournament for players to join, its creator starts it
+func (ts *TournamentService) Create(w http.ResponseWriter, r *http.Request) {
+	user, userErr := ts.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	var request NewTournamentRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, tournamentError(1, "Invalid JSON request", err.Error()))
+		return
+	}
+
+	tournament := &Tournament{
+		CreatedBy:   user.UUID.String(),
+		Name:        request.Name,
+		Type:        request.Type,
+		Variant:     request.Variant,
+		ClubID:      request.ClubID,
+		TimeControl: request.TimeControl,
+		DaysPerMove: request.DaysPerMove,
+		Status:      TournamentOpen,
+	}
+
+	if tournament.Variant == "" {
+		tournament.Variant = VariantStandard
+	}
+
+	switch tournament.Type {
+	case RoundRobin:
+		tournament.Cycles = max(request.Cycles, 1)
+	case Knockout:
+		tournament.MatchGames = max(request.MatchGames, 1)
+		tournament.Tiebreak = request.Tiebreak
+		if tournament.Tiebreak == "" {
+			tournament.Tiebreak = TiebreakArmageddon
+		}
+		tournament.PlayoffTimeControl = request.PlayoffTimeControl
+		if tournament.PlayoffTimeControl == "" {
+			tournament.PlayoffTimeControl = defaultPlayoffTimeControls[tournament.Tiebreak]
+		}
+	}
+
+	if err := tournament.validate(); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, tournamentError(100, "Invalid tournament settings", err.Error()))
+		return
+	}
+
+	if err := checkClubEvent(ts.db, tournament.ClubID, tournament.CreatedBy); err != nil {
+		RenderJSONResponse(w, http.StatusForbidden, tournamentError(113, "Not a club admin", err.Error()))
+		return
+	}
+
+	if err := ts.db.Create(tournament).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, tournamentError(28, "Internal server error", "Error creating tournament"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusCreated, &TournamentResponse{Successful: true, Tournament: tournament})
+}
+
+// List Shows the tournaments that are open or being played
+func (ts *TournamentService) List(w http.ResponseWriter, r *http.Request) {
+	var tournaments []*Tournament
+	if err := ts.db.Where("status <> ?", TournamentFinished).Order("created_at").Find(&tournaments).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &TournamentListResponse{Error: jsonerror.New(28, "Internal server error", "Error loading tournaments").Render()})
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &TournamentListResponse{Successful: true, Tournaments: tournaments})
+}
+
+// Show Gives a tournament with its players and every match of its schedule
+func (ts *TournamentService) Show(w http.ResponseWriter, r *http.Request) {
+	tournament, errResponse, status := ts.findTournament(r.URL.Query().Get("id"))
+	if errResponse != nil {
+		RenderJSONResponse(w, status, errResponse)
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &TournamentResponse{Successful: true, Tournament: tournament})
+}
+
+// findTournament Loads a tournament by its id with its players in seed order and its matches by round and board
+func (ts *TournamentService) findTournament(rawID string) (*Tournament, *TournamentResponse, int) {
+	id, err := strconv.ParseUint(rawID, 10, 64)
+	if err != nil {
+		return nil, tournamentError(101, "Tournament not found", "Invalid tournament id: "+rawID), http.StatusBadRequest
+	}
+
+	tournament := &Tournament{}
+	result := ts.db.Preload("Players", func(db *gorm.DB) *gorm.DB {
+		return db.Order("seed, created_at")
+	}).Preload("Matches", func(db *gorm.DB) *gorm.DB {
+		return db.Order("round, board")
+	}).Preload("Matches.Games", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).First(tournament, id)
+	if result.RowsAffected == 0 {
+		return nil, tournamentError(101, "Tournament not found", fmt.Sprintf("Tournament does not exist with given ID: %d", id)), http.StatusNotFound
+	}
+
+	return tournament, nil, http.StatusOK
+}
+
+// authenticatedTournament Authenticates the user and loads the tournament they are acting on
+func (ts *TournamentService) authenticatedTournament(w http.ResponseWriter, r *http.Request) (*User, *Tournament, bool) {
+	if r.Method != http.MethodPost {
+		return nil, nil, false
+	}
+
+	user, userErr := ts.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return nil, nil, false
+	}
+
+	tournament, errResponse, status := ts.findTournament(r.URL.Query().Get("id"))
+	if errResponse != nil {
+		RenderJSONResponse(w, status, errResponse)
+		return nil, nil, false
+	}
+
+	return user, tournament, true
+}
+
+// Join Enters the user in an open tournament with their current rating
+func (ts *TournamentService) Join(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	user, tournament, ok := ts.authenticatedTournament(w, r)
+	if !ok {
+		return
+	}
+
+	switch {
+	case tournament.Status != TournamentOpen:
+		RenderJSONResponse(w, http.StatusBadRequest, tournamentError(102, "Tournament has started", "Players can only join before the tournament starts"))
+		return
+	case len(tournament.Players) >= maxTournamentPlayers:
+		RenderJSONResponse(w, http.StatusBadRequest, tournamentError(103, "Tournament is full", fmt.Sprintf("A tournament is limited to %d players", maxTournamentPlayers)))
+		return
+	}
+
+	if tournament.ClubID != 0 && !clubMember(ts.db, tournament.ClubID, user.UUID.String()) {
+		RenderJSONResponse(w, http.StatusForbidden, &TournamentResponse{Error: membersOnly(tournament.ClubID)})
+		return
+	}
+
+	for _, player := range tournament.Players {
+		if player.Player == user.UUID.String() {
+			RenderJSONResponse(w, http.StatusBadRequest, tournamentError(104, "Already joined", "You have already joined this tournament"))
+			return
+		}
+	}
+
+	player := &TournamentPlayer{
+		TournamentID: tournament.ID,
+		Player:       user.UUID.String(),
+		Name:         user.FirstName + " " + user.LastName,
+		Rating:       user.ELO,
+	}
+	if err := ts.db.Create(player).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, tournamentError(28, "Internal server error", "Error joining tournament"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &TournamentResponse{Successful: true})
+}
+
+// Start Seeds the players by rating, draws up the whole schedule and opens the first round. Only the
+// creator can start their tournament.
+func (ts *TournamentService) Start(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	user, tournament, ok := ts.authenticatedTournament(w, r)
+	if !ok {
+		return
+	}
+
+	switch {
+	case tournament.CreatedBy != user.UUID.String():
+		RenderJSONResponse(w, http.StatusForbidden, tournamentError(105, "Not the organiser", "Only the creator can start the tournament"))
+		return
+	case tournament.Status != TournamentOpen:
+		RenderJSONResponse(w, http.StatusBadRequest, tournamentError(102, "Tournament has started", "The tournament has already started"))
+		return
+	case len(tournament.Players) < 2:
+		RenderJSONResponse(w, http.StatusBadRequest, tournamentError(106, "Not enough players", "A tournament needs at least two players"))
+		return
+	}
+
+	players := tournament.Players
+	sort.SliceStable(players, func(i, j int) bool {
+		return players[i].Rating > players[j].Rating
+	})
+	for i, player := range players {
+		player.Seed = i + 1
+		ts.db.Model(player).Update("seed", player.Seed)
+	}
+
+	var matches []*TournamentMatch
+	if tournament.Type == RoundRobin {
+		matches = roundRobinSchedule(tournament, players)
+	} else {
+		matches = knockoutSchedule(tournament, players)
+	}
+
+	if err := ts.db.Create(matches).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, tournamentError(28, "Internal server error", "Error drawing up the schedule"))
+		return
+	}
+
+	tournament.Status = TournamentStarted
+	ts.db.Save(tournament)
+
+	ts.gs.mu.Lock()
+	defer ts.gs.mu.Unlock()
+
+	var uuids []string
+	for _, player := range players {
+		uuids = append(uuids, player.Player)
+	}
+	ts.gs.notifyAll(uuids, NotifyTournamentStart, fmt.Sprintf("The tournament %s has started", tournament.Name), fmt.Sprintf("/tournaments?id=%d", tournament.ID))
+
+	// Knockout byes go straight through before the first round opens
+	for _, match := range matches {
+		if match.Result == MatchBye && match.Winner != "" {
+			ts.advance(tournament, match)
+		}
+	}
+	ts.openRound(tournament, 1)
+
+	RenderJSONResponse(w, http.StatusOK, &TournamentResponse{Successful: true, Tournament: tournament})
+}
+
+// roundRobinSchedule Pairs every player with every other by the Berger tables, the second cycle of a
+// double round-robin repeats the first with colors reversed
+func roundRobinSchedule(t *Tournament, players []*TournamentPlayer) []*TournamentMatch {
+	rounds := bergerRounds(len(players))
+	var matches []*TournamentMatch
+	for cycle := 0; cycle < t.Cycles; cycle++ {
+		for r, pairs := range rounds {
+			for board, pair := range pairs {
+				white, black := pair[0], pair[1]
+				if cycle == 1 {
+					white, black = black, white
+				}
+
+				match := &TournamentMatch{TournamentID: t.ID, Round: cycle*len(rounds) + r + 1, Board: board + 1, Result: NoOutcome.String()}
+				switch {
+				case white >= len(players):
+					match.White, match.Result = players[black].Player, MatchBye
+				case black >= len(players):
+					match.White, match.Result = players[white].Player, MatchBye
+				default:
+					match.White, match.Black = players[white].Player, players[black].Player
+				}
+				matches = append(matches, match)
+			}
+		}
+	}
+
+	t.Rounds = t.Cycles * len(rounds)
+	return matches
+}
+
+// knockoutSchedule Draws up the bracket with the top seeds kept apart until the late rounds, seeds
+// without an opponent in the first round go through on a bye
+func knockoutSchedule(t *Tournament, players []*TournamentPlayer) []*TournamentMatch {
+	size := bracketSize(len(players))
+	seeds := bracketSeeds(size)
+
+	var matches []*TournamentMatch
+	for board := 0; board < size/2; board++ {
+		match := &TournamentMatch{TournamentID: t.ID, Round: 1, Board: board + 1, Result: NoOutcome.String()}
+		top, bottom := seeds[2*board], seeds[2*board+1]
+		match.White = players[top].Player
+		if bottom < len(players) {
+			match.Black = players[bottom].Player
+		} else {
+			match.Winner, match.Result = match.White, MatchBye
+		}
+		matches = append(matches, match)
+	}
+
+	t.Rounds = bracketRounds(size)
+	for round, boards := 2, size/4; round <= t.Rounds; round, boards = round+1, boards/2 {
+		for board := 0; board < boards; board++ {
+			matches = append(matches, &TournamentMatch{TournamentID: t.ID, Round: round, Board: board + 1, Result: NoOutcome.String()})
+		}
+	}
+
+	return matches
+}
+
+// openRound Starts the games of every match of the round, called with the game service lock held
+func (ts *TournamentService) openRound(t *Tournament, round int) {
+	t.CurrentRound = round
+	ts.db.Save(t)
+
+	var matches []*TournamentMatch
+	if err := ts.db.Preload("Games").Where("tournament_id = ? AND round = ?", t.ID, round).Find(&matches).Error; err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, match := range matches {
+		if match.Result == NoOutcome.String() {
+			ts.play(t, match)
+		}
+	}
+
+	message := &broadcastMessage{Type: "tournament_round", Payload: map[string]interface{}{"tournament_id": t.ID, "round": round, "matches": matches}}
+	var players []*TournamentPlayer
+	ts.db.Where("tournament_id = ?", t.ID).Find(&players)
+	for _, player := range players {
+		ts.gs.send(player.Player, message)
+	}
+
+	ts.checkRound(t)
+}
+
+// play Starts the next game of a match, or records its result and sends the winner on once it is decided
+func (ts *TournamentService) play(t *Tournament, match *TournamentMatch) {
+	stage, white, black, result := t.decide(match)
+	if result != "" {
+		match.Result = result
+		switch result {
+		case WhiteWon.String():
+			match.Winner = match.White
+		case BlackWon.String():
+			match.Winner = match.Black
+		}
+		ts.db.Model(match).Select("result", "winner").Updates(match)
+		ts.advance(t, match)
+		return
+	}
+
+	setup, err := t.setup(stage)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	game, err := ts.gs.createGame(white, black, setup, time.Now())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	game.TournamentID = t.ID
+	// In armageddon black has less time to make up for draw odds
+	if stage == StageArmageddon && game.timed() {
+		game.BlackClock = game.ClockInitial * 4 / 5
+	}
+	ts.db.Save(game)
+
+	tournamentGame := &TournamentGame{TournamentID: t.ID, MatchID: match.ID, GameID: game.ID, Stage: stage, White: white, Black: black, Result: NoOutcome.String()}
+	if err := ts.db.Create(tournamentGame).Error; err != nil {
+		log.Println(err)
+		return
+	}
+	match.Games = append(match.Games, tournamentGame)
+
+	ts.gs.announceGame(game)
+}
+
+// advance Puts the winner of a knockout match into their place in the next round
+func (ts *TournamentService) advance(t *Tournament, match *TournamentMatch) {
+	if t.Type != Knockout || match.Winner == "" || match.Round >= t.Rounds {
+		return
+	}
+
+	side := "white"
+	if match.Board%2 == 0 {
+		side = "black"
+	}
+
+	ts.db.Model(&TournamentMatch{}).
+		Where("tournament_id = ? AND round = ? AND board = ?", t.ID, match.Round+1, (match.Board+1)/2).
+		Update(side, match.Winner)
+}
+
+// checkRound Opens the next round once every match of the current one is decided, or finishes the tournament
+func (ts *TournamentService) checkRound(t *Tournament) {
+	var undecided int64
+	ts.db.Model(&TournamentMatch{}).Where("tournament_id = ? AND round = ? AND result = ?", t.ID, t.CurrentRound, NoOutcome.String()).Count(&undecided)
+	if undecided > 0 {
+		return
+	}
+
+	if t.CurrentRound < t.Rounds {
+		ts.openRound(t, t.CurrentRound+1)
+		return
+	}
+
+	ts.finish(t)
+}
+
+// finish Ranks the players and sends the final standings. Round-robins rank on points and Sonneborn-Berger,
+// knockouts by the round each player went out in.
+func (ts *TournamentService) finish(t *Tournament) {
+	players := ts.standings(t)
+	for _, player := range players {
+		ts.db.Model(player).Select("points", "sonneborn_berger", "rank").Updates(player)
+	}
+
+	now := time.Now()
+	t.Status = TournamentFinished
+	t.FinishedAt = &now
+	ts.db.Save(t)
+
+	t.Players = players
+	message := &broadcastMessage{Type: "tournament_result", Payload: t}
+	for _, player := range players {
+		ts.gs.send(player.Player, message)
+	}
+}
+
+// standings Scores every game of the tournament and ranks the players
+func (ts *TournamentService) standings(t *Tournament) []*TournamentPlayer {
+	var players []*TournamentPlayer
+	var matches []*TournamentMatch
+	ts.db.Where("tournament_id = ?", t.ID).Order("seed").Find(&players)
+	ts.db.Preload("Games").Where("tournament_id = ?", t.ID).Find(&matches)
+
+	byPlayer := make(map[string]*TournamentPlayer, len(players))
+	for _, player := range players {
+		player.Points, player.SonnebornBerger = 0, 0
+		byPlayer[player.Player] = player
+	}
+
+	type result struct {
+		player, opponent *TournamentPlayer
+		points           float64
+	}
+	var results []result
+	for _, match := range matches {
+		for _, game := range match.Games {
+			white, black := byPlayer[game.White], byPlayer[game.Black]
+			if white == nil || black == nil || game.Result == NoOutcome.String() {
+				continue
+			}
+
+			points := map[string]float64{WhiteWon.String(): 1, Draw.String(): 0.5}[game.Result]
+			white.Points += points
+			black.Points += 1 - points
+			results = append(results, result{white, black, points}, result{black, white, 1 - points})
+		}
+	}
+
+	for _, r := range results {
+		r.player.SonnebornBerger += r.points * r.opponent.Points
+	}
+
+	if t.Type == Knockout {
+		// A player's rank comes from how far they went, the champion never lost a match
+		out := make(map[string]int, len(players))
+		for _, match := range matches {
+			if match.Winner == "" || match.Result == MatchBye {
+				continue
+			}
+			loser := match.White
+			if match.Winner == match.White {
+				loser = match.Black
+			}
+			out[loser] = match.Round
+		}
+
+		for _, player := range players {
+			if round, ok := out[player.Player]; ok {
+				player.Rank = 1<<(t.Rounds-round) + 1
+			} else {
+				player.Rank = 1
+			}
+		}
+
+		sort.SliceStable(players, func(i, j int) bool {
+			return players[i].Rank < players[j].Rank
+		})
+		return players
+	}
+
+	sort.SliceStable(players, func(i, j int) bool {
+		a, b := players[i], players[j]
+		if a.Points != b.Points {
+			return a.Points > b.Points
+		}
+		return a.SonnebornBerger > b.SonnebornBerger
+	})
+	for i, player := range players {
+		player.Rank = i + 1
+	}
+
+	return players
+}
+
+// GameStarted Tournament games need nothing when they start, they are announced by the service that made them
+func (ts *TournamentService) GameStarted(*Game) {}
+
+// GameMoved Tournament games need nothing on a move
+func (ts *TournamentService) GameMoved(*Game) {}
+
+// GameEnded Records the result of a tournament game, then plays on the match and opens the next round when it can
+func (ts *TournamentService) GameEnded(game *Game) {
+	if game.TournamentID == 0 {
+		return
+	}
+
+	ts.db.Model(&TournamentGame{}).Where("game_id = ?", game.ID).Update("result", game.board.Outcome().String())
+
+	tournamentGame := &TournamentGame{}
+	tournament := &Tournament{}
+	match := &TournamentMatch{}
+	if ts.db.Where("game_id = ?", game.ID).First(tournamentGame).RowsAffected == 0 ||
+		ts.db.First(tournament, game.TournamentID).RowsAffected == 0 ||
+		ts.db.Preload("Games").First(match, tournamentGame.MatchID).RowsAffected == 0 {
+		return
+	}
+
+	if match.playing() || match.Result != NoOutcome.String() {
+		return
+	}
+
+	ts.play(tournament, match)
+	ts.checkRound(tournament)
+}
+
+// CrosstableRow is a player's line of a round-robin crosstable, Results holds their score against each seed
+type CrosstableRow struct {
+	Seed            int      `json:"seed"`
+	Player          string   `json:"player"`
+	Name            string   `json:"name"`
+	Points          float64  `json:"points"`
+	SonnebornBerger float64  `json:"sonneborn_berger"`
+	Rank            int      `json:"rank"`
+	Results         []string `json:"results"`
+}
+
+type CrosstableResponse struct {
+	Successful bool              `json:"success"`
+	Crosstable []*CrosstableRow  `json:"crosstable,omitempty"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+// Crosstable Shows a round-robin as a table of every player's results against every other, in seed order
+func (ts *TournamentService) Crosstable(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	tournament, errResponse, status := ts.findTournament(r.URL.Query().Get("id"))
+	if errResponse != nil {
+		RenderJSONResponse(w, status, errResponse)
+		return
+	}
+
+	if tournament.Type != RoundRobin {
+		RenderJSONResponse(w, http.StatusBadRequest, &CrosstableResponse{Error: jsonerror.New(107, "Not a round-robin", "Only round-robins have a crosstable, see the bracket").Render()})
+		return
+	}
+
+	ranked := ts.standings(tournament)
+	rank := make(map[string]*TournamentPlayer, len(ranked))
+	for _, player := range ranked {
+		rank[player.Player] = player
+	}
+
+	seed := make(map[string]int, len(ranked))
+	rows := make([]*CrosstableRow, len(ranked))
+	for i, player := range tournament.Players {
+		seed[player.Player] = i
+		standing := rank[player.Player]
+		rows[i] = &CrosstableRow{
+			Seed:            player.Seed,
+			Player:          player.Player,
+			Name:            player.Name,
+			Points:          standing.Points,
+			SonnebornBerger: standing.SonnebornBerger,
+			Rank:            standing.Rank,
+			Results:         make([]string, len(ranked)),
+		}
+		rows[i].Results[i] = "X"
+	}
+
+	symbols := map[float64]string{1: "1", 0.5: "½", 0: "0"}
+	for _, match := range tournament.Matches {
+		for _, game := range match.Games {
+			if game.Result == NoOutcome.String() {
+				continue
+			}
+
+			white, black := seed[game.White], seed[game.Black]
+			points := map[string]float64{WhiteWon.String(): 1, Draw.String(): 0.5}[game.Result]
+			rows[white].Results[black] += symbols[points]
+			rows[black].Results[white] += symbols[1-points]
+		}
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &CrosstableResponse{Successful: true, Crosstable: rows})
+}
+
+type BracketResponse struct {
+	Successful bool                 `json:"success"`
+	Rounds     [][]*TournamentMatch `json:"rounds,omitempty"`
+	Error      map[string]string    `json:"error,omitempty"`
+}
+
+// Bracket Shows a knockout as its rounds of matches, with the games of each match and who went through
+func (ts *TournamentService) Bracket(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	tournament, errResponse, status := ts.findTournament(r.URL.Query().Get("id"))
+	if errResponse != nil {
+		RenderJSONResponse(w, status, errResponse)
+		return
+	}
+
+	if tournament.Type != Knockout {
+		RenderJSONResponse(w, http.StatusBadRequest, &BracketResponse{Error: jsonerror.New(108, "Not a knockout", "Only knockouts have a bracket, see the crosstable").Render()})
+		return
+	}
+
+	rounds := make([][]*TournamentMatch, tournament.Rounds)
+	for _, match := range tournament.Matches {
+		if match.Round >= 1 && match.Round <= tournament.Rounds {
+			rounds[match.Round-1] = append(rounds[match.Round-1], match)
+		}
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &BracketResponse{Successful: true, Rounds: rounds})
+}
@@ -0,0 +1,77 @@
+package main
+
+// bergerRounds Returns the rounds of a round-robin between n players as in the FIDE Berger tables,
+// each round a list of pairs of zero-based starting numbers with white first. With an odd number of
+// players a pair with index n is the player sitting the round out.
+func bergerRounds(n int) [][][2]int {
+	if n%2 == 1 {
+		n++
+	}
+
+	// Round one is 1-n, 2-(n-1), 3-(n-2)...
+	pairs := make([][2]int, n/2)
+	for i := range pairs {
+		pairs[i] = [2]int{i, n - 1 - i}
+	}
+
+	// Every other number moves on by n/2, the last player keeps their place and alternates colors
+	shift := func(p int) int {
+		if p == n-1 {
+			return p
+		}
+		return (p + n/2) % (n - 1)
+	}
+
+	rounds := make([][][2]int, 0, n-1)
+	for r := 0; r < n-1; r++ {
+		rounds = append(rounds, pairs)
+
+		next := make([][2]int, len(pairs))
+		for i, pair := range pairs {
+			white, black := shift(pair[0]), shift(pair[1])
+			if pair[0] == n-1 || pair[1] == n-1 {
+				white, black = black, white
+			}
+			next[i] = [2]int{white, black}
+		}
+		pairs = next
+	}
+
+	return rounds
+}
+
+// bracketSize is the smallest power of two that fits every player
+func bracketSize(players int) int {
+	size := 1
+	for size < players {
+		size *= 2
+	}
+
+	return size
+}
+
+// bracketSeeds Orders zero-based seeds into the first round of a knockout bracket of the given size,
+// so that 1 meets the lowest seed and the top two seeds can only meet in the final
+func bracketSeeds(size int) []int {
+	seeds := []int{0}
+	for len(seeds) < size {
+		next := make([]int, 0, len(seeds)*2)
+		for _, seed := range seeds {
+			next = append(next, seed, len(seeds)*2-1-seed)
+		}
+		seeds = next
+	}
+
+	return seeds
+}
+
+// bracketRounds counts the rounds of a knockout bracket of the given size
+func bracketRounds(size int) int {
+	rounds := 0
+	for size > 1 {
+		size /= 2
+		rounds++
+	}
+
+	return rounds
+}
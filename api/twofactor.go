@@ -0,0 +1,545 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pjebs/jsonerror"
+	"github.com/skip2/go-qrcode"
+	"gorm.io/gorm"
+)
+
+const (
+	totpIssuer = "Checkers"
+	totpPeriod = 30
+	totpDigits = 6
+	// Codes from one period either side are accepted to allow for clocks drifting
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	loginChallengeLifetime = 5 * time.Minute
+	maxChallengeAttempts   = 5
+	// maxLiveChallenges is how many logins of a user can wait for their code at once, older ones are dropped
+	maxLiveChallenges = 3
+
+	// A user's codes are turned down for twoFactorLockout once maxTwoFactorFailures wrong ones were given in a
+	// row, however many logins they were spread over
+	maxTwoFactorFailures = 10
+	twoFactorLockout     = 15 * time.Minute
+)
+
+var (
+	base32NoPadding  = base32.StdEncoding.WithPadding(base32.NoPadding)
+	errCodeRejected  = errors.New("two-factor code rejected")
+	errChallengeUsed = errors.New("login challenge used up")
+	errCodesLocked   = errors.New("too many wrong two-factor codes")
+)
+
+// TwoFactor is a user's TOTP secret, only checked at login once the first code from it is confirmed
+type TwoFactor struct {
+	UserUUID  uuid.UUID `gorm:"primaryKey;type:uuid"`
+	CreatedAt time.Time
+	Secret    string `gorm:"not null"`
+	Enabled   bool   `gorm:"not null;default:false"`
+	// LastStep is the time step of the last code accepted, so a code can't be used twice
+	LastStep int64
+	// Failures counts the codes given since the last right one, and LockedUntil is when codes are taken again
+	// after too many were wrong
+	Failures    int `gorm:"not null;default:0"`
+	LockedUntil time.Time
+}
+
+// RecoveryCode lets a user in once without their authenticator, only its hash is kept
+type RecoveryCode struct {
+	ID       uint      `gorm:"primarykey"`
+	UserUUID uuid.UUID `gorm:"not null;index;type:uuid"`
+	Hash     string    `gorm:"not null"`
+	UsedAt   sql.NullTime
+}
+
+// LoginChallenge is a login whose password was right, waiting for the two-factor code
+type LoginChallenge struct {
+	Hash      string    `gorm:"primaryKey"`
+	UserUUID  uuid.UUID `gorm:"not null;type:uuid"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	Attempts  int       `gorm:"not null;default:0"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type LoginTwoFactorRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+type TwoFactorResponse struct {
+	Successful bool `json:"success"`
+	Enabled    bool `json:"enabled"`
+	// Secret, URI and QRCode, a base64 PNG of the URI, are only given on enrolment
+	Secret string `json:"secret,omitempty"`
+	URI    string `json:"uri,omitempty"`
+	QRCode string `json:"qr_code,omitempty"`
+	// RecoveryCodes are only given when they are made, RecoveryCodesLeft counts those still unused
+	RecoveryCodes     []string          `json:"recovery_codes,omitempty"`
+	RecoveryCodesLeft int64             `json:"recovery_codes_left"`
+	Error             map[string]string `json:"error,omitempty"`
+}
+
+func twoFactorError(code int, error, message string) *TwoFactorResponse {
+	return &TwoFactorResponse{Error: jsonerror.New(code, error, message).Render()}
+}
+
+// totpCode Works out the code of the secret for a time step as in RFC 6238
+func totpCode(secret []byte, step int64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP Gives the time step the code belongs to, or -1 when it matches none close to now
+func matchTOTP(secret, code string, now time.Time) int64 {
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil {
+		return -1
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step
+		}
+	}
+
+	return -1
+}
+
+// normaliseCode Strips the spaces and dashes people type into codes
+func normaliseCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// TwoFactorEnabled Reports whether the user has to give a code to login
+func (service *UserService) TwoFactorEnabled(user *User) bool {
+	return service.db.Where("user_uuid = ? AND enabled = ?", user.UUID, true).First(&TwoFactor{}).RowsAffected > 0
+}
+
+// checkTwoFactor Accepts a code from the user's authenticator, or with allowRecovery one of their recovery codes
+// which is then used up. Wrong codes are counted for the user rather than for a login, so that starting new
+// logins doesn't give more guesses, and too many lock the codes out for a while.
+func (service *UserService) checkTwoFactor(user *User, code string, allowRecovery bool) error {
+	code = normaliseCode(code)
+	twoFactor := &TwoFactor{}
+	if service.db.First(twoFactor, "user_uuid = ?", user.UUID).RowsAffected == 0 {
+		return errCodeRejected
+	}
+
+	// Every code is counted before it is checked, so codes sent at the same time can't go over the limit
+	now := time.Now()
+	result := service.db.Model(twoFactor).Where("failures < ? AND (locked_until IS NULL OR locked_until < ?)", maxTwoFactorFailures, now).Update("failures", gorm.Expr("failures + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		err := service.db.Model(twoFactor).Where("failures >= ?", maxTwoFactorFailures).Updates(map[string]interface{}{"failures": 0, "locked_until": now.Add(twoFactorLockout)}).Error
+		if err != nil {
+			return err
+		}
+
+		return errCodesLocked
+	}
+
+	if step := matchTOTP(twoFactor.Secret, code, now); step >= 0 {
+		// The same code can't be accepted twice, even by two requests at once
+		result := service.db.Model(twoFactor).Where("last_step < ?", step).Updates(map[string]interface{}{"last_step": step, "failures": 0})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errCodeRejected
+		}
+
+		return nil
+	}
+
+	if !allowRecovery || !twoFactor.Enabled {
+		return errCodeRejected
+	}
+
+	result = service.db.Model(&RecoveryCode{}).Where("user_uuid = ? AND hash = ? AND used_at IS NULL", user.UUID, hashToken(code)).Update("used_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errCodeRejected
+	}
+
+	return service.db.Model(twoFactor).Update("failures", 0).Error
+}
+
+// codesLockedMessage tells the user how long codes are turned down for
+var codesLockedMessage = fmt.Sprintf("Too many wrong two-factor codes, try again in %d minutes", int(twoFactorLockout.Minutes()))
+
+// renderCodeError Answers a rejected code, or an error checking it
+func renderCodeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errCodeRejected) {
+		RenderJSONResponse(w, http.StatusForbidden, twoFactorError(37, "Invalid code", "The two-factor code is wrong or was already used"))
+		return
+	}
+
+	if errors.Is(err, errCodesLocked) {
+		RenderJSONResponse(w, http.StatusTooManyRequests, twoFactorError(45, "Too many wrong codes", codesLockedMessage))
+		return
+	}
+
+	log.Println(err)
+	RenderJSONResponse(w, http.StatusInternalServerError, twoFactorError(28, "Internal server error", "Error checking code"))
+}
+
+// newRecoveryCodes Replaces the user's recovery codes, giving the new ones in the clear for the only time
+func (service *UserService) newRecoveryCodes(tx *gorm.DB, user *User) ([]string, error) {
+	if err := tx.Where("user_uuid = ?", user.UUID).Delete(&RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	stored := make([]*RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		random := make([]byte, 7)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+
+		code := base32NoPadding.EncodeToString(random)[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		stored[i] = &RecoveryCode{UserUUID: user.UUID, Hash: hashToken(code)}
+	}
+
+	return codes, tx.Create(&stored).Error
+}
+
+// recoveryCodesLeft Counts the user's unused recovery codes
+func (service *UserService) recoveryCodesLeft(user *User) int64 {
+	var left int64
+	if err := service.db.Model(&RecoveryCode{}).Where("user_uuid = ? AND used_at IS NULL", user.UUID).Count(&left).Error; err != nil {
+		log.Println(err)
+	}
+
+	return left
+}
+
+// authenticateTwoFactor Authenticates a request to one of the two-factor endpoints, reading the code in its body
+func (service *UserService) authenticateTwoFactor(w http.ResponseWriter, r *http.Request) (*User, *TwoFactorCodeRequest, bool) {
+	SetCors(&w)
+
+	if r.Method != http.MethodPost {
+		return nil, nil, false
+	}
+
+	user, userErr := service.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return nil, nil, false
+	}
+
+	request := &TwoFactorCodeRequest{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			RenderJSONResponse(w, http.StatusBadRequest, twoFactorError(1, "Invalid JSON request", err.Error()))
+			return nil, nil, false
+		}
+	}
+
+	return user, request, true
+}
+
+// TwoFactorStatus Tells the user whether two-factor authentication is on and how many recovery codes are left
+func (service *UserService) TwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodGet {
+		return
+	}
+
+	user, userErr := service.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &TwoFactorResponse{Successful: true, Enabled: service.TwoFactorEnabled(user), RecoveryCodesLeft: service.recoveryCodesLeft(user)})
+}
+
+// EnrollTwoFactor Makes a new secret for the user's authenticator, which is only turned on once a code from
+// it is confirmed. Enrolling again before confirming replaces the secret.
+func (service *UserService) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _, ok := service.authenticateTwoFactor(w, r)
+	if !ok {
+		return
+	}
+
+	if service.TwoFactorEnabled(user) {
+		RenderJSONResponse(w, http.StatusConflict, twoFactorError(38, "Two-factor already enabled", "Disable two-factor authentication before enrolling again"))
+		return
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, twoFactorError(28, "Internal server error", "Error making secret"))
+		return
+	}
+
+	secret := base32NoPadding.EncodeToString(key)
+	if err := service.db.Save(&TwoFactor{UserUUID: user.UUID, Secret: secret}).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, twoFactorError(28, "Internal server error", "Error saving secret"))
+		return
+	}
+
+	uri := fmt.Sprintf("otpauth://totp/%s?%s", url.PathEscape(totpIssuer+":"+user.Email), url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}.Encode())
+
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, twoFactorError(28, "Internal server error", "Error drawing QR code"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &TwoFactorResponse{Successful: true, Secret: secret, URI: uri, QRCode: base64.StdEncoding.EncodeToString(png)})
+}
+
+// ConfirmTwoFactor Turns two-factor authentication on with the first code from the authenticator, giving
+// the recovery codes
+func (service *UserService) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, request, ok := service.authenticateTwoFactor(w, r)
+	if !ok {
+		return
+	}
+
+	twoFactor := &TwoFactor{}
+	if service.db.First(twoFactor, "user_uuid = ?", user.UUID).RowsAffected == 0 || twoFactor.Enabled {
+		RenderJSONResponse(w, http.StatusConflict, twoFactorError(39, "Nothing to confirm", "Enroll before confirming two-factor authentication"))
+		return
+	}
+
+	if err := service.checkTwoFactor(user, request.Code, false); err != nil {
+		renderCodeError(w, err)
+		return
+	}
+
+	var codes []string
+	err := service.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(twoFactor).Update("enabled", true).Error; err != nil {
+			return err
+		}
+
+		var err error
+		codes, err = service.newRecoveryCodes(tx, user)
+		return err
+	})
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, twoFactorError(28, "Internal server error", "Error enabling two-factor authentication"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &TwoFactorResponse{Successful: true, Enabled: true, RecoveryCodes: codes, RecoveryCodesLeft: int64(len(codes))})
+}
+
+// DisableTwoFactor Turns two-factor authentication off with a code from the authenticator or a recovery code
+func (service *UserService) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, request, ok := service.authenticateTwoFactor(w, r)
+	if !ok {
+		return
+	}
+
+	if !service.TwoFactorEnabled(user) {
+		RenderJSONResponse(w, http.StatusConflict, twoFactorError(39, "Two-factor not enabled", "Two-factor authentication is not enabled"))
+		return
+	}
+
+	if err := service.checkTwoFactor(user, request.Code, true); err != nil {
+		renderCodeError(w, err)
+		return
+	}
+
+	err := service.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_uuid = ?", user.UUID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("user_uuid = ?", user.UUID).Delete(&TwoFactor{}).Error
+	})
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, twoFactorError(28, "Internal server error", "Error disabling two-factor authentication"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &TwoFactorResponse{Successful: true})
+}
+
+// RegenerateRecoveryCodes Replaces the recovery codes with new ones, given a code from the authenticator
+func (service *UserService) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, request, ok := service.authenticateTwoFactor(w, r)
+	if !ok {
+		return
+	}
+
+	if !service.TwoFactorEnabled(user) {
+		RenderJSONResponse(w, http.StatusConflict, twoFactorError(39, "Two-factor not enabled", "Two-factor authentication is not enabled"))
+		return
+	}
+
+	if err := service.checkTwoFactor(user, request.Code, false); err != nil {
+		renderCodeError(w, err)
+		return
+	}
+
+	var codes []string
+	err := service.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = service.newRecoveryCodes(tx, user)
+		return err
+	})
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, twoFactorError(28, "Internal server error", "Error making recovery codes"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &TwoFactorResponse{Successful: true, Enabled: true, RecoveryCodes: codes, RecoveryCodesLeft: int64(len(codes))})
+}
+
+// newLoginChallenge Makes the challenge a login waiting for its two-factor code is finished with, dropping the
+// user's oldest challenges so only maxLiveChallenges wait at once
+func (service *UserService) newLoginChallenge(user *User) (string, error) {
+	challenge, err := GenerateVerificationToken()
+	if err != nil {
+		return "", err
+	}
+
+	return challenge, service.db.Transaction(func(tx *gorm.DB) error {
+		var live []string
+		if err := tx.Model(&LoginChallenge{}).Where("user_uuid = ? AND expires_at > ?", user.UUID, time.Now()).Order("expires_at desc").Pluck("hash", &live).Error; err != nil {
+			return err
+		}
+
+		if len(live) >= maxLiveChallenges {
+			if err := tx.Where("user_uuid = ? AND hash NOT IN ?", user.UUID, live[:maxLiveChallenges-1]).Delete(&LoginChallenge{}).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Create(&LoginChallenge{Hash: hashToken(challenge), UserUUID: user.UUID, ExpiresAt: time.Now().Add(loginChallengeLifetime)}).Error
+	})
+}
+
+// challengeLogin Holds back the tokens of a login until the two-factor code is given with the challenge
+func (service *UserService) challengeLogin(w http.ResponseWriter, user *User) {
+	challenge, err := service.newLoginChallenge(user)
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, NewUserError(28, "Internal server error", "Error making login challenge"))
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusAccepted, &LoginResponse{Successful: true, UUID: user.UUID.String(), TwoFactorRequired: true, Challenge: challenge})
+}
+
+// LoginTwoFactor Finishes a login with the challenge from /login and a code from the authenticator or a
+// recovery code. A challenge lasts five minutes and allows five wrong codes, and the user's codes are locked
+// for a while after ten wrong ones over any number of challenges.
+func (service *UserService) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodPost {
+		return
+	}
+
+	request := &LoginTwoFactorRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, NewUserError(1, "Invalid JSON request", err.Error()))
+		return
+	}
+
+	challenge := &LoginChallenge{}
+	user := &User{}
+	if service.db.First(challenge, "hash = ?", hashToken(request.Challenge)).RowsAffected == 0 || time.Now().After(challenge.ExpiresAt) ||
+		service.db.First(user, "uuid = ?", challenge.UserUUID).RowsAffected == 0 {
+		RenderJSONResponse(w, http.StatusUnauthorized, NewUserError(40, "Invalid login challenge", "The login challenge is wrong or has expired. Please login again."))
+		return
+	}
+
+	// Every attempt is counted before the code is checked, so attempts at the same time can't go over the limit
+	err := service.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(challenge).Where("attempts < ?", maxChallengeAttempts).Update("attempts", gorm.Expr("attempts + 1"))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errChallengeUsed
+		}
+
+		return nil
+	})
+	if errors.Is(err, errChallengeUsed) {
+		service.db.Delete(challenge)
+		RenderJSONResponse(w, http.StatusUnauthorized, NewUserError(40, "Invalid login challenge", "Too many wrong codes. Please login again."))
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, NewUserError(28, "Internal server error", "Error checking login challenge"))
+		return
+	}
+
+	if err := service.checkTwoFactor(user, request.Code, true); errors.Is(err, errCodeRejected) {
+		RenderJSONResponse(w, http.StatusForbidden, NewUserError(37, "Invalid code", "The two-factor code is wrong or was already used"))
+		return
+	} else if errors.Is(err, errCodesLocked) {
+		RenderJSONResponse(w, http.StatusTooManyRequests, NewUserError(45, "Too many wrong codes", codesLockedMessage))
+		return
+	} else if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, NewUserError(28, "Internal server error", "Error checking code"))
+		return
+	}
+
+	if err := service.db.Delete(challenge).Error; err != nil {
+		log.Println(err)
+	}
+
+	service.completeLogin(w, r, user)
+}
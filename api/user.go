@@ -31,21 +31,36 @@ type UserService struct {
 	emailDialer *gomail.Dialer
 	privateKey  crypto.PrivateKey
 	publicKey   crypto.PublicKey
+	listeners   []UserListener
+	// sessionListeners are told when a session is revoked
+	sessionListeners []SessionListener
+	// oidcProviders are the OpenID Connect providers users can sign in with, by name
+	oidcProviders map[string]*OIDCProvider
+}
+
+// UserListener is told when someone registers, when they verify their email and become a user, and when they
+// delete their account
+type UserListener interface {
+	UserRegistered(user *UnverifiedUser)
+	UserVerified(user *User)
+	UserDeleted(user *User)
+}
+
+// AddListener Registers a listener to be told about new registrations, verified users and deleted accounts
+func (service *UserService) AddListener(listener UserListener) {
+	service.listeners = append(service.listeners, listener)
 }
 
 type User struct {
-	UUID               uuid.UUID `gorm:"primaryKey;unique;type:uuid"`
-	FirstName          string    `gorm:"not null"`
-	LastName           string    `gorm:"not null"`
-	Password           []byte    `gorm:"not null"`
-	ELO                int       `gorm:"not null"`
-	Email              string    `gorm:"unique,not null"`
-	RefreshToken       string
-	AccessToken        string
-	RefreshTokenExpiry sql.NullTime
-	CreatedAt          time.Time
-	UpdatedAt          time.Time
-	DeletedAt          gorm.DeletedAt `gorm:"index"`
+	UUID      uuid.UUID `gorm:"primaryKey;unique;type:uuid"`
+	FirstName string    `gorm:"not null"`
+	LastName  string    `gorm:"not null"`
+	Password  []byte    `gorm:"not null"`
+	ELO       int       `gorm:"not null"`
+	Email     string    `gorm:"unique,not null"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
 }
 
 type UnverifiedUser struct {
@@ -56,6 +71,7 @@ type UnverifiedUser struct {
 	VerificationToken string    `gorm:"not null"`
 	Password          []byte    `gorm:"not null"`
 	Expiry            time.Time `gorm:"not null"`
+	EmailSentAt       time.Time
 	Activated         sql.NullTime
 }
 
@@ -105,11 +121,61 @@ func NewUserService(db *gorm.DB, emailDialer *gomail.Dialer, privateKeyPath, pub
 		panic(err)
 	}
 
-	service := &UserService{db, emailDialer, privateKey, pubicKey}
+	// Refresh tokens used to be kept in plain text on the user, they live hashed in their sessions now
+	for _, column := range []string{"refresh_token", "access_token", "refresh_token_expiry"} {
+		if db.Migrator().HasColumn(&User{}, column) {
+			if err = db.Migrator().DropColumn(&User{}, column); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	if err = db.AutoMigrate(&Session{}, &RefreshToken{}, &RevokedToken{}, &PasswordReset{}, &Profile{}, &EmailChange{}); err != nil {
+		panic(err)
+	}
+
+	if err = db.AutoMigrate(&TwoFactor{}, &RecoveryCode{}, &LoginChallenge{}); err != nil {
+		panic(err)
+	}
+
+	if err = db.AutoMigrate(&OIDCIdentity{}, &OIDCLogin{}); err != nil {
+		panic(err)
+	}
+
+	if err = db.AutoMigrate(&PersonalToken{}); err != nil {
+		panic(err)
+	}
+
+	service := &UserService{db, emailDialer, privateKey, pubicKey, nil, nil, loadOIDCProviders()}
+	go service.sessionCleaner()
+	go service.verificationCleaner()
 
 	http.HandleFunc("/register", service.HandleRegister)
 	http.HandleFunc("/verify", service.VerifyUser)
+	http.HandleFunc("/verify/resend", service.ResendVerification)
 	http.HandleFunc("/login", service.Login)
+	http.HandleFunc("/login/2fa", service.LoginTwoFactor)
+	http.HandleFunc("/oidc/providers", service.OIDCProviders)
+	http.HandleFunc("/oidc/{provider}/login", service.StartOIDCLogin)
+	http.HandleFunc("/oidc/{provider}/callback", service.OIDCCallback)
+	http.HandleFunc("/2fa", service.TwoFactorStatus)
+	http.HandleFunc("/2fa/enroll", service.EnrollTwoFactor)
+	http.HandleFunc("/2fa/confirm", service.ConfirmTwoFactor)
+	http.HandleFunc("/2fa/disable", service.DisableTwoFactor)
+	http.HandleFunc("/2fa/recovery-codes", service.RegenerateRecoveryCodes)
+	http.HandleFunc("/token/refresh", service.RefreshToken)
+	http.HandleFunc("/logout", service.Logout)
+	http.HandleFunc("/sessions", service.ListSessions)
+	http.HandleFunc("/sessions/{id}", service.DeleteSession)
+	http.HandleFunc("/tokens", service.HandlePersonalTokens)
+	http.HandleFunc("/tokens/{id}", service.RevokePersonalToken)
+	http.HandleFunc("/password/forgot", service.ForgotPassword)
+	http.HandleFunc("/password/reset", service.ResetPassword)
+	http.HandleFunc("/password/change", service.ChangePassword)
+	http.HandleFunc("/profile", service.HandleProfile)
+	http.HandleFunc("/players/{uuid}", service.PublicProfile)
+	http.HandleFunc("/email/change", service.ChangeEmail)
+	http.HandleFunc("/email/verify", service.VerifyEmailChange)
 
 	return service
 }
@@ -161,26 +227,33 @@ func (service *UserService) UnverifiedUserExists(email, verificationToken string
 	return service.db.First(&unverifiedUser, "email = ? AND verification_token = ?", email, verificationToken).Error == nil
 }
 
-// SendVerificationEmail Create and broadcast a verification email
+// SendVerificationEmail Create and broadcast a verification email, a failure is only logged as the user can
+// ask for it again
 func (service *UserService) SendVerificationEmail(user UnverifiedUser, host string) {
-	tpl, err := ParseTemplate("verify-email.tmpl", fmt.Sprintf("https://%s/verify?token=%s&email=%s", host, user.VerificationToken, url.QueryEscape(user.Email)))
+	link := fmt.Sprintf("https://%s/verify?token=%s&email=%s", host, user.VerificationToken, url.QueryEscape(user.Email))
+	if err := service.SendEmail(user.Email, "Verify Email", "verify-email.tmpl", link); err != nil {
+		log.Println(err)
+	}
+}
+
+// SendEmail Renders an email template with the data and sends it to the address
+func (service *UserService) SendEmail(to, subject, templateName string, data interface{}) error {
+	tpl, err := ParseTemplate(templateName, data)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 
 	m := gomail.NewMessage()
 	m.SetHeader("From", service.emailDialer.Username)
-	m.SetHeader("To", user.Email)
-	m.SetHeader("Subject", "Verify Email")
+	m.SetHeader("To", to)
+	m.SetHeader("Subject", subject)
 	m.SetBody("text/html", tpl)
 
-	if err := service.emailDialer.DialAndSend(m); err != nil {
-		log.Fatalln(err)
-	}
+	return service.emailDialer.DialAndSend(m)
 }
 
 // ParseTemplate Parse and execute a template file
-func ParseTemplate(templateName, data string) (string, error) {
+func ParseTemplate(templateName string, data interface{}) (string, error) {
 	t, err := template.New(templateName).ParseFiles("./templates/" + templateName)
 	if err != nil {
 		return "", err
@@ -198,45 +271,67 @@ func ShowError(w http.ResponseWriter) {
 	RenderErrorTemplate(w, "error", nil)
 }
 
+// VerifyUser Verifies an email from the link in the verification email, showing a page on GET. Apps can
+// POST the email and token as JSON instead and get a JSON response.
 func (service *UserService) VerifyUser(w http.ResponseWriter, r *http.Request) {
 	SetCors(&w)
 
-	if r.Method != http.MethodGet {
-		return
-	}
+	switch r.Method {
+	case http.MethodGet:
+		unverifiedUser, failure := service.verify(strings.ToLower(r.URL.Query().Get("email")), r.URL.Query().Get("token"))
+		if failure != nil && failure.code == 28 {
+			ShowError(w)
+			return
+		}
 
-	email := strings.ToLower(r.URL.Query().Get("email"))
-	token := r.URL.Query().Get("token")
+		if failure != nil {
+			data := map[string]string{"Error": failure.reason}
+			if unverifiedUser != nil {
+				data["Name"] = unverifiedUser.FirstName
+			}
 
-	if !service.UnverifiedUserExists(email, token) {
-		RenderErrorTemplate(w, "verification-failed", map[string]string{"Error": "we couldn't find your verification link in our database."})
-		return
+			RenderErrorTemplate(w, "verification-failed", data)
+			return
+		}
+
+		RenderErrorTemplate(w, "successfully-verified", map[string]string{"Name": unverifiedUser.FirstName})
+	case http.MethodPost:
+		request := &VerifyRequest{}
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			RenderJSONResponse(w, http.StatusBadRequest, NewUserError(1, "Invalid JSON request", err.Error()))
+			return
+		}
+
+		unverifiedUser, failure := service.verify(strings.ToLower(request.Email), request.Token)
+		if failure != nil {
+			RenderJSONResponse(w, failure.status, NewUserError(failure.code, "Verification failed", "Verification failed because "+failure.reason))
+			return
+		}
+
+		RenderJSONResponse(w, http.StatusOK, &VerifyResponse{Successful: true, UUID: unverifiedUser.UUID.String()})
 	}
+}
 
+// verify Turns the unverified user with the email and token into a user. Opening the link again once it
+// worked succeeds again without doing anything.
+func (service *UserService) verify(email, token string) (*UnverifiedUser, *verificationFailure) {
 	var unverifiedUser UnverifiedUser
-	service.db.First(&unverifiedUser, "email = ? AND verification_token = ?", email, token)
+	if token == "" || service.db.First(&unverifiedUser, "email = ? AND verification_token = ?", email, token).RowsAffected == 0 {
+		return nil, &verificationFailure{35, http.StatusNotFound, "we couldn't find your verification link in our database."}
+	}
 
 	if unverifiedUser.Activated.Valid && unverifiedUser.Activated.Time.Before(time.Now()) {
-		RenderErrorTemplate(w, "successfully-verified", map[string]string{"Name": unverifiedUser.FirstName})
-		return
+		return &unverifiedUser, nil
 	}
 
 	// Check if verification token has expired
 	if time.Now().After(unverifiedUser.Expiry) {
-		RenderErrorTemplate(w, "verification-failed", map[string]string{
-			"Name":  unverifiedUser.FirstName,
-			"Error": "too much time has passed since the verification email was sent.",
-		})
-		return
+		return &unverifiedUser, &verificationFailure{36, http.StatusGone, "too much time has passed since the verification email was sent."}
 	}
 
 	// Check if the user already exists
 	if service.EmailExists(email) {
-		RenderErrorTemplate(w, "verification-failed", map[string]string{
-			"Name":  unverifiedUser.FirstName,
-			"Error": "an account with this email already exists.",
-		})
-		return
+		return &unverifiedUser, &verificationFailure{33, http.StatusConflict, "an account with this email already exists."}
 	}
 
 	// Create the new user
@@ -251,8 +346,7 @@ func (service *UserService) VerifyUser(w http.ResponseWriter, r *http.Request) {
 
 	if err := service.db.Create(user).Error; err != nil {
 		log.Println(err)
-		ShowError(w)
-		return
+		return &unverifiedUser, &verificationFailure{28, http.StatusInternalServerError, "of an internal server error."}
 	}
 
 	unverifiedUser.Activated = sql.NullTime{
@@ -263,17 +357,14 @@ func (service *UserService) VerifyUser(w http.ResponseWriter, r *http.Request) {
 	// Mark the link as used
 	if err := service.db.Save(&unverifiedUser).Error; err != nil {
 		log.Println(err)
-		ShowError(w)
-		return
+		return &unverifiedUser, &verificationFailure{28, http.StatusInternalServerError, "of an internal server error."}
 	}
 
-	// Send the success response
-	err := render.New().HTML(w, http.StatusOK, "successfully-verified", map[string]string{
-		"Name": unverifiedUser.FirstName,
-	})
-	if err != nil {
-		log.Println(err)
+	for _, listener := range service.listeners {
+		listener.UserVerified(user)
 	}
+
+	return &unverifiedUser, nil
 }
 
 func (service *UserService) HandleRegister(w http.ResponseWriter, r *http.Request) {
@@ -291,23 +382,44 @@ func (service *UserService) HandleRegister(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	user, err := service.ProcessUser(&request, w, r.Host)
+	user, err := service.ProcessUser(&request, w)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	// Create the unverified user
-	if err := service.db.Create(user).Error; err != nil {
+	// Registering again straight after isn't a way around the cooldown on verification emails, the earlier
+	// registration stands and the response is the same
+	if service.recentlyEmailed(user.Email, user.EmailSentAt) {
+		RenderJSONResponse(w, http.StatusCreated, &NewUserResponse{Successful: true})
+		return
+	}
+
+	// Create the unverified user, replacing any earlier registration with the same email that was never verified
+	err = service.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("email = ? AND activated IS NULL", user.Email).Delete(&UnverifiedUser{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(user).Error
+	})
+	if err != nil {
 		response := NewUserError(31, "Error adding user to database", err.Error())
 		RenderJSONResponse(w, http.StatusInternalServerError, response)
 		return
 	}
 
+	// Send verification email asynchronously
+	go service.SendVerificationEmail(*user, r.Host)
+
+	for _, listener := range service.listeners {
+		listener.UserRegistered(user)
+	}
+
 	RenderJSONResponse(w, http.StatusCreated, &NewUserResponse{Successful: true})
 }
 
-func (service *UserService) ProcessUser(request *NewUserRequest, w http.ResponseWriter, host string) (*UnverifiedUser, error) {
+func (service *UserService) ProcessUser(request *NewUserRequest, w http.ResponseWriter) (*UnverifiedUser, error) {
 	email := strings.ToLower(request.Email)
 	if _, err := mail.ParseAddress(email); err != nil {
 		response := NewUserError(32, "Invalid email", err.Error())
@@ -343,18 +455,20 @@ func (service *UserService) ProcessUser(request *NewUserRequest, w http.Response
 	}
 
 	user.VerificationToken = token
-	user.Expiry = time.Now().Add(time.Hour * 24 * 7)
-
-	// Send verification email asynchronously
-	go service.SendVerificationEmail(*user, host)
+	user.Expiry = time.Now().Add(verificationLifetime)
+	user.EmailSentAt = time.Now()
 
 	return user, nil
 }
 
 type LoginResponse struct {
-	Successful  bool   `json:"success"`
-	AccessToken string `json:"access_token"`
-	UUID        string `json:"uuid"`
+	Successful  bool      `json:"success"`
+	AccessToken string    `json:"access_token"`
+	Expiry      time.Time `json:"expiry"`
+	UUID        string    `json:"uuid"`
+	// TwoFactorRequired asks for a code, sent to /login/2fa with the challenge, before any token is given
+	TwoFactorRequired bool   `json:"two_factor_required,omitempty"`
+	Challenge         string `json:"challenge,omitempty"`
 }
 
 func (service *UserService) Login(w http.ResponseWriter, r *http.Request) {
@@ -385,39 +499,13 @@ func (service *UserService) Login(w http.ResponseWriter, r *http.Request) {
 	service.db.First(user, "email = ?", request.Email)
 
 	if bytes.Equal(HashPassword(request.Password, user.UUID.String()), user.Password) {
-		accessToken, err := service.GenerateAccessToken(user)
-		if err != nil {
-			log.Println(err)
-			response := NewUserError(14, "Error signing token", err.Error())
-			RenderJSONResponse(w, http.StatusInternalServerError, response)
+		// Users with two-factor authentication still have to give a code
+		if service.TwoFactorEnabled(user) {
+			service.challengeLogin(w, user)
 			return
 		}
 
-		refreshToken, err := uuid.NewRandom()
-		if err != nil {
-			log.Println(err)
-			response := NewUserError(15, "Error creating refresh token", err.Error())
-			RenderJSONResponse(w, http.StatusInternalServerError, response)
-			return
-		}
-
-		user.RefreshToken = refreshToken.String()
-		user.AccessToken = accessToken
-		user.RefreshTokenExpiry = sql.NullTime{
-			Time:  time.Now().Add(time.Hour * 24 * 7),
-			Valid: true,
-		}
-
-		service.db.Save(user)
-
-		http.SetCookie(w, &http.Cookie{
-			Name:     "refresh_token",
-			Value:    user.RefreshToken,
-			HttpOnly: true,
-			Domain:   r.Host,
-		})
-
-		RenderJSONResponse(w, 200, &LoginResponse{true, accessToken, user.UUID.String()})
+		service.completeLogin(w, r, user)
 		return
 	}
 
@@ -426,77 +514,64 @@ func (service *UserService) Login(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func (service *UserService) GenerateAccessToken(user *User) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodES256,
-		jwt.MapClaims{
-			"uuid":   user.UUID,
-			"expiry": time.Now().Add(time.Hour).Unix(),
-		})
-
-	signedString, err := token.SignedString(service.privateKey)
+// completeLogin Starts a session for a user who has proven who they are and gives them its tokens
+func (service *UserService) completeLogin(w http.ResponseWriter, r *http.Request, user *User) {
+	session, tokens, err := service.StartSession(user, r)
 	if err != nil {
-		return "", err
+		log.Println(err)
+		response := NewUserError(14, "Error signing token", err.Error())
+		RenderJSONResponse(w, http.StatusInternalServerError, response)
+		return
 	}
 
-	return signedString, nil
-}
+	setRefreshCookie(w, r, tokens.RefreshToken, session.ExpiresAt)
 
-type RefreshTokenResponse struct {
-	AccessToken string    `json:"access_token"`
-	Expiry      time.Time `json:"expiry"`
+	RenderJSONResponse(w, 200, &LoginResponse{Successful: true, AccessToken: tokens.AccessToken, Expiry: tokens.Expiry, UUID: user.UUID.String()})
 }
 
-func (service *UserService) RefreshToken(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		return
+// GenerateAccessToken Signs a short lived access token for the user in one of their sessions, returning it with
+// when it expires. The token id is what gets listed when the token is revoked.
+func (service *UserService) GenerateAccessToken(user *User, session *Session, tokenID string) (string, time.Time, error) {
+	expiry := time.Now().Add(accessTokenLifetime)
+	claims := jwt.MapClaims{
+		"uuid":   user.UUID,
+		"expiry": expiry.Unix(),
+		"jti":    tokenID,
+		"sid":    session.ID.String(),
 	}
 
-	email := strings.ToLower(r.URL.Query().Get("email"))
-
-	if !service.EmailExists(email) {
-		response := NewUserError(13, "Email not found.", "Email not found: "+email)
-		RenderJSONResponse(w, http.StatusBadRequest, response)
-		return
+	// Tokens of OAuth apps carry what they were authorized to do
+	if session.ClientID != "" {
+		claims["cid"] = session.ClientID
+		claims["scope"] = session.Scopes
 	}
 
-	refreshToken, err := r.Cookie("refresh_token")
-	if err != nil {
-		response := NewUserError(14, "Invalid refresh token.", err.Error())
-		RenderJSONResponse(w, http.StatusInternalServerError, response)
-		return
-	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
 
-	user := &User{
-		Email:        email,
-		RefreshToken: refreshToken.Value,
+	signedString, err := token.SignedString(service.privateKey)
+	if err != nil {
+		return "", time.Time{}, err
 	}
 
-	if service.db.First(&user, "email = ?", email).RowsAffected == 0 {
-		response := NewUserError(14, "Invalid refresh token.", "Invalid refresh token with email: "+email)
-		RenderJSONResponse(w, http.StatusBadRequest, response)
-		return
-	}
+	return signedString, expiry, nil
+}
 
-	if time.Now().After(user.RefreshTokenExpiry.Time) {
-		response := NewUserError(15, "Refresh token is expired.", "Refresh token is expired. Please login again.")
-		RenderJSONResponse(w, http.StatusUnauthorized, response)
-		return
-	}
+// AuthenticateRequest Checks the access token of a request, giving the user it belongs to. Tokens of OAuth apps
+// and personal tokens are only accepted when they were granted one of the scopes given, so endpoints that don't
+// name any scope are kept to the user's own logins. Apps and personal tokens may leave out the email.
+func (service *UserService) AuthenticateRequest(email, accessToken string, scopes ...string) (*User, *NewUserResponse) {
+	user, _, userErr := service.AuthenticateSession(email, accessToken, scopes...)
+	return user, userErr
+}
 
-	accessToken, err := service.GenerateAccessToken(user)
-	if err != nil {
-		log.Println(err)
-		response := NewUserError(14, "Error signing token", err.Error())
-		RenderJSONResponse(w, http.StatusInternalServerError, response)
-		return
+// AuthenticateSession Checks an access token like AuthenticateRequest, also giving the id of the session it belongs to
+func (service *UserService) AuthenticateSession(email, accessToken string, scopes ...string) (*User, string, *NewUserResponse) {
+	if email != "" && !service.EmailExists(email) {
+		return nil, "", NewUserError(13, "Email not found.", "Email not found: "+email)
 	}
 
-	RenderJSONResponse(w, 200, &RefreshTokenResponse{accessToken, time.Now().Add(time.Minute * 15)})
-}
-
-func (service *UserService) AuthenticateRequest(email, accessToken string) (*User, *NewUserResponse) {
-	if !service.EmailExists(email) {
-		return nil, NewUserError(13, "Email not found.", "Email not found: "+email)
+	if strings.HasPrefix(accessToken, personalTokenPrefix) {
+		return service.authenticatePersonalToken(email, accessToken, scopes)
 	}
 
 	token, err := jwt.Parse(accessToken, func(token *jwt.Token) (interface{}, error) {
@@ -508,34 +583,65 @@ func (service *UserService) AuthenticateRequest(email, accessToken string) (*Use
 	})
 
 	if err != nil {
-		return nil, NewUserError(14, "Error parsing token", err.Error())
+		return nil, "", NewUserError(14, "Error parsing token", err.Error())
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
 		expiryUnix, ok := claims["expiry"].(float64)
 		if !ok {
-			return nil, NewUserError(15, "Error parsing token expiry", "Error parsing token expiry: ")
+			return nil, "", NewUserError(15, "Error parsing token expiry", "Error parsing token expiry: ")
 		}
 
 		expiry := time.Unix(int64(expiryUnix), 0)
 		if time.Now().After(expiry) {
-			return nil, NewUserError(15, "Access token is expired", "Access token is expired")
+			return nil, "", NewUserError(15, "Access token is expired", "Access token is expired")
 		}
 
 		userID, ok := claims["uuid"].(string)
 		if !ok {
-			return nil, NewUserError(16, "Error parsing token uuid", "Error parsing token uuid")
+			return nil, "", NewUserError(16, "Error parsing token uuid", "Error parsing token uuid")
+		}
+
+		tokenID, _ := claims["jti"].(string)
+		sessionID, _ := claims["sid"].(string)
+		if tokenID == "" || sessionID == "" {
+			return nil, "", NewUserError(15, "Invalid token", "Access token has no session. Please login again.")
+		}
+
+		if service.db.First(&RevokedToken{}, "jti = ?", tokenID).RowsAffected > 0 {
+			return nil, "", NewUserError(15, "Access token is revoked", "Access token is revoked. Please login again.")
+		}
+
+		// The session itself is checked too, so a token left off the revoked list still ends with its session
+		session := &Session{}
+		if service.db.First(session, "id = ? AND user_uuid = ?", sessionID, userID).RowsAffected == 0 || session.RevokedAt.Valid {
+			return nil, "", NewUserError(15, "Access token is revoked", "Access token is revoked. Please login again.")
+		}
+
+		granted, _ := claims["scope"].(string)
+		_, app := claims["cid"]
+		if app {
+			if userErr := scopeError(granted, scopes); userErr != nil {
+				return nil, "", userErr
+			}
+		}
+
+		query := service.db.Where("uuid = ?", userID)
+		if email != "" {
+			query = query.Where("email = ?", email)
+		} else if !app {
+			return nil, "", NewUserError(13, "Email not found.", "Email not found: "+email)
 		}
 
 		user := &User{}
-		if service.db.First(&user, "uuid = ? AND email = ?", userID, email).Error != nil {
-			return nil, NewUserError(17, "User not found.", "User not found with provided email or has incorrect access token.")
+		if query.First(&user).Error != nil {
+			return nil, "", NewUserError(17, "User not found.", "User not found with provided email or has incorrect access token.")
 		}
 
-		return user, nil
+		return user, sessionID, nil
 	}
 
-	return nil, NewUserError(15, "Invalid token", "Invalid token")
+	return nil, "", NewUserError(15, "Invalid token", "Invalid token")
 }
 
 func (service *UserService) GetUser(uuid string) (*User, error) {
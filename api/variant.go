@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	VariantStandard      = "standard"
+	VariantChess960      = "chess960"
+	VariantFromPosition  = "from_position"
+	VariantKingOfTheHill = "king_of_the_hill"
+	VariantThreeCheck    = "three_check"
+	VariantAntichess     = "antichess"
+	VariantAtomic        = "atomic"
+	VariantHorde         = "horde"
+	VariantRacingKings   = "racing_kings"
+	VariantCrazyhouse    = "crazyhouse"
+	VariantBughouse      = "bughouse"
+)
+
+// Variant is a set of chess rules: how pieces move, what a move does to the board and how the game ends
+type Variant interface {
+	// Name is the key clients use to ask for the variant and that is stored on the Game
+	Name() string
+	// PGNName is the value of the PGN Variant tag
+	PGNName() string
+	StartingPosition() *Position
+	LegalMoves(pos *Position) []*Move
+	// Play returns the position after the move, which has already been checked to be legal
+	Play(pos *Position, m *Move) *Position
+	InCheck(pos *Position) bool
+	// Result decides the game in the position given its legal moves, NoOutcome if play continues
+	Result(pos *Position, legal []*Move) (Outcome, Method)
+}
+
+var variants = map[string]Variant{
+	VariantStandard:      standardVariant{},
+	VariantKingOfTheHill: kingOfTheHillVariant{},
+	VariantThreeCheck:    threeCheckVariant{},
+	VariantAntichess:     antichessVariant{},
+	VariantAtomic:        atomicVariant{},
+	VariantHorde:         hordeVariant{},
+	VariantRacingKings:   racingKingsVariant{},
+	VariantCrazyhouse:    crazyhouseVariant{},
+	VariantBughouse:      bughouseVariant{},
+}
+
+// VariantFor Looks up the rules for a game variant, Chess960 and from position games use the standard rules
+func VariantFor(name string) (Variant, error) {
+	switch name {
+	case "", VariantChess960, VariantFromPosition:
+		return standardVariant{}, nil
+	}
+
+	variant, ok := variants[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown variant: %s", name)
+	}
+
+	return variant, nil
+}
+
+var variantNameReplacer = strings.NewReplacer(" ", "", "-", "", "_", "")
+
+// variantFromPGNTag Finds the rules named by a PGN Variant tag and whether it marks a Chess960 game
+func variantFromPGNTag(tag string) (Variant, bool, error) {
+	normalized := strings.ToLower(variantNameReplacer.Replace(tag))
+	switch normalized {
+	case "", "standard", "fromposition":
+		return standardVariant{}, false, nil
+	case "chess960", "fischerandom", "fischerrandom", "960":
+		return standardVariant{}, true, nil
+	}
+
+	for _, variant := range variants {
+		if strings.ToLower(variantNameReplacer.Replace(variant.PGNName())) == normalized {
+			return variant, false, nil
+		}
+	}
+
+	return nil, false, fmt.Errorf("unknown pgn variant: %s", tag)
+}
+
+// ParseVariantFEN Parses a FEN for a position played under the variant, three-check FENs carry
+// the remaining checks of each side (e.g. 3+3) before the half move clock
+func ParseVariantFEN(variant Variant, fen string) (*Position, error) {
+	var checks [3]int
+	if _, ok := variant.(threeCheckVariant); ok {
+		fields := strings.Fields(fen)
+		for i, field := range fields {
+			var white, black int
+			if i < 4 || !strings.Contains(field, "+") {
+				continue
+			}
+
+			if _, err := fmt.Sscanf(field, "%d+%d", &white, &black); err != nil || white < 0 || black < 0 || white > threeCheckLimit || black > threeCheckLimit {
+				return nil, fmt.Errorf("invalid fen: bad remaining checks %q", field)
+			}
+
+			checks[White], checks[Black] = threeCheckLimit-white, threeCheckLimit-black
+			fen = strings.Join(append(fields[:i:i], fields[i+1:]...), " ")
+			break
+		}
+	}
+
+	pos, err := ParseFEN(fen)
+	if err != nil {
+		return nil, err
+	}
+
+	pos.variant = variant
+	pos.checks = checks
+
+	if !pos.hasPockets() && !pos.hasEmptyPockets() {
+		return nil, fmt.Errorf("invalid fen: pockets are only allowed in drop variants")
+	}
+
+	return pos, nil
+}
+
+// RandomChess960Position is used in place of a position number to have one picked when the game starts
+const RandomChess960Position = -1
+
+// defaultBughouseTimeControl is used for Bughouse games requested without a time control, as the
+// clocks are what end a game where a player is waiting for pieces
+var defaultBughouseTimeControl = TimeControl{Initial: 3 * time.Minute}
+
+const maxDaysPerMove = 14
+
+// GameSetup describes how a game should start
+type GameSetup struct {
+	Variant          string
+	Chess960Position int
+	FEN              string
+	// TimeControl is zero for untimed games
+	TimeControl TimeControl
+	// DaysPerMove makes the game a correspondence game when set
+	DaysPerMove int
+	// ClubID only pairs the player with other members of the club
+	ClubID uint
+}
+
+// key identifies setups that players can be paired on
+func (s *GameSetup) key() string {
+	key := s.Variant
+	switch s.Variant {
+	case VariantChess960:
+		if s.Chess960Position != RandomChess960Position {
+			key = fmt.Sprintf("%s:%d", VariantChess960, s.Chess960Position)
+		}
+	case VariantFromPosition:
+		key = VariantFromPosition + ":" + s.FEN
+	}
+
+	if s.TimeControl.Initial > 0 {
+		key += " " + s.TimeControl.String()
+	}
+
+	if s.DaysPerMove > 0 {
+		key += fmt.Sprintf(" %dd", s.DaysPerMove)
+	}
+
+	if s.ClubID > 0 {
+		key += fmt.Sprintf(" club:%d", s.ClubID)
+	}
+
+	return key
+}
+
+// Players returns how many players a game with this setup needs, four for the two boards of Bughouse
+func (s *GameSetup) Players() int {
+	if s.Variant == VariantBughouse {
+		return 4
+	}
+
+	return 2
+}
+
+// Validate Checks that the setup can be used to start a game
+func (s *GameSetup) Validate() error {
+	switch {
+	case s.DaysPerMove < 0 || s.DaysPerMove > maxDaysPerMove:
+		return fmt.Errorf("days per move must be between 1 and %d, got %d", maxDaysPerMove, s.DaysPerMove)
+	case s.DaysPerMove > 0 && s.TimeControl.Initial > 0:
+		return errors.New("correspondence games cannot have a time control")
+	case s.DaysPerMove > 0 && s.Variant == VariantBughouse:
+		return errors.New("bughouse cannot be played by correspondence")
+	}
+
+	switch s.Variant {
+	case VariantChess960:
+		if s.Chess960Position != RandomChess960Position && (s.Chess960Position < 0 || s.Chess960Position > 959) {
+			return fmt.Errorf("chess960 position must be between 0 and 959, got %d", s.Chess960Position)
+		}
+		return nil
+	case VariantFromPosition:
+		pos, err := ParseFEN(s.FEN)
+		if err != nil {
+			return err
+		}
+		return ValidateSetupPosition(pos)
+	case VariantBughouse:
+		if s.TimeControl.Initial <= 0 {
+			return errors.New("bughouse games must have a time control")
+		}
+	}
+
+	_, err := VariantFor(s.Variant)
+	return err
+}
+
+// NewBoard Creates the board a game with this setup starts on
+func (s *GameSetup) NewBoard() (*Board, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch s.Variant {
+	case VariantChess960:
+		n := s.Chess960Position
+		if n == RandomChess960Position {
+			n = rand.Intn(960)
+		}
+		return NewBoard(Chess960Position(n)), nil
+	case VariantFromPosition:
+		pos, err := ParseFEN(s.FEN)
+		if err != nil {
+			return nil, err
+		}
+		return NewBoard(pos), nil
+	}
+
+	variant, err := VariantFor(s.Variant)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBoard(variant.StartingPosition()), nil
+}
+
+// Chess960Position Builds starting position n (0-959) using the standard Scharnagl numbering, 518 is the normal setup
+func Chess960Position(n int) *Position {
+	var backRank [8]PieceType
+
+	// placeOnEmpty puts the piece on the i-th empty square of the back rank
+	placeOnEmpty := func(pt PieceType, i int) {
+		for file := range backRank {
+			if backRank[file] != NoPieceType {
+				continue
+			}
+			if i == 0 {
+				backRank[file] = pt
+				return
+			}
+			i--
+		}
+	}
+
+	backRank[2*(n%4)+1] = Bishop
+	n /= 4
+	backRank[2*(n%4)] = Bishop
+	n /= 4
+	placeOnEmpty(Queen, n%6)
+	n /= 6
+
+	knights := [10][2]int{{0, 1}, {0, 2}, {0, 3}, {0, 4}, {1, 2}, {1, 3}, {1, 4}, {2, 3}, {2, 4}, {3, 4}}[n]
+	// Placing the second knight first keeps the first knight's index valid
+	placeOnEmpty(Knight, knights[1])
+	placeOnEmpty(Knight, knights[0])
+
+	placeOnEmpty(Rook, 0)
+	placeOnEmpty(King, 0)
+	placeOnEmpty(Rook, 0)
+
+	pos := emptyPosition()
+	pos.chess960 = true
+	for file, pt := range backRank {
+		pos.board[NewSquare(file, 0)] = Piece{pt, White}
+		pos.board[NewSquare(file, 1)] = Piece{Pawn, White}
+		pos.board[NewSquare(file, 6)] = Piece{Pawn, Black}
+		pos.board[NewSquare(file, 7)] = Piece{pt, Black}
+	}
+
+	for _, color := range []Color{White, Black} {
+		pos.castling[color][KingSide] = pos.outermostRook(color, KingSide)
+		pos.castling[color][QueenSide] = pos.outermostRook(color, QueenSide)
+	}
+
+	return pos
+}
+
+// ValidateSetupPosition Checks that a position could be reached in a game of standard chess and is not already over
+func ValidateSetupPosition(pos *Position) error {
+	if !pos.hasEmptyPockets() {
+		return errors.New("pockets are only allowed in drop variants")
+	}
+
+	var pieces, pawns [3]int
+	for sq := Square(0); sq < 64; sq++ {
+		p := pos.board[sq]
+		if p == NoPiece {
+			continue
+		}
+
+		pieces[p.Color]++
+		if p.Type == Pawn {
+			pawns[p.Color]++
+			if sq.Rank() == 0 || sq.Rank() == 7 {
+				return fmt.Errorf("pawn on the back rank at %s", sq)
+			}
+		}
+	}
+
+	for _, color := range []Color{White, Black} {
+		if kings := pos.countPieces(Piece{King, color}); kings != 1 {
+			return fmt.Errorf("%s must have exactly one king, found %d", color.Name(), kings)
+		}
+		if pieces[color] > 16 || pawns[color] > 8 {
+			return fmt.Errorf("%s has too many pieces", color.Name())
+		}
+
+		king := pos.kingSquare(color)
+		for _, rook := range pos.castling[color] {
+			if rook == NoSquare {
+				continue
+			}
+			if king != NewSquare(4, color.backRank()) || (rook.File() != 0 && rook.File() != 7) {
+				return fmt.Errorf("%s castling rights require the king and rooks on their original squares", color.Name())
+			}
+		}
+	}
+
+	opponentKing := pos.kingSquare(pos.turn.Other())
+	if pos.IsAttacked(opponentKing, pos.turn) {
+		return errors.New("the side not to move is in check")
+	}
+
+	if pos.enPassant != NoSquare {
+		// The pawn that just moved two squares must sit in front of the en passant square
+		pawn := offset(pos.enPassant, 0, pos.turn.Other().forward())
+		origin := offset(pos.enPassant, 0, -pos.turn.Other().forward())
+		if pos.enPassant.Rank() != pos.turn.Other().backRank()+2*pos.turn.Other().forward() ||
+			pos.Piece(pawn) != (Piece{Pawn, pos.turn.Other()}) ||
+			pos.Piece(pos.enPassant) != NoPiece || pos.Piece(origin) != NoPiece {
+			return fmt.Errorf("invalid en passant square %s", pos.enPassant)
+		}
+	}
+
+	if len(pos.ValidMoves()) == 0 || pos.hasInsufficientMaterial() {
+		return errors.New("the game is already over in this position")
+	}
+
+	return nil
+}
+
+func (pos *Position) countPieces(p Piece) int {
+	count := 0
+	for sq := Square(0); sq < 64; sq++ {
+		if pos.board[sq] == p {
+			count++
+		}
+	}
+
+	return count
+}
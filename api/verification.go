@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	verificationLifetime = 7 * 24 * time.Hour
+	// verificationCooldown is how long to wait before another verification email can be sent
+	verificationCooldown    = time.Minute
+	verificationCleanupTick = time.Hour
+)
+
+type VerifyRequest struct {
+	Email string `json:"email"`
+	Token string `json:"token"`
+}
+
+type VerifyResponse struct {
+	Successful bool              `json:"success"`
+	UUID       string            `json:"uuid,omitempty"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+// verificationFailure is why an email could not be verified, worded to end the sentence on the failure page
+type verificationFailure struct {
+	code   int
+	status int
+	reason string
+}
+
+// recentlyEmailed Reports whether a registration of the email waiting to be verified was sent its link within the
+// cooldown, in which case neither registering again nor asking for the link again sends another
+func (service *UserService) recentlyEmailed(email string, now time.Time) bool {
+	return service.db.Where("email = ? AND activated IS NULL AND email_sent_at > ?", email, now.Add(-verificationCooldown)).First(&UnverifiedUser{}).RowsAffected > 0
+}
+
+// ResendVerification Sends a new verification link to an email that registered but never verified, the old
+// link stops working. Every email gets the same response, whether it has anything waiting to be verified or
+// was sent a link too recently, so the endpoint can't tell anyone which emails registered.
+func (service *UserService) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if r.Method != http.MethodPost {
+		return
+	}
+
+	request := &ResendVerificationRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, NewUserError(1, "Invalid JSON request", err.Error()))
+		return
+	}
+
+	now := time.Now()
+	unverifiedUser := &UnverifiedUser{}
+	email := strings.ToLower(strings.TrimSpace(request.Email))
+	if service.recentlyEmailed(email, now) || service.db.Where("email = ? AND activated IS NULL", email).Order("email_sent_at desc").First(unverifiedUser).RowsAffected == 0 {
+		RenderJSONResponse(w, http.StatusOK, &NewUserResponse{Successful: true})
+		return
+	}
+
+	token, err := GenerateVerificationToken()
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, NewUserError(28, "Internal server error", "Error creating verification link"))
+		return
+	}
+
+	unverifiedUser.VerificationToken = token
+	unverifiedUser.Expiry = now.Add(verificationLifetime)
+	unverifiedUser.EmailSentAt = now
+	if err := service.db.Save(unverifiedUser).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, NewUserError(28, "Internal server error", "Error saving verification link"))
+		return
+	}
+
+	go service.SendVerificationEmail(*unverifiedUser, r.Host)
+
+	RenderJSONResponse(w, http.StatusOK, &NewUserResponse{Successful: true})
+}
+
+// verificationCleaner Deletes registrations whose verification link has expired
+func (service *UserService) verificationCleaner() {
+	for range time.Tick(verificationCleanupTick) {
+		if err := service.db.Where("expiry < ?", time.Now()).Delete(&UnverifiedUser{}).Error; err != nil {
+			log.Println(err)
+		}
+	}
+}
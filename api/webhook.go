@@ -0,0 +1,559 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pjebs/jsonerror"
+	"gorm.io/gorm"
+)
+
+const (
+	WebhookGameStart      = "game_start"
+	WebhookMove           = "move"
+	WebhookGameResult     = "game_result"
+	WebhookUserRegistered = "user_registered"
+	WebhookUserVerified   = "user_verified"
+
+	// A pending delivery is retried until it is delivered or has failed maxWebhookAttempts times, when it is dead
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+
+	// Retries wait webhookBackoff after the first failure, doubling after every one up to maxWebhookBackoff
+	maxWebhookAttempts = 8
+	webhookBackoff     = 10 * time.Second
+	maxWebhookBackoff  = time.Hour
+
+	webhookTick    = 5 * time.Second
+	webhookTimeout = 10 * time.Second
+	webhookBatch   = 20
+	deliveryPage   = 100
+)
+
+var webhookEvents = []string{WebhookGameStart, WebhookMove, WebhookGameResult, WebhookUserRegistered, WebhookUserVerified}
+
+// Webhook is a URL registered by an admin to be sent server events as signed JSON
+type Webhook struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `gorm:"not null" json:"created_by"`
+	URL       string    `gorm:"not null" json:"url"`
+	// Secret is the HMAC key deliveries are signed with, it is only shown when the webhook is registered
+	Secret string `gorm:"not null" json:"secret,omitempty"`
+	// Events are the events sent to the webhook, every event when empty
+	Events []string `gorm:"serializer:json" json:"events"`
+}
+
+// wants Reports whether the webhook is sent the event
+func (h *Webhook) wants(event string) bool {
+	return len(h.Events) == 0 || slices.Contains(h.Events, event)
+}
+
+// WebhookDelivery is one event queued for a webhook, kept after it is delivered or dead as the delivery log
+type WebhookDelivery struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	WebhookID   uint      `gorm:"not null;index" json:"webhook_id"`
+	Event       string    `gorm:"not null" json:"event"`
+	Body        string    `gorm:"not null" json:"body"`
+	Status      string    `gorm:"not null;index" json:"status"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `gorm:"index" json:"next_attempt"`
+	// ResponseStatus and LastError are the outcome of the latest attempt
+	ResponseStatus int        `json:"response_status,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// webhookBody is the JSON posted to a webhook
+type webhookBody struct {
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// WebhookMoveData is the data of a move event
+type WebhookMoveData struct {
+	GameID uint   `json:"game_id"`
+	Move   string `json:"move"`
+	FEN    string `json:"fen"`
+}
+
+// WebhookUserData is the data of the user events
+type WebhookUserData struct {
+	UUID      string `json:"uuid"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+}
+
+// signWebhook Signs a delivery body with the webhook's secret, sent as the X-Checkers-Signature header
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryAfter is how long a delivery waits after failing the given number of times
+func retryAfter(attempts int) time.Duration {
+	wait := webhookBackoff
+	for i := 1; i < attempts && wait < maxWebhookBackoff; i++ {
+		wait *= 2
+	}
+
+	return min(wait, maxWebhookBackoff)
+}
+
+type WebhookService struct {
+	db     *gorm.DB
+	gs     *GameService
+	client *http.Client
+	// admins are the emails of the users who can manage webhooks, from the comma separated ADMINS
+	admins map[string]bool
+	// mu guards hooks, the registered webhooks
+	mu    sync.Mutex
+	hooks []*Webhook
+	// wake tells the deliverer there are new deliveries
+	wake chan struct{}
+}
+
+func NewWebhookService(db *gorm.DB, gs *GameService) *WebhookService {
+	if err := db.AutoMigrate(&Webhook{}, &WebhookDelivery{}); err != nil {
+		panic(err)
+	}
+
+	service := &WebhookService{
+		db:     db,
+		gs:     gs,
+		client: &http.Client{Timeout: webhookTimeout},
+		admins: EmailsFromEnv("ADMINS"),
+		wake:   make(chan struct{}, 1),
+	}
+
+	if err := service.loadHooks(); err != nil {
+		panic(err)
+	}
+
+	gs.AddListener(service)
+	gs.us.AddListener(service)
+	go service.deliverer()
+
+	http.HandleFunc("/webhooks", service.HandleWebhooks)
+	http.HandleFunc("/webhooks/delete", service.DeleteWebhook)
+	http.HandleFunc("/webhooks/deliveries", service.ListDeliveries)
+	http.HandleFunc("/webhooks/deliveries/retry", service.RetryDelivery)
+
+	return service
+}
+
+// loadHooks Reads the registered webhooks into memory, so events don't need to look them up
+func (ws *WebhookService) loadHooks() error {
+	var hooks []*Webhook
+	if err := ws.db.Order("id").Find(&hooks).Error; err != nil {
+		return err
+	}
+
+	ws.mu.Lock()
+	ws.hooks = hooks
+	ws.mu.Unlock()
+
+	return nil
+}
+
+// enqueue Queues the event for every webhook that wants it and wakes the deliverer
+func (ws *WebhookService) enqueue(event string, data interface{}) {
+	ws.mu.Lock()
+	hooks := slices.Clone(ws.hooks)
+	ws.mu.Unlock()
+
+	var body []byte
+	var deliveries []*WebhookDelivery
+	now := time.Now()
+	for _, hook := range hooks {
+		if !hook.wants(event) {
+			continue
+		}
+
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(&webhookBody{Event: event, CreatedAt: now, Data: data}); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+
+		deliveries = append(deliveries, &WebhookDelivery{WebhookID: hook.ID, Event: event, Body: string(body), Status: DeliveryPending, NextAttempt: now})
+	}
+
+	if len(deliveries) == 0 {
+		return
+	}
+
+	if err := ws.db.Create(deliveries).Error; err != nil {
+		log.Println(err)
+		return
+	}
+
+	select {
+	case ws.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (ws *WebhookService) GameStarted(game *Game) {
+	ws.enqueue(WebhookGameStart, game)
+}
+
+func (ws *WebhookService) GameMoved(game *Game) {
+	ws.enqueue(WebhookMove, &WebhookMoveData{GameID: game.ID, Move: game.lastMove(), FEN: game.board.FEN()})
+}
+
+func (ws *WebhookService) GameEnded(game *Game) {
+	outcome := &GameOutcome{
+		GameID: game.ID,
+		Result: game.board.Outcome().String(),
+		Method: game.board.Method().String(),
+		IsDraw: game.board.Outcome() == Draw,
+	}
+
+	switch game.board.Outcome() {
+	case WhiteWon:
+		outcome.Winner, outcome.Loser = game.PlayerWhite, game.PlayerBlack
+	case BlackWon:
+		outcome.Winner, outcome.Loser = game.PlayerBlack, game.PlayerWhite
+	}
+
+	ws.enqueue(WebhookGameResult, outcome)
+}
+
+func (ws *WebhookService) UserRegistered(user *UnverifiedUser) {
+	ws.enqueue(WebhookUserRegistered, &WebhookUserData{user.UUID.String(), user.FirstName, user.LastName, user.Email})
+}
+
+func (ws *WebhookService) UserVerified(user *User) {
+	ws.enqueue(WebhookUserVerified, &WebhookUserData{user.UUID.String(), user.FirstName, user.LastName, user.Email})
+}
+
+// UserDeleted Stops sending events to the webhooks the deleted user registered, their rows are deleted with the
+// account and their pending deliveries become dead
+func (ws *WebhookService) UserDeleted(user *User) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	ws.hooks = slices.DeleteFunc(ws.hooks, func(hook *Webhook) bool { return hook.CreatedBy == user.UUID.String() })
+}
+
+// deliverer Sends the deliveries that are due, woken by new events and checking for retries every webhookTick
+func (ws *WebhookService) deliverer() {
+	ticker := time.NewTicker(webhookTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ws.wake:
+		}
+
+		ws.deliverDue(time.Now())
+	}
+}
+
+// deliverDue Attempts every pending delivery whose time has come, oldest first
+func (ws *WebhookService) deliverDue(now time.Time) {
+	for {
+		var deliveries []*WebhookDelivery
+		if err := ws.db.Where("status = ? AND next_attempt <= ?", DeliveryPending, now).Order("id").Limit(webhookBatch).Find(&deliveries).Error; err != nil {
+			log.Println(err)
+			return
+		}
+
+		for _, delivery := range deliveries {
+			ws.attempt(delivery, now)
+		}
+
+		if len(deliveries) < webhookBatch {
+			return
+		}
+	}
+}
+
+// attempt Posts a delivery to its webhook, scheduling a retry with backoff when it fails
+func (ws *WebhookService) attempt(delivery *WebhookDelivery, now time.Time) {
+	ws.mu.Lock()
+	index := slices.IndexFunc(ws.hooks, func(hook *Webhook) bool { return hook.ID == delivery.WebhookID })
+	var hook *Webhook
+	if index >= 0 {
+		hook = ws.hooks[index]
+	}
+	ws.mu.Unlock()
+
+	delivery.Attempts++
+	var err error
+	if hook == nil {
+		delivery.Attempts = maxWebhookAttempts
+		err = errors.New("the webhook was deleted")
+	} else {
+		delivery.ResponseStatus, err = ws.post(hook, delivery)
+	}
+
+	switch {
+	case err == nil:
+		delivered := time.Now()
+		delivery.Status, delivery.DeliveredAt, delivery.LastError = DeliveryDelivered, &delivered, ""
+	case delivery.Attempts >= maxWebhookAttempts:
+		delivery.Status, delivery.LastError = DeliveryDead, err.Error()
+	default:
+		delivery.NextAttempt, delivery.LastError = now.Add(retryAfter(delivery.Attempts)), err.Error()
+	}
+
+	if err := ws.db.Save(delivery).Error; err != nil {
+		log.Println(err)
+	}
+}
+
+// post Sends a delivery to a webhook, any answer other than 2xx is a failure
+func (ws *WebhookService) post(hook *Webhook, delivery *WebhookDelivery) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, hook.URL, strings.NewReader(delivery.Body))
+	if err != nil {
+		return 0, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "Checkers-Webhook")
+	request.Header.Set("X-Checkers-Event", delivery.Event)
+	request.Header.Set("X-Checkers-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	request.Header.Set("X-Checkers-Signature", signWebhook(hook.Secret, []byte(delivery.Body)))
+
+	response, err := ws.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if _, err := io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10)); err != nil {
+		log.Println(err)
+	}
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("webhook answered %s", response.Status)
+	}
+
+	return response.StatusCode, nil
+}
+
+type NewWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+type WebhookResponse struct {
+	Successful bool              `json:"success"`
+	Webhook    *Webhook          `json:"webhook,omitempty"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+type WebhookListResponse struct {
+	Successful bool              `json:"success"`
+	Webhooks   []*Webhook        `json:"webhooks"`
+	Error      map[string]string `json:"error,omitempty"`
+}
+
+type DeliveryListResponse struct {
+	Successful bool               `json:"success"`
+	Deliveries []*WebhookDelivery `json:"deliveries"`
+	Error      map[string]string  `json:"error,omitempty"`
+}
+
+func webhookError(code int, error, message string) *WebhookResponse {
+	return &WebhookResponse{Error: jsonerror.New(code, error, message).Render()}
+}
+
+// authenticatedAdmin Authenticates one of the admins named in ADMINS for a request with the given method
+func (ws *WebhookService) authenticatedAdmin(w http.ResponseWriter, r *http.Request, method string) (*User, bool) {
+	if r.Method != method {
+		return nil, false
+	}
+
+	user, userErr := ws.gs.us.AuthenticateRequest(r.URL.Query().Get("email"), r.Header.Get("Authorization"))
+	if userErr != nil {
+		RenderJSONResponse(w, http.StatusUnauthorized, userErr)
+		return nil, false
+	}
+
+	if !ws.admins[strings.ToLower(user.Email)] {
+		RenderJSONResponse(w, http.StatusForbidden, webhookError(160, "Not an admin", "Only admins can manage webhooks"))
+		return nil, false
+	}
+
+	return user, true
+}
+
+// HandleWebhooks Lists the webhooks on GET and registers a new one on POST
+func (ws *WebhookService) HandleWebhooks(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	switch r.Method {
+	case http.MethodGet:
+		ws.ListWebhooks(w, r)
+	case http.MethodPost:
+		ws.CreateWebhook(w, r)
+	}
+}
+
+// ListWebhooks Gives every registered webhook, without their secrets
+func (ws *WebhookService) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	if _, ok := ws.authenticatedAdmin(w, r, http.MethodGet); !ok {
+		return
+	}
+
+	ws.mu.Lock()
+	hooks := make([]*Webhook, len(ws.hooks))
+	for i, hook := range ws.hooks {
+		listed := *hook
+		listed.Secret = ""
+		hooks[i] = &listed
+	}
+	ws.mu.Unlock()
+
+	RenderJSONResponse(w, http.StatusOK, &WebhookListResponse{Successful: true, Webhooks: hooks})
+}
+
+// CreateWebhook Registers a URL to be sent the given events, or all of them, returning the secret deliveries are signed with
+func (ws *WebhookService) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	user, ok := ws.authenticatedAdmin(w, r, http.MethodPost)
+	if !ok {
+		return
+	}
+
+	var request NewWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		RenderJSONResponse(w, http.StatusBadRequest, webhookError(1, "Invalid JSON request", err.Error()))
+		return
+	}
+
+	target, err := url.Parse(request.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		RenderJSONResponse(w, http.StatusBadRequest, webhookError(161, "Invalid webhook", "The URL must be an absolute http or https URL"))
+		return
+	}
+
+	for _, event := range request.Events {
+		if !slices.Contains(webhookEvents, event) {
+			RenderJSONResponse(w, http.StatusBadRequest, webhookError(161, "Invalid webhook", fmt.Sprintf("Unknown event %q, events are %s", event, strings.Join(webhookEvents, ", "))))
+			return
+		}
+	}
+
+	secret, err := GenerateVerificationToken()
+	if err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, webhookError(28, "Internal server error", "Error generating webhook secret"))
+		return
+	}
+
+	hook := &Webhook{CreatedBy: user.UUID.String(), URL: target.String(), Secret: secret, Events: request.Events}
+	if err := ws.db.Create(hook).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, webhookError(28, "Internal server error", "Error saving webhook"))
+		return
+	}
+
+	ws.mu.Lock()
+	ws.hooks = append(ws.hooks, hook)
+	ws.mu.Unlock()
+
+	RenderJSONResponse(w, http.StatusCreated, &WebhookResponse{Successful: true, Webhook: hook})
+}
+
+// DeleteWebhook Stops sending events to a webhook, its pending deliveries become dead
+func (ws *WebhookService) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if _, ok := ws.authenticatedAdmin(w, r, http.MethodPost); !ok {
+		return
+	}
+
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil || ws.db.Delete(&Webhook{}, id).RowsAffected == 0 {
+		RenderJSONResponse(w, http.StatusNotFound, webhookError(162, "Webhook not found", "No webhook with given ID: "+r.URL.Query().Get("id")))
+		return
+	}
+
+	ws.mu.Lock()
+	ws.hooks = slices.DeleteFunc(ws.hooks, func(hook *Webhook) bool { return hook.ID == uint(id) })
+	ws.mu.Unlock()
+
+	RenderJSONResponse(w, http.StatusOK, &WebhookResponse{Successful: true})
+}
+
+// ListDeliveries Gives the latest deliveries, newest first. webhook= keeps to one webhook and status= to
+// pending, delivered or dead deliveries, status=dead being the dead-letter list.
+func (ws *WebhookService) ListDeliveries(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if _, ok := ws.authenticatedAdmin(w, r, http.MethodGet); !ok {
+		return
+	}
+
+	query := ws.db.Order("id desc").Limit(deliveryPage)
+	if webhook := r.URL.Query().Get("webhook"); webhook != "" {
+		query = query.Where("webhook_id = ?", webhook)
+	}
+
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	response := &DeliveryListResponse{Successful: true, Deliveries: []*WebhookDelivery{}}
+	if err := query.Find(&response.Deliveries).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, &DeliveryListResponse{Error: jsonerror.New(28, "Internal server error", "Error loading deliveries").Render()})
+		return
+	}
+
+	RenderJSONResponse(w, http.StatusOK, response)
+}
+
+// RetryDelivery Queues a dead delivery again with a fresh set of attempts
+func (ws *WebhookService) RetryDelivery(w http.ResponseWriter, r *http.Request) {
+	SetCors(&w)
+
+	if _, ok := ws.authenticatedAdmin(w, r, http.MethodPost); !ok {
+		return
+	}
+
+	delivery := &WebhookDelivery{}
+	if ws.db.Where("id = ? AND status = ?", r.URL.Query().Get("id"), DeliveryDead).First(delivery).RowsAffected == 0 {
+		RenderJSONResponse(w, http.StatusNotFound, webhookError(163, "Delivery not found", "No dead delivery with given ID: "+r.URL.Query().Get("id")))
+		return
+	}
+
+	delivery.Status, delivery.Attempts, delivery.NextAttempt = DeliveryPending, 0, time.Now()
+	if err := ws.db.Save(delivery).Error; err != nil {
+		log.Println(err)
+		RenderJSONResponse(w, http.StatusInternalServerError, webhookError(28, "Internal server error", "Error saving delivery"))
+		return
+	}
+
+	select {
+	case ws.wake <- struct{}{}:
+	default:
+	}
+
+	RenderJSONResponse(w, http.StatusOK, &WebhookResponse{Successful: true})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a local endpoint standing in for a webhook, answering with the statuses given in turn and
+// with the last one after that
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	status := wr.statuses[min(len(wr.requests), len(wr.statuses)-1)]
+	wr.requests = append(wr.requests, r)
+	wr.bodies = append(wr.bodies, body)
+	w.WriteHeader(status)
+}
+
+func (wr *webhookReceiver) received() int {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	return len(wr.requests)
+}
+
+// newTestWebhookService Makes a webhook service without its handlers or deliverer, sending to the hooks given
+func newTestWebhookService(t *testing.T, hooks ...*Webhook) *WebhookService {
+	t.Helper()
+
+	ws := &WebhookService{
+		db:     newTestDB(t, &Webhook{}, &WebhookDelivery{}),
+		client: &http.Client{Timeout: webhookTimeout},
+		wake:   make(chan struct{}, 1),
+	}
+
+	for _, hook := range hooks {
+		if err := ws.db.Create(hook).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ws.loadHooks(); err != nil {
+		t.Fatal(err)
+	}
+
+	return ws
+}
+
+func (ws *WebhookService) testDelivery(t *testing.T, hookID uint) *WebhookDelivery {
+	t.Helper()
+
+	delivery := &WebhookDelivery{}
+	if err := ws.db.First(delivery, "webhook_id = ?", hookID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return delivery
+}
+
+func TestWebhookSignature(t *testing.T) {
+	receiver := &webhookReceiver{statuses: []int{http.StatusOK}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	hook := &Webhook{CreatedBy: "admin", URL: server.URL, Secret: "shh"}
+	ws := newTestWebhookService(t, hook)
+
+	ws.UserVerified(&User{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"})
+	ws.deliverDue(time.Now())
+
+	if receiver.received() != 1 {
+		t.Fatalf("got %d requests, want 1", receiver.received())
+	}
+
+	request, body := receiver.requests[0], receiver.bodies[0]
+	if got, want := request.Header.Get("X-Checkers-Signature"), signWebhook("shh", body); got != want {
+		t.Errorf("signature %q, want %q", got, want)
+	}
+	if got := request.Header.Get("X-Checkers-Signature"); got == signWebhook("other", body) {
+		t.Error("signature doesn't depend on the secret")
+	}
+	if got := request.Header.Get("X-Checkers-Event"); got != WebhookUserVerified {
+		t.Errorf("event header %q, want %q", got, WebhookUserVerified)
+	}
+
+	delivery := ws.testDelivery(t, hook.ID)
+	if delivery.Status != DeliveryDelivered || delivery.DeliveredAt == nil || delivery.ResponseStatus != http.StatusOK {
+		t.Errorf("delivery is %s with status %d, want delivered with 200", delivery.Status, delivery.ResponseStatus)
+	}
+}
+
+func TestWebhookEventFilter(t *testing.T) {
+	moves := &webhookReceiver{statuses: []int{http.StatusOK}}
+	movesServer := httptest.NewServer(moves)
+	defer movesServer.Close()
+
+	everything := &webhookReceiver{statuses: []int{http.StatusOK}}
+	everythingServer := httptest.NewServer(everything)
+	defer everythingServer.Close()
+
+	ws := newTestWebhookService(t,
+		&Webhook{CreatedBy: "admin", URL: movesServer.URL, Secret: "a", Events: []string{WebhookMove}},
+		&Webhook{CreatedBy: "admin", URL: everythingServer.URL, Secret: "b"},
+	)
+
+	ws.UserVerified(&User{Email: "ada@example.com"})
+	ws.UserRegistered(&UnverifiedUser{Email: "grace@example.com"})
+	ws.deliverDue(time.Now())
+
+	if moves.received() != 0 {
+		t.Errorf("webhook for moves got %d user events", moves.received())
+	}
+	if everything.received() != 2 {
+		t.Errorf("webhook for every event got %d events, want 2", everything.received())
+	}
+}
+
+func TestWebhookRetryBackoff(t *testing.T) {
+	receiver := &webhookReceiver{statuses: []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	hook := &Webhook{CreatedBy: "admin", URL: server.URL, Secret: "shh"}
+	ws := newTestWebhookService(t, hook)
+
+	ws.UserVerified(&User{Email: "ada@example.com"})
+	now := time.Now()
+
+	ws.deliverDue(now)
+	delivery := ws.testDelivery(t, hook.ID)
+	if delivery.Status != DeliveryPending || delivery.Attempts != 1 || delivery.ResponseStatus != http.StatusInternalServerError {
+		t.Fatalf("after a failure the delivery is %s after %d attempts, want pending after 1", delivery.Status, delivery.Attempts)
+	}
+	if !delivery.NextAttempt.Equal(now.Add(webhookBackoff)) {
+		t.Errorf("first retry at %v, want %v", delivery.NextAttempt, now.Add(webhookBackoff))
+	}
+
+	// Nothing is sent before the retry is due
+	ws.deliverDue(now.Add(webhookBackoff - time.Second))
+	if receiver.received() != 1 {
+		t.Fatalf("retried early, %d requests", receiver.received())
+	}
+
+	now = now.Add(webhookBackoff)
+	ws.deliverDue(now)
+	delivery = ws.testDelivery(t, hook.ID)
+	if !delivery.NextAttempt.Equal(now.Add(2 * webhookBackoff)) {
+		t.Errorf("second retry at %v, want the wait doubled to %v", delivery.NextAttempt, now.Add(2*webhookBackoff))
+	}
+
+	ws.deliverDue(now.Add(2 * webhookBackoff))
+	delivery = ws.testDelivery(t, hook.ID)
+	if delivery.Status != DeliveryDelivered || delivery.Attempts != 3 || delivery.LastError != "" {
+		t.Errorf("delivery is %s after %d attempts with error %q, want delivered after 3", delivery.Status, delivery.Attempts, delivery.LastError)
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	receiver := &webhookReceiver{statuses: []int{http.StatusServiceUnavailable}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	hook := &Webhook{CreatedBy: "admin", URL: server.URL, Secret: "shh"}
+	ws := newTestWebhookService(t, hook)
+
+	ws.UserVerified(&User{Email: "ada@example.com"})
+	now := time.Now()
+	for attempt := 1; attempt <= maxWebhookAttempts; attempt++ {
+		ws.deliverDue(now)
+		now = now.Add(retryAfter(attempt))
+	}
+
+	delivery := ws.testDelivery(t, hook.ID)
+	if delivery.Status != DeliveryDead || delivery.Attempts != maxWebhookAttempts || delivery.LastError == "" {
+		t.Fatalf("delivery is %s after %d attempts, want dead after %d", delivery.Status, delivery.Attempts, maxWebhookAttempts)
+	}
+
+	// Dead deliveries stay in the log and aren't tried again
+	ws.deliverDue(now.Add(maxWebhookBackoff))
+	if receiver.received() != maxWebhookAttempts {
+		t.Errorf("got %d requests, want %d", receiver.received(), maxWebhookAttempts)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, webhookBackoff},
+		{2, 2 * webhookBackoff},
+		{3, 4 * webhookBackoff},
+		{20, maxWebhookBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := retryAfter(tt.attempts); got != tt.want {
+			t.Errorf("retryAfter(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}